@@ -0,0 +1,147 @@
+package archive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/rabbitprincess/blob-retriever/params"
+	"github.com/rabbitprincess/blob-retriever/storage"
+	"github.com/rs/zerolog"
+)
+
+// Export packs the stored sidecars of the slot range into bundles in dir, one per bundleEpochs epochs.
+// Bundles are aligned to multiples of bundleEpochs, so the first and last bundle may cover a partial range.
+// It returns the paths of the written bundles.
+func Export(log zerolog.Logger, store storage.BlobReader, network *params.NetworkConfig, dir string, fromSlot, toSlot, bundleEpochs uint64) ([]string, error) {
+	if bundleEpochs == 0 {
+		return nil, fmt.Errorf("bundle epochs must be greater than 0")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	slots, err := store.SlotIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	bundleSlots := bundleEpochs * network.SlotsPerEpoch
+	var paths []string
+	for start := fromSlot; start <= toSlot; {
+		end := (start/bundleSlots+1)*bundleSlots - 1
+		if end > toSlot {
+			end = toSlot
+		}
+
+		var sidecars []BundleSidecar
+		for slot := start; slot <= end; slot++ {
+			root, ok := slots.Root(slot)
+			if !ok {
+				continue
+			}
+			mask, err := store.Indices(root)
+			if err != nil {
+				return paths, err
+			}
+			for i, ok := range mask {
+				if !ok {
+					continue
+				}
+				sidecar, err := store.Get(root, uint64(i))
+				if err != nil {
+					return paths, err
+				}
+				sidecars = append(sidecars, BundleSidecar{Root: root, Sidecar: sidecar})
+			}
+		}
+
+		path := filepath.Join(dir, fmt.Sprintf("blobs-%d-%d%s", start, end, BundleExt))
+		if err := WriteBundle(path, start, end, sidecars); err != nil {
+			return paths, fmt.Errorf("failed to write bundle %s: %w", path, err)
+		}
+		log.Info().Str("path", path).Uint64("fromSlot", start).Uint64("toSlot", end).Int("sidecars", len(sidecars)).Msg("Bundle exported")
+		paths = append(paths, path)
+
+		if end == toSlot {
+			break
+		}
+		start = end + 1
+	}
+	return paths, nil
+}
+
+// Import checks the bundle at path, or every bundle in the directory at path, and saves its sidecars to store.
+// Every sidecar of a bundle is verified before any of them is saved. It returns the number of sidecars imported.
+func Import(log zerolog.Logger, path string, store storage.BlobStore) (int, error) {
+	paths, err := bundlePaths(path)
+	if err != nil {
+		return 0, err
+	}
+	imported := 0
+	for _, path := range paths {
+		n, err := importBundle(path, store)
+		imported += n
+		if err != nil {
+			return imported, fmt.Errorf("failed to import bundle %s: %w", path, err)
+		}
+		log.Info().Str("path", path).Int("sidecars", n).Msg("Bundle imported")
+	}
+	return imported, nil
+}
+
+func importBundle(path string, store storage.BlobStore) (int, error) {
+	bundle, err := OpenBundle(path)
+	if err != nil {
+		return 0, err
+	}
+	defer bundle.Close()
+
+	for i, entry := range bundle.Index.Entries {
+		sidecar, err := bundle.Sidecar(i)
+		if err != nil {
+			return 0, err
+		}
+		root, err := sidecar.SignedBlockHeader.Header.HashTreeRoot()
+		if err != nil {
+			return 0, err
+		}
+		if root != entry.Root {
+			return 0, fmt.Errorf("%w: sidecar at slot %d index %d belongs to block %#x, expected %#x", ErrInvalidBundle, entry.Slot, entry.Index, root, entry.Root)
+		}
+		if entry.Slot < bundle.Index.StartSlot || entry.Slot > bundle.Index.EndSlot {
+			return 0, fmt.Errorf("%w: sidecar at slot %d is outside of the bundle range", ErrInvalidBundle, entry.Slot)
+		}
+		if err := storage.VerifySidecar(sidecar); err != nil {
+			return 0, fmt.Errorf("invalid sidecar at slot %d index %d: %w", entry.Slot, entry.Index, err)
+		}
+	}
+
+	// the sidecars are read again, their checksums guarding against changes since verification
+	for i, entry := range bundle.Index.Entries {
+		sidecar, err := bundle.Sidecar(i)
+		if err != nil {
+			return i, err
+		}
+		if _, err := store.Save(entry.Root, storage.ConvDenebSideCar(sidecar)); err != nil {
+			return i, err
+		}
+	}
+	return len(bundle.Index.Entries), nil
+}
+
+func bundlePaths(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(path, "*"+BundleExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
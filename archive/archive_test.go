@@ -0,0 +1,113 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rabbitprincess/blob-retriever/internal/testutil"
+	"github.com/rabbitprincess/blob-retriever/params"
+	"github.com/rabbitprincess/blob-retriever/storage"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *testing.T) {
+	network := params.MainnetConfig()
+	source, err := storage.NewPrysmBlobStorage(zerolog.Nop(), t.TempDir(), 6)
+	require.NoError(t, err)
+	rootA, sidecarsA := testutil.NewVerifiedSidecars(t, 9000010, 2)
+	rootB, sidecarsB := testutil.NewVerifiedSidecars(t, 9000040, 1)
+	for _, sidecar := range sidecarsA {
+		_, err := source.Save(rootA, sidecar)
+		require.NoError(t, err)
+	}
+	for _, sidecar := range sidecarsB {
+		_, err := source.Save(rootB, sidecar)
+		require.NoError(t, err)
+	}
+
+	// one epoch bundles split the range at slot 9000032
+	dir := t.TempDir()
+	paths, err := Export(zerolog.Nop(), source, network, dir, 9000000, 9000063, 1)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		filepath.Join(dir, "blobs-9000000-9000031.bundle"),
+		filepath.Join(dir, "blobs-9000032-9000063.bundle"),
+	}, paths)
+
+	bundle, err := OpenBundle(paths[0])
+	require.NoError(t, err)
+	require.Equal(t, uint64(9000000), bundle.Index.StartSlot)
+	require.Equal(t, uint64(9000031), bundle.Index.EndSlot)
+	require.Len(t, bundle.Index.Entries, 2)
+	require.Equal(t, rootA, bundle.Index.Entries[1].Root)
+	require.Equal(t, uint64(1), bundle.Index.Entries[1].Index)
+	require.NoError(t, bundle.Close())
+
+	target, err := storage.NewPrysmBlobStorage(zerolog.Nop(), t.TempDir(), 6)
+	require.NoError(t, err)
+	imported, err := Import(zerolog.Nop(), dir, target)
+	require.NoError(t, err)
+	require.Equal(t, 3, imported)
+	for i, sidecar := range sidecarsA {
+		valid, err := target.Valid(rootA, sidecar)
+		require.NoError(t, err)
+		require.True(t, valid, "sidecar %d", i)
+	}
+	require.True(t, target.Exist(rootB))
+
+	// a corrupted sidecar fails the checksum and nothing of the bundle is imported
+	data, err := os.ReadFile(paths[0])
+	require.NoError(t, err)
+	data[len(data)-1000] ^= 1
+	corrupted := filepath.Join(t.TempDir(), "corrupted.bundle")
+	require.NoError(t, os.WriteFile(corrupted, data, 0600))
+	target, err = storage.NewPrysmBlobStorage(zerolog.Nop(), t.TempDir(), 6)
+	require.NoError(t, err)
+	_, err = Import(zerolog.Nop(), corrupted, target)
+	require.ErrorIs(t, err, ErrInvalidBundle)
+	require.False(t, target.Exist(rootA))
+}
+
+func TestImportBlobDir(t *testing.T) {
+	rootA, sidecarsA := testutil.NewVerifiedSidecars(t, 9000000, 3)
+	rootB, sidecarsB := testutil.NewVerifiedSidecars(t, 9000100, 1)
+
+	// a by-epoch source with one corrupted sidecar
+	dir := t.TempDir()
+	epochA, err := storage.NewPrysmBlobStorage(zerolog.Nop(), filepath.Join(dir, "by-epoch", "68", "281250"), 6)
+	require.NoError(t, err)
+	for _, sidecar := range sidecarsA {
+		_, err := epochA.Save(rootA, sidecar)
+		require.NoError(t, err)
+	}
+	epochB, err := storage.NewPrysmBlobStorage(zerolog.Nop(), filepath.Join(dir, "by-epoch", "68", "281253"), 6)
+	require.NoError(t, err)
+	corrupted := *sidecarsB[0]
+	corrupted.Blob[100] = 1
+	_, err = epochB.Save(rootB, &corrupted)
+	require.NoError(t, err)
+	require.False(t, IsBundlePath(dir))
+
+	// the target already holds one of the sidecars
+	target, err := storage.NewPrysmBlobStorage(zerolog.Nop(), t.TempDir(), 6)
+	require.NoError(t, err)
+	_, err = target.Save(rootA, sidecarsA[1])
+	require.NoError(t, err)
+
+	stats, err := ImportBlobDir(zerolog.Nop(), dir, 6, target)
+	require.NoError(t, err)
+	require.Equal(t, BlobDirStats{Saved: 2, Present: 1, Invalid: 1}, stats)
+	mask, err := target.Indices(rootA)
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, true, true, false, false, false}, mask)
+	require.False(t, target.Exist(rootB))
+
+	// the flat layout is read from the top level directory
+	target, err = storage.NewPrysmBlobStorage(zerolog.Nop(), t.TempDir(), 6)
+	require.NoError(t, err)
+	stats, err = ImportBlobDir(zerolog.Nop(), filepath.Join(dir, "by-epoch", "68", "281250"), 6, target)
+	require.NoError(t, err)
+	require.Equal(t, BlobDirStats{Saved: 3}, stats)
+}
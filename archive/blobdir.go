@@ -0,0 +1,113 @@
+package archive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	ethpb "github.com/prysmaticlabs/prysm/v5/proto/prysm/v1alpha1"
+	"github.com/rabbitprincess/blob-retriever/storage"
+	"github.com/rs/zerolog"
+)
+
+// Target is a store sidecars are imported into. Its indices are checked so only missing sidecars are saved.
+type Target interface {
+	storage.BlobStore
+	Indices(root [32]byte) ([]bool, error)
+}
+
+// BlobDirStats counts the sidecars seen by ImportBlobDir.
+type BlobDirStats struct {
+	Saved   int
+	Present int
+	Invalid int
+}
+
+// IsBundlePath reports whether path is a bundle file or a directory holding bundles,
+// as opposed to the blob directory of a node.
+func IsBundlePath(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if !info.IsDir() {
+		return filepath.Ext(path) == BundleExt
+	}
+	paths, err := filepath.Glob(filepath.Join(path, "*"+BundleExt))
+	return err == nil && len(paths) > 0
+}
+
+// ImportBlobDir reads the blob directory of another prysm node, in the flat or by-epoch layout,
+// verifies its sidecars and saves the ones missing from target. Sidecars which fail verification are
+// logged and skipped, so a partly corrupted directory can still be imported.
+func ImportBlobDir(log zerolog.Logger, dir string, maxBlobsPerBlock uint64, target Target) (BlobDirStats, error) {
+	var stats BlobDirStats
+	sources, err := storage.OpenBlobDirs(log, dir, maxBlobsPerBlock)
+	if err != nil {
+		return stats, err
+	}
+	for _, source := range sources {
+		roots, err := source.Roots()
+		if err != nil {
+			return stats, err
+		}
+		for _, root := range roots {
+			if err := importRoot(log, source, root, target, &stats); err != nil {
+				return stats, err
+			}
+		}
+	}
+	return stats, nil
+}
+
+func importRoot(log zerolog.Logger, source *storage.BlobStorage, root [32]byte, target Target, stats *BlobDirStats) error {
+	mask, err := source.Indices(root)
+	if err != nil {
+		log.Warn().Err(err).Str("root", fmt.Sprintf("%#x", root)).Msg("Skipping root with unreadable indices")
+		stats.Invalid++
+		return nil
+	}
+	present, err := target.Indices(root)
+	if err != nil {
+		return err
+	}
+	for i, ok := range mask {
+		if !ok {
+			continue
+		}
+		if i < len(present) && present[i] {
+			stats.Present++
+			continue
+		}
+		sidecar, err := source.Get(root, uint64(i))
+		if err == nil {
+			err = verifyStored(root, uint64(i), sidecar)
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("root", fmt.Sprintf("%#x", root)).Int("index", i).Msg("Skipping invalid blob sidecar")
+			stats.Invalid++
+			continue
+		}
+		if _, err := target.Save(root, storage.ConvDenebSideCar(sidecar)); err != nil {
+			return err
+		}
+		stats.Saved++
+		log.Info().Uint64("slot", uint64(sidecar.SignedBlockHeader.Header.Slot)).Str("root", fmt.Sprintf("%#x", root)).Int("index", i).Msg("Blob sidecar imported")
+	}
+	return nil
+}
+
+// verifyStored checks a sidecar read from the file of a root and index against them and its proofs.
+func verifyStored(root [32]byte, index uint64, sidecar *ethpb.BlobSidecar) error {
+	if sidecar.Index != index {
+		return fmt.Errorf("sidecar index %d does not match its file index %d", sidecar.Index, index)
+	}
+	headerRoot, err := sidecar.SignedBlockHeader.Header.HashTreeRoot()
+	if err != nil {
+		return err
+	}
+	if headerRoot != root {
+		return fmt.Errorf("sidecar belongs to block %#x", headerRoot)
+	}
+	return storage.VerifySidecar(sidecar)
+}
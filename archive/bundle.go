@@ -0,0 +1,220 @@
+package archive
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	fieldparams "github.com/prysmaticlabs/prysm/v5/config/fieldparams"
+	ethpb "github.com/prysmaticlabs/prysm/v5/proto/prysm/v1alpha1"
+)
+
+// A bundle file is laid out as
+//
+//	magic [8]byte | index length uint64 | SSZ index | sidecars
+//
+// where the sidecars are the SSZ encoded blob sidecars in slot and index order.
+// The index records the slot range covered by the bundle and, for every sidecar, its slot, block root, blob index,
+// offset in the file and the SHA-256 checksum of its SSZ encoding.
+const (
+	BundleExt = ".bundle"
+
+	sidecarSize = 8 + fieldparams.BlobLength + 2*fieldparams.BLSPubkeyLength + 208 + fieldparams.KzgCommitmentInclusionProofDepth*32
+	entrySize   = 8 + 32 + 8 + 8 + 32
+	// indexFixedSize is the size of the start slot, end slot and the offset of the entry list.
+	indexFixedSize = 8 + 8 + 4
+)
+
+var (
+	bundleMagic = [8]byte{'b', 'l', 'o', 'b', 'a', 'r', 'c', '1'}
+
+	ErrInvalidBundle = errors.New("invalid bundle")
+)
+
+// BundleEntry locates a sidecar in a bundle.
+type BundleEntry struct {
+	Slot     uint64
+	Root     [32]byte
+	Index    uint64
+	Offset   uint64
+	Checksum [32]byte
+}
+
+// BundleIndex describes the content of a bundle.
+type BundleIndex struct {
+	StartSlot uint64
+	EndSlot   uint64
+	Entries   []BundleEntry
+}
+
+// MarshalSSZ encodes the index as an SSZ container of the slot range and the list of entries.
+func (b *BundleIndex) MarshalSSZ() []byte {
+	buf := make([]byte, 0, indexFixedSize+len(b.Entries)*entrySize)
+	buf = binary.LittleEndian.AppendUint64(buf, b.StartSlot)
+	buf = binary.LittleEndian.AppendUint64(buf, b.EndSlot)
+	buf = binary.LittleEndian.AppendUint32(buf, indexFixedSize)
+	for _, e := range b.Entries {
+		buf = binary.LittleEndian.AppendUint64(buf, e.Slot)
+		buf = append(buf, e.Root[:]...)
+		buf = binary.LittleEndian.AppendUint64(buf, e.Index)
+		buf = binary.LittleEndian.AppendUint64(buf, e.Offset)
+		buf = append(buf, e.Checksum[:]...)
+	}
+	return buf
+}
+
+func (b *BundleIndex) UnmarshalSSZ(buf []byte) error {
+	if len(buf) < indexFixedSize {
+		return fmt.Errorf("%w: index too short", ErrInvalidBundle)
+	}
+	if offset := binary.LittleEndian.Uint32(buf[16:20]); offset != indexFixedSize {
+		return fmt.Errorf("%w: unexpected entry list offset %d", ErrInvalidBundle, offset)
+	}
+	entries := buf[indexFixedSize:]
+	if len(entries)%entrySize != 0 {
+		return fmt.Errorf("%w: entry list size %d", ErrInvalidBundle, len(entries))
+	}
+	b.StartSlot = binary.LittleEndian.Uint64(buf[0:8])
+	b.EndSlot = binary.LittleEndian.Uint64(buf[8:16])
+	b.Entries = make([]BundleEntry, len(entries)/entrySize)
+	for i := range b.Entries {
+		e := entries[i*entrySize:]
+		b.Entries[i].Slot = binary.LittleEndian.Uint64(e[0:8])
+		copy(b.Entries[i].Root[:], e[8:40])
+		b.Entries[i].Index = binary.LittleEndian.Uint64(e[40:48])
+		b.Entries[i].Offset = binary.LittleEndian.Uint64(e[48:56])
+		copy(b.Entries[i].Checksum[:], e[56:88])
+	}
+	return nil
+}
+
+// BundleSidecar is a sidecar to be written to a bundle with its block root.
+type BundleSidecar struct {
+	Root    [32]byte
+	Sidecar *ethpb.BlobSidecar
+}
+
+// WriteBundle writes the sidecars covering the slot range to a bundle file at path.
+// The file is written next to path first and renamed once complete.
+func WriteBundle(path string, startSlot, endSlot uint64, sidecars []BundleSidecar) (err error) {
+	index := &BundleIndex{StartSlot: startSlot, EndSlot: endSlot, Entries: make([]BundleEntry, len(sidecars))}
+	encoded := make([][]byte, len(sidecars))
+	for i, s := range sidecars {
+		if encoded[i], err = s.Sidecar.MarshalSSZ(); err != nil {
+			return err
+		}
+		if len(encoded[i]) != sidecarSize {
+			return fmt.Errorf("unexpected sidecar size %d", len(encoded[i]))
+		}
+		index.Entries[i] = BundleEntry{
+			Slot:     uint64(s.Sidecar.SignedBlockHeader.Header.Slot),
+			Root:     s.Root,
+			Index:    s.Sidecar.Index,
+			Checksum: sha256.Sum256(encoded[i]),
+		}
+	}
+	indexSize := uint64(indexFixedSize + len(sidecars)*entrySize)
+	for i := range index.Entries {
+		index.Entries[i].Offset = uint64(len(bundleMagic)) + 8 + indexSize + uint64(i)*sidecarSize
+	}
+
+	partPath := path + ".part"
+	f, err := os.Create(partPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(partPath)
+		}
+	}()
+	w := bufio.NewWriter(f)
+	w.Write(bundleMagic[:])
+	binary.Write(w, binary.LittleEndian, indexSize)
+	w.Write(index.MarshalSSZ())
+	for _, data := range encoded {
+		w.Write(data)
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partPath, path)
+}
+
+// BundleReader reads the sidecars of a bundle file.
+type BundleReader struct {
+	f     *os.File
+	Index *BundleIndex
+}
+
+// OpenBundle opens a bundle file and decodes its index.
+func OpenBundle(path string) (*BundleReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	index, err := readIndex(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &BundleReader{f: f, Index: index}, nil
+}
+
+func readIndex(r io.Reader) (*BundleIndex, error) {
+	var header [len(bundleMagic) + 8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidBundle, err)
+	}
+	if [8]byte(header[:8]) != bundleMagic {
+		return nil, fmt.Errorf("%w: unknown magic %x", ErrInvalidBundle, header[:8])
+	}
+	size := binary.LittleEndian.Uint64(header[8:])
+	if size > 1<<30 {
+		return nil, fmt.Errorf("%w: index size %d", ErrInvalidBundle, size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidBundle, err)
+	}
+	index := &BundleIndex{}
+	if err := index.UnmarshalSSZ(buf); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// Sidecar reads the sidecar of the i-th index entry, checking it against the entry's checksum, slot and index.
+func (r *BundleReader) Sidecar(i int) (*ethpb.BlobSidecar, error) {
+	entry := r.Index.Entries[i]
+	data := make([]byte, sidecarSize)
+	if _, err := r.f.ReadAt(data, int64(entry.Offset)); err != nil {
+		return nil, fmt.Errorf("failed to read sidecar at slot %d index %d: %w", entry.Slot, entry.Index, err)
+	}
+	if sha256.Sum256(data) != entry.Checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch for sidecar at slot %d index %d", ErrInvalidBundle, entry.Slot, entry.Index)
+	}
+	sidecar := &ethpb.BlobSidecar{}
+	if err := sidecar.UnmarshalSSZ(data); err != nil {
+		return nil, err
+	}
+	if uint64(sidecar.SignedBlockHeader.Header.Slot) != entry.Slot || sidecar.Index != entry.Index {
+		return nil, fmt.Errorf("%w: sidecar at slot %d index %d does not match its entry", ErrInvalidBundle, entry.Slot, entry.Index)
+	}
+	return sidecar, nil
+}
+
+func (r *BundleReader) Close() error {
+	return r.f.Close()
+}
@@ -0,0 +1,211 @@
+// Package audit checks the sidecars of a store offline, without fetching anything from the network.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	ethpb "github.com/prysmaticlabs/prysm/v5/proto/prysm/v1alpha1"
+	"github.com/rabbitprincess/blob-retriever/params"
+	"github.com/rabbitprincess/blob-retriever/storage"
+	"github.com/rs/zerolog"
+)
+
+// Issue kinds reported by Audit.
+const (
+	// KindUnreadable is a root whose files can not be listed, or a sidecar file which can not be read or decoded.
+	KindUnreadable = "unreadable"
+	// KindIndexMismatch is a sidecar whose index differs from the index in its file name.
+	KindIndexMismatch = "index_mismatch"
+	// KindRootMismatch is a sidecar whose header root differs from the name of its root directory.
+	KindRootMismatch = "root_mismatch"
+	// KindInclusionProof is a sidecar whose commitment is not proven to be in the block body.
+	KindInclusionProof = "inclusion_proof"
+	// KindKZGProof is a sidecar whose blob does not match its commitment and proof.
+	KindKZGProof = "kzg_proof"
+	// KindIndexGap is a missing index below the highest stored index of a root.
+	KindIndexGap = "index_gap"
+	// KindTooManyBlobs is a root with more sidecars than the network allows at its slot.
+	KindTooManyBlobs = "too_many_blobs"
+	// KindDuplicateCommitment is a commitment stored under more than one index of a root.
+	KindDuplicateCommitment = "duplicate_commitment"
+	// KindDuplicateSlot is a slot stored under more than one root, e.g. a block orphaned by a reorg.
+	KindDuplicateSlot = "duplicate_slot"
+)
+
+// Store is the read access to a store needed by Audit.
+type Store interface {
+	Roots() ([][32]byte, error)
+	Indices(root [32]byte) ([]bool, error)
+	Get(root [32]byte, index uint64) (*ethpb.BlobSidecar, error)
+}
+
+// Issue is a problem found in a root directory or one of its sidecars.
+type Issue struct {
+	Kind   string  `json:"kind"`
+	Root   string  `json:"root"`
+	Slot   *uint64 `json:"slot,omitempty"`
+	Index  *uint64 `json:"index,omitempty"`
+	Detail string  `json:"detail,omitempty"`
+}
+
+// Report is the machine-readable result of an audit.
+type Report struct {
+	Roots    int     `json:"roots"`
+	Sidecars int     `json:"sidecars"`
+	Valid    int     `json:"valid"`
+	Issues   []Issue `json:"issues"`
+}
+
+// OK reports whether the audit found no issues.
+func (r *Report) OK() bool {
+	return len(r.Issues) == 0
+}
+
+// WriteJSON writes the report as indented JSON.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// Audit decodes every sidecar of the store and verifies its index, header root, inclusion proof and KZG proof,
+// then checks every root for index gaps, duplicate commitments and the blob limit, and the store for slots held
+// by several roots.
+func Audit(log zerolog.Logger, store Store, network *params.NetworkConfig) (*Report, error) {
+	roots, err := store.Roots()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(roots, func(i, j int) bool { return string(roots[i][:]) < string(roots[j][:]) })
+
+	report := &Report{Roots: len(roots), Issues: []Issue{}}
+	slotRoots := make(map[uint64][][32]byte)
+	for _, root := range roots {
+		slot, ok := auditRoot(store, network, root, report)
+		if ok {
+			slotRoots[slot] = append(slotRoots[slot], root)
+		}
+	}
+
+	slots := make([]uint64, 0, len(slotRoots))
+	for slot := range slotRoots {
+		slots = append(slots, slot)
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i] < slots[j] })
+	for _, slot := range slots {
+		if len(slotRoots[slot]) < 2 {
+			continue
+		}
+		for _, root := range slotRoots[slot] {
+			report.add(Issue{Kind: KindDuplicateSlot, Root: rootString(root), Slot: &slot,
+				Detail: fmt.Sprintf("%d roots stored for the slot", len(slotRoots[slot]))})
+		}
+	}
+	log.Info().Int("roots", report.Roots).Int("sidecars", report.Sidecars).Int("valid", report.Valid).Int("issues", len(report.Issues)).Msg("Audit done")
+	return report, nil
+}
+
+// auditRoot checks the sidecars of a root and returns the slot of its header, if any sidecar could be decoded.
+func auditRoot(store Store, network *params.NetworkConfig, root [32]byte, report *Report) (uint64, bool) {
+	mask, err := store.Indices(root)
+	if err != nil {
+		report.add(Issue{Kind: KindUnreadable, Root: rootString(root), Detail: err.Error()})
+		return 0, false
+	}
+
+	var (
+		slot        uint64
+		decoded     bool
+		stored      int
+		highest     = -1
+		commitments = make(map[string]uint64)
+	)
+	for i, ok := range mask {
+		if !ok {
+			continue
+		}
+		index := uint64(i)
+		stored++
+		highest = i
+		report.Sidecars++
+		sidecar, err := store.Get(root, index)
+		if err != nil {
+			report.add(Issue{Kind: KindUnreadable, Root: rootString(root), Index: &index, Detail: err.Error()})
+			continue
+		}
+		if !decoded {
+			slot, decoded = uint64(sidecar.SignedBlockHeader.Header.Slot), true
+		}
+		if first, ok := commitments[string(sidecar.KzgCommitment)]; ok {
+			report.add(Issue{Kind: KindDuplicateCommitment, Root: rootString(root), Slot: &slot, Index: &index,
+				Detail: fmt.Sprintf("commitment also stored at index %d", first)})
+		} else {
+			commitments[string(sidecar.KzgCommitment)] = index
+		}
+		if issue, ok := checkSidecar(root, index, sidecar); !ok {
+			report.add(issue)
+			continue
+		}
+		report.Valid++
+	}
+
+	for i := 0; i < highest; i++ {
+		if !mask[i] {
+			index := uint64(i)
+			report.add(Issue{Kind: KindIndexGap, Root: rootString(root), Slot: slotPtr(slot, decoded), Index: &index})
+		}
+	}
+	if decoded {
+		if limit := network.MaxBlobsPerBlockAtSlot(slot); uint64(stored) > limit {
+			report.add(Issue{Kind: KindTooManyBlobs, Root: rootString(root), Slot: &slot,
+				Detail: fmt.Sprintf("%d sidecars stored, %d allowed", stored, limit)})
+		}
+	}
+	return slot, decoded
+}
+
+// checkSidecar verifies a decoded sidecar against the root directory and file it was read from, and its proofs.
+func checkSidecar(root [32]byte, index uint64, sidecar *ethpb.BlobSidecar) (Issue, bool) {
+	slot := uint64(sidecar.SignedBlockHeader.Header.Slot)
+	issue := Issue{Root: rootString(root), Slot: &slot, Index: &index}
+	if sidecar.Index != index {
+		issue.Kind, issue.Detail = KindIndexMismatch, fmt.Sprintf("sidecar index %d", sidecar.Index)
+		return issue, false
+	}
+	headerRoot, err := sidecar.SignedBlockHeader.Header.HashTreeRoot()
+	if err != nil {
+		issue.Kind, issue.Detail = KindRootMismatch, err.Error()
+		return issue, false
+	}
+	if headerRoot != root {
+		issue.Kind, issue.Detail = KindRootMismatch, fmt.Sprintf("header root %#x", headerRoot)
+		return issue, false
+	}
+	if err := storage.VerifyInclusionProof(sidecar); err != nil {
+		issue.Kind, issue.Detail = KindInclusionProof, err.Error()
+		return issue, false
+	}
+	if err := storage.VerifyKZGProof(sidecar); err != nil {
+		issue.Kind, issue.Detail = KindKZGProof, err.Error()
+		return issue, false
+	}
+	return Issue{}, true
+}
+
+func (r *Report) add(issue Issue) {
+	r.Issues = append(r.Issues, issue)
+}
+
+func slotPtr(slot uint64, ok bool) *uint64 {
+	if !ok {
+		return nil
+	}
+	return &slot
+}
+
+func rootString(root [32]byte) string {
+	return fmt.Sprintf("%#x", root)
+}
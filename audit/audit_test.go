@@ -0,0 +1,56 @@
+package audit
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rabbitprincess/blob-retriever/internal/testutil"
+	"github.com/rabbitprincess/blob-retriever/params"
+	"github.com/rabbitprincess/blob-retriever/storage"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAudit(t *testing.T) {
+	store, err := storage.NewPrysmBlobStorage(zerolog.Nop(), t.TempDir(), 6)
+	require.NoError(t, err)
+
+	rootA, sidecarsA := testutil.NewVerifiedSidecars(t, 9000100, 3)
+	for _, sidecar := range sidecarsA {
+		_, err := store.Save(rootA, sidecar)
+		require.NoError(t, err)
+	}
+	// index 0 is missing
+	rootB, sidecarsB := testutil.NewVerifiedSidecars(t, 9000200, 2)
+	_, err = store.Save(rootB, sidecarsB[1])
+	require.NoError(t, err)
+	// the blob does not match its proof
+	rootC, sidecarsC := testutil.NewVerifiedSidecars(t, 9000300, 1)
+	sidecarsC[0].Blob[31] ^= 1
+	_, err = store.Save(rootC, sidecarsC[0])
+	require.NoError(t, err)
+	// a sidecar in the directory of another root, at the slot of rootA
+	wrongRoot := [32]byte{9}
+	_, err = store.Save(wrongRoot, sidecarsA[0])
+	require.NoError(t, err)
+
+	report, err := Audit(zerolog.Nop(), store, params.MainnetConfig())
+	require.NoError(t, err)
+	require.Equal(t, 4, report.Roots)
+	require.Equal(t, 6, report.Sidecars)
+	require.Equal(t, 4, report.Valid)
+
+	kinds := make(map[string][]string)
+	for _, issue := range report.Issues {
+		kinds[issue.Kind] = append(kinds[issue.Kind], issue.Root)
+	}
+	require.Equal(t, []string{rootString(rootB)}, kinds[KindIndexGap])
+	require.Equal(t, []string{rootString(rootC)}, kinds[KindKZGProof])
+	require.Equal(t, []string{rootString(wrongRoot)}, kinds[KindRootMismatch])
+	require.ElementsMatch(t, []string{rootString(rootA), rootString(wrongRoot)}, kinds[KindDuplicateSlot])
+	require.Len(t, report.Issues, 5)
+
+	var buf bytes.Buffer
+	require.NoError(t, report.WriteJSON(&buf))
+	require.Contains(t, buf.String(), `"kind": "index_gap"`)
+}
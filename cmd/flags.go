@@ -1,88 +1,391 @@
-package main
-
-import (
-	"os"
-	"strconv"
-
-	"github.com/urfave/cli/v2"
-)
-
-var (
-	mode      string
-	apiUrl    string
-	apiType   string
-	dataPath  string
-	dataType  string
-	numWorker uint64
-	fromSlot  uint64
-	toSlot    uint64
-)
-
-func flags() []cli.Flag {
-	return []cli.Flag{
-		&cli.StringFlag{
-			Name:        "mode",
-			Aliases:     []string{"m"},
-			Value:       getEnv("MODE", "retrieve"),
-			Usage:       "run mode (retrieve / check)",
-			Destination: &mode,
-		},
-		&cli.StringFlag{
-			Name:        "api_url",
-			Aliases:     []string{"u"},
-			Value:       getEnv("API_URL", ""),
-			Usage:       "Beacon node URL",
-			Destination: &apiUrl,
-		},
-		&cli.StringFlag{
-			Name:        "api_type",
-			Aliases:     []string{"a"},
-			Value:       getEnv("API_TYPE", "any"),
-			Usage:       "Beacon node network type (any or prysm)",
-			Destination: &apiType,
-		},
-		&cli.StringFlag{
-			Name:        "data_path",
-			Aliases:     []string{"d"},
-			Value:       getEnv("DATA_PATH", "./blobs"),
-			Usage:       "data path to store blobs",
-			Destination: &dataPath,
-		},
-		&cli.Uint64Flag{
-			Name:        "worker",
-			Aliases:     []string{"w"},
-			Value:       getEnvAsUint64("NUM_WORKER", 1),
-			Usage:       "number of workers",
-			Destination: &numWorker,
-		},
-		&cli.Uint64Flag{
-			Name:        "from",
-			Aliases:     []string{"f"},
-			Value:       getEnvAsUint64("FROM_SLOT", 0),
-			Usage:       "from slot. minimum is 8626176",
-			Destination: &fromSlot,
-		},
-		&cli.Uint64Flag{
-			Name:        "to",
-			Aliases:     []string{"t"},
-			Value:       getEnvAsUint64("TO_SLOT", 0),
-			Usage:       "to slot",
-			Destination: &toSlot,
-		},
-	}
-}
-
-func getEnv(key, defaultValue string) string {
-	if value, exists := os.LookupEnv(key); exists {
-		return value
-	}
-	return defaultValue
-}
-
-func getEnvAsUint64(name string, defaultValue uint64) uint64 {
-	valueStr := getEnv(name, "")
-	if value, err := strconv.ParseUint(valueStr, 10, 64); err == nil {
-		return value
-	}
-	return defaultValue
-}
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/mattn/go-isatty"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	mode          string
+	apiUrl        string
+	apiType       string
+	dataPath      string
+	dataType      string
+	numWorker     uint64
+	fromSlot      uint64
+	toSlot        uint64
+	source        string
+	sourceUrl     string
+	jwtSecret     string
+	p2pPeers      string
+	p2pListen     string
+	network       string
+	listenAddr    string
+	versionedHash string
+	archivePath   string
+	bundleEpochs  uint64
+	compression   string
+	dedup         bool
+	sharedNode    bool
+	nodeRetention uint64
+	retention     uint64
+	keepFrom      uint64
+	keepTo        uint64
+	dryRun        bool
+	pruneInterval time.Duration
+	minFreeGiB    uint64
+	maxStoreGiB   uint64
+	reportPath    string
+	repairLog     string
+	metricsAddr   string
+	progress      time.Duration
+	adminAddr     string
+	adminToken    string
+	queuePath     string
+	jobMode       string
+	priority      int
+	leasePath     string
+	leaseSlots    uint64
+	leaseTTL      time.Duration
+	leaseShared   bool
+	leaseToken    string
+	coordinator   string
+	workerID      string
+)
+
+func flags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:        "mode",
+			Aliases:     []string{"m"},
+			Value:       getEnv("MODE", "retrieve"),
+			Usage:       "run mode (retrieve / check / repair / daemon / submit / coordinator / worker / serve / proxy / lookup / export / import / prune / audit)",
+			Destination: &mode,
+		},
+		&cli.StringFlag{
+			Name:        "network",
+			Aliases:     []string{"n"},
+			Value:       getEnv("NETWORK", "mainnet"),
+			Usage:       "network preset (mainnet / sepolia / holesky / gnosis) or path to a config YAML",
+			Destination: &network,
+		},
+		&cli.StringFlag{
+			Name:        "api_url",
+			Aliases:     []string{"u"},
+			Value:       getEnv("API_URL", ""),
+			Usage:       "Beacon node URL",
+			Destination: &apiUrl,
+		},
+		&cli.StringFlag{
+			Name:        "api_type",
+			Aliases:     []string{"a"},
+			Value:       getEnv("API_TYPE", "any"),
+			Usage:       "Beacon node network type (any or prysm)",
+			Destination: &apiType,
+		},
+		&cli.StringFlag{
+			Name:        "data_path",
+			Aliases:     []string{"d"},
+			Value:       getEnv("DATA_PATH", "./blobs"),
+			Usage:       "data path to store blobs",
+			Destination: &dataPath,
+		},
+		&cli.StringFlag{
+			Name:        "data_type",
+			Value:       getEnv("DATA_TYPE", "prysm"),
+			Usage:       "storage type (prysm / archive)",
+			Destination: &dataType,
+		},
+		&cli.StringFlag{
+			Name:        "compression",
+			Value:       getEnv("COMPRESSION", "none"),
+			Usage:       "compression of saved sidecars for archive storage (none / snappy / zstd)",
+			Destination: &compression,
+		},
+		&cli.BoolFlag{
+			Name:        "dedup",
+			Value:       getEnvAsBool("DEDUP", false),
+			Usage:       "store identical blobs once for archive storage",
+			Destination: &dedup,
+		},
+		&cli.BoolFlag{
+			Name:        "shared_node",
+			Value:       getEnvAsBool("SHARED_NODE", false),
+			Usage:       "data path is the blob directory of a running beacon node, for prysm storage",
+			Destination: &sharedNode,
+		},
+		&cli.Uint64Flag{
+			Name:        "node_retention_epochs",
+			Value:       getEnvAsUint64("NODE_RETENTION_EPOCHS", 0),
+			Usage:       "--blob-retention-epochs of the shared beacon node. slots it would prune are refused. 0 is the network minimum",
+			Destination: &nodeRetention,
+		},
+		&cli.Uint64Flag{
+			Name:        "worker",
+			Aliases:     []string{"w"},
+			Value:       getEnvAsUint64("NUM_WORKER", 1),
+			Usage:       "number of workers",
+			Destination: &numWorker,
+		},
+		&cli.Uint64Flag{
+			Name:        "from",
+			Aliases:     []string{"f"},
+			Value:       getEnvAsUint64("FROM_SLOT", 0),
+			Usage:       "from slot. defaults to the deneb fork slot of the network",
+			Destination: &fromSlot,
+		},
+		&cli.Uint64Flag{
+			Name:        "to",
+			Aliases:     []string{"t"},
+			Value:       getEnvAsUint64("TO_SLOT", 0),
+			Usage:       "to slot",
+			Destination: &toSlot,
+		},
+		&cli.StringFlag{
+			Name:        "source",
+			Aliases:     []string{"s"},
+			Value:       getEnv("BLOB_SOURCE", "beacon"),
+			Usage:       "blob source (beacon / blobscan / engine / p2p)",
+			Destination: &source,
+		},
+		&cli.StringFlag{
+			Name:        "source_url",
+			Value:       getEnv("BLOB_SOURCE_URL", ""),
+			Usage:       "blob archive API URL for non-beacon sources",
+			Destination: &sourceUrl,
+		},
+		&cli.StringFlag{
+			Name:        "jwt_secret",
+			Value:       getEnv("JWT_SECRET_PATH", ""),
+			Usage:       "path to the engine API JWT secret for engine source",
+			Destination: &jwtSecret,
+		},
+		&cli.StringFlag{
+			Name:        "p2p_peers",
+			Value:       getEnv("P2P_PEERS", ""),
+			Usage:       "comma separated multiaddrs of the consensus peers for p2p source, ending in /p2p/<peer id>",
+			Destination: &p2pPeers,
+		},
+		&cli.StringFlag{
+			Name:        "p2p_listen",
+			Value:       getEnv("P2P_LISTEN", ""),
+			Usage:       "multiaddr the libp2p host of p2p source listens on, e.g. /ip4/0.0.0.0/tcp/13000. empty only dials out",
+			Destination: &p2pListen,
+		},
+		&cli.StringFlag{
+			Name:        "listen",
+			Aliases:     []string{"l"},
+			Value:       getEnv("LISTEN_ADDR", ":3500"),
+			Usage:       "address to serve the beacon API on in serve and proxy modes, or the lease API in coordinator mode",
+			Destination: &listenAddr,
+		},
+		&cli.StringFlag{
+			Name:        "versioned_hash",
+			Value:       getEnv("VERSIONED_HASH", ""),
+			Usage:       "versioned hash of the blob to print in lookup mode",
+			Destination: &versionedHash,
+		},
+		&cli.StringFlag{
+			Name:        "archive_path",
+			Value:       getEnv("ARCHIVE_PATH", "./bundles"),
+			Usage:       "bundle directory to export to, or bundle file, bundle directory or node blob directory to import from",
+			Destination: &archivePath,
+		},
+		&cli.Uint64Flag{
+			Name:        "bundle_epochs",
+			Value:       getEnvAsUint64("BUNDLE_EPOCHS", 32),
+			Usage:       "number of epochs per exported bundle",
+			Destination: &bundleEpochs,
+		},
+		&cli.Uint64Flag{
+			Name:        "retention_epochs",
+			Value:       getEnvAsUint64("RETENTION_EPOCHS", 0),
+			Usage:       "epochs behind the head of the beacon node to keep when pruning. 0 keeps all",
+			Destination: &retention,
+		},
+		&cli.Uint64Flag{
+			Name:        "keep_from",
+			Value:       getEnvAsUint64("KEEP_FROM_SLOT", 0),
+			Usage:       "first slot prune mode keeps",
+			Destination: &keepFrom,
+		},
+		&cli.Uint64Flag{
+			Name:        "keep_to",
+			Value:       getEnvAsUint64("KEEP_TO_SLOT", 0),
+			Usage:       "last slot prune mode keeps. 0 keeps every slot from keep_from on",
+			Destination: &keepTo,
+		},
+		&cli.BoolFlag{
+			Name:        "dry_run",
+			Value:       getEnvAsBool("DRY_RUN", false),
+			Usage:       "list the roots prune mode would remove without removing them",
+			Destination: &dryRun,
+		},
+		&cli.DurationFlag{
+			Name:        "prune_interval",
+			Value:       getEnvAsDuration("PRUNE_INTERVAL", 0),
+			Usage:       "interval of the background pruner in retrieve, serve and proxy modes. 0 disables it",
+			Destination: &pruneInterval,
+		},
+		&cli.Uint64Flag{
+			Name:        "min_free_gib",
+			Value:       getEnvAsUint64("MIN_FREE_GIB", 0),
+			Usage:       "free disk space in GiB to leave when retrieving. 0 disables the threshold",
+			Destination: &minFreeGiB,
+		},
+		&cli.Uint64Flag{
+			Name:        "max_store_gib",
+			Value:       getEnvAsUint64("MAX_STORE_GIB", 0),
+			Usage:       "largest size in GiB the store may grow to when retrieving. 0 disables the limit",
+			Destination: &maxStoreGiB,
+		},
+		&cli.StringFlag{
+			Name:        "report",
+			Value:       getEnv("REPORT_PATH", ""),
+			Usage:       "file to write the run or audit report to, as CSV if it ends with .csv and JSON otherwise. the audit report defaults to stdout",
+			Destination: &reportPath,
+		},
+		&cli.StringFlag{
+			Name:        "repair_log",
+			Value:       getEnv("REPAIR_LOG", "repair.log"),
+			Usage:       "file repair mode appends a JSON line to for every sidecar it writes",
+			Destination: &repairLog,
+		},
+		&cli.StringFlag{
+			Name:        "metrics",
+			Value:       getEnv("METRICS_ADDR", ""),
+			Usage:       "address to serve Prometheus metrics on in retrieve, check, repair, daemon and worker modes, e.g. :9090. empty disables it",
+			Destination: &metricsAddr,
+		},
+		&cli.DurationFlag{
+			Name:        "progress",
+			Value:       getEnvAsDuration("PROGRESS_INTERVAL", defaultProgressInterval()),
+			Usage:       "interval of progress reports in retrieve, check, repair, daemon and worker modes, drawn as a bar when stderr is a terminal and logged otherwise. defaults to 10s on a terminal and 0, which disables them, otherwise",
+			Destination: &progress,
+		},
+		&cli.StringFlag{
+			Name:        "admin",
+			Value:       getEnv("ADMIN_ADDR", ""),
+			Usage:       "address to serve the admin API on in retrieve, check, repair, daemon and worker modes, e.g. :8080 for the loopback address, or of the daemon to send the job to in submit mode. empty disables it",
+			Destination: &adminAddr,
+		},
+		&cli.StringFlag{
+			Name:        "admin_token",
+			Value:       getEnv("ADMIN_TOKEN", ""),
+			Usage:       "bearer token the admin API requires to change a run or the job queue, sent by submit mode. needed to serve it on a non-loopback address",
+			Destination: &adminToken,
+		},
+		&cli.StringFlag{
+			Name:        "queue",
+			Value:       getEnv("QUEUE_PATH", "jobs.json"),
+			Usage:       "file daemon mode keeps its job queue in",
+			Destination: &queuePath,
+		},
+		&cli.StringFlag{
+			Name:        "job",
+			Value:       getEnv("JOB_MODE", "retrieve"),
+			Usage:       "mode of the job sent to the daemon in submit mode, or of the leases of coordinator mode (retrieve / check / repair)",
+			Destination: &jobMode,
+		},
+		&cli.IntFlag{
+			Name:        "priority",
+			Value:       getEnvAsInt("JOB_PRIORITY", 0),
+			Usage:       "priority of the job sent in submit mode. higher runs first",
+			Destination: &priority,
+		},
+		&cli.StringFlag{
+			Name:        "leases",
+			Value:       getEnv("LEASES_PATH", "leases.json"),
+			Usage:       "file coordinator mode keeps its leases in",
+			Destination: &leasePath,
+		},
+		&cli.Uint64Flag{
+			Name:        "lease_slots",
+			Value:       getEnvAsUint64("LEASE_SLOTS", 3200),
+			Usage:       "number of slots per lease in coordinator mode",
+			Destination: &leaseSlots,
+		},
+		&cli.DurationFlag{
+			Name:        "lease_ttl",
+			Value:       getEnvAsDuration("LEASE_TTL", 2*time.Minute),
+			Usage:       "time a lease is held without being renewed by its worker before coordinator mode hands it out again",
+			Destination: &leaseTTL,
+		},
+		&cli.BoolFlag{
+			Name:        "lease_shared_store",
+			Value:       getEnvAsBool("LEASE_SHARED_STORE", false),
+			Usage:       "set in coordinator mode if the workers write to one store, so a lease handed out again resumes from the cursor of its last worker",
+			Destination: &leaseShared,
+		},
+		&cli.StringFlag{
+			Name:        "lease_token",
+			Value:       getEnv("LEASE_TOKEN", ""),
+			Usage:       "bearer token coordinator mode requires from workers and worker mode sends. empty disables it",
+			Destination: &leaseToken,
+		},
+		&cli.StringFlag{
+			Name:        "coordinator",
+			Value:       getEnv("COORDINATOR_URL", ""),
+			Usage:       "URL of the coordinator to claim leases from in worker mode, e.g. http://10.0.0.1:3500",
+			Destination: &coordinator,
+		},
+		&cli.StringFlag{
+			Name:        "worker_id",
+			Value:       getEnv("WORKER_ID", ""),
+			Usage:       "id of the worker in worker mode. defaults to the host name and process id",
+			Destination: &workerID,
+		},
+	}
+}
+
+// defaultProgressInterval draws the progress bar by default only when stderr is a terminal. Progress lines are logged
+// to other outputs only when an interval is set.
+func defaultProgressInterval() time.Duration {
+	if isatty.IsTerminal(os.Stderr.Fd()) || isatty.IsCygwinTerminal(os.Stderr.Fd()) {
+		return 10 * time.Second
+	}
+	return 0
+}
+
+func getEnv(key, defaultValue string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvAsBool(name string, defaultValue bool) bool {
+	valueStr := getEnv(name, "")
+	if value, err := strconv.ParseBool(valueStr); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvAsDuration(name string, defaultValue time.Duration) time.Duration {
+	valueStr := getEnv(name, "")
+	if value, err := time.ParseDuration(valueStr); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvAsInt(name string, defaultValue int) int {
+	valueStr := getEnv(name, "")
+	if value, err := strconv.Atoi(valueStr); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvAsUint64(name string, defaultValue uint64) uint64 {
+	valueStr := getEnv(name, "")
+	if value, err := strconv.ParseUint(valueStr, 10, 64); err == nil {
+		return value
+	}
+	return defaultValue
+}
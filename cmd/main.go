@@ -1,84 +1,510 @@
-package main
-
-import (
-	"context"
-	"fmt"
-	"os"
-	"os/signal"
-	"syscall"
-
-	"github.com/joho/godotenv"
-	"github.com/rabbitprincess/blob-retriever/retriever"
-	"github.com/rs/zerolog"
-	"github.com/urfave/cli/v2"
-)
-
-func main() {
-	err := godotenv.Load(".env")
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-
-	app := &cli.App{
-		Name:  "blob_retriever",
-		Usage: "Retrieve and check pruned blobs",
-		Flags: flags(),
-		Action: func(c *cli.Context) error {
-			return rootRun()
-		},
-	}
-
-	if err := app.Run(os.Args); err != nil {
-		os.Exit(1)
-	}
-}
-
-func rootRun() error {
-	logger := zerolog.New(os.Stdout).With().Timestamp().Logger()
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	cfg := retriever.NewConfig(apiUrl, apiType, 0, dataType, dataPath, numWorker)
-	blobRetriever := retriever.NewBlobRetriever(ctx, logger, cfg)
-	if blobRetriever == nil {
-		logger.Error().Msg("Failed to create blob retriever")
-		return nil
-	}
-
-	logger.Info().Str("mode", mode).Uint64("from slot", fromSlot).Uint64("to slot", toSlot).Msg("Run blob retriever")
-
-	interrupt := handleKillSig(func() {
-	}, logger)
-
-	go func() {
-		defer close(interrupt.C)
-		blobRetriever.Run(ctx, mode, fromSlot, toSlot)
-	}()
-
-	// Wait main routine to stop
-	<-interrupt.C
-	return nil
-}
-
-type interrupt struct {
-	C chan struct{}
-}
-
-func handleKillSig(handler func(), logger zerolog.Logger) interrupt {
-	i := interrupt{
-		C: make(chan struct{}),
-	}
-
-	sigChannel := make(chan os.Signal, 1)
-
-	signal.Notify(sigChannel, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
-	go func() {
-		for signal := range sigChannel {
-			logger.Info().Msgf("Receive signal %s, Shutting down...", signal)
-			handler()
-			close(i.C)
-		}
-	}()
-	return i
-}
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/joho/godotenv"
+	"github.com/rabbitprincess/blob-retriever/archive"
+	"github.com/rabbitprincess/blob-retriever/audit"
+	"github.com/rabbitprincess/blob-retriever/jobs"
+	"github.com/rabbitprincess/blob-retriever/lease"
+	"github.com/rabbitprincess/blob-retriever/params"
+	"github.com/rabbitprincess/blob-retriever/retriever"
+	"github.com/rabbitprincess/blob-retriever/server"
+	"github.com/rabbitprincess/blob-retriever/storage"
+	"github.com/rs/zerolog"
+	"github.com/urfave/cli/v2"
+)
+
+func main() {
+	err := godotenv.Load(".env")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	app := &cli.App{
+		Name:  "blob_retriever",
+		Usage: "Retrieve and check pruned blobs",
+		Flags: flags(),
+		Action: func(c *cli.Context) error {
+			return rootRun()
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		os.Exit(1)
+	}
+}
+
+func rootRun() error {
+	// log lines go through the progress writer, so they do not overwrite the progress bar on a terminal
+	progressOut := retriever.NewProgressWriter(os.Stdout, os.Stderr)
+	logger := zerolog.New(progressOut).With().Timestamp().Logger()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	networkCfg, err := params.LoadNetworkConfig(network)
+	if err != nil {
+		logger.Error().Err(err).Str("network", network).Msg("Failed to load network config")
+		return err
+	}
+	if fromSlot == 0 {
+		fromSlot = networkCfg.DenebForkSlot()
+	}
+
+	cfg := retriever.NewConfig(apiUrl, apiType, 0, dataType, dataPath, numWorker)
+	cfg.Network = networkCfg
+	cfg.Compression = compression
+	cfg.Dedup = dedup
+	cfg.SharedNode = sharedNode
+	cfg.NodeRetentionEpochs = nodeRetention
+	cfg.RetentionEpochs = retention
+	switch mode {
+	case "serve", "proxy":
+		return serveRun(ctx, logger, cfg, mode)
+	case "lookup":
+		return lookupRun(logger, cfg)
+	case "export":
+		return exportRun(logger, cfg)
+	case "import":
+		return importRun(logger, cfg)
+	case "prune":
+		return pruneRun(ctx, logger, cfg)
+	case "audit":
+		return auditRun(logger, cfg)
+	case "submit":
+		return submitRun(logger)
+	case "coordinator":
+		return coordinatorRun(ctx, logger)
+	}
+	cfg.BlobSource = source
+	cfg.BlobSourceUrl = sourceUrl
+	cfg.JwtSecretPath = jwtSecret
+	if p2pPeers != "" {
+		cfg.P2PPeers = strings.Split(p2pPeers, ",")
+	}
+	cfg.P2PListen = p2pListen
+	cfg.RepairLogPath = repairLog
+	cfg.ProgressInterval = progress
+	cfg.ProgressOutput = progressOut
+	cfg.AdminToken = adminToken
+	cfg.LeaseToken = leaseToken
+	cfg.SpaceLimits = storage.SpaceLimits{MinFreeBytes: minFreeGiB << 30, MaxStoreBytes: maxStoreGiB << 30}
+	blobRetriever := retriever.NewBlobRetriever(ctx, logger, cfg)
+	if blobRetriever == nil {
+		logger.Error().Msg("Failed to create blob retriever")
+		return nil
+	}
+	defer func() {
+		if err := blobRetriever.Close(); err != nil {
+			logger.Error().Err(err).Msg("Failed to close blob storage")
+		}
+	}()
+
+	logger.Info().Str("mode", mode).Str("network", networkCfg.ConfigName).Uint64("from slot", fromSlot).Uint64("to slot", toSlot).Msg("Run blob retriever")
+	if store, ok := blobRetriever.Storage().(storage.PrunableStore); ok && mode == "retrieve" {
+		if err := startPruner(ctx, logger, cfg, store); err != nil {
+			logger.Error().Err(err).Msg("Failed to start background pruner")
+			return err
+		}
+	}
+
+	if mode == "daemon" {
+		queue, err := jobs.Open(queuePath)
+		if err != nil {
+			logger.Error().Err(err).Str("path", queuePath).Msg("Failed to open job queue")
+			return err
+		}
+		defer queue.Close()
+		blobRetriever.SetJobQueue(queue)
+		if adminAddr == "" {
+			logger.Warn().Msg("No admin address set, only jobs already in the queue are run")
+		}
+	}
+
+	if metricsAddr != "" {
+		go func() {
+			if err := blobRetriever.Metrics().ListenAndServe(ctx, logger, metricsAddr); err != nil {
+				logger.Error().Err(err).Msg("Failed to serve metrics")
+			}
+		}()
+	}
+
+	if adminAddr != "" {
+		go func() {
+			if err := blobRetriever.ServeAdmin(ctx, adminAddr); err != nil {
+				logger.Error().Err(err).Msg("Failed to serve admin API")
+			}
+		}()
+	}
+
+	if mode == "daemon" {
+		ctx, cancel := context.WithCancel(ctx)
+		handleKillSig(cancel, logger)
+		if err := blobRetriever.RunDaemon(ctx); err != nil {
+			logger.Error().Err(err).Msg("Failed to run daemon")
+			return err
+		}
+		return nil
+	}
+
+	if mode == "worker" {
+		if coordinator == "" {
+			err := fmt.Errorf("worker mode needs the URL of the coordinator")
+			logger.Error().Err(err).Msg("Failed to run worker")
+			return err
+		}
+		if workerID == "" {
+			host, _ := os.Hostname()
+			workerID = fmt.Sprintf("%s-%d", host, os.Getpid())
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		handleKillSig(cancel, logger)
+		if err := blobRetriever.RunWorker(ctx, coordinator, workerID); err != nil {
+			logger.Error().Err(err).Msg("Failed to run worker")
+			return err
+		}
+		return nil
+	}
+
+	// an interrupt cancels the run, which lets running slots finish, so the report covers the slots done before it
+	handleKillSig(cancel, logger)
+	runErr := blobRetriever.Run(ctx, mode, fromSlot, toSlot)
+	if runErr != nil {
+		logger.Error().Err(runErr).Msg("Failed to run blob retriever")
+	}
+	if report := blobRetriever.Report(); report != nil && reportPath != "" {
+		if err := report.WriteFile(reportPath); err != nil {
+			logger.Error().Err(err).Str("path", reportPath).Msg("Failed to write run report")
+		}
+	}
+	// the run error is returned after the report is written, so a failed or interrupted run exits non-zero
+	return runErr
+}
+
+func coordinatorRun(ctx context.Context, logger zerolog.Logger) error {
+	if toSlot < fromSlot {
+		err := fmt.Errorf("to slot %d is less than from slot %d", toSlot, fromSlot)
+		logger.Error().Err(err).Msg("Failed to run coordinator")
+		return err
+	}
+	c, err := lease.Open(leasePath, lease.Plan{Mode: jobMode, FromSlot: fromSlot, ToSlot: toSlot, Slots: leaseSlots, SharedStore: leaseShared}, leaseTTL)
+	if err != nil {
+		logger.Error().Err(err).Str("path", leasePath).Msg("Failed to open leases")
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	handleKillSig(cancel, logger)
+	if err := retriever.RunCoordinator(ctx, logger, listenAddr, c, leaseToken); err != nil {
+		logger.Error().Err(err).Msg("Failed to run coordinator")
+		return err
+	}
+	return nil
+}
+
+func submitRun(logger zerolog.Logger) error {
+	if adminAddr == "" {
+		return fmt.Errorf("submit mode needs the admin address of the daemon")
+	}
+	path, err := filepath.Abs(dataPath)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(jobs.Job{Mode: jobMode, FromSlot: fromSlot, ToSlot: toSlot, StorageType: dataType, StoragePath: path, Priority: priority})
+	if err != nil {
+		return err
+	}
+	url := adminAddr
+	if strings.HasPrefix(url, ":") {
+		url = "127.0.0.1" + url
+	}
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	req, err := http.NewRequest(http.MethodPost, url+"/jobs", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logger.Error().Err(err).Str("admin", adminAddr).Msg("Failed to submit job")
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		err := fmt.Errorf("daemon refused job with status %d: %s", resp.StatusCode, apiErr.Message)
+		logger.Error().Err(err).Msg("Failed to submit job")
+		return err
+	}
+	var job jobs.Job
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return err
+	}
+	logger.Info().Uint64("job", job.ID).Str("mode", job.Mode).Uint64("from slot", job.FromSlot).Uint64("to slot", job.ToSlot).Int("priority", job.Priority).Msg("Job submitted")
+	return nil
+}
+
+func serveRun(ctx context.Context, logger zerolog.Logger, cfg *retriever.Config, mode string) error {
+	store, err := openStore(logger, cfg, mode == "serve" && !prunerEnabled())
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to open blob storage")
+		return err
+	}
+	defer closeStore(logger, store)
+	index, err := store.SlotIndex()
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to build slot index")
+		return err
+	}
+	logger.Info().Int("blocks", index.Len()).Msg("Slot index built")
+	if err := startPruner(ctx, logger, cfg, store); err != nil {
+		logger.Error().Err(err).Msg("Failed to start background pruner")
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	interrupt := handleKillSig(cancel, logger)
+	var srv interface {
+		ListenAndServe(ctx context.Context, addr string) error
+	} = server.NewServer(logger, store, cfg.Network)
+	if mode == "proxy" {
+		client, err := retriever.NewBeaconClientFromConfig(ctx, logger, cfg)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to create beacon client")
+			return err
+		}
+		proxy, err := server.NewProxy(logger, store, cfg.Network, client, cfg.BeaconApiUrl)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to create proxy")
+			return err
+		}
+		srv = proxy
+	}
+	if err := srv.ListenAndServe(ctx, listenAddr); err != nil {
+		logger.Error().Err(err).Msg("Failed to serve blob sidecars")
+		return err
+	}
+	<-interrupt.C
+	return nil
+}
+
+func lookupRun(logger zerolog.Logger, cfg *retriever.Config) error {
+	var hash [32]byte
+	if err := storage.DecodeHex(versionedHash, hash[:]); err != nil {
+		err = fmt.Errorf("invalid versioned hash %s", versionedHash)
+		logger.Error().Err(err).Msg("Failed to look up blob")
+		return err
+	}
+	store, err := openStore(logger, cfg, true)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to open blob storage")
+		return err
+	}
+	defer closeStore(logger, store)
+	sidecar, err := store.GetByVersionedHash(hash)
+	if err != nil {
+		logger.Error().Err(err).Str("versioned_hash", versionedHash).Msg("Failed to look up blob")
+		return err
+	}
+	blob, err := server.NewBlob(sidecar)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(os.Stdout).Encode(blob)
+}
+
+func exportRun(logger zerolog.Logger, cfg *retriever.Config) error {
+	store, err := openStore(logger, cfg, true)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to open blob storage")
+		return err
+	}
+	defer closeStore(logger, store)
+	if toSlot == 0 {
+		index, err := store.SlotIndex()
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to build slot index")
+			return err
+		}
+		toSlot, _, _ = index.Head()
+	}
+	paths, err := archive.Export(logger, store, cfg.Network, archivePath, fromSlot, toSlot, bundleEpochs)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to export bundles")
+		return err
+	}
+	logger.Info().Int("bundles", len(paths)).Uint64("from slot", fromSlot).Uint64("to slot", toSlot).Msg("Export done")
+	return nil
+}
+
+func importRun(logger zerolog.Logger, cfg *retriever.Config) error {
+	store, err := openStore(logger, cfg, false)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to open blob storage")
+		return err
+	}
+	defer closeStore(logger, store)
+	if !archive.IsBundlePath(archivePath) {
+		stats, err := archive.ImportBlobDir(logger, archivePath, cfg.Network.MaxBlobsPerBlockLimit(), store)
+		if err != nil {
+			logger.Error().Err(err).Int("imported", stats.Saved).Msg("Failed to import blob directory")
+			return err
+		}
+		logger.Info().Int("imported", stats.Saved).Int("present", stats.Present).Int("invalid", stats.Invalid).Msg("Import done")
+		return nil
+	}
+	imported, err := archive.Import(logger, archivePath, store)
+	if err != nil {
+		logger.Error().Err(err).Int("imported", imported).Msg("Failed to import bundles")
+		return err
+	}
+	logger.Info().Int("imported", imported).Msg("Import done")
+	return nil
+}
+
+func pruneRun(ctx context.Context, logger zerolog.Logger, cfg *retriever.Config) error {
+	store, err := openStore(logger, cfg, dryRun)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to open blob storage")
+		return err
+	}
+	defer closeStore(logger, store)
+	policy := storage.PrunePolicy{FromSlot: keepFrom, ToSlot: keepTo}
+	if retention > 0 {
+		headSlot, err := newHeadSlot(ctx, logger, cfg)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to create beacon client")
+			return err
+		}
+		if policy.HeadSlot, err = headSlot(ctx); err != nil {
+			logger.Error().Err(err).Msg("Failed to get the head slot")
+			return err
+		}
+	}
+	report, err := storage.Prune(logger, store, policy, dryRun)
+	if err != nil {
+		logger.Error().Err(err).Int("pruned", report.Pruned).Msg("Failed to prune blob storage")
+		return err
+	}
+	logger.Info().Bool("dry run", report.DryRun).Int("pruned", report.Pruned).Int("kept", report.Kept).Uint64("bytes", report.Bytes).Msg("Prune done")
+	return nil
+}
+
+func auditRun(logger zerolog.Logger, cfg *retriever.Config) error {
+	store, err := openStore(logger, cfg, true)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to open blob storage")
+		return err
+	}
+	defer closeStore(logger, store)
+	report, err := audit.Audit(logger, store, cfg.Network)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to audit blob storage")
+		return err
+	}
+	out := os.Stdout
+	if reportPath != "" {
+		if out, err = os.Create(reportPath); err != nil {
+			logger.Error().Err(err).Msg("Failed to create audit report")
+			return err
+		}
+		defer out.Close()
+	}
+	if err := report.WriteJSON(out); err != nil {
+		return err
+	}
+	if !report.OK() {
+		return fmt.Errorf("audit found %d issues", len(report.Issues))
+	}
+	return nil
+}
+
+// openStore opens the blob storage of the config. A read-only store takes no lock, so it can be opened next to
+// a retriever writing it.
+func openStore(logger zerolog.Logger, cfg *retriever.Config, readOnly bool) (storage.ReadableBlobStore, error) {
+	opts := cfg.StoreOptions()
+	opts.ReadOnly = readOnly
+	return storage.NewBlobStore(logger, cfg.StorageType, cfg.StoragePath, cfg.Network.MaxBlobsPerBlockLimit(), opts)
+}
+
+// closeStore closes a store opened by openStore, which persists its indices and, for a writable store, records a
+// clean shutdown.
+func closeStore(logger zerolog.Logger, store storage.ReadableBlobStore) {
+	if closer, ok := store.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.Error().Err(err).Msg("Failed to close blob storage")
+		}
+	}
+}
+
+func prunerEnabled() bool {
+	return pruneInterval > 0 && retention > 0
+}
+
+// startPruner runs the background pruner with the retention window, if an interval and a window are set.
+func startPruner(ctx context.Context, logger zerolog.Logger, cfg *retriever.Config, store storage.PrunableStore) error {
+	if !prunerEnabled() {
+		return nil
+	}
+	headSlot, err := newHeadSlot(ctx, logger, cfg)
+	if err != nil {
+		return err
+	}
+	logger.Info().Uint64("retention epochs", retention).Dur("interval", pruneInterval).Msg("Start background pruner")
+	go storage.RunPruner(ctx, logger, store, headSlot, pruneInterval)
+	return nil
+}
+
+// newHeadSlot returns a function getting the head slot of the beacon node, which the retention window ends at.
+func newHeadSlot(ctx context.Context, logger zerolog.Logger, cfg *retriever.Config) (func(context.Context) (uint64, error), error) {
+	client, err := retriever.NewBeaconClientFromConfig(ctx, logger, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context) (uint64, error) {
+		return retriever.HeadSlot(ctx, client)
+	}, nil
+}
+
+type interrupt struct {
+	C chan struct{}
+}
+
+func handleKillSig(handler func(), logger zerolog.Logger) interrupt {
+	i := interrupt{
+		C: make(chan struct{}),
+	}
+
+	sigChannel := make(chan os.Signal, 1)
+
+	signal.Notify(sigChannel, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	var once sync.Once
+	go func() {
+		for signal := range sigChannel {
+			logger.Info().Msgf("Receive signal %s, Shutting down...", signal)
+			handler()
+			once.Do(func() { close(i.C) })
+		}
+	}()
+	return i
+}
@@ -0,0 +1,75 @@
+// Package testutil provides fixtures shared by the tests of several packages.
+package testutil
+
+import (
+	"testing"
+
+	"github.com/attestantio/go-eth2-client/spec/deneb"
+	gokzg4844 "github.com/crate-crypto/go-kzg-4844"
+	"github.com/prysmaticlabs/prysm/v5/consensus-types/blocks"
+	"github.com/prysmaticlabs/prysm/v5/consensus-types/primitives"
+	enginev1 "github.com/prysmaticlabs/prysm/v5/proto/engine/v1"
+	ethpb "github.com/prysmaticlabs/prysm/v5/proto/prysm/v1alpha1"
+	"github.com/rabbitprincess/blob-retriever/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// NewVerifiedSidecars returns sidecars with valid kzg and inclusion proofs for a block at slot.
+func NewVerifiedSidecars(t *testing.T, slot uint64, count int) ([32]byte, []*deneb.BlobSidecar) {
+	ctx, err := gokzg4844.NewContext4096Secure()
+	require.NoError(t, err)
+
+	body := &ethpb.BeaconBlockBodyDeneb{
+		RandaoReveal: make([]byte, 96),
+		Eth1Data:     &ethpb.Eth1Data{DepositRoot: make([]byte, 32), BlockHash: make([]byte, 32)},
+		Graffiti:     make([]byte, 32),
+		SyncAggregate: &ethpb.SyncAggregate{
+			SyncCommitteeBits:      make([]byte, 64),
+			SyncCommitteeSignature: make([]byte, 96),
+		},
+		ExecutionPayload: &enginev1.ExecutionPayloadDeneb{
+			ParentHash:    make([]byte, 32),
+			FeeRecipient:  make([]byte, 20),
+			StateRoot:     make([]byte, 32),
+			ReceiptsRoot:  make([]byte, 32),
+			LogsBloom:     make([]byte, 256),
+			PrevRandao:    make([]byte, 32),
+			BaseFeePerGas: make([]byte, 32),
+			BlockHash:     make([]byte, 32),
+		},
+	}
+	blobs := make([]gokzg4844.Blob, count)
+	proofs := make([]gokzg4844.KZGProof, count)
+	for i := range blobs {
+		blobs[i][31] = byte(i + 1)
+		commitment, err := ctx.BlobToKZGCommitment(&blobs[i], 0)
+		require.NoError(t, err)
+		proofs[i], err = ctx.ComputeBlobKZGProof(&blobs[i], commitment, 0)
+		require.NoError(t, err)
+		body.BlobKzgCommitments = append(body.BlobKzgCommitments, commitment[:])
+	}
+	roBody, err := blocks.NewBeaconBlockBody(body)
+	require.NoError(t, err)
+	bodyRoot, err := roBody.HashTreeRoot()
+	require.NoError(t, err)
+	header := storage.HydrateSignedBeaconHeader(&ethpb.SignedBeaconBlockHeader{
+		Header: &ethpb.BeaconBlockHeader{Slot: primitives.Slot(slot), BodyRoot: bodyRoot[:]},
+	})
+	root, err := header.Header.HashTreeRoot()
+	require.NoError(t, err)
+
+	sidecars := make([]*deneb.BlobSidecar, count)
+	for i := range sidecars {
+		proof, err := blocks.MerkleProofKZGCommitment(roBody, i)
+		require.NoError(t, err)
+		sidecars[i] = storage.ConvDenebSideCar(&ethpb.BlobSidecar{
+			Index:                    uint64(i),
+			Blob:                     blobs[i][:],
+			KzgCommitment:            body.BlobKzgCommitments[i],
+			KzgProof:                 proofs[i][:],
+			SignedBlockHeader:        header,
+			CommitmentInclusionProof: proof,
+		})
+	}
+	return root, sidecars
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin
+
+package jobs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func flock(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrLocked
+	}
+	return err
+}
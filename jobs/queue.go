@@ -0,0 +1,369 @@
+// Package jobs keeps the persistent queue of retrieval jobs run by the daemon mode.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job states.
+const (
+	StateQueued    = "queued"
+	StateRunning   = "running"
+	StateDone      = "done"
+	StateFailed    = "failed"
+	StateCancelled = "cancelled"
+)
+
+var (
+	ErrNotFound = errors.New("job not found")
+	ErrOverlap  = errors.New("job overlaps a queued or running job on the same store")
+	// ErrLocked is returned by Open when another process holds the lock of the queue file.
+	ErrLocked = errors.New("job queue is locked by another process")
+)
+
+// Job is a slot range run in a mode against a store.
+type Job struct {
+	ID          uint64 `json:"id"`
+	Mode        string `json:"mode"`
+	FromSlot    uint64 `json:"from_slot"`
+	ToSlot      uint64 `json:"to_slot"`
+	StorageType string `json:"storage_type"`
+	StoragePath string `json:"storage_path"`
+	// Priority orders the queue, higher first. Jobs of the same priority run in submission order.
+	Priority int    `json:"priority"`
+	State    string `json:"state"`
+	// Cursor is the lowest slot of the job not completed yet, from which an interrupted job is resumed.
+	Cursor      uint64     `json:"cursor"`
+	Error       string     `json:"error,omitempty"`
+	SubmittedAt time.Time  `json:"submitted_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+// active reports whether the job is queued or running.
+func (j *Job) active() bool {
+	return j.State == StateQueued || j.State == StateRunning
+}
+
+// overlaps reports whether the jobs target the same store and their slot ranges intersect.
+func (j *Job) overlaps(other *Job) bool {
+	return j.StorageType == other.StorageType && j.StoragePath == other.StoragePath &&
+		j.FromSlot <= other.ToSlot && other.FromSlot <= j.ToSlot
+}
+
+// Queue is a job queue saved to a JSON file on every change. Jobs are run one at a time.
+type Queue struct {
+	mu   sync.Mutex
+	path string
+	// lock is the flock of the <path>.lock file, kept so only one daemon uses the queue file.
+	lock   *os.File
+	nextID uint64
+	jobs   []*Job
+	// notify is signalled when a job is queued.
+	notify chan struct{}
+}
+
+// queueFile is the content of the queue file.
+type queueFile struct {
+	NextID uint64 `json:"next_id"`
+	Jobs   []*Job `json:"jobs"`
+}
+
+// Open locks the queue file and loads the queue saved at path, or starts an empty one if there is no file. Jobs which
+// were running when the queue was last saved are queued again, to resume from their cursor. The queue must be closed
+// to release the lock.
+func Open(path string) (*Queue, error) {
+	lock, err := lockQueue(path)
+	if err != nil {
+		return nil, err
+	}
+	q := &Queue{path: path, lock: lock, nextID: 1, notify: make(chan struct{}, 1)}
+	if err := q.load(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// lockQueue takes the lock of the queue file at path. The queue file itself is replaced on every save, so the lock is
+// taken on a file next to it.
+func lockQueue(path string) (*os.File, error) {
+	lockPath := path + ".lock"
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open job queue lock %s: %w", lockPath, err)
+	}
+	if err := flock(file); err != nil {
+		file.Close()
+		if errors.Is(err, ErrLocked) {
+			return nil, fmt.Errorf("%w: %s is held by another daemon", ErrLocked, lockPath)
+		}
+		return nil, fmt.Errorf("failed to lock job queue %s: %w", lockPath, err)
+	}
+	return file, nil
+}
+
+func (q *Queue) load() error {
+	data, err := os.ReadFile(q.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read job queue %s: %w", q.path, err)
+	}
+	var file queueFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to decode job queue %s: %w", q.path, err)
+	}
+	q.nextID, q.jobs = max(file.NextID, 1), file.Jobs
+	for _, job := range q.jobs {
+		if job.State == StateRunning {
+			job.State = StateQueued
+		}
+	}
+	return q.save()
+}
+
+// Close releases the lock of the queue file.
+func (q *Queue) Close() error {
+	// closing the file releases the flock
+	return q.lock.Close()
+}
+
+// Submit validates a job and queues it. The store path is made absolute, so jobs on the same store are compared
+// by their path.
+func (q *Queue) Submit(job Job) (Job, error) {
+	switch job.Mode {
+	case "retrieve", "check", "repair":
+	default:
+		return Job{}, fmt.Errorf("unknown job mode %s. Only support 'retrieve', 'check' or 'repair' mode", job.Mode)
+	}
+	if job.ToSlot < job.FromSlot {
+		return Job{}, fmt.Errorf("to slot %d is less than from slot %d", job.ToSlot, job.FromSlot)
+	}
+	if job.StoragePath == "" {
+		return Job{}, errors.New("job has no storage path")
+	}
+	if job.StorageType == "" {
+		job.StorageType = "prysm"
+	}
+	path, err := filepath.Abs(job.StoragePath)
+	if err != nil {
+		return Job{}, err
+	}
+	job.StoragePath = path
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, other := range q.jobs {
+		if other.active() && job.overlaps(other) {
+			return Job{}, fmt.Errorf("%w: job %d", ErrOverlap, other.ID)
+		}
+	}
+	job.ID = q.nextID
+	job.State = StateQueued
+	job.Cursor = job.FromSlot
+	job.Error = ""
+	job.SubmittedAt = time.Now().UTC()
+	job.StartedAt, job.FinishedAt = nil, nil
+	if err := q.update(func() { q.nextID++; q.jobs = append(q.jobs, &job) }); err != nil {
+		return Job{}, err
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// Next blocks until a job is queued, marks the one of the highest priority as running and returns it.
+func (q *Queue) Next(ctx context.Context) (Job, error) {
+	for {
+		q.mu.Lock()
+		var next *Job
+		for _, job := range q.jobs {
+			if job.State == StateQueued && (next == nil || job.Priority > next.Priority) {
+				next = job
+			}
+		}
+		if next != nil {
+			now := time.Now().UTC()
+			err := q.update(func() {
+				next.State = StateRunning
+				if next.StartedAt == nil {
+					next.StartedAt = &now
+				}
+			})
+			job := *next
+			q.mu.Unlock()
+			return job, err
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return Job{}, ctx.Err()
+		case <-q.notify:
+		}
+	}
+}
+
+// Progress saves the cursor of a running job.
+func (q *Queue) Progress(id, cursor uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, err := q.find(id)
+	if err != nil {
+		return err
+	}
+	if job.Cursor == cursor {
+		return nil
+	}
+	return q.update(func() { job.Cursor = cursor })
+}
+
+// Release queues a running job again at its cursor, e.g. when the daemon is stopped.
+func (q *Queue) Release(id, cursor uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, err := q.find(id)
+	if err != nil {
+		return err
+	}
+	return q.update(func() {
+		job.State = StateQueued
+		job.Cursor = cursor
+	})
+}
+
+// Finish marks a running job as done, or as failed with the error it stopped on.
+func (q *Queue) Finish(id, cursor uint64, runErr error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, err := q.find(id)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	return q.update(func() {
+		job.State = StateDone
+		job.Cursor = cursor
+		if runErr != nil {
+			job.State = StateFailed
+			job.Error = runErr.Error()
+		}
+		job.FinishedAt = &now
+	})
+}
+
+// Cancel removes a queued job from the queue. Running jobs can not be cancelled.
+func (q *Queue) Cancel(id uint64) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, err := q.find(id)
+	if err != nil {
+		return Job{}, err
+	}
+	if job.State != StateQueued {
+		return Job{}, fmt.Errorf("job %d is %s, only queued jobs can be cancelled", id, job.State)
+	}
+	now := time.Now().UTC()
+	err = q.update(func() {
+		job.State = StateCancelled
+		job.FinishedAt = &now
+	})
+	return *job, err
+}
+
+// List returns the jobs of the queue, queued and running ones first in the order they run, then the finished ones
+// by ID.
+func (q *Queue) List() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]Job, len(q.jobs))
+	for i, job := range q.jobs {
+		jobs[i] = *job
+	}
+	rank := func(job Job) int {
+		switch job.State {
+		case StateRunning:
+			return 0
+		case StateQueued:
+			return 1
+		}
+		return 2
+	}
+	sort.SliceStable(jobs, func(i, j int) bool {
+		if rank(jobs[i]) != rank(jobs[j]) {
+			return rank(jobs[i]) < rank(jobs[j])
+		}
+		if jobs[i].State == StateQueued && jobs[i].Priority != jobs[j].Priority {
+			return jobs[i].Priority > jobs[j].Priority
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs
+}
+
+func (q *Queue) find(id uint64) (*Job, error) {
+	for _, job := range q.jobs {
+		if job.ID == id {
+			return job, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %d", ErrNotFound, id)
+}
+
+// update applies a change to the queue and saves it, undoing the change if the queue can not be saved.
+func (q *Queue) update(change func()) error {
+	nextID := q.nextID
+	jobs := make([]*Job, len(q.jobs))
+	saved := make([]Job, len(q.jobs))
+	for i, job := range q.jobs {
+		jobs[i], saved[i] = job, *job
+	}
+	change()
+	if err := q.save(); err != nil {
+		q.nextID, q.jobs = nextID, jobs
+		for i, job := range jobs {
+			*job = saved[i]
+		}
+		return err
+	}
+	return nil
+}
+
+// save atomically writes the queue file, syncing it before it replaces the old one so a crash leaves either.
+func (q *Queue) save() error {
+	data, err := json.MarshalIndent(queueFile{NextID: q.nextID, Jobs: q.jobs}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write job queue %s: %w", q.path, err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write job queue %s: %w", q.path, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync job queue %s: %w", q.path, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write job queue %s: %w", q.path, err)
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		return fmt.Errorf("failed to write job queue %s: %w", q.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueue(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "jobs.json")
+	q, err := Open(path)
+	require.NoError(t, err)
+
+	low, err := q.Submit(Job{Mode: "retrieve", FromSlot: 100, ToSlot: 199, StoragePath: dir})
+	require.NoError(t, err)
+	high, err := q.Submit(Job{Mode: "check", FromSlot: 200, ToSlot: 299, StoragePath: dir, Priority: 5})
+	require.NoError(t, err)
+	_, err = q.Submit(Job{Mode: "repair", FromSlot: 150, ToSlot: 250, StoragePath: dir})
+	require.True(t, errors.Is(err, ErrOverlap))
+	_, err = q.Submit(Job{Mode: "repair", FromSlot: 150, ToSlot: 250, StoragePath: filepath.Join(dir, "other")})
+	require.NoError(t, err)
+	_, err = q.Submit(Job{Mode: "prune", FromSlot: 300, ToSlot: 399, StoragePath: dir})
+	require.Error(t, err)
+
+	// the higher priority runs first, then jobs in submission order
+	job, err := q.Next(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, high.ID, job.ID)
+	require.Equal(t, StateRunning, job.State)
+	require.NoError(t, q.Progress(job.ID, 250))
+
+	// only one daemon uses the queue file at a time
+	_, err = Open(path)
+	require.ErrorIs(t, err, ErrLocked)
+
+	// a job running when the daemon stopped is resumed from its cursor
+	require.NoError(t, q.Close())
+	q, err = Open(path)
+	require.NoError(t, err)
+	job, err = q.Next(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, high.ID, job.ID)
+	require.Equal(t, uint64(250), job.Cursor)
+	require.NoError(t, q.Finish(job.ID, 300, nil))
+
+	job, err = q.Next(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, low.ID, job.ID)
+	require.NoError(t, q.Finish(job.ID, 200, errors.New("1 slots failed")))
+
+	list := q.List()
+	require.Len(t, list, 3)
+	require.Equal(t, StateQueued, list[0].State)
+	cancelled, err := q.Cancel(list[0].ID)
+	require.NoError(t, err)
+	require.Equal(t, StateCancelled, cancelled.State)
+	_, err = q.Cancel(low.ID)
+	require.Error(t, err)
+
+	// the range of a finished job can be submitted again
+	_, err = q.Submit(Job{Mode: "repair", FromSlot: 100, ToSlot: 199, StoragePath: dir})
+	require.NoError(t, err)
+
+	require.NoError(t, q.Close())
+	q, err = Open(path)
+	require.NoError(t, err)
+	defer q.Close()
+	list = q.List()
+	require.Equal(t, uint64(4), list[0].ID)
+	states := map[uint64]string{}
+	for _, job := range list {
+		states[job.ID] = job.State
+	}
+	require.Equal(t, map[uint64]string{1: StateFailed, 2: StateDone, 3: StateCancelled, 4: StateQueued}, states)
+	require.Equal(t, "1 slots failed", list[1].Error)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = q.Next(ctx)
+	require.NoError(t, err)
+	_, err = q.Next(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
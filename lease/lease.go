@@ -0,0 +1,323 @@
+// Package lease splits the slot range of a distributed run into leases which workers claim from a coordinator.
+package lease
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Lease states.
+const (
+	StatePending = "pending"
+	StateLeased  = "leased"
+	StateDone    = "done"
+	StateFailed  = "failed"
+)
+
+// maxFailures is the number of failed runs after which a lease is no longer handed out.
+const maxFailures = 3
+
+var (
+	// ErrNoLease is returned by Claim when every unfinished lease is held by a worker.
+	ErrNoLease = errors.New("no lease available")
+	// ErrFinished is returned by Claim once every lease is done or failed.
+	ErrFinished = errors.New("all leases are finished")
+	// ErrLost is returned when a worker renews or completes a lease it no longer holds, e.g. after it expired.
+	ErrLost     = errors.New("lease is not held by the worker")
+	ErrNotFound = errors.New("lease not found")
+)
+
+// Plan is the run a coordinator splits into leases.
+type Plan struct {
+	Mode     string `json:"mode"`
+	FromSlot uint64 `json:"from_slot"`
+	ToSlot   uint64 `json:"to_slot"`
+	// Slots is the number of slots of a lease. The last lease may be shorter.
+	Slots uint64 `json:"lease_slots"`
+	// SharedStore is set when the workers write to one store, e.g. on a network file system. A lease handed out again
+	// then resumes from the cursor its last worker reported, as the slots below it are stored already. Otherwise it
+	// starts again from its first slot, as they are only in the store of the worker which ran them.
+	SharedStore bool `json:"shared_store"`
+}
+
+// Lease is a slot range of the plan which is run by one worker at a time.
+type Lease struct {
+	ID       uint64 `json:"id"`
+	Mode     string `json:"mode"`
+	FromSlot uint64 `json:"from_slot"`
+	ToSlot   uint64 `json:"to_slot"`
+	State    string `json:"state"`
+	Worker   string `json:"worker,omitempty"`
+	// Cursor is the lowest slot of the lease not completed yet, as last reported by its worker.
+	Cursor    uint64     `json:"cursor"`
+	Failures  int        `json:"failures"`
+	Error     string     `json:"error,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Coordinator hands out the leases of a plan and takes leases back from workers which stop renewing them. The leases
+// are saved to a JSON file on every change.
+type Coordinator struct {
+	mu       sync.Mutex
+	path     string
+	plan     Plan
+	ttl      time.Duration
+	leases   []*Lease
+	finished chan struct{}
+}
+
+// leaseFile is the content of the lease file.
+type leaseFile struct {
+	Plan   Plan     `json:"plan"`
+	Leases []*Lease `json:"leases"`
+}
+
+// Open loads the leases saved at path, or splits the plan into new ones if there is no file. A lease held when the
+// file was last saved is handed out again. Whether the workers share a store may change between runs of a plan.
+func Open(path string, plan Plan, ttl time.Duration) (*Coordinator, error) {
+	switch plan.Mode {
+	case "retrieve", "check", "repair":
+	default:
+		return nil, fmt.Errorf("unknown lease mode %s. Only support 'retrieve', 'check' or 'repair' mode", plan.Mode)
+	}
+	if plan.ToSlot < plan.FromSlot {
+		return nil, fmt.Errorf("to slot %d is less than from slot %d", plan.ToSlot, plan.FromSlot)
+	}
+	if plan.Slots == 0 {
+		return nil, errors.New("lease size must be at least one slot")
+	}
+	if ttl <= 0 {
+		return nil, errors.New("lease ttl must be positive")
+	}
+
+	c := &Coordinator{path: path, plan: plan, ttl: ttl, finished: make(chan struct{})}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		for from, id := plan.FromSlot, uint64(1); from <= plan.ToSlot; id++ {
+			to := min(from+plan.Slots-1, plan.ToSlot)
+			c.leases = append(c.leases, &Lease{ID: id, Mode: plan.Mode, FromSlot: from, ToSlot: to, State: StatePending, Cursor: from})
+			if to == plan.ToSlot {
+				break
+			}
+			from = to + 1
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read lease file %s: %w", path, err)
+	} else {
+		var file leaseFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("failed to decode lease file %s: %w", path, err)
+		}
+		saved := file.Plan
+		saved.SharedStore = plan.SharedStore
+		if saved != plan {
+			return nil, fmt.Errorf("lease file %s holds %s leases of slots %d to %d by %d slots, not the ones of this run", path, file.Plan.Mode, file.Plan.FromSlot, file.Plan.ToSlot, file.Plan.Slots)
+		}
+		c.leases = file.Leases
+		for _, lease := range c.leases {
+			if lease.State == StateLeased {
+				lease.release(plan.SharedStore)
+			}
+		}
+	}
+	c.checkFinished()
+	return c, c.save()
+}
+
+// Plan returns the plan the leases were made from.
+func (c *Coordinator) Plan() Plan {
+	return c.plan
+}
+
+// Finished is closed once every lease is done or failed.
+func (c *Coordinator) Finished() <-chan struct{} {
+	return c.finished
+}
+
+// Claim hands the pending lease of the lowest slots to a worker until the ttl passes without a renewal.
+// Leases whose ttl passed are pending again. A lease handed out again is run from its cursor if the workers share a
+// store, and from its first slot otherwise.
+func (c *Coordinator) Claim(worker string) (Lease, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now().UTC()
+	var next *Lease
+	for _, lease := range c.leases {
+		if lease.State == StatePending || (lease.State == StateLeased && lease.ExpiresAt.Before(now)) {
+			next = lease
+			break
+		}
+	}
+	if next == nil {
+		select {
+		case <-c.finished:
+			return Lease{}, ErrFinished
+		default:
+			return Lease{}, ErrNoLease
+		}
+	}
+	expiresAt := now.Add(c.ttl)
+	err := c.update(func() {
+		next.State = StateLeased
+		next.Worker = worker
+		if !c.plan.SharedStore {
+			next.Cursor = next.FromSlot
+		}
+		next.ExpiresAt = &expiresAt
+	})
+	return *next, err
+}
+
+// Renew extends the lease held by a worker by the ttl and records its cursor.
+func (c *Coordinator) Renew(id uint64, worker string, cursor uint64) (Lease, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lease, err := c.held(id, worker)
+	if err != nil {
+		return Lease{}, err
+	}
+	expiresAt := time.Now().UTC().Add(c.ttl)
+	// renewals are frequent, so they are saved with the next change rather than on their own
+	lease.ExpiresAt = &expiresAt
+	lease.Cursor = min(max(cursor, lease.FromSlot), lease.ToSlot+1)
+	return *lease, nil
+}
+
+// Release hands a lease held by a worker back without counting a failure, e.g. when the worker is stopped.
+func (c *Coordinator) Release(id uint64, worker string) (Lease, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lease, err := c.held(id, worker)
+	if err != nil {
+		return Lease{}, err
+	}
+	err = c.update(func() { lease.release(c.plan.SharedStore) })
+	return *lease, err
+}
+
+// Complete records the outcome of the run of a lease held by a worker. A failed lease is handed out again until it
+// failed maxFailures times.
+func (c *Coordinator) Complete(id uint64, worker string, cursor uint64, runErr string) (Lease, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lease, err := c.held(id, worker)
+	if err != nil {
+		return Lease{}, err
+	}
+	err = c.update(func() {
+		lease.ExpiresAt = nil
+		lease.Cursor = min(max(cursor, lease.FromSlot), lease.ToSlot+1)
+		lease.Error = runErr
+		if runErr == "" {
+			lease.State = StateDone
+			lease.Cursor = lease.ToSlot + 1
+			return
+		}
+		lease.Failures++
+		if lease.Failures >= maxFailures {
+			lease.State = StateFailed
+		} else {
+			lease.release(c.plan.SharedStore)
+		}
+	})
+	return *lease, err
+}
+
+// List returns the leases by slot.
+func (c *Coordinator) List() []Lease {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	leases := make([]Lease, len(c.leases))
+	for i, lease := range c.leases {
+		leases[i] = *lease
+	}
+	return leases
+}
+
+// Failed returns the number of leases which failed maxFailures times.
+func (c *Coordinator) Failed() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	failed := 0
+	for _, lease := range c.leases {
+		if lease.State == StateFailed {
+			failed++
+		}
+	}
+	return failed
+}
+
+// release makes the lease pending again, keeping its cursor if the workers share a store.
+func (l *Lease) release(sharedStore bool) {
+	l.State = StatePending
+	l.Worker = ""
+	if !sharedStore {
+		l.Cursor = l.FromSlot
+	}
+	l.ExpiresAt = nil
+}
+
+// held returns the lease if the worker holds it and its ttl did not pass.
+func (c *Coordinator) held(id uint64, worker string) (*Lease, error) {
+	for _, lease := range c.leases {
+		if lease.ID != id {
+			continue
+		}
+		if lease.State != StateLeased || lease.Worker != worker || lease.ExpiresAt.Before(time.Now()) {
+			return nil, fmt.Errorf("%w: %d", ErrLost, id)
+		}
+		return lease, nil
+	}
+	return nil, fmt.Errorf("%w: %d", ErrNotFound, id)
+}
+
+// checkFinished closes finished once no lease is pending or held.
+func (c *Coordinator) checkFinished() {
+	for _, lease := range c.leases {
+		if lease.State == StatePending || lease.State == StateLeased {
+			return
+		}
+	}
+	select {
+	case <-c.finished:
+	default:
+		close(c.finished)
+	}
+}
+
+// update applies a change to the leases and saves them, undoing the change if they can not be saved.
+func (c *Coordinator) update(change func()) error {
+	saved := make([]Lease, len(c.leases))
+	for i, lease := range c.leases {
+		saved[i] = *lease
+	}
+	change()
+	if err := c.save(); err != nil {
+		for i, lease := range c.leases {
+			*lease = saved[i]
+		}
+		return err
+	}
+	c.checkFinished()
+	return nil
+}
+
+// save atomically writes the lease file.
+func (c *Coordinator) save() error {
+	data, err := json.MarshalIndent(leaseFile{Plan: c.plan, Leases: c.leases}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write lease file %s: %w", c.path, err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("failed to write lease file %s: %w", c.path, err)
+	}
+	return nil
+}
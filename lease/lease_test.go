@@ -0,0 +1,125 @@
+package lease
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoordinator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	plan := Plan{Mode: "retrieve", FromSlot: 100, ToSlot: 124, Slots: 10}
+	c, err := Open(path, plan, time.Hour)
+	require.NoError(t, err)
+	leases := c.List()
+	require.Len(t, leases, 3)
+	require.Equal(t, uint64(120), leases[2].FromSlot)
+	require.Equal(t, uint64(124), leases[2].ToSlot)
+
+	first, err := c.Claim("a")
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), first.FromSlot)
+	second, err := c.Claim("b")
+	require.NoError(t, err)
+	require.Equal(t, uint64(110), second.FromSlot)
+	_, err = c.Renew(first.ID, "b", 105)
+	require.True(t, errors.Is(err, ErrLost))
+	renewed, err := c.Renew(first.ID, "a", 105)
+	require.NoError(t, err)
+	require.Equal(t, uint64(105), renewed.Cursor)
+
+	// a failed lease is handed out again until it failed maxFailures times
+	done, err := c.Complete(first.ID, "a", 111, "")
+	require.NoError(t, err)
+	require.Equal(t, StateDone, done.State)
+	failed, err := c.Complete(second.ID, "b", 110, "2 slots failed")
+	require.NoError(t, err)
+	require.Equal(t, StatePending, failed.State)
+	require.Equal(t, 1, failed.Failures)
+	_, err = c.Claim("c")
+	require.NoError(t, err)
+
+	// held leases are handed out again when the coordinator is restarted
+	c, err = Open(path, plan, time.Hour)
+	require.NoError(t, err)
+	_, err = Open(path, Plan{Mode: "retrieve", FromSlot: 100, ToSlot: 200, Slots: 10}, time.Hour)
+	require.Error(t, err)
+	again, err := c.Claim("d")
+	require.NoError(t, err)
+	require.Equal(t, second.ID, again.ID)
+	for range maxFailures - 2 {
+		_, err = c.Complete(again.ID, "d", 110, "2 slots failed")
+		require.NoError(t, err)
+		again, err = c.Claim("d")
+		require.NoError(t, err)
+	}
+	failed, err = c.Complete(again.ID, "d", 110, "2 slots failed")
+	require.NoError(t, err)
+	require.Equal(t, StateFailed, failed.State)
+
+	// a lease which is not renewed within its ttl is handed out again
+	c.ttl = 10 * time.Millisecond
+	last, err := c.Claim("e")
+	require.NoError(t, err)
+	require.Equal(t, uint64(120), last.FromSlot)
+	_, err = c.Claim("f")
+	require.True(t, errors.Is(err, ErrNoLease))
+	time.Sleep(20 * time.Millisecond)
+	last, err = c.Claim("f")
+	require.NoError(t, err)
+	require.Equal(t, "f", last.Worker)
+	_, err = c.Complete(last.ID, "e", 125, "")
+	require.True(t, errors.Is(err, ErrLost))
+
+	select {
+	case <-c.Finished():
+		t.Fatal("finished before the last lease completed")
+	default:
+	}
+	_, err = c.Complete(last.ID, "f", 125, "")
+	require.NoError(t, err)
+	<-c.Finished()
+	_, err = c.Claim("f")
+	require.True(t, errors.Is(err, ErrFinished))
+	require.Equal(t, 1, c.Failed())
+}
+
+func TestCoordinatorSharedStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	plan := Plan{Mode: "retrieve", FromSlot: 100, ToSlot: 119, Slots: 10}
+	c, err := Open(path, plan, time.Hour)
+	require.NoError(t, err)
+	first, err := c.Claim("a")
+	require.NoError(t, err)
+	_, err = c.Renew(first.ID, "a", 105)
+	require.NoError(t, err)
+	// the renewed cursor is saved with the next change
+	_, err = c.Claim("x")
+	require.NoError(t, err)
+
+	// restarted on a shared store, the held lease resumes from its cursor
+	plan.SharedStore = true
+	c, err = Open(path, plan, time.Hour)
+	require.NoError(t, err)
+	again, err := c.Claim("b")
+	require.NoError(t, err)
+	require.Equal(t, first.ID, again.ID)
+	require.Equal(t, uint64(105), again.Cursor)
+	_, err = c.Renew(again.ID, "b", 108)
+	require.NoError(t, err)
+	released, err := c.Release(again.ID, "b")
+	require.NoError(t, err)
+	require.Equal(t, uint64(108), released.Cursor)
+
+	// without a shared store it starts again from its first slot
+	plan.SharedStore = false
+	c, err = Open(path, plan, time.Hour)
+	require.NoError(t, err)
+	again, err = c.Claim("c")
+	require.NoError(t, err)
+	require.Equal(t, first.ID, again.ID)
+	require.Equal(t, again.FromSlot, again.Cursor)
+}
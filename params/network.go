@@ -0,0 +1,185 @@
+package params
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	fieldparams "github.com/prysmaticlabs/prysm/v5/config/fieldparams"
+	"gopkg.in/yaml.v3"
+)
+
+// NetworkConfig holds the fork parameters of a network that affect blob retrieval.
+// Field names follow the consensus specs config files so a network's config.yaml can be loaded directly.
+type NetworkConfig struct {
+	ConfigName                       string              `yaml:"CONFIG_NAME"`
+	SlotsPerEpoch                    uint64              `yaml:"SLOTS_PER_EPOCH"`
+	DenebForkEpoch                   uint64              `yaml:"DENEB_FORK_EPOCH"`
+	MaxBlobsPerBlock                 uint64              `yaml:"MAX_BLOBS_PER_BLOCK"`
+	MinEpochsForBlobSidecarsRequests uint64              `yaml:"MIN_EPOCHS_FOR_BLOB_SIDECARS_REQUESTS"`
+	ElectraForkEpoch                 uint64              `yaml:"ELECTRA_FORK_EPOCH"`
+	MaxBlobsPerBlockElectra          uint64              `yaml:"MAX_BLOBS_PER_BLOCK_ELECTRA"`
+	FuluForkEpoch                    uint64              `yaml:"FULU_FORK_EPOCH"`
+	NumberOfColumns                  uint64              `yaml:"NUMBER_OF_COLUMNS"`
+	BlobSchedule                     []BlobScheduleEntry `yaml:"BLOB_SCHEDULE"`
+
+	// MinEpochsForDataColumnSidecarsRequests is also the number of epochs per period directory of prysm's data
+	// column layout.
+	MinEpochsForDataColumnSidecarsRequests uint64 `yaml:"MIN_EPOCHS_FOR_DATA_COLUMN_SIDECARS_REQUESTS"`
+}
+
+// BlobScheduleEntry changes the blob limit from an epoch on, as done by blob parameter only forks after fulu.
+type BlobScheduleEntry struct {
+	Epoch            uint64 `yaml:"EPOCH"`
+	MaxBlobsPerBlock uint64 `yaml:"MAX_BLOBS_PER_BLOCK"`
+}
+
+// LoadNetworkConfig returns the preset for a known network name, or loads a config YAML from the given path.
+// Values missing from the YAML file default to mainnet, except for forks which default to not scheduled.
+func LoadNetworkConfig(network string) (*NetworkConfig, error) {
+	if preset, ok := presets[strings.ToLower(network)]; ok {
+		cfg := *preset
+		return &cfg, nil
+	}
+
+	data, err := os.ReadFile(network)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("unknown network %s", network)
+		}
+		return nil, err
+	}
+	cfg := *MainnetConfig()
+	cfg.ConfigName = network
+	cfg.ElectraForkEpoch = math.MaxUint64
+	cfg.FuluForkEpoch = math.MaxUint64
+	cfg.BlobSchedule = nil
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse network config %s: %w", network, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks that the config can be used with the blob storage of this build.
+func (c *NetworkConfig) Validate() error {
+	if c.SlotsPerEpoch == 0 {
+		return fmt.Errorf("slots per epoch must be greater than 0")
+	}
+	if c.MaxBlobsPerBlock == 0 {
+		return fmt.Errorf("max blobs per block must be greater than 0")
+	}
+	if c.MaxBlobsPerBlock > fieldparams.MaxBlobCommitmentsPerBlock {
+		return fmt.Errorf("max blobs per block %d exceeds the commitment limit %d", c.MaxBlobsPerBlock, fieldparams.MaxBlobCommitmentsPerBlock)
+	}
+	if c.MaxBlobsPerBlockElectra > fieldparams.MaxBlobCommitmentsPerBlock {
+		return fmt.Errorf("max blobs per block electra %d exceeds the commitment limit %d", c.MaxBlobsPerBlockElectra, fieldparams.MaxBlobCommitmentsPerBlock)
+	}
+	if c.DenebForkEpoch > math.MaxUint64/c.SlotsPerEpoch {
+		return fmt.Errorf("deneb fork epoch %d is not scheduled", c.DenebForkEpoch)
+	}
+	if c.ElectraForkEpoch < c.DenebForkEpoch {
+		return fmt.Errorf("electra fork epoch %d is before deneb fork epoch %d", c.ElectraForkEpoch, c.DenebForkEpoch)
+	}
+	if c.ElectraForkEpoch != math.MaxUint64 && c.MaxBlobsPerBlockElectra == 0 {
+		return fmt.Errorf("max blobs per block electra must be greater than 0")
+	}
+	if c.FuluForkEpoch < c.ElectraForkEpoch {
+		return fmt.Errorf("fulu fork epoch %d is before electra fork epoch %d", c.FuluForkEpoch, c.ElectraForkEpoch)
+	}
+	if c.FuluForkEpoch != math.MaxUint64 && c.NumberOfColumns == 0 {
+		return fmt.Errorf("number of columns must be greater than 0")
+	}
+	if c.FuluForkEpoch != math.MaxUint64 && c.MinEpochsForDataColumnSidecarsRequests == 0 {
+		return fmt.Errorf("min epochs for data column sidecars requests must be greater than 0")
+	}
+	for _, entry := range c.BlobSchedule {
+		// blob parameter only forks follow fulu, the limits before it are the ones of the forks
+		if entry.Epoch < c.FuluForkEpoch {
+			return fmt.Errorf("blob schedule entry at epoch %d is before fulu fork epoch %d", entry.Epoch, c.FuluForkEpoch)
+		}
+		if entry.MaxBlobsPerBlock > fieldparams.MaxBlobCommitmentsPerBlock {
+			return fmt.Errorf("blob schedule limit %d at epoch %d exceeds the commitment limit %d", entry.MaxBlobsPerBlock, entry.Epoch, fieldparams.MaxBlobCommitmentsPerBlock)
+		}
+	}
+	return nil
+}
+
+// DenebForkSlot returns the first slot which may carry blobs.
+func (c *NetworkConfig) DenebForkSlot() uint64 {
+	return c.DenebForkEpoch * c.SlotsPerEpoch
+}
+
+// MaxBlobsPerBlockAtSlot returns the blob limit of the fork active at the slot.
+func (c *NetworkConfig) MaxBlobsPerBlockAtSlot(slot uint64) uint64 {
+	epoch := c.SlotToEpoch(slot)
+	var scheduled *BlobScheduleEntry
+	for i := range c.BlobSchedule {
+		entry := &c.BlobSchedule[i]
+		if entry.Epoch <= epoch && (scheduled == nil || entry.Epoch > scheduled.Epoch) {
+			scheduled = entry
+		}
+	}
+	if scheduled != nil {
+		return scheduled.MaxBlobsPerBlock
+	}
+	if epoch >= c.ElectraForkEpoch {
+		return c.MaxBlobsPerBlockElectra
+	}
+	return c.MaxBlobsPerBlock
+}
+
+// MaxBlobsPerBlockLimit returns the largest blob limit across all forks, which bounds the blob indices on disk.
+func (c *NetworkConfig) MaxBlobsPerBlockLimit() uint64 {
+	limit := c.MaxBlobSidecarsPerBlockLimit()
+	for _, entry := range c.BlobSchedule {
+		if entry.Epoch != math.MaxUint64 && entry.MaxBlobsPerBlock > limit {
+			limit = entry.MaxBlobsPerBlock
+		}
+	}
+	return limit
+}
+
+// MaxBlobSidecarsPerBlockLimit returns the largest blob limit of the forks before fulu, the only ones serving blob
+// sidecars. The blob schedule only applies from fulu on.
+func (c *NetworkConfig) MaxBlobSidecarsPerBlockLimit() uint64 {
+	limit := c.MaxBlobsPerBlock
+	if c.ElectraForkEpoch != math.MaxUint64 && c.MaxBlobsPerBlockElectra > limit {
+		limit = c.MaxBlobsPerBlockElectra
+	}
+	return limit
+}
+
+// FuluForkSlot returns the first slot whose blobs are stored as data columns.
+func (c *NetworkConfig) FuluForkSlot() uint64 {
+	if c.FuluForkEpoch > math.MaxUint64/c.SlotsPerEpoch {
+		return math.MaxUint64
+	}
+	return c.FuluForkEpoch * c.SlotsPerEpoch
+}
+
+// ForkAtSlot returns the name of the blob carrying fork active at the slot, as used in the Eth-Consensus-Version header.
+func (c *NetworkConfig) ForkAtSlot(slot uint64) string {
+	epoch := c.SlotToEpoch(slot)
+	switch {
+	case epoch >= c.FuluForkEpoch:
+		return "fulu"
+	case epoch >= c.ElectraForkEpoch:
+		return "electra"
+	default:
+		return "deneb"
+	}
+}
+
+// SlotToEpoch returns the epoch of the slot.
+func (c *NetworkConfig) SlotToEpoch(slot uint64) uint64 {
+	return slot / c.SlotsPerEpoch
+}
+
+// RetentionSlots returns the number of slots beacon nodes are required to serve blobs for.
+func (c *NetworkConfig) RetentionSlots() uint64 {
+	return c.MinEpochsForBlobSidecarsRequests * c.SlotsPerEpoch
+}
@@ -0,0 +1,73 @@
+package params
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadNetworkConfig(t *testing.T) {
+	cfg, err := LoadNetworkConfig("mainnet")
+	require.NoError(t, err)
+	require.Equal(t, uint64(8626176), cfg.DenebForkSlot())
+	require.Equal(t, uint64(6), cfg.MaxBlobsPerBlockAtSlot(364032*32-1))
+	require.Equal(t, uint64(9), cfg.MaxBlobsPerBlockAtSlot(364032*32))
+	require.Equal(t, uint64(9), cfg.MaxBlobsPerBlockAtSlot(412672*32-1))
+	require.Equal(t, uint64(15), cfg.MaxBlobsPerBlockAtSlot(412672*32))
+	require.Equal(t, uint64(21), cfg.MaxBlobsPerBlockLimit())
+	require.Equal(t, uint64(9), cfg.MaxBlobSidecarsPerBlockLimit())
+
+	cfg, err = LoadNetworkConfig("Gnosis")
+	require.NoError(t, err)
+	require.Equal(t, uint64(889856*16), cfg.DenebForkSlot())
+	require.Equal(t, uint64(2), cfg.MaxBlobsPerBlock)
+
+	_, err = LoadNetworkConfig("unknown")
+	require.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+CONFIG_NAME: 'devnet'
+PRESET_BASE: 'minimal'
+SLOTS_PER_EPOCH: 8
+DENEB_FORK_EPOCH: 10
+DENEB_FORK_VERSION: 0x50000038
+MAX_BLOBS_PER_BLOCK: 4
+`), 0600))
+	cfg, err = LoadNetworkConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, "devnet", cfg.ConfigName)
+	require.Equal(t, uint64(80), cfg.DenebForkSlot())
+	require.Equal(t, uint64(4), cfg.MaxBlobsPerBlock)
+	require.Equal(t, uint64(4096), cfg.MinEpochsForBlobSidecarsRequests)
+	require.Equal(t, uint64(4), cfg.MaxBlobsPerBlockLimit())
+
+	require.NoError(t, os.WriteFile(path, []byte(`
+DENEB_FORK_EPOCH: 10
+ELECTRA_FORK_EPOCH: 20
+MAX_BLOBS_PER_BLOCK_ELECTRA: 12
+`), 0600))
+	cfg, err = LoadNetworkConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), cfg.MaxBlobsPerBlockAtSlot(20*32-1))
+	require.Equal(t, uint64(12), cfg.MaxBlobsPerBlockAtSlot(20*32))
+	require.Equal(t, uint64(12), cfg.MaxBlobsPerBlockLimit())
+
+	require.NoError(t, os.WriteFile(path, []byte("MAX_BLOBS_PER_BLOCK: 8192\n"), 0600))
+	_, err = LoadNetworkConfig(path)
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte(`
+DENEB_FORK_EPOCH: 10
+ELECTRA_FORK_EPOCH: 20
+FULU_FORK_EPOCH: 30
+NUMBER_OF_COLUMNS: 128
+BLOB_SCHEDULE:
+  - EPOCH: 20
+    MAX_BLOBS_PER_BLOCK: 15
+`), 0600))
+	_, err = LoadNetworkConfig(path)
+	require.ErrorContains(t, err, "before fulu fork epoch")
+}
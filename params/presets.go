@@ -0,0 +1,85 @@
+package params
+
+import "math"
+
+var presets = map[string]*NetworkConfig{
+	"mainnet": MainnetConfig(),
+	"sepolia": SepoliaConfig(),
+	"holesky": HoleskyConfig(),
+	"gnosis":  GnosisConfig(),
+}
+
+// MainnetConfig returns the ethereum mainnet parameters.
+func MainnetConfig() *NetworkConfig {
+	return &NetworkConfig{
+		ConfigName:                       "mainnet",
+		SlotsPerEpoch:                    32,
+		DenebForkEpoch:                   269568,
+		MaxBlobsPerBlock:                 6,
+		MinEpochsForBlobSidecarsRequests: 4096,
+		ElectraForkEpoch:                 364032,
+		MaxBlobsPerBlockElectra:          9,
+		FuluForkEpoch:                    411392,
+		NumberOfColumns:                  128,
+		BlobSchedule: []BlobScheduleEntry{
+			{Epoch: 412672, MaxBlobsPerBlock: 15},
+			{Epoch: 419072, MaxBlobsPerBlock: 21},
+		},
+		MinEpochsForDataColumnSidecarsRequests: 4096,
+	}
+}
+
+// SepoliaConfig returns the sepolia testnet parameters.
+func SepoliaConfig() *NetworkConfig {
+	return &NetworkConfig{
+		ConfigName:                       "sepolia",
+		SlotsPerEpoch:                    32,
+		DenebForkEpoch:                   132608,
+		MaxBlobsPerBlock:                 6,
+		MinEpochsForBlobSidecarsRequests: 4096,
+		ElectraForkEpoch:                 222464,
+		MaxBlobsPerBlockElectra:          9,
+		FuluForkEpoch:                    272640,
+		NumberOfColumns:                  128,
+		BlobSchedule: []BlobScheduleEntry{
+			{Epoch: 274176, MaxBlobsPerBlock: 15},
+			{Epoch: 275712, MaxBlobsPerBlock: 21},
+		},
+		MinEpochsForDataColumnSidecarsRequests: 4096,
+	}
+}
+
+// HoleskyConfig returns the holesky testnet parameters.
+func HoleskyConfig() *NetworkConfig {
+	return &NetworkConfig{
+		ConfigName:                       "holesky",
+		SlotsPerEpoch:                    32,
+		DenebForkEpoch:                   29696,
+		MaxBlobsPerBlock:                 6,
+		MinEpochsForBlobSidecarsRequests: 4096,
+		ElectraForkEpoch:                 115968,
+		MaxBlobsPerBlockElectra:          9,
+		FuluForkEpoch:                    165120,
+		NumberOfColumns:                  128,
+		BlobSchedule: []BlobScheduleEntry{
+			{Epoch: 166400, MaxBlobsPerBlock: 15},
+			{Epoch: 167936, MaxBlobsPerBlock: 21},
+		},
+		MinEpochsForDataColumnSidecarsRequests: 4096,
+	}
+}
+
+// GnosisConfig returns the gnosis chain parameters.
+func GnosisConfig() *NetworkConfig {
+	return &NetworkConfig{
+		ConfigName:                       "gnosis",
+		SlotsPerEpoch:                    16,
+		DenebForkEpoch:                   889856,
+		MaxBlobsPerBlock:                 2,
+		MinEpochsForBlobSidecarsRequests: 16384,
+		ElectraForkEpoch:                 1337856,
+		MaxBlobsPerBlockElectra:          2,
+		FuluForkEpoch:                    math.MaxUint64,
+		NumberOfColumns:                  128,
+	}
+}
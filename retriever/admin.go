@@ -0,0 +1,325 @@
+package retriever
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rabbitprincess/blob-retriever/jobs"
+	"github.com/rs/zerolog"
+)
+
+// Run states reported by Status.
+const (
+	StateIdle    = "idle"
+	StateRunning = "running"
+	StatePaused  = "paused"
+)
+
+// Status is the state and progress of the current or last run.
+type Status struct {
+	State          string  `json:"state"`
+	Mode           string  `json:"mode"`
+	FromSlot       uint64  `json:"from_slot"`
+	ToSlot         uint64  `json:"to_slot"`
+	Cursor         uint64  `json:"cursor"`
+	Completed      uint64  `json:"completed"`
+	Total          uint64  `json:"total"`
+	Percent        float64 `json:"percent"`
+	SlotsPerSecond float64 `json:"slots_per_second"`
+	ETASeconds     float64 `json:"eta_seconds"`
+	Workers        int     `json:"workers"`
+	Active         int     `json:"active"`
+	Queued         uint64  `json:"queued"`
+	Failed         uint64  `json:"failed"`
+}
+
+// Status returns the state and progress of the current run, or of the last one when idle.
+func (bs *BlobRetriever) Status() Status {
+	control, progress := bs.control.state(), bs.progress.snapshot()
+	status := Status{
+		State:     StateIdle,
+		Mode:      control.Mode,
+		Workers:   control.Workers,
+		Active:    control.Active,
+		Queued:    control.Queued,
+		Failed:    bs.stats.failedCount(),
+		FromSlot:  progress.FromSlot,
+		ToSlot:    progress.ToSlot,
+		Cursor:    progress.Cursor,
+		Completed: progress.Completed,
+	}
+	if progress.Elapsed > 0 {
+		status.Total = progress.Total()
+		status.Percent = progress.Percent()
+		status.SlotsPerSecond = progress.Rate()
+		status.ETASeconds = progress.ETA().Seconds()
+	}
+	switch {
+	case control.Running && control.Paused:
+		status.State = StatePaused
+	case control.Running:
+		status.State = StateRunning
+	}
+	return status
+}
+
+// FailedSlots returns the slots of the current or last run whose last attempt failed, in ascending order.
+func (bs *BlobRetriever) FailedSlots() []FailedSlot {
+	return bs.stats.failedSlots()
+}
+
+// Pause stops handing out slots to workers until Resume. Slots already running are finished.
+func (bs *BlobRetriever) Pause() error {
+	return bs.control.setPaused(true)
+}
+
+// Resume continues a paused run.
+func (bs *BlobRetriever) Resume() error {
+	return bs.control.setPaused(false)
+}
+
+// SetWorkers changes the number of slots run at a time.
+func (bs *BlobRetriever) SetWorkers(workers int) error {
+	return bs.control.setWorkers(workers)
+}
+
+// Requeue runs failed slots of the current run again, before the rest of the range. Without slots every failed slot
+// is requeued, otherwise the ones which did not fail are skipped. It returns the slots requeued.
+func (bs *BlobRetriever) Requeue(slots []uint64) ([]uint64, error) {
+	if len(slots) == 0 {
+		for _, failed := range bs.stats.failedSlots() {
+			slots = append(slots, failed.Slot)
+		}
+	}
+	retried := bs.stats.retry(slots)
+	requeued := make([]uint64, len(retried))
+	for i, failed := range retried {
+		requeued[i] = failed.Slot
+	}
+	if err := bs.control.requeue(requeued); err != nil {
+		bs.stats.restore(retried)
+		return nil, err
+	}
+	bs.progress.retry(len(requeued))
+	bs.logger.Info().Int("slots", len(requeued)).Msg("Requeued failed slots")
+	return requeued, nil
+}
+
+// AdminHandler serves the admin API controlling runs:
+//
+//	GET  /status   state and progress of the run
+//	GET  /failed   failed slots with their reason
+//	POST /pause    pause the run
+//	POST /resume   resume the run
+//	PUT  /workers  change the worker count, with a {"workers": n} body
+//	POST /requeue  run failed slots again, all of them or the ones in a {"slots": [...]} body
+//
+// With a job queue set, jobs are listed, submitted and cancelled as well:
+//
+//	GET    /jobs       jobs of the queue
+//	POST   /jobs       submit a job, with a jobs.Job body
+//	DELETE /jobs/{id}  cancel a queued job
+//
+// With an admin token set, the routes changing the run or the queue require it as a bearer token.
+func (bs *BlobRetriever) AdminHandler() http.Handler {
+	mux := &authMux{ServeMux: http.NewServeMux(), token: bs.cfg.AdminToken}
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, bs.Status())
+	})
+	mux.HandleFunc("GET /failed", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, bs.FailedSlots())
+	})
+	mux.HandleAuthFunc("POST /pause", func(w http.ResponseWriter, r *http.Request) {
+		if err := bs.Pause(); err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		bs.logger.Info().Msg("Run paused")
+		writeJSON(w, bs.Status())
+	})
+	mux.HandleAuthFunc("POST /resume", func(w http.ResponseWriter, r *http.Request) {
+		if err := bs.Resume(); err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		bs.logger.Info().Msg("Run resumed")
+		writeJSON(w, bs.Status())
+	})
+	mux.HandleAuthFunc("PUT /workers", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Workers int `json:"workers"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid body: %v", err))
+			return
+		}
+		if err := bs.SetWorkers(req.Workers); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		bs.logger.Info().Int("workers", req.Workers).Msg("Worker count changed")
+		writeJSON(w, bs.Status())
+	})
+	mux.HandleAuthFunc("POST /requeue", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Slots []uint64 `json:"slots"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid body: %v", err))
+				return
+			}
+		}
+		requeued, err := bs.Requeue(req.Slots)
+		if err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(w, struct {
+			Requeued []uint64 `json:"requeued"`
+		}{requeued})
+	})
+	if bs.queue == nil {
+		return mux.ServeMux
+	}
+	mux.HandleFunc("GET /jobs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, bs.queue.List())
+	})
+	mux.HandleAuthFunc("POST /jobs", func(w http.ResponseWriter, r *http.Request) {
+		var job jobs.Job
+		if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid body: %v", err))
+			return
+		}
+		job, err := bs.queue.Submit(job)
+		if errors.Is(err, jobs.ErrOverlap) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		bs.logger.Info().Uint64("job", job.ID).Str("mode", job.Mode).Uint64("fromSlot", job.FromSlot).Uint64("toSlot", job.ToSlot).Int("priority", job.Priority).Msg("Job submitted")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(job)
+	})
+	mux.HandleAuthFunc("DELETE /jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid job id %s", r.PathValue("id")))
+			return
+		}
+		job, err := bs.queue.Cancel(id)
+		if errors.Is(err, jobs.ErrNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		bs.logger.Info().Uint64("job", job.ID).Msg("Job cancelled")
+		writeJSON(w, job)
+	})
+	return mux.ServeMux
+}
+
+// authMux is a ServeMux whose routes can require a bearer token.
+type authMux struct {
+	*http.ServeMux
+	token string
+}
+
+// HandleAuthFunc registers handler for pattern, refusing requests without the token if one is set.
+func (m *authMux) HandleAuthFunc(pattern string, handler http.HandlerFunc) {
+	m.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if !validToken(r, m.token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// validToken reports whether r carries token as its bearer token. Every request is valid without a token.
+func validToken(r *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// ServeAdmin serves the admin API on addr until ctx is done. An address without a host is bound to the loopback
+// address, and other addresses than loopback ones are refused without an admin token.
+func (bs *BlobRetriever) ServeAdmin(ctx context.Context, addr string) error {
+	addr, err := adminListenAddr(addr, bs.cfg.AdminToken)
+	if err != nil {
+		return err
+	}
+	bs.logger.Info().Str("addr", addr).Bool("token", bs.cfg.AdminToken != "").Msg("Serving admin API")
+	return listenAndServe(ctx, bs.logger, addr, bs.AdminHandler())
+}
+
+// adminListenAddr returns the address to serve the admin API on.
+func adminListenAddr(addr, token string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid admin address %s: %w", addr, err)
+	}
+	if host == "" {
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+	if token == "" && !isLoopback(host) {
+		return "", fmt.Errorf("admin address %s is not a loopback address, set an admin token to serve the admin API on it", addr)
+	}
+	return addr, nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// listenAndServe serves handler on addr until ctx is done.
+func listenAndServe(ctx context.Context, log zerolog.Logger, addr string, handler http.Handler) error {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Error().Err(err).Str("addr", addr).Msg("Failed to shut down server")
+		}
+	}()
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}{code, message})
+}
@@ -0,0 +1,166 @@
+package retriever
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/attestantio/go-eth2-client/api"
+	apiv1 "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/attestantio/go-eth2-client/spec/deneb"
+	"github.com/gammazero/workerpool"
+	"github.com/rabbitprincess/blob-retriever/params"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// slotBeaconClient serves a block without blobs at every slot.
+type slotBeaconClient struct {
+	BeaconClient
+}
+
+func (c *slotBeaconClient) BeaconBlockHeader(ctx context.Context, opts *api.BeaconBlockHeaderOpts) (*api.Response[*apiv1.BeaconBlockHeader], error) {
+	header := &apiv1.BeaconBlockHeader{}
+	copy(header.Root[:], opts.Block)
+	return &api.Response[*apiv1.BeaconBlockHeader]{Data: header}, nil
+}
+
+// gatedSource fails the sidecars of a slot while failing is set, and holds the ones of another until released.
+type gatedSource struct {
+	failSlot string
+	failing  atomic.Bool
+	holdSlot string
+	release  chan struct{}
+}
+
+func (s *gatedSource) BlobSidecars(ctx context.Context, header *apiv1.BeaconBlockHeader) ([]*deneb.BlobSidecar, error) {
+	block := strings.TrimRight(string(header.Root[:]), "\x00")
+	if block == s.failSlot && s.failing.Load() {
+		return nil, errors.New("unavailable")
+	}
+	if block == s.holdSlot {
+		<-s.release
+	}
+	return nil, nil
+}
+
+func TestAdminAPI(t *testing.T) {
+	network := params.MainnetConfig()
+	from := network.DenebForkSlot()
+	source := &gatedSource{failSlot: strconv.FormatUint(from, 10), holdSlot: strconv.FormatUint(from+7, 10), release: make(chan struct{})}
+	source.failing.Store(true)
+	bs := &BlobRetriever{
+		cfg:     &Config{Network: network},
+		logger:  zerolog.Nop(),
+		wp:      workerpool.New(maxWorkers),
+		control: newRunControl(1),
+		client:  &slotBeaconClient{},
+		source:  source,
+	}
+	srv := httptest.NewServer(bs.AdminHandler())
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/pause", "", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	done := make(chan error)
+	go func() {
+		done <- bs.Run(context.Background(), "check", from, from+7)
+	}()
+	require.Eventually(t, func() bool {
+		return bs.Status().Failed == 1 && bs.Status().Active == 1 && bs.Status().Queued == 0
+	}, 10*time.Second, 10*time.Millisecond)
+
+	var status Status
+	resp, err = http.Post(srv.URL+"/pause", "", nil)
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	require.Equal(t, StatePaused, status.State)
+	// the failed slot holds the cursor
+	require.Equal(t, from, status.Cursor)
+	require.Equal(t, uint64(7), status.Completed)
+
+	var failed []FailedSlot
+	resp, err = http.Get(srv.URL + "/failed")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&failed))
+	require.Len(t, failed, 1)
+	require.Equal(t, from, failed[0].Slot)
+	require.Equal(t, FailureFetch, failed[0].Reason)
+
+	// the held slot occupies the only worker, so the requeued slot runs once the run is resized and resumed
+	source.failing.Store(false)
+	var requeued struct {
+		Requeued []uint64 `json:"requeued"`
+	}
+	resp, err = http.Post(srv.URL+"/requeue", "", nil)
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&requeued))
+	require.Equal(t, []uint64{from}, requeued.Requeued)
+
+	req, err := http.NewRequest(http.MethodPut, srv.URL+"/workers", strings.NewReader(`{"workers": 2}`))
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	require.Equal(t, 2, status.Workers)
+
+	resp, err = http.Post(srv.URL+"/resume", "", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Eventually(t, func() bool {
+		return bs.Status().Completed == 7 && bs.Status().Active == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	require.Empty(t, bs.FailedSlots())
+	close(source.release)
+
+	require.NoError(t, <-done)
+	require.Equal(t, StateIdle, bs.Status().State)
+	require.Equal(t, from+8, bs.Status().Cursor)
+	require.Empty(t, bs.Report().Failures)
+	require.Equal(t, uint64(8), bs.Report().BlocksWithoutBlobs)
+}
+
+func TestAdminToken(t *testing.T) {
+	bs := &BlobRetriever{
+		cfg:     &Config{Network: params.MainnetConfig(), AdminToken: "secret"},
+		logger:  zerolog.Nop(),
+		control: newRunControl(1),
+	}
+	srv := httptest.NewServer(bs.AdminHandler())
+	defer srv.Close()
+
+	// reading needs no token, changing the run does
+	resp, err := http.Get(srv.URL + "/status")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	for token, code := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "secret": http.StatusConflict} {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/pause", nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, code, resp.StatusCode, token)
+	}
+
+	// only loopback addresses are served without a token
+	addr, err := adminListenAddr(":8080", "")
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1:8080", addr)
+	_, err = adminListenAddr("[::1]:8080", "")
+	require.NoError(t, err)
+	_, err = adminListenAddr("0.0.0.0:8080", "")
+	require.Error(t, err)
+	_, err = adminListenAddr("0.0.0.0:8080", "secret")
+	require.NoError(t, err)
+}
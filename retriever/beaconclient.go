@@ -1,38 +1,72 @@
-package retriever
-
-import (
-	"context"
-	"time"
-
-	client "github.com/attestantio/go-eth2-client"
-	"github.com/attestantio/go-eth2-client/http"
-	"github.com/rs/zerolog"
-)
-
-type BeaconClient interface {
-	client.BlobSidecarsProvider
-	client.BeaconBlockHeadersProvider
-}
-
-// NewBeaconClient returns a new HTTP beacon client.
-func NewBeaconClient(ctx context.Context, beaconUrl string, beaconType string, timeout time.Duration) (BeaconClient, error) {
-	cctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	var withEnforceJSON bool
-	if beaconType == "prysm" {
-		withEnforceJSON = true
-	}
-
-	c, err := http.New(cctx,
-		http.WithTimeout(timeout),
-		http.WithAddress(beaconUrl),
-		http.WithLogLevel(zerolog.ErrorLevel),
-		http.WithEnforceJSON(withEnforceJSON),
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	return c.(*http.Service), nil
-}
+package retriever
+
+import (
+	"context"
+	"time"
+
+	client "github.com/attestantio/go-eth2-client"
+	"github.com/attestantio/go-eth2-client/api"
+	"github.com/attestantio/go-eth2-client/http"
+	"github.com/rs/zerolog"
+)
+
+type BeaconClient interface {
+	client.BlobSidecarsProvider
+	client.BeaconBlockHeadersProvider
+	client.SignedBeaconBlockProvider
+}
+
+// sszBlobSidecarsLimit is the number of sidecars go-eth2-client decodes from an SSZ blob sidecar list, the ssz-max
+// of api.BlobSidecars.
+const sszBlobSidecarsLimit = 12
+
+// beaconApiType returns the beacon api type to use for the config. Networks allowing more blobs per block before
+// fulu than go-eth2-client decodes from SSZ are queried with JSON, as for prysm. Blob sidecars are not queried from
+// fulu on, so the blob schedule does not matter.
+func beaconApiType(cfg *Config) string {
+	if cfg.Network.MaxBlobSidecarsPerBlockLimit() > sszBlobSidecarsLimit {
+		return "prysm"
+	}
+	return cfg.BeaconApiType
+}
+
+// NewBeaconClientFromConfig returns a new HTTP beacon client for the beacon node of the config.
+func NewBeaconClientFromConfig(ctx context.Context, log zerolog.Logger, cfg *Config) (BeaconClient, error) {
+	apiType := beaconApiType(cfg)
+	if apiType != cfg.BeaconApiType {
+		log.Warn().Uint64("maxBlobsPerBlock", cfg.Network.MaxBlobSidecarsPerBlockLimit()).Int("sszLimit", sszBlobSidecarsLimit).Msg("Querying the beacon node with JSON, as SSZ blob sidecar lists can not hold the blobs of a block")
+	}
+	return NewBeaconClient(ctx, cfg.BeaconApiUrl, apiType, cfg.Timeout)
+}
+
+// HeadSlot returns the slot of the head block of the beacon node.
+func HeadSlot(ctx context.Context, provider client.BeaconBlockHeadersProvider) (uint64, error) {
+	res, err := provider.BeaconBlockHeader(ctx, &api.BeaconBlockHeaderOpts{Block: "head"})
+	if err != nil {
+		return 0, err
+	}
+	return uint64(res.Data.Header.Message.Slot), nil
+}
+
+// NewBeaconClient returns a new HTTP beacon client.
+func NewBeaconClient(ctx context.Context, beaconUrl string, beaconType string, timeout time.Duration) (BeaconClient, error) {
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var withEnforceJSON bool
+	if beaconType == "prysm" {
+		withEnforceJSON = true
+	}
+
+	c, err := http.New(cctx,
+		http.WithTimeout(timeout),
+		http.WithAddress(beaconUrl),
+		http.WithLogLevel(zerolog.ErrorLevel),
+		http.WithEnforceJSON(withEnforceJSON),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.(*http.Service), nil
+}
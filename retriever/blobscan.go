@@ -0,0 +1,168 @@
+package retriever
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	apiv1 "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/attestantio/go-eth2-client/spec"
+	"github.com/attestantio/go-eth2-client/spec/deneb"
+	"github.com/rabbitprincess/blob-retriever/storage"
+)
+
+var _ BlobSource = &BlobscanSource{}
+
+// BlobscanSource fetches blobs by block root or versioned hash from a Blobscan-style archive API
+// and joins them with the block header and inclusion proofs from the beacon node.
+type BlobscanSource struct {
+	client  BeaconClient
+	baseUrl string
+	http    *http.Client
+}
+
+// NewBlobscanSource returns a blob source backed by the archive API at baseUrl.
+func NewBlobscanSource(client BeaconClient, baseUrl string, timeout time.Duration) *BlobscanSource {
+	return &BlobscanSource{
+		client:  client,
+		baseUrl: strings.TrimSuffix(baseUrl, "/"),
+		http:    &http.Client{Timeout: timeout},
+	}
+}
+
+type blobscanBlob struct {
+	VersionedHash string `json:"versionedHash"`
+	Commitment    string `json:"commitment"`
+	Proof         string `json:"proof"`
+	Data          string `json:"data"`
+}
+
+// BlobSidecars looks the blobs of the block up by its execution block hash first, with one request for the whole block,
+// and falls back to one request per versioned hash for archives which do not serve the block.
+func (s *BlobscanSource) BlobSidecars(ctx context.Context, header *apiv1.BeaconBlockHeader) ([]*deneb.BlobSidecar, error) {
+	return buildBlockSidecars(ctx, s.client, header, func(ctx context.Context, block *spec.VersionedSignedBeaconBlock, commitments []deneb.KZGCommitment) ([]*deneb.Blob, []deneb.KZGProof, error) {
+		blobs, proofs, err := s.fetchBlockBlobs(ctx, block, commitments)
+		if err == nil {
+			return blobs, proofs, nil
+		}
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return s.fetchBlobs(ctx, commitments)
+	})
+}
+
+// blobscanBlock is a block of the Blobscan API with its transactions' blobs and their data expanded.
+type blobscanBlock struct {
+	Hash         string `json:"hash"`
+	Transactions []struct {
+		Blobs []blobscanBlob `json:"blobs"`
+	} `json:"transactions"`
+}
+
+// fetchBlockBlobs fetches the blobs of a block from the /blocks/{hash} endpoint of the Blobscan API, which identifies
+// blocks by their execution block hash, with the blobs and their data expanded.
+func (s *BlobscanSource) fetchBlockBlobs(ctx context.Context, block *spec.VersionedSignedBeaconBlock, commitments []deneb.KZGCommitment) ([]*deneb.Blob, []deneb.KZGProof, error) {
+	hash, err := block.ExecutionBlockHash()
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/blocks/%#x?expand=blob,blob_data", s.baseUrl, hash), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := s.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+
+	var data blobscanBlock
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return nil, nil, err
+	}
+	byCommitment := make(map[deneb.KZGCommitment]blobscanBlob)
+	for _, tx := range data.Transactions {
+		for _, blob := range tx.Blobs {
+			var commitment deneb.KZGCommitment
+			if err := storage.DecodeHex(blob.Commitment, commitment[:]); err != nil {
+				return nil, nil, fmt.Errorf("invalid commitment: %w", err)
+			}
+			byCommitment[commitment] = blob
+		}
+	}
+	blobs := make([]*deneb.Blob, len(commitments))
+	proofs := make([]deneb.KZGProof, len(commitments))
+	for i, commitment := range commitments {
+		blob, ok := byCommitment[commitment]
+		if !ok {
+			return nil, nil, fmt.Errorf("blob %d of block %#x missing from archive", i, hash)
+		}
+		blobs[i] = &deneb.Blob{}
+		if err := storage.DecodeHex(blob.Data, blobs[i][:]); err != nil {
+			return nil, nil, fmt.Errorf("invalid blob data: %w", err)
+		}
+		if err := storage.DecodeHex(blob.Proof, proofs[i][:]); err != nil {
+			return nil, nil, fmt.Errorf("invalid proof: %w", err)
+		}
+	}
+	return blobs, proofs, nil
+}
+
+func (s *BlobscanSource) fetchBlobs(ctx context.Context, commitments []deneb.KZGCommitment) ([]*deneb.Blob, []deneb.KZGProof, error) {
+	blobs := make([]*deneb.Blob, len(commitments))
+	proofs := make([]deneb.KZGProof, len(commitments))
+	for i, commitment := range commitments {
+		versionedHash := storage.KzgToVersionedHash(commitment[:])
+		blob, proof, err := s.fetchBlob(ctx, versionedHash, commitment)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to fetch blob %#x: %w", versionedHash, err)
+		}
+		blobs[i], proofs[i] = blob, proof
+	}
+	return blobs, proofs, nil
+}
+
+func (s *BlobscanSource) fetchBlob(ctx context.Context, versionedHash [32]byte, commitment deneb.KZGCommitment) (*deneb.Blob, deneb.KZGProof, error) {
+	var proof deneb.KZGProof
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/blobs/%#x", s.baseUrl, versionedHash), nil)
+	if err != nil {
+		return nil, proof, err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := s.http.Do(req)
+	if err != nil {
+		return nil, proof, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, proof, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+
+	var data blobscanBlob
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return nil, proof, err
+	}
+	var remoteCommitment deneb.KZGCommitment
+	if err := storage.DecodeHex(data.Commitment, remoteCommitment[:]); err != nil {
+		return nil, proof, fmt.Errorf("invalid commitment: %w", err)
+	}
+	if remoteCommitment != commitment {
+		return nil, proof, fmt.Errorf("commitment mismatch %s", data.Commitment)
+	}
+	if err := storage.DecodeHex(data.Proof, proof[:]); err != nil {
+		return nil, proof, fmt.Errorf("invalid proof: %w", err)
+	}
+	blob := &deneb.Blob{}
+	if err := storage.DecodeHex(data.Data, blob[:]); err != nil {
+		return nil, proof, fmt.Errorf("invalid blob data: %w", err)
+	}
+	return blob, proof, nil
+}
@@ -0,0 +1,274 @@
+package retriever
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/attestantio/go-eth2-client/api"
+	apiv1 "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/attestantio/go-eth2-client/spec"
+	"github.com/attestantio/go-eth2-client/spec/altair"
+	"github.com/attestantio/go-eth2-client/spec/deneb"
+	"github.com/attestantio/go-eth2-client/spec/electra"
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	gokzg4844 "github.com/crate-crypto/go-kzg-4844"
+	"github.com/holiman/uint256"
+	"github.com/prysmaticlabs/go-bitfield"
+	"github.com/rabbitprincess/blob-retriever/storage"
+	"github.com/stretchr/testify/require"
+)
+
+type testBlob struct {
+	blob       deneb.Blob
+	commitment deneb.KZGCommitment
+	proof      deneb.KZGProof
+}
+
+// fakeBeaconClient serves a single block from memory.
+type fakeBeaconClient struct {
+	header   *apiv1.BeaconBlockHeader
+	block    *deneb.SignedBeaconBlock
+	electra  *electra.SignedBeaconBlock
+	sidecars []*deneb.BlobSidecar
+}
+
+func (c *fakeBeaconClient) BeaconBlockHeader(ctx context.Context, opts *api.BeaconBlockHeaderOpts) (*api.Response[*apiv1.BeaconBlockHeader], error) {
+	return &api.Response[*apiv1.BeaconBlockHeader]{Data: c.header}, nil
+}
+
+func (c *fakeBeaconClient) BlobSidecars(ctx context.Context, opts *api.BlobSidecarsOpts) (*api.Response[[]*deneb.BlobSidecar], error) {
+	return &api.Response[[]*deneb.BlobSidecar]{Data: c.sidecars}, nil
+}
+
+func (c *fakeBeaconClient) SignedBeaconBlock(ctx context.Context, opts *api.SignedBeaconBlockOpts) (*api.Response[*spec.VersionedSignedBeaconBlock], error) {
+	if opts.Block != c.header.Root.String() {
+		return nil, &api.Error{StatusCode: http.StatusNotFound}
+	}
+	if c.electra != nil {
+		return &api.Response[*spec.VersionedSignedBeaconBlock]{
+			Data: &spec.VersionedSignedBeaconBlock{Version: spec.DataVersionElectra, Electra: c.electra},
+		}, nil
+	}
+	return &api.Response[*spec.VersionedSignedBeaconBlock]{
+		Data: &spec.VersionedSignedBeaconBlock{Version: spec.DataVersionDeneb, Deneb: c.block},
+	}, nil
+}
+
+// newTestBlobs returns blobs with valid kzg commitments and proofs.
+func newTestBlobs(t *testing.T, count int) []*testBlob {
+	ctx, err := gokzg4844.NewContext4096Secure()
+	require.NoError(t, err)
+
+	blobs := make([]*testBlob, count)
+	for i := range blobs {
+		b := &testBlob{}
+		// keep every field element canonical by leaving the first byte of each 32 byte chunk zero.
+		for j := 0; j < deneb.BlobLength; j += 32 {
+			b.blob[j+31] = byte(i + 1)
+		}
+		kzgBlob := gokzg4844.Blob(b.blob)
+		commitment, err := ctx.BlobToKZGCommitment(&kzgBlob, 0)
+		require.NoError(t, err)
+		proof, err := ctx.ComputeBlobKZGProof(&kzgBlob, commitment, 0)
+		require.NoError(t, err)
+		b.commitment = deneb.KZGCommitment(commitment)
+		b.proof = deneb.KZGProof(proof)
+		blobs[i] = b
+	}
+	return blobs
+}
+
+// newTestBlock returns a deneb block committing to the given blobs, with its header.
+func newTestBlock(t *testing.T, slot phase0.Slot, blobs []*testBlob) (*apiv1.BeaconBlockHeader, *deneb.SignedBeaconBlock) {
+	body := &deneb.BeaconBlockBody{
+		ETH1Data: &phase0.ETH1Data{BlockHash: make([]byte, 32)},
+		SyncAggregate: &altair.SyncAggregate{
+			SyncCommitteeBits: bitfield.NewBitvector512(),
+		},
+		ExecutionPayload: &deneb.ExecutionPayload{
+			BlockHash:     phase0.Hash32{0xb1, byte(slot)},
+			BaseFeePerGas: uint256.NewInt(7),
+		},
+	}
+	for _, blob := range blobs {
+		body.BlobKZGCommitments = append(body.BlobKZGCommitments, blob.commitment)
+	}
+	bodyRoot, err := body.HashTreeRoot()
+	require.NoError(t, err)
+
+	block := &deneb.SignedBeaconBlock{
+		Message: &deneb.BeaconBlock{
+			Slot:          slot,
+			ProposerIndex: 1,
+			Body:          body,
+		},
+	}
+	message := &phase0.BeaconBlockHeader{
+		Slot:          slot,
+		ProposerIndex: 1,
+		BodyRoot:      bodyRoot,
+	}
+	root, err := message.HashTreeRoot()
+	require.NoError(t, err)
+
+	return &apiv1.BeaconBlockHeader{
+		Root:      root,
+		Canonical: true,
+		Header:    &phase0.SignedBeaconBlockHeader{Message: message},
+	}, block
+}
+
+// handlerErrors collects the failures of test server handlers. Handlers run off the test goroutine, where require
+// must not be called, so their failures are checked by the test once its requests returned.
+type handlerErrors chan error
+
+func newHandlerErrors() handlerErrors {
+	return make(handlerErrors, 16)
+}
+
+// record records err, dropping it once the buffer is full.
+func (e handlerErrors) record(err error) {
+	select {
+	case e <- err:
+	default:
+	}
+}
+
+// fail records err and answers the request with it.
+func (e handlerErrors) fail(w http.ResponseWriter, err error) {
+	e.record(err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func (e handlerErrors) require(t *testing.T) {
+	for {
+		select {
+		case err := <-e:
+			require.NoError(t, err)
+		default:
+			return
+		}
+	}
+}
+
+// blobscanServer is an archive serving blobs by versioned hash, and by execution block hash if block is set.
+type blobscanServer struct {
+	*httptest.Server
+	byBlock atomic.Int32
+	byHash  atomic.Int32
+}
+
+func newBlobscanServer(errs handlerErrors, block *deneb.SignedBeaconBlock, blobs []*testBlob) *blobscanServer {
+	byHash := make(map[string]*testBlob)
+	var blockBlobs []blobscanBlob
+	for _, blob := range blobs {
+		hash := fmt.Sprintf("%#x", storage.KzgToVersionedHash(blob.commitment[:]))
+		byHash[hash] = blob
+		blockBlobs = append(blockBlobs, blobscanBlob{
+			VersionedHash: hash,
+			Commitment:    fmt.Sprintf("%#x", blob.commitment),
+			Proof:         fmt.Sprintf("%#x", blob.proof),
+			Data:          fmt.Sprintf("%#x", blob.blob),
+		})
+	}
+	srv := &blobscanServer{}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hash, ok := strings.CutPrefix(r.URL.Path, "/blocks/"); ok {
+			srv.byBlock.Add(1)
+			if block == nil || hash != fmt.Sprintf("%#x", block.Message.Body.ExecutionPayload.BlockHash) {
+				http.NotFound(w, r)
+				return
+			}
+			if r.URL.Query().Get("expand") != "blob,blob_data" {
+				errs.fail(w, fmt.Errorf("unexpected expand %s", r.URL.Query().Get("expand")))
+				return
+			}
+			// the blobs are split across two transactions
+			half := len(blockBlobs) / 2
+			if err := json.NewEncoder(w).Encode(map[string]any{"hash": hash, "transactions": []map[string]any{
+				{"blobs": blockBlobs[:half]}, {"blobs": blockBlobs[half:]},
+			}}); err != nil {
+				errs.fail(w, err)
+			}
+			return
+		}
+		srv.byHash.Add(1)
+		blob, ok := byHash[strings.TrimPrefix(r.URL.Path, "/blobs/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(&blobscanBlob{
+			VersionedHash: strings.TrimPrefix(r.URL.Path, "/blobs/"),
+			Commitment:    fmt.Sprintf("%#x", blob.commitment),
+			Proof:         fmt.Sprintf("%#x", blob.proof),
+			Data:          fmt.Sprintf("%#x", blob.blob),
+		}); err != nil {
+			errs.fail(w, err)
+		}
+	}))
+	return srv
+}
+
+func TestBlobscanSource(t *testing.T) {
+	ctx := context.Background()
+	blobs := newTestBlobs(t, 3)
+	header, block := newTestBlock(t, 8626200, blobs)
+	client := &fakeBeaconClient{header: header, block: block}
+
+	errs := newHandlerErrors()
+	defer errs.require(t)
+	server := newBlobscanServer(errs, nil, blobs)
+	defer server.Close()
+
+	source := NewBlobscanSource(client, server.URL, time.Second*5)
+	sidecars, err := source.BlobSidecars(ctx, header)
+	require.NoError(t, err)
+	require.Len(t, sidecars, len(blobs))
+	for i, sidecar := range sidecars {
+		require.Equal(t, deneb.BlobIndex(i), sidecar.Index)
+		require.Equal(t, blobs[i].blob, sidecar.Blob)
+		require.Equal(t, blobs[i].commitment, sidecar.KZGCommitment)
+		require.Equal(t, header.Header, sidecar.SignedBlockHeader)
+	}
+
+	// a blob missing from the archive fails the whole block
+	partial := newBlobscanServer(errs, nil, blobs[:2])
+	defer partial.Close()
+	_, err = NewBlobscanSource(client, partial.URL, time.Second*5).BlobSidecars(ctx, header)
+	require.Error(t, err)
+
+	// blobs served for the wrong commitment are rejected
+	swapped := newBlobscanServer(errs, nil, []*testBlob{blobs[0], blobs[1], {blob: blobs[1].blob, commitment: blobs[2].commitment, proof: blobs[1].proof}})
+	defer swapped.Close()
+	_, err = NewBlobscanSource(client, swapped.URL, time.Second*5).BlobSidecars(ctx, header)
+	require.Error(t, err)
+
+	// an archive serving the block answers all of its blobs at once
+	byBlock := newBlobscanServer(errs, block, blobs)
+	defer byBlock.Close()
+	sidecars, err = NewBlobscanSource(client, byBlock.URL, time.Second*5).BlobSidecars(ctx, header)
+	require.NoError(t, err)
+	require.Len(t, sidecars, len(blobs))
+	require.Equal(t, blobs[2].blob, sidecars[2].Blob)
+	require.Equal(t, int32(1), byBlock.byBlock.Load())
+	require.Zero(t, byBlock.byHash.Load())
+
+	// without it, every blob is looked up by versioned hash
+	require.Equal(t, int32(1), server.byBlock.Load())
+	require.Equal(t, int32(len(blobs)), server.byHash.Load())
+
+	// a cancelled lookup does not fall back to the versioned hashes
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = NewBlobscanSource(client, server.URL, time.Second*5).BlobSidecars(cancelled, header)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, int32(len(blobs)), server.byHash.Load())
+}
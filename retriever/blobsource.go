@@ -0,0 +1,172 @@
+package retriever
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/attestantio/go-eth2-client/api"
+	apiv1 "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/attestantio/go-eth2-client/spec"
+	"github.com/attestantio/go-eth2-client/spec/deneb"
+	ssz "github.com/ferranbt/fastssz"
+	fieldparams "github.com/prysmaticlabs/prysm/v5/config/fieldparams"
+	"github.com/rabbitprincess/blob-retriever/storage"
+)
+
+// BlobSource provides the blob sidecars of a beacon block.
+type BlobSource interface {
+	BlobSidecars(ctx context.Context, header *apiv1.BeaconBlockHeader) ([]*deneb.BlobSidecar, error)
+}
+
+// NewBlobSource returns the blob source selected by the config.
+// Sources other than the beacon node still use the beacon client for block headers and inclusion proofs.
+func NewBlobSource(client BeaconClient, cfg *Config) (BlobSource, error) {
+	switch cfg.BlobSource {
+	case "", "beacon":
+		return &beaconBlobSource{client: client}, nil
+	case "blobscan":
+		if cfg.BlobSourceUrl == "" {
+			return nil, fmt.Errorf("blob source url is required for blobscan source")
+		}
+		return NewBlobscanSource(client, cfg.BlobSourceUrl, cfg.Timeout), nil
+	case "engine":
+		if cfg.BlobSourceUrl == "" {
+			return nil, fmt.Errorf("blob source url is required for engine source")
+		}
+		var jwtSecret []byte
+		if cfg.JwtSecretPath != "" {
+			secret, err := LoadJwtSecret(cfg.JwtSecretPath)
+			if err != nil {
+				return nil, err
+			}
+			jwtSecret = secret
+		}
+		return NewEngineSource(client, cfg.BlobSourceUrl, jwtSecret, cfg.Timeout), nil
+	case "p2p":
+		chain, ok := client.(ChainInfo)
+		if !ok {
+			return nil, fmt.Errorf("beacon client does not provide the chain info of the p2p source")
+		}
+		peers, err := ParsePeers(cfg.P2PPeers)
+		if err != nil {
+			return nil, err
+		}
+		if len(peers) == 0 {
+			return nil, fmt.Errorf("p2p peers are required for p2p source")
+		}
+		host, err := NewP2PHost(cfg.P2PListen)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create libp2p host: %w", err)
+		}
+		source, err := NewP2PSource(host, peers, chain, cfg.Network)
+		if err != nil {
+			host.Close()
+			return nil, err
+		}
+		return source, nil
+	default:
+		return nil, fmt.Errorf("unknown blob source %s", cfg.BlobSource)
+	}
+}
+
+// beaconBlobSource fetches blob sidecars directly from the beacon node.
+type beaconBlobSource struct {
+	client BeaconClient
+}
+
+func (s *beaconBlobSource) BlobSidecars(ctx context.Context, header *apiv1.BeaconBlockHeader) ([]*deneb.BlobSidecar, error) {
+	res, err := s.client.BlobSidecars(ctx, &api.BlobSidecarsOpts{
+		Block: header.Root.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Data, nil
+}
+
+// blobFetcher returns the blobs and kzg proofs for the commitments of a block, in the same order.
+type blobFetcher func(ctx context.Context, commitments []deneb.KZGCommitment) ([]*deneb.Blob, []deneb.KZGProof, error)
+
+// blockBlobFetcher is a blobFetcher which is also given the block the commitments are from.
+type blockBlobFetcher func(ctx context.Context, block *spec.VersionedSignedBeaconBlock, commitments []deneb.KZGCommitment) ([]*deneb.Blob, []deneb.KZGProof, error)
+
+// blobCommitmentsGindex is the generalized index of blob_kzg_commitments in the deneb and electra block bodies, the
+// 12th of their 16 field leaves.
+const blobCommitmentsGindex = 16 + 11
+
+// buildSidecars rebuilds the blob sidecars of a block from blobs fetched outside the beacon node.
+// The block body is fetched from the beacon node to compute the commitment inclusion proofs,
+// and every sidecar is verified before it is returned.
+func buildSidecars(ctx context.Context, client BeaconClient, header *apiv1.BeaconBlockHeader, fetch blobFetcher) ([]*deneb.BlobSidecar, error) {
+	return buildBlockSidecars(ctx, client, header, func(ctx context.Context, _ *spec.VersionedSignedBeaconBlock, commitments []deneb.KZGCommitment) ([]*deneb.Blob, []deneb.KZGProof, error) {
+		return fetch(ctx, commitments)
+	})
+}
+
+// buildBlockSidecars is buildSidecars for fetchers which look the blobs up by the block.
+func buildBlockSidecars(ctx context.Context, client BeaconClient, header *apiv1.BeaconBlockHeader, fetch blockBlobFetcher) ([]*deneb.BlobSidecar, error) {
+	res, err := client.SignedBeaconBlock(ctx, &api.SignedBeaconBlockOpts{
+		Block: header.Root.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var body interface {
+		GetTree() (*ssz.Node, error)
+	}
+	switch {
+	case res.Data.Version == spec.DataVersionDeneb && res.Data.Deneb != nil:
+		body = res.Data.Deneb.Message.Body
+	case res.Data.Version == spec.DataVersionElectra && res.Data.Electra != nil:
+		body = res.Data.Electra.Message.Body
+	default:
+		return nil, fmt.Errorf("unsupported block version %s", res.Data.Version)
+	}
+	commitments, err := res.Data.BlobKZGCommitments()
+	if err != nil {
+		return nil, err
+	}
+	if len(commitments) == 0 {
+		return nil, nil
+	}
+
+	tree, err := body.GetTree()
+	if err != nil {
+		return nil, err
+	}
+	blobs, proofs, err := fetch(ctx, res.Data, commitments)
+	if err != nil {
+		return nil, err
+	}
+	if len(blobs) != len(commitments) || len(proofs) != len(commitments) {
+		return nil, fmt.Errorf("fetched %d blobs for %d commitments", len(blobs), len(commitments))
+	}
+
+	sidecars := make([]*deneb.BlobSidecar, 0, len(commitments))
+	for i, commitment := range commitments {
+		// the commitment is a leaf of the data tree of the list, left of its length
+		inclusionProof, err := tree.Prove(blobCommitmentsGindex<<(fieldparams.LogMaxBlobCommitments+1) | i)
+		if err != nil {
+			return nil, err
+		}
+		if len(inclusionProof.Hashes) != fieldparams.KzgCommitmentInclusionProofDepth {
+			return nil, fmt.Errorf("inclusion proof of commitment %d has %d hashes", i, len(inclusionProof.Hashes))
+		}
+
+		sidecar := &deneb.BlobSidecar{
+			Index:             deneb.BlobIndex(i),
+			Blob:              *blobs[i],
+			KZGCommitment:     commitment,
+			KZGProof:          proofs[i],
+			SignedBlockHeader: header.Header,
+		}
+		for j := range inclusionProof.Hashes {
+			copy(sidecar.KZGCommitmentInclusionProof[j][:], inclusionProof.Hashes[j])
+		}
+		if err := storage.VerifySidecar(storage.ConvSideCar(sidecar)); err != nil {
+			return nil, fmt.Errorf("invalid blob sidecar %d: %w", i, err)
+		}
+		sidecars = append(sidecars, sidecar)
+	}
+	return sidecars, nil
+}
@@ -0,0 +1,88 @@
+package retriever
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	apiv1 "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/attestantio/go-eth2-client/spec/altair"
+	"github.com/attestantio/go-eth2-client/spec/deneb"
+	"github.com/attestantio/go-eth2-client/spec/electra"
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	"github.com/holiman/uint256"
+	"github.com/prysmaticlabs/go-bitfield"
+	"github.com/rabbitprincess/blob-retriever/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestElectraBlock returns an electra block committing to the given blobs and carrying execution requests, with
+// its header.
+func newTestElectraBlock(t *testing.T, slot phase0.Slot, blobs []*testBlob) (*apiv1.BeaconBlockHeader, *electra.SignedBeaconBlock) {
+	body := &electra.BeaconBlockBody{
+		ETH1Data: &phase0.ETH1Data{BlockHash: make([]byte, 32)},
+		SyncAggregate: &altair.SyncAggregate{
+			SyncCommitteeBits: bitfield.NewBitvector512(),
+		},
+		ExecutionPayload: &deneb.ExecutionPayload{
+			BaseFeePerGas: uint256.NewInt(7),
+		},
+		ExecutionRequests: &electra.ExecutionRequests{
+			Withdrawals: []*electra.WithdrawalRequest{{ValidatorPubkey: phase0.BLSPubKey{0x01}, Amount: 32}},
+		},
+	}
+	for _, blob := range blobs {
+		body.BlobKZGCommitments = append(body.BlobKZGCommitments, blob.commitment)
+	}
+	bodyRoot, err := body.HashTreeRoot()
+	require.NoError(t, err)
+
+	message := &phase0.BeaconBlockHeader{
+		Slot:          slot,
+		ProposerIndex: 1,
+		BodyRoot:      bodyRoot,
+	}
+	root, err := message.HashTreeRoot()
+	require.NoError(t, err)
+	block := &electra.SignedBeaconBlock{
+		Message: &electra.BeaconBlock{
+			Slot:          slot,
+			ProposerIndex: 1,
+			Body:          body,
+		},
+	}
+	return &apiv1.BeaconBlockHeader{
+		Root:      root,
+		Canonical: true,
+		Header:    &phase0.SignedBeaconBlockHeader{Message: message},
+	}, block
+}
+
+func TestBuildSidecarsElectra(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	blobs := newTestBlobs(t, 3)
+	header, block := newTestElectraBlock(t, 11649100, blobs)
+	client := &fakeBeaconClient{header: header, electra: block}
+	sidecars, err := buildSidecars(ctx, client, header, func(ctx context.Context, commitments []deneb.KZGCommitment) ([]*deneb.Blob, []deneb.KZGProof, error) {
+		var res []*deneb.Blob
+		var proofs []deneb.KZGProof
+		for _, blob := range blobs {
+			res = append(res, &blob.blob)
+			proofs = append(proofs, blob.proof)
+		}
+		return res, proofs, nil
+	})
+	require.NoError(t, err)
+	require.Len(t, sidecars, len(blobs))
+	for i, sidecar := range sidecars {
+		require.Equal(t, deneb.BlobIndex(i), sidecar.Index)
+		require.Equal(t, blobs[i].commitment, sidecar.KZGCommitment)
+		require.NoError(t, storage.VerifySidecar(storage.ConvSideCar(sidecar)))
+	}
+
+	// a tampered inclusion proof does not verify
+	sidecars[1].KZGCommitmentInclusionProof[0][0] ^= 0xff
+	require.Error(t, storage.VerifySidecar(storage.ConvSideCar(sidecars[1])))
+}
@@ -0,0 +1,96 @@
+package retriever
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	apiv1 "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/rabbitprincess/blob-retriever/storage"
+)
+
+// ColumnSource fetches fulu data column sidecars from the beacon node debug API.
+// go-eth2-client has no fulu support yet, so the SSZ response is requested and decoded directly.
+type ColumnSource struct {
+	baseUrl         string
+	numberOfColumns uint64
+	http            *http.Client
+}
+
+// NewColumnSource returns a data column source backed by the beacon API at baseUrl.
+func NewColumnSource(baseUrl string, numberOfColumns uint64, timeout time.Duration) *ColumnSource {
+	return &ColumnSource{
+		baseUrl:         strings.TrimSuffix(baseUrl, "/"),
+		numberOfColumns: numberOfColumns,
+		http:            &http.Client{Timeout: timeout},
+	}
+}
+
+// DataColumnSidecars returns the data column sidecars the beacon node custodies for the block.
+// Each sidecar is checked to belong to the block, and its commitments inclusion proof and cell KZG proofs are verified.
+func (s *ColumnSource) DataColumnSidecars(ctx context.Context, header *apiv1.BeaconBlockHeader) ([]*storage.DataColumnSidecar, error) {
+	url := fmt.Sprintf("%s/eth/v1/debug/beacon/data_column_sidecars/%#x", s.baseUrl, header.Root)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/octet-stream")
+	res, err := s.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	if contentType := res.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "application/octet-stream") {
+		return nil, fmt.Errorf("unexpected content type %s", contentType)
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	sidecars, err := storage.DecodeDataColumnSidecars(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, sidecar := range sidecars {
+		root, err := sidecar.BlockRoot()
+		if err != nil {
+			return nil, err
+		}
+		if root != header.Root {
+			return nil, fmt.Errorf("column %d belongs to block %#x, expected %#x", sidecar.Index, root, header.Root)
+		}
+		if err := storage.VerifyDataColumnSidecar(sidecar, s.numberOfColumns); err != nil {
+			return nil, fmt.Errorf("column %d: %w", sidecar.Index, err)
+		}
+	}
+	if err := checkColumnCount(sidecars, s.numberOfColumns); err != nil {
+		return nil, err
+	}
+	return sidecars, nil
+}
+
+// checkColumnCount fails the columns of a block unless they are at least half of its columns, the number needed to
+// rebuild its blobs. A block without columns carries no blobs.
+func checkColumnCount(sidecars []*storage.DataColumnSidecar, numberOfColumns uint64) error {
+	if len(sidecars) == 0 {
+		return nil
+	}
+	indices := make(map[uint64]struct{}, len(sidecars))
+	for _, sidecar := range sidecars {
+		indices[sidecar.Index] = struct{}{}
+	}
+	if needed := (numberOfColumns + 1) / 2; uint64(len(indices)) < needed {
+		return fmt.Errorf("beacon node returned %d distinct columns, %d of %d are needed to rebuild the blobs", len(indices), needed, numberOfColumns)
+	}
+	return nil
+}
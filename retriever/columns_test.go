@@ -0,0 +1,23 @@
+package retriever
+
+import (
+	"testing"
+
+	"github.com/rabbitprincess/blob-retriever/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckColumnCount(t *testing.T) {
+	columns := func(indices ...uint64) []*storage.DataColumnSidecar {
+		sidecars := make([]*storage.DataColumnSidecar, 0, len(indices))
+		for _, index := range indices {
+			sidecars = append(sidecars, &storage.DataColumnSidecar{Index: index})
+		}
+		return sidecars
+	}
+	require.NoError(t, checkColumnCount(nil, 8))
+	require.NoError(t, checkColumnCount(columns(0, 2, 5, 7), 8))
+	require.ErrorContains(t, checkColumnCount(columns(0, 2, 5), 8), "3 distinct columns, 4 of 8")
+	// a column sent twice counts once
+	require.Error(t, checkColumnCount(columns(0, 2, 5, 5), 8))
+}
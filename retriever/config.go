@@ -1,34 +1,90 @@
-package retriever
-
-import "time"
-
-const (
-	serverTimeout = 60 * time.Second
-)
-
-func NewConfig(beaconUrl, beaconType string, timeout time.Duration, storageType, storagePath string, numWorker uint64) *Config {
-	if timeout == 0 {
-		timeout = serverTimeout
-	}
-	if storageType == "" {
-		storageType = "prysm"
-	}
-	return &Config{
-		BeaconApiUrl:  beaconUrl,
-		BeaconApiType: beaconType,
-		Timeout:       serverTimeout,
-		StorageType:   storageType,
-		StoragePath:   storagePath,
-		NumWorker:     numWorker,
-	}
-}
-
-type Config struct {
-	Mode          string
-	BeaconApiUrl  string
-	BeaconApiType string
-	Timeout       time.Duration
-	StorageType   string
-	StoragePath   string
-	NumWorker     uint64
-}
+package retriever
+
+import (
+	"time"
+
+	"github.com/rabbitprincess/blob-retriever/params"
+	"github.com/rabbitprincess/blob-retriever/storage"
+)
+
+const (
+	serverTimeout = 60 * time.Second
+)
+
+func NewConfig(beaconUrl, beaconType string, timeout time.Duration, storageType, storagePath string, numWorker uint64) *Config {
+	if timeout == 0 {
+		timeout = serverTimeout
+	}
+	if storageType == "" {
+		storageType = "prysm"
+	}
+	return &Config{
+		BeaconApiUrl:  beaconUrl,
+		BeaconApiType: beaconType,
+		Timeout:       serverTimeout,
+		StorageType:   storageType,
+		StoragePath:   storagePath,
+		NumWorker:     numWorker,
+		Network:       params.MainnetConfig(),
+	}
+}
+
+type Config struct {
+	Mode          string
+	BeaconApiUrl  string
+	BeaconApiType string
+	Timeout       time.Duration
+	StorageType   string
+	StoragePath   string
+	Compression   string
+	Dedup         bool
+	SharedNode    bool
+	SpaceLimits   storage.SpaceLimits
+	RepairLogPath string
+	NumWorker     uint64
+	BlobSource    string
+	BlobSourceUrl string
+	JwtSecretPath string
+	Network       *params.NetworkConfig
+
+	// NodeRetentionEpochs is the blob retention of the shared beacon node, 0 is the network minimum.
+	NodeRetentionEpochs uint64
+	// RetentionEpochs is the number of epochs behind the chain head the store keeps when pruned, 0 keeps all.
+	RetentionEpochs uint64
+
+	// P2PPeers are the multiaddrs of the consensus peers of the p2p source, ending in /p2p/<peer id>.
+	P2PPeers []string
+	// P2PListen is the multiaddr the libp2p host of the p2p source listens on, empty only dials out.
+	P2PListen string
+
+	// ProgressInterval is the interval of progress reports during a run, 0 disables them.
+	ProgressInterval time.Duration
+	// AdminToken is the bearer token the admin API requires on the routes changing a run or the job queue. Without
+	// it the API is only served on loopback addresses.
+	AdminToken string
+
+	// LeaseToken is the bearer token a worker sends to its coordinator.
+	LeaseToken string
+
+	// ProgressOutput draws the progress bar, clearing it around the log lines written through it. Nil draws to stderr
+	// without log lines.
+	ProgressOutput *ProgressWriter
+}
+
+// StoreOptions returns the options of the blob storage.
+func (c *Config) StoreOptions() storage.StoreOptions {
+	opts := storage.StoreOptions{Compression: c.Compression, Dedup: c.Dedup, SharedNode: c.SharedNode, RetentionEpochs: c.RetentionEpochs}
+	if c.Network != nil {
+		opts.SlotsPerEpoch = c.Network.SlotsPerEpoch
+	}
+	return opts
+}
+
+// ColumnLayout returns the network parameters the data column files are laid out by.
+func (c *Config) ColumnLayout() storage.ColumnLayout {
+	return storage.ColumnLayout{
+		NumberOfColumns: c.Network.NumberOfColumns,
+		SlotsPerEpoch:   c.Network.SlotsPerEpoch,
+		EpochsPerPeriod: c.Network.MinEpochsForDataColumnSidecarsRequests,
+	}
+}
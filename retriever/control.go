@@ -0,0 +1,146 @@
+package retriever
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// maxWorkers bounds the number of workers a run can be resized to.
+const maxWorkers = 256
+
+var errNotRunning = errors.New("no run in progress")
+
+// runControl hands out the slots of a run to a limited number of workers. A run can be paused, resized and given
+// failed slots to run again while it is in progress.
+type runControl struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	mode     string
+	running  bool
+	paused   bool
+	workers  int
+	active   int
+	next     uint64
+	toSlot   uint64
+	requeued []uint64
+}
+
+// controlState is the state of the control at a point in time.
+type controlState struct {
+	Mode    string
+	Running bool
+	Paused  bool
+	Workers int
+	Active  int
+	Queued  uint64
+}
+
+func newRunControl(workers int) *runControl {
+	c := &runControl{workers: min(max(workers, 1), maxWorkers)}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *runControl) start(mode string, fromSlot, toSlot uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mode = mode
+	c.running = true
+	c.paused = false
+	c.active = 0
+	c.next, c.toSlot = fromSlot, toSlot
+	c.requeued = nil
+}
+
+// take blocks until the run is not paused and a worker is free, and returns the next slot, requeued ones first.
+// It returns false once ctx is done, or every slot was taken and no worker is left which could fail a slot to requeue.
+func (c *runControl) take(ctx context.Context) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if ctx.Err() != nil {
+			c.running = false
+			return 0, false
+		}
+		if !c.paused && c.active < c.workers {
+			if len(c.requeued) > 0 {
+				slot := c.requeued[0]
+				c.requeued = c.requeued[1:]
+				c.active++
+				return slot, true
+			}
+			if c.next <= c.toSlot {
+				slot := c.next
+				c.next++
+				c.active++
+				return slot, true
+			}
+		}
+		if c.active == 0 && len(c.requeued) == 0 && c.next > c.toSlot {
+			c.running = false
+			return 0, false
+		}
+		c.cond.Wait()
+	}
+}
+
+// done frees the worker of a slot returned by take.
+func (c *runControl) done() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active--
+	c.cond.Broadcast()
+}
+
+// wake wakes take up to notice a done context.
+func (c *runControl) wake() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cond.Broadcast()
+}
+
+func (c *runControl) setPaused(paused bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running {
+		return errNotRunning
+	}
+	c.paused = paused
+	c.cond.Broadcast()
+	return nil
+}
+
+// setWorkers changes the number of slots run at a time. Running slots above a lower count are finished.
+func (c *runControl) setWorkers(workers int) error {
+	if workers < 1 || workers > maxWorkers {
+		return fmt.Errorf("worker count must be between 1 and %d", maxWorkers)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.workers = workers
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *runControl) requeue(slots []uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running {
+		return errNotRunning
+	}
+	c.requeued = append(c.requeued, slots...)
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *runControl) state() controlState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := controlState{Mode: c.mode, Running: c.running, Paused: c.paused, Workers: c.workers, Active: c.active, Queued: uint64(len(c.requeued))}
+	if c.running && c.next <= c.toSlot {
+		s.Queued += c.toSlot - c.next + 1
+	}
+	return s
+}
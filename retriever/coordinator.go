@@ -0,0 +1,151 @@
+package retriever
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rabbitprincess/blob-retriever/lease"
+	"github.com/rs/zerolog"
+)
+
+// leaseRequest is the body of the lease API requests of a worker.
+type leaseRequest struct {
+	Worker string `json:"worker"`
+	Cursor uint64 `json:"cursor"`
+	Error  string `json:"error,omitempty"`
+}
+
+// CoordinatorHandler serves the lease API of a coordinator:
+//
+//	GET  /leases                leases with their state, worker and cursor
+//	POST /leases/claim          claim a lease, 204 while every unfinished lease is held and 410 once all are finished
+//	POST /leases/{id}/renew     extend a held lease and report its cursor
+//	POST /leases/{id}/release   hand a held lease back
+//	POST /leases/{id}/complete  report the outcome of a lease, with the run error if it failed
+//
+// Requests of a worker carry a {"worker": id} body, and the token as a bearer token if one is set. A lease which is
+// no longer held by the worker answers 409.
+func CoordinatorHandler(log zerolog.Logger, c *lease.Coordinator, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /leases", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, c.List())
+	})
+	mux.HandleFunc("POST /leases/claim", func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decodeLeaseRequest(w, r, token)
+		if !ok {
+			return
+		}
+		l, err := c.Claim(req.Worker)
+		switch {
+		case errors.Is(err, lease.ErrNoLease):
+			w.WriteHeader(http.StatusNoContent)
+		case errors.Is(err, lease.ErrFinished):
+			writeError(w, http.StatusGone, err.Error())
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, err.Error())
+		default:
+			log.Info().Uint64("lease", l.ID).Str("worker", l.Worker).Uint64("fromSlot", l.FromSlot).Uint64("toSlot", l.ToSlot).Msg("Lease claimed")
+			writeJSON(w, l)
+		}
+	})
+	mux.HandleFunc("POST /leases/{id}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid lease id %s", r.PathValue("id")))
+			return
+		}
+		req, ok := decodeLeaseRequest(w, r, token)
+		if !ok {
+			return
+		}
+		var l lease.Lease
+		switch r.PathValue("action") {
+		case "renew":
+			l, err = c.Renew(id, req.Worker, req.Cursor)
+		case "release":
+			l, err = c.Release(id, req.Worker)
+		case "complete":
+			l, err = c.Complete(id, req.Worker, req.Cursor, req.Error)
+		default:
+			writeError(w, http.StatusNotFound, fmt.Sprintf("unknown lease action %s", r.PathValue("action")))
+			return
+		}
+		switch {
+		case errors.Is(err, lease.ErrNotFound):
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		case errors.Is(err, lease.ErrLost):
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		switch r.PathValue("action") {
+		case "release":
+			log.Info().Uint64("lease", l.ID).Str("worker", req.Worker).Msg("Lease released")
+		case "complete":
+			log.Info().Uint64("lease", l.ID).Str("worker", req.Worker).Str("state", l.State).Str("error", l.Error).Msg("Lease completed")
+		}
+		writeJSON(w, l)
+	})
+	return mux
+}
+
+func decodeLeaseRequest(w http.ResponseWriter, r *http.Request, token string) (leaseRequest, bool) {
+	var req leaseRequest
+	if !validToken(r, token) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+		return req, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid body: %v", err))
+		return req, false
+	}
+	if req.Worker == "" {
+		writeError(w, http.StatusBadRequest, "request has no worker id")
+		return req, false
+	}
+	return req, true
+}
+
+// RunCoordinator serves the lease API on addr until every lease is finished or ctx is done, requiring token from
+// workers if it is set. The API is served for another two poll intervals once the leases are finished, so idle
+// workers learn the run is over. It returns an error if a lease failed.
+func RunCoordinator(ctx context.Context, log zerolog.Logger, addr string, c *lease.Coordinator, token string) error {
+	plan := c.Plan()
+	log.Info().Str("addr", addr).Str("mode", plan.Mode).Uint64("fromSlot", plan.FromSlot).Uint64("toSlot", plan.ToSlot).Uint64("leaseSlots", plan.Slots).Bool("sharedStore", plan.SharedStore).Bool("token", token != "").Msg("Serving lease API")
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- listenAndServe(ctx, log, addr, CoordinatorHandler(log, c, token))
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+		return <-served
+	case <-c.Finished():
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * leasePollInterval):
+	}
+	cancel()
+	if err := <-served; err != nil {
+		return err
+	}
+	if failed := c.Failed(); failed > 0 {
+		return fmt.Errorf("%d leases failed", failed)
+	}
+	log.Info().Msg("All leases are done")
+	return nil
+}
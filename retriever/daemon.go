@@ -0,0 +1,127 @@
+package retriever
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/rabbitprincess/blob-retriever/jobs"
+	"github.com/rabbitprincess/blob-retriever/storage"
+)
+
+// cursorSaveInterval is the interval at which the cursor of a running job is saved to the queue.
+const cursorSaveInterval = 10 * time.Second
+
+// SetJobQueue sets the queue RunDaemon takes jobs from, which the admin API then lists and submits to.
+// It is set before the admin API is served.
+func (bs *BlobRetriever) SetJobQueue(queue *jobs.Queue) {
+	bs.queue = queue
+}
+
+// RunDaemon runs the jobs of the job queue one at a time, the highest priority first, until ctx is done.
+// A job interrupted by the end of ctx is queued again at its cursor.
+func (bs *BlobRetriever) RunDaemon(ctx context.Context) error {
+	if bs.queue == nil {
+		return fmt.Errorf("no job queue set")
+	}
+	for {
+		job, err := bs.queue.Next(ctx)
+		if ctx.Err() != nil {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := bs.runJob(ctx, job); err != nil {
+			return err
+		}
+	}
+}
+
+// runJob runs a job from its cursor against its store and records the outcome in the queue.
+func (bs *BlobRetriever) runJob(ctx context.Context, job jobs.Job) error {
+	log := bs.logger.With().Uint64("job", job.ID).Logger()
+	log.Info().Str("mode", job.Mode).Uint64("fromSlot", job.Cursor).Uint64("toSlot", job.ToSlot).Str("storageType", job.StorageType).Str("storagePath", job.StoragePath).Int("priority", job.Priority).Msg("Starting job")
+	restore, err := bs.useStore(job.StorageType, job.StoragePath)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to open job storage")
+		return bs.queue.Finish(job.ID, job.Cursor, err)
+	}
+	defer restore()
+
+	// the progress is started before the run, so the cursor saved before the run started is the job's
+	bs.progress.start(job.Cursor, job.ToSlot)
+	saveCtx, stopSaving := context.WithCancel(ctx)
+	saved := make(chan struct{})
+	go func() {
+		defer close(saved)
+		ticker := time.NewTicker(cursorSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-saveCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := bs.queue.Progress(job.ID, bs.progress.snapshot().Cursor); err != nil {
+				log.Error().Err(err).Msg("Failed to save job cursor")
+			}
+		}
+	}()
+	runErr := bs.Run(ctx, job.Mode, job.Cursor, job.ToSlot)
+	stopSaving()
+	<-saved
+
+	cursor := bs.progress.snapshot().Cursor
+	if ctx.Err() != nil {
+		log.Info().Uint64("cursor", cursor).Msg("Job interrupted, queued again")
+		return bs.queue.Release(job.ID, cursor)
+	}
+	if runErr != nil {
+		log.Error().Err(runErr).Msg("Job failed")
+	} else {
+		log.Info().Msg("Job done")
+	}
+	return bs.queue.Finish(job.ID, cursor, runErr)
+}
+
+// useStore points the retriever at the store of a job and returns the function restoring the default store.
+// The default store of the config is used as is.
+func (bs *BlobRetriever) useStore(storageType, path string) (func(), error) {
+	defaultPath, err := filepath.Abs(bs.cfg.StoragePath)
+	if err != nil {
+		return nil, err
+	}
+	if storageType == bs.cfg.StorageType && path == defaultPath {
+		return func() {}, nil
+	}
+
+	blobStorage, err := storage.NewBlobStore(bs.logger, storageType, path, bs.cfg.Network.MaxBlobsPerBlockLimit(), bs.cfg.StoreOptions())
+	if err != nil {
+		return nil, err
+	}
+	closers := []io.Closer{blobStorage.(io.Closer)}
+	guard, err := newSpaceGuard(bs.cfg, path)
+	if err != nil {
+		closeAll(closers)
+		return nil, err
+	}
+
+	// the column store of the job's store is opened by its run if the range reaches fulu
+	prevStorage, prevGuard, prevColumns, prevPath := bs.storage, bs.guard, bs.columns, bs.storagePath
+	bs.storage, bs.guard, bs.columns, bs.storagePath = blobStorage, guard, nil, path
+	return func() {
+		if closer, ok := bs.columns.(io.Closer); ok {
+			closers = append(closers, closer)
+		}
+		bs.storage, bs.guard, bs.columns, bs.storagePath = prevStorage, prevGuard, prevColumns, prevPath
+		closeAll(closers)
+	}, nil
+}
+
+func closeAll(closers []io.Closer) {
+	for _, closer := range closers {
+		closer.Close()
+	}
+}
@@ -0,0 +1,76 @@
+package retriever
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gammazero/workerpool"
+	"github.com/rabbitprincess/blob-retriever/jobs"
+	"github.com/rabbitprincess/blob-retriever/params"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunDaemon(t *testing.T) {
+	dir := t.TempDir()
+	network := params.MainnetConfig()
+	from := network.DenebForkSlot()
+	queue, err := jobs.Open(filepath.Join(dir, "jobs.json"))
+	require.NoError(t, err)
+	defer queue.Close()
+	bs := &BlobRetriever{
+		cfg:     &Config{Network: network, StorageType: "prysm", StoragePath: dir},
+		logger:  zerolog.Nop(),
+		wp:      workerpool.New(maxWorkers),
+		control: newRunControl(2),
+		client:  &slotBeaconClient{},
+		source:  &gatedSource{},
+	}
+	bs.SetJobQueue(queue)
+	srv := httptest.NewServer(bs.AdminHandler())
+	defer srv.Close()
+
+	// jobs queued before the daemon starts run by priority
+	low, err := queue.Submit(jobs.Job{Mode: "check", FromSlot: from, ToSlot: from + 9, StorageType: "prysm", StoragePath: dir})
+	require.NoError(t, err)
+	resp, err := http.Post(srv.URL+"/jobs", "application/json", strings.NewReader(fmt.Sprintf(
+		`{"mode": "check", "from_slot": %d, "to_slot": %d, "storage_type": "prysm", "storage_path": %q, "priority": 1}`, from+10, from+19, dir)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var high jobs.Job
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&high))
+	resp, err = http.Post(srv.URL+"/jobs", "application/json", strings.NewReader(fmt.Sprintf(
+		`{"mode": "check", "from_slot": %d, "to_slot": %d, "storage_type": "prysm", "storage_path": %q}`, from+5, from+15, dir)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- bs.RunDaemon(ctx)
+	}()
+	require.Eventually(t, func() bool {
+		list := queue.List()
+		return list[0].State == jobs.StateDone && list[1].State == jobs.StateDone
+	}, 10*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+
+	var list []jobs.Job
+	resp, err = http.Get(srv.URL + "/jobs")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	require.Len(t, list, 2)
+	require.Equal(t, low.ID, list[0].ID)
+	require.Equal(t, from+10, list[0].Cursor)
+	require.Equal(t, high.ID, list[1].ID)
+	require.Equal(t, from+20, list[1].Cursor)
+	require.True(t, list[1].StartedAt.Before(*list[0].StartedAt))
+}
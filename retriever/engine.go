@@ -0,0 +1,175 @@
+package retriever
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	apiv1 "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/attestantio/go-eth2-client/spec/deneb"
+	"github.com/rabbitprincess/blob-retriever/storage"
+)
+
+const engineGetBlobsV1 = "engine_getBlobsV1"
+
+var _ BlobSource = &EngineSource{}
+
+// EngineSource fetches blobs from the blob pool of an execution client with engine_getBlobsV1,
+// and joins them with the block header and inclusion proofs from the beacon node.
+// Execution clients only keep blobs of pending transactions, so this only works for very recent slots.
+type EngineSource struct {
+	client    BeaconClient
+	url       string
+	jwtSecret []byte
+	http      *http.Client
+	requestId atomic.Uint64
+}
+
+// NewEngineSource returns a blob source backed by the engine API at url.
+// The JWT secret is the hex encoded secret shared with the execution client, it may be empty
+// for endpoints that don't require authentication.
+func NewEngineSource(client BeaconClient, url string, jwtSecret []byte, timeout time.Duration) *EngineSource {
+	return &EngineSource{
+		client:    client,
+		url:       url,
+		jwtSecret: jwtSecret,
+		http:      &http.Client{Timeout: timeout},
+	}
+}
+
+// LoadJwtSecret reads a hex encoded JWT secret file as used by execution and consensus clients.
+func LoadJwtSecret(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(string(data)), "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwt secret: %w", err)
+	}
+	if len(secret) != 32 {
+		return nil, fmt.Errorf("invalid jwt secret length %d", len(secret))
+	}
+	return secret, nil
+}
+
+type engineRequest struct {
+	JsonRpc string        `json:"jsonrpc"`
+	Id      uint64        `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type engineResponse struct {
+	Result []*engineBlobAndProof `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type engineBlobAndProof struct {
+	Blob  string `json:"blob"`
+	Proof string `json:"proof"`
+}
+
+func (s *EngineSource) BlobSidecars(ctx context.Context, header *apiv1.BeaconBlockHeader) ([]*deneb.BlobSidecar, error) {
+	return buildSidecars(ctx, s.client, header, s.fetchBlobs)
+}
+
+func (s *EngineSource) fetchBlobs(ctx context.Context, commitments []deneb.KZGCommitment) ([]*deneb.Blob, []deneb.KZGProof, error) {
+	versionedHashes := make([]string, len(commitments))
+	for i, commitment := range commitments {
+		versionedHashes[i] = fmt.Sprintf("%#x", storage.KzgToVersionedHash(commitment[:]))
+	}
+	res, err := s.call(ctx, engineGetBlobsV1, versionedHashes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(res) != len(commitments) {
+		return nil, nil, fmt.Errorf("%s returned %d blobs for %d versioned hashes", engineGetBlobsV1, len(res), len(commitments))
+	}
+
+	blobs := make([]*deneb.Blob, len(commitments))
+	proofs := make([]deneb.KZGProof, len(commitments))
+	for i, item := range res {
+		if item == nil {
+			return nil, nil, fmt.Errorf("blob %s not found in blob pool", versionedHashes[i])
+		}
+		blobs[i] = &deneb.Blob{}
+		if err := storage.DecodeHex(item.Blob, blobs[i][:]); err != nil {
+			return nil, nil, fmt.Errorf("invalid blob data: %w", err)
+		}
+		if err := storage.DecodeHex(item.Proof, proofs[i][:]); err != nil {
+			return nil, nil, fmt.Errorf("invalid proof: %w", err)
+		}
+	}
+	return blobs, proofs, nil
+}
+
+func (s *EngineSource) call(ctx context.Context, method string, params ...interface{}) ([]*engineBlobAndProof, error) {
+	body, err := json.Marshal(&engineRequest{
+		JsonRpc: "2.0",
+		Id:      s.requestId.Add(1),
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(s.jwtSecret) > 0 {
+		token, err := newJwtToken(s.jwtSecret, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := s.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	var data engineResponse
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	if data.Error != nil {
+		return nil, fmt.Errorf("%s failed with code %d: %s", method, data.Error.Code, data.Error.Message)
+	}
+	return data.Result, nil
+}
+
+// newJwtToken returns an HS256 token with the iat claim, as required by the engine API authentication spec.
+func newJwtToken(secret []byte, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]int64{"iat": now.Unix()})
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
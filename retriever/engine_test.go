@@ -0,0 +1,85 @@
+package retriever
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rabbitprincess/blob-retriever/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngineSource(t *testing.T) {
+	ctx := context.Background()
+	blobs := newTestBlobs(t, 2)
+	header, block := newTestBlock(t, 8626200, blobs)
+	client := &fakeBeaconClient{header: header, block: block}
+
+	secret := []byte(strings.Repeat("s", 32))
+	pool := make(map[string]*testBlob)
+	for _, blob := range blobs {
+		pool[fmt.Sprintf("%#x", storage.KzgToVersionedHash(blob.commitment[:]))] = blob
+	}
+	errs := newHandlerErrors()
+	defer errs.require(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		if len(token) != 3 {
+			errs.fail(w, fmt.Errorf("malformed token %s", r.Header.Get("Authorization")))
+			return
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(token[0] + "." + token[1]))
+		if base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) != token[2] {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			Method string     `json:"method"`
+			Params [][]string `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			errs.fail(w, err)
+			return
+		}
+		if req.Method != engineGetBlobsV1 {
+			errs.fail(w, fmt.Errorf("unexpected method %s", req.Method))
+			return
+		}
+		result := make([]*engineBlobAndProof, len(req.Params[0]))
+		for i, hash := range req.Params[0] {
+			if blob, ok := pool[hash]; ok {
+				result[i] = &engineBlobAndProof{Blob: fmt.Sprintf("%#x", blob.blob), Proof: fmt.Sprintf("%#x", blob.proof)}
+			}
+		}
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "result": result}); err != nil {
+			errs.fail(w, err)
+		}
+	}))
+	defer server.Close()
+
+	sidecars, err := NewEngineSource(client, server.URL, secret, time.Second*5).BlobSidecars(ctx, header)
+	require.NoError(t, err)
+	require.Len(t, sidecars, len(blobs))
+	for i, sidecar := range sidecars {
+		require.Equal(t, blobs[i].blob, sidecar.Blob)
+	}
+
+	// a wrong secret is rejected by the engine
+	_, err = NewEngineSource(client, server.URL, []byte(strings.Repeat("x", 32)), time.Second*5).BlobSidecars(ctx, header)
+	require.Error(t, err)
+
+	// blobs dropped from the pool are reported as missing
+	delete(pool, fmt.Sprintf("%#x", storage.KzgToVersionedHash(blobs[1].commitment[:])))
+	_, err = NewEngineSource(client, server.URL, secret, time.Second*5).BlobSidecars(ctx, header)
+	require.ErrorContains(t, err, "not found in blob pool")
+}
@@ -0,0 +1,142 @@
+package retriever
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+)
+
+const (
+	MetricsPath = "/metrics"
+
+	metricsNamespace = "blob_retriever"
+)
+
+// Slot outcomes counted by the slots processed metric.
+const (
+	OutcomeEmpty     = "empty"
+	OutcomeNoBlobs   = "no_blobs"
+	OutcomeDone      = "done"
+	OutcomeFailed    = "failed"
+	OutcomeRequeued  = "requeued"
+	OutcomeCancelled = "cancelled"
+)
+
+// Beacon endpoints whose requests are timed and retried.
+const (
+	endpointBlockHeader        = "block_header"
+	endpointBlobSidecars       = "blob_sidecars"
+	endpointDataColumnSidecars = "data_column_sidecars"
+)
+
+// Metrics exposes the progress of a retriever to Prometheus. Its methods do nothing on a nil Metrics.
+type Metrics struct {
+	registry   *prometheus.Registry
+	slots      *prometheus.CounterVec
+	latency    *prometheus.HistogramVec
+	retries    *prometheus.CounterVec
+	bytesSaved prometheus.Counter
+}
+
+func newMetrics(bs *BlobRetriever) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		slots: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "slots_processed_total",
+			Help:      "Slots processed, by outcome.",
+		}, []string{"outcome"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "Latency of beacon requests, by endpoint.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+		}, []string{"endpoint"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_retries_total",
+			Help:      "Beacon requests retried after a failure, by endpoint.",
+		}, []string{"endpoint"}),
+		bytesSaved: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "saved_bytes_total",
+			Help:      "Bytes written to the store for the sidecars saved.",
+		}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.slots,
+		m.latency,
+		m.retries,
+		m.bytesSaved,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "queue_depth",
+			Help:      "Slots waiting for a worker.",
+		}, func() float64 {
+			return float64(bs.control.state().Queued)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "cursor_slot",
+			Help:      "Lowest slot of the run not completed yet.",
+		}, func() float64 {
+			return float64(bs.progress.snapshot().Cursor)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "eta_seconds",
+			Help:      "Projected time until the run completes, 0 before the first slot completed.",
+		}, func() float64 {
+			return bs.progress.snapshot().ETA().Seconds()
+		}),
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ListenAndServe serves the metrics on addr until ctx is done.
+func (m *Metrics) ListenAndServe(ctx context.Context, log zerolog.Logger, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("GET "+MetricsPath, m.Handler())
+	log.Info().Str("addr", addr).Msg("Serving metrics")
+	return listenAndServe(ctx, log, addr, mux)
+}
+
+func (m *Metrics) slot(outcome string) {
+	if m == nil {
+		return
+	}
+	m.slots.WithLabelValues(outcome).Inc()
+}
+
+func (m *Metrics) observe(endpoint string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.latency.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) retry(endpoint string) {
+	if m == nil {
+		return
+	}
+	m.retries.WithLabelValues(endpoint).Inc()
+}
+
+func (m *Metrics) saved(bytes uint64) {
+	if m == nil {
+		return
+	}
+	m.bytesSaved.Add(float64(bytes))
+}
@@ -0,0 +1,38 @@
+package retriever
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	bs := &BlobRetriever{control: newRunControl(1)}
+	bs.metrics = newMetrics(bs)
+	bs.progress.start(100, 199)
+	bs.control.start("retrieve", 101, 199)
+	bs.progress.complete(100)
+	bs.metrics.slot(OutcomeDone)
+	bs.metrics.observe(endpointBlockHeader, time.Now())
+	bs.metrics.retry(endpointBlobSidecars)
+	bs.metrics.saved(131928)
+
+	rec := httptest.NewRecorder()
+	bs.metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", MetricsPath, nil))
+	body, err := io.ReadAll(rec.Body)
+	require.NoError(t, err)
+	for _, series := range []string{
+		`blob_retriever_slots_processed_total{outcome="done"} 1`,
+		`blob_retriever_request_duration_seconds_count{endpoint="block_header"} 1`,
+		`blob_retriever_request_retries_total{endpoint="blob_sidecars"} 1`,
+		`blob_retriever_saved_bytes_total 131928`,
+		`blob_retriever_queue_depth 99`,
+		`blob_retriever_cursor_slot 101`,
+		`blob_retriever_eta_seconds`,
+	} {
+		require.Contains(t, string(body), series)
+	}
+}
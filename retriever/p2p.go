@@ -0,0 +1,518 @@
+package retriever
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	eth2client "github.com/attestantio/go-eth2-client"
+	"github.com/attestantio/go-eth2-client/api"
+	apiv1 "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/attestantio/go-eth2-client/spec/deneb"
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/muxer/yamux"
+	"github.com/libp2p/go-libp2p/p2p/security/noise"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	ssz "github.com/prysmaticlabs/fastssz"
+	"github.com/prysmaticlabs/go-bitfield"
+	"github.com/prysmaticlabs/prysm/v5/beacon-chain/p2p/encoder"
+	p2ptypes "github.com/prysmaticlabs/prysm/v5/beacon-chain/p2p/types"
+	"github.com/prysmaticlabs/prysm/v5/consensus-types/primitives"
+	ethpb "github.com/prysmaticlabs/prysm/v5/proto/prysm/v1alpha1"
+	"github.com/rabbitprincess/blob-retriever/params"
+	"github.com/rabbitprincess/blob-retriever/storage"
+)
+
+const (
+	protocolPrefix = "/eth2/beacon_chain/req/"
+
+	ProtocolStatus              = protocolPrefix + "status/1/" + encoder.ProtocolSuffixSSZSnappy
+	ProtocolGoodbye             = protocolPrefix + "goodbye/1/" + encoder.ProtocolSuffixSSZSnappy
+	ProtocolPing                = protocolPrefix + "ping/1/" + encoder.ProtocolSuffixSSZSnappy
+	ProtocolMetadata            = protocolPrefix + "metadata/2/" + encoder.ProtocolSuffixSSZSnappy
+	ProtocolBlobSidecarsByRange = protocolPrefix + "blob_sidecars_by_range/1/" + encoder.ProtocolSuffixSSZSnappy
+	ProtocolBlobSidecarsByRoot  = protocolPrefix + "blob_sidecars_by_root/1/" + encoder.ProtocolSuffixSSZSnappy
+
+	responseCodeSuccess = 0x00
+	forkDigestLength    = 4
+
+	// p2pRequestTimeout bounds a request to a peer when ctx has no earlier deadline.
+	p2pRequestTimeout = 20 * time.Second
+)
+
+var _ BlobSource = &P2PSource{}
+
+// ChainInfo provides the chain state a P2PSource announces in its Status handshake, the fork schedule its
+// fork digests are computed from and the blocks whose blob commitments the sidecars of peers are checked against.
+// The HTTP client of the beacon node implements it.
+type ChainInfo interface {
+	eth2client.GenesisProvider
+	eth2client.ForkScheduleProvider
+	eth2client.FinalityProvider
+	eth2client.BeaconBlockHeadersProvider
+	eth2client.SignedBeaconBlockProvider
+}
+
+// forkDigest is the fork digest of the network from a fork epoch on.
+type forkDigest struct {
+	epoch  uint64
+	digest [forkDigestLength]byte
+}
+
+// P2PSource fetches blob sidecars from consensus peers over libp2p with the BlobSidecarsByRange and
+// BlobSidecarsByRoot req/resp protocols, using prysm's ssz_snappy encoding. Peers are dialed on first use and
+// greeted with a Status handshake built from the beacon node's head and finality. Requests go to the peers in turn,
+// and to the next peer when one fails.
+type P2PSource struct {
+	host     host.Host
+	peers    []peer.AddrInfo
+	chain    ChainInfo
+	network  *params.NetworkConfig
+	encoding encoder.SszNetworkEncoder
+
+	mu        sync.Mutex
+	next      int
+	forks     []forkDigest
+	handshook map[peer.ID]bool
+}
+
+// NewP2PHost returns a libp2p host with the transport, security and muxer consensus clients speak. It listens on
+// the multiaddr listen, or only dials out if listen is empty.
+func NewP2PHost(listen string) (host.Host, error) {
+	key, _, err := crypto.GenerateSecp256k1Key(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	opts := []libp2p.Option{
+		libp2p.Identity(key),
+		libp2p.Transport(tcp.NewTCPTransport),
+		libp2p.Security(noise.ID, noise.New),
+		libp2p.Muxer(yamux.ID, yamux.DefaultTransport),
+		libp2p.DisableRelay(),
+		libp2p.Ping(false),
+	}
+	if listen != "" {
+		opts = append(opts, libp2p.ListenAddrStrings(listen))
+	} else {
+		opts = append(opts, libp2p.NoListenAddrs)
+	}
+	return libp2p.New(opts...)
+}
+
+// NewP2PSource returns a blob source requesting sidecars from peers through h. It answers the Status, Ping,
+// Metadata and Goodbye requests of peers on h, so they keep the connection open.
+func NewP2PSource(h host.Host, peers []peer.AddrInfo, chain ChainInfo, networkConfig *params.NetworkConfig) (*P2PSource, error) {
+	if len(peers) == 0 {
+		return nil, errors.New("no peers for p2p source")
+	}
+	s := &P2PSource{
+		host:      h,
+		peers:     peers,
+		chain:     chain,
+		network:   networkConfig,
+		handshook: make(map[peer.ID]bool),
+	}
+	h.SetStreamHandler(ProtocolStatus, s.handleStatus)
+	h.SetStreamHandler(ProtocolPing, s.handlePing)
+	h.SetStreamHandler(ProtocolMetadata, s.handleMetadata)
+	h.SetStreamHandler(ProtocolGoodbye, func(stream network.Stream) {
+		stream.Close()
+	})
+	h.Network().Notify(&network.NotifyBundle{
+		DisconnectedF: func(_ network.Network, conn network.Conn) {
+			s.mu.Lock()
+			delete(s.handshook, conn.RemotePeer())
+			s.mu.Unlock()
+		},
+	})
+	return s, nil
+}
+
+// ParsePeers parses peer multiaddrs ending in /p2p/<peer id>.
+func ParsePeers(addrs []string) ([]peer.AddrInfo, error) {
+	peers := make([]peer.AddrInfo, 0, len(addrs))
+	for _, addr := range addrs {
+		info, err := peer.AddrInfoFromString(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer %s: %w", addr, err)
+		}
+		peers = append(peers, *info)
+	}
+	return peers, nil
+}
+
+// Close closes the libp2p host of the source.
+func (s *P2PSource) Close() error {
+	return s.host.Close()
+}
+
+// BlobSidecars requests the sidecars of every blob commitment of the block by root. A peer missing any of them
+// fails, so the next peer is asked.
+func (s *P2PSource) BlobSidecars(ctx context.Context, header *apiv1.BeaconBlockHeader) ([]*deneb.BlobSidecar, error) {
+	res, err := s.chain.SignedBeaconBlock(ctx, &api.SignedBeaconBlockOpts{
+		Block: header.Root.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	commitments, err := res.Data.BlobKZGCommitments()
+	if err != nil {
+		return nil, err
+	}
+	if len(commitments) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]*ethpb.BlobIdentifier, len(commitments))
+	for i := range commitments {
+		ids[i] = &ethpb.BlobIdentifier{BlockRoot: header.Root[:], Index: uint64(i)}
+	}
+	req := p2ptypes.BlobSidecarsByRootReq(ids)
+	var sidecars []*deneb.BlobSidecar
+	_, err = s.request(ctx, ProtocolBlobSidecarsByRoot, &req, uint64(len(ids)), func(received []*deneb.BlobSidecar) error {
+		sidecars, err = blockSidecars(header.Root, commitments, received)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sidecars, nil
+}
+
+// blockSidecars orders the sidecars a peer sent for a block by index, and fails if they are not exactly the
+// sidecars of its commitments.
+func blockSidecars(root phase0.Root, commitments []deneb.KZGCommitment, received []*deneb.BlobSidecar) ([]*deneb.BlobSidecar, error) {
+	sidecars := make([]*deneb.BlobSidecar, len(commitments))
+	for _, sidecar := range received {
+		sidecarRoot, err := sidecar.SignedBlockHeader.Message.HashTreeRoot()
+		if err != nil {
+			return nil, err
+		}
+		if sidecarRoot != root {
+			return nil, fmt.Errorf("peer sent a sidecar of block %#x", sidecarRoot)
+		}
+		index := uint64(sidecar.Index)
+		if index >= uint64(len(commitments)) || sidecars[index] != nil {
+			return nil, fmt.Errorf("peer sent an unexpected sidecar %d", index)
+		}
+		if sidecar.KZGCommitment != commitments[index] {
+			return nil, fmt.Errorf("commitment of sidecar %d does not match the block", index)
+		}
+		sidecars[index] = sidecar
+	}
+	if len(received) != len(commitments) {
+		return nil, fmt.Errorf("peer sent %d of %d sidecars", len(received), len(commitments))
+	}
+	return sidecars, nil
+}
+
+// BlobSidecarsByRange requests the blob sidecars of count slots starting at startSlot.
+func (s *P2PSource) BlobSidecarsByRange(ctx context.Context, startSlot, count uint64) ([]*deneb.BlobSidecar, error) {
+	req := &ethpb.BlobSidecarsByRangeRequest{
+		StartSlot: primitives.Slot(startSlot),
+		Count:     count,
+	}
+	return s.request(ctx, ProtocolBlobSidecarsByRange, req, count*s.network.MaxBlobsPerBlockLimit(), nil)
+}
+
+// BlobSidecarsByRoot requests the blob sidecars with the given block root and index.
+func (s *P2PSource) BlobSidecarsByRoot(ctx context.Context, ids []*ethpb.BlobIdentifier) ([]*deneb.BlobSidecar, error) {
+	req := p2ptypes.BlobSidecarsByRootReq(ids)
+	return s.request(ctx, ProtocolBlobSidecarsByRoot, &req, uint64(len(ids)), nil)
+}
+
+// request sends req to the peers in turn until one answers it. An answer is also skipped for the next peer if check
+// is set and fails it.
+func (s *P2PSource) request(ctx context.Context, protocol protocol.ID, req ssz.Marshaler, maxChunks uint64, check func([]*deneb.BlobSidecar) error) ([]*deneb.BlobSidecar, error) {
+	var errs []error
+	for range s.peers {
+		s.mu.Lock()
+		info := s.peers[s.next%len(s.peers)]
+		s.next++
+		s.mu.Unlock()
+
+		sidecars, err := s.requestPeer(ctx, info, protocol, req, maxChunks)
+		if err == nil && check != nil {
+			err = check(sidecars)
+		}
+		if err == nil {
+			return sidecars, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		errs = append(errs, fmt.Errorf("peer %s: %w", info.ID, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (s *P2PSource) requestPeer(ctx context.Context, info peer.AddrInfo, protocol protocol.ID, req ssz.Marshaler, maxChunks uint64) ([]*deneb.BlobSidecar, error) {
+	ctx, cancel := context.WithTimeout(ctx, p2pRequestTimeout)
+	defer cancel()
+	if err := s.connect(ctx, info); err != nil {
+		return nil, err
+	}
+	stream, err := s.newStream(ctx, info.ID, protocol, req)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	var sidecars []*deneb.BlobSidecar
+	for i := uint64(0); ; i++ {
+		sidecar, err := s.readSidecar(ctx, stream)
+		if err == io.EOF {
+			return sidecars, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i >= maxChunks {
+			return nil, fmt.Errorf("peer sent more than %d response chunks", maxChunks)
+		}
+		if err := storage.VerifySidecar(sidecar); err != nil {
+			return nil, fmt.Errorf("invalid blob sidecar from peer: %w", err)
+		}
+		sidecars = append(sidecars, storage.ConvDenebSideCar(sidecar))
+	}
+}
+
+// connect dials the peer if it is not connected and exchanges Status messages with it once per connection.
+func (s *P2PSource) connect(ctx context.Context, info peer.AddrInfo) error {
+	if err := s.host.Connect(ctx, info); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	handshook := s.handshook[info.ID]
+	s.mu.Unlock()
+	if handshook {
+		return nil
+	}
+
+	status, err := s.status(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to build status: %w", err)
+	}
+	stream, err := s.newStream(ctx, info.ID, ProtocolStatus, status)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	remote := &ethpb.Status{}
+	if err := s.readResponse(stream, remote); err != nil {
+		return fmt.Errorf("status handshake failed: %w", err)
+	}
+	if !bytes.Equal(remote.ForkDigest, status.ForkDigest) {
+		s.host.Network().ClosePeer(info.ID)
+		return fmt.Errorf("peer is on fork digest %#x, not %#x", remote.ForkDigest, status.ForkDigest)
+	}
+	s.mu.Lock()
+	s.handshook[info.ID] = true
+	s.mu.Unlock()
+	return nil
+}
+
+// newStream opens a stream for protocol and writes req to it.
+func (s *P2PSource) newStream(ctx context.Context, id peer.ID, protocol protocol.ID, req ssz.Marshaler) (network.Stream, error) {
+	stream, err := s.host.NewStream(ctx, id, protocol)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := stream.SetDeadline(deadline); err != nil {
+			stream.Reset()
+			return nil, err
+		}
+	}
+	if _, err := s.encoding.EncodeWithMaxLength(stream, req); err != nil {
+		stream.Reset()
+		return nil, fmt.Errorf("failed to write request: %w", err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		stream.Reset()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// readResponse reads a response chunk without context bytes into msg.
+func (s *P2PSource) readResponse(r io.Reader, msg ssz.Unmarshaler) error {
+	if err := s.readCode(r); err != nil {
+		return unexpectedEOF(err)
+	}
+	return unexpectedEOF(s.encoding.DecodeWithMaxLength(r, msg))
+}
+
+// readSidecar reads a blob sidecar response chunk, returning io.EOF when the peer closed the stream. The fork digest
+// of the chunk must be the one of the sidecar's slot.
+func (s *P2PSource) readSidecar(ctx context.Context, r io.Reader) (*ethpb.BlobSidecar, error) {
+	if err := s.readCode(r); err != nil {
+		return nil, err
+	}
+	digest := make([]byte, forkDigestLength)
+	if _, err := io.ReadFull(r, digest); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	sidecar := &ethpb.BlobSidecar{}
+	if err := s.encoding.DecodeWithMaxLength(r, sidecar); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	expected, err := s.forkDigest(ctx, uint64(sidecar.SignedBlockHeader.Header.Slot)/s.network.SlotsPerEpoch)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(digest, expected[:]) {
+		return nil, fmt.Errorf("unexpected fork digest %#x for slot %d", digest, sidecar.SignedBlockHeader.Header.Slot)
+	}
+	return sidecar, nil
+}
+
+// readCode reads the result code of a response chunk and turns error responses into errors.
+func (s *P2PSource) readCode(r io.Reader) error {
+	code := make([]byte, 1)
+	if _, err := io.ReadFull(r, code); err != nil {
+		return err
+	}
+	if code[0] == responseCodeSuccess {
+		return nil
+	}
+	msg := p2ptypes.ErrorMessage{}
+	if err := s.encoding.DecodeWithMaxLength(r, &msg); err != nil {
+		return fmt.Errorf("peer responded with code %d", code[0])
+	}
+	return fmt.Errorf("peer responded with code %d: %s", code[0], string(msg))
+}
+
+// status returns the Status message of the beacon node's head and finalized checkpoint.
+func (s *P2PSource) status(ctx context.Context) (*ethpb.Status, error) {
+	head, err := s.chain.BeaconBlockHeader(ctx, &api.BeaconBlockHeaderOpts{Block: "head"})
+	if err != nil {
+		return nil, err
+	}
+	finality, err := s.chain.Finality(ctx, &api.FinalityOpts{State: "head"})
+	if err != nil {
+		return nil, err
+	}
+	headSlot := head.Data.Header.Message.Slot
+	digest, err := s.forkDigest(ctx, uint64(headSlot)/s.network.SlotsPerEpoch)
+	if err != nil {
+		return nil, err
+	}
+	return &ethpb.Status{
+		ForkDigest:     digest[:],
+		FinalizedRoot:  finality.Data.Finalized.Root[:],
+		FinalizedEpoch: primitives.Epoch(finality.Data.Finalized.Epoch),
+		HeadRoot:       head.Data.Root[:],
+		HeadSlot:       primitives.Slot(headSlot),
+	}, nil
+}
+
+// forkDigest returns the fork digest of the network at epoch, loading the fork schedule from the beacon node once.
+func (s *P2PSource) forkDigest(ctx context.Context, epoch uint64) ([forkDigestLength]byte, error) {
+	s.mu.Lock()
+	forks := s.forks
+	s.mu.Unlock()
+	if forks == nil {
+		genesis, err := s.chain.Genesis(ctx, &api.GenesisOpts{})
+		if err != nil {
+			return [forkDigestLength]byte{}, err
+		}
+		schedule, err := s.chain.ForkSchedule(ctx, &api.ForkScheduleOpts{})
+		if err != nil {
+			return [forkDigestLength]byte{}, err
+		}
+		for _, fork := range schedule.Data {
+			root, err := (&phase0.ForkData{CurrentVersion: fork.CurrentVersion, GenesisValidatorsRoot: genesis.Data.GenesisValidatorsRoot}).HashTreeRoot()
+			if err != nil {
+				return [forkDigestLength]byte{}, err
+			}
+			forks = append(forks, forkDigest{epoch: uint64(fork.Epoch), digest: [forkDigestLength]byte(root[:forkDigestLength])})
+		}
+		if len(forks) == 0 {
+			return [forkDigestLength]byte{}, errors.New("beacon node returned an empty fork schedule")
+		}
+		s.mu.Lock()
+		s.forks = forks
+		s.mu.Unlock()
+	}
+
+	digest := forks[0].digest
+	for _, fork := range forks {
+		if fork.epoch <= epoch {
+			digest = fork.digest
+		}
+	}
+	return digest, nil
+}
+
+// handleStatus answers the Status request of a peer with the status of the beacon node.
+func (s *P2PSource) handleStatus(stream network.Stream) {
+	defer stream.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), p2pRequestTimeout)
+	defer cancel()
+	stream.SetDeadline(time.Now().Add(p2pRequestTimeout))
+	remote := &ethpb.Status{}
+	if err := s.encoding.DecodeWithMaxLength(stream, remote); err != nil {
+		stream.Reset()
+		return
+	}
+	status, err := s.status(ctx)
+	if err != nil {
+		stream.Reset()
+		return
+	}
+	if s.writeResponse(stream, status) == nil && bytes.Equal(remote.ForkDigest, status.ForkDigest) {
+		s.mu.Lock()
+		s.handshook[stream.Conn().RemotePeer()] = true
+		s.mu.Unlock()
+	}
+}
+
+// handlePing answers a Ping with the metadata sequence number, which stays 0 as the source subscribes to no subnets.
+func (s *P2PSource) handlePing(stream network.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(p2pRequestTimeout))
+	seq := primitives.SSZUint64(0)
+	if err := s.encoding.DecodeWithMaxLength(stream, &seq); err != nil {
+		stream.Reset()
+		return
+	}
+	seq = 0
+	s.writeResponse(stream, &seq)
+}
+
+// handleMetadata answers a Metadata request with empty attestation and sync committee subnets.
+func (s *P2PSource) handleMetadata(stream network.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(p2pRequestTimeout))
+	s.writeResponse(stream, &ethpb.MetaDataV1{
+		Attnets:  bitfield.NewBitvector64(),
+		Syncnets: bitfield.NewBitvector4(),
+	})
+}
+
+func (s *P2PSource) writeResponse(w io.Writer, msg ssz.Marshaler) error {
+	if _, err := w.Write([]byte{responseCodeSuccess}); err != nil {
+		return err
+	}
+	_, err := s.encoding.EncodeWithMaxLength(w, msg)
+	return err
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,217 @@
+package retriever
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/attestantio/go-eth2-client/api"
+	apiv1 "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/attestantio/go-eth2-client/spec"
+	"github.com/attestantio/go-eth2-client/spec/deneb"
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	ssz "github.com/prysmaticlabs/fastssz"
+	"github.com/prysmaticlabs/prysm/v5/beacon-chain/p2p/encoder"
+	p2ptypes "github.com/prysmaticlabs/prysm/v5/beacon-chain/p2p/types"
+	ethpb "github.com/prysmaticlabs/prysm/v5/proto/prysm/v1alpha1"
+	"github.com/rabbitprincess/blob-retriever/params"
+	"github.com/rabbitprincess/blob-retriever/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeChain is a beacon node on mainnet's fork schedule at the head header, serving the block of the header.
+type fakeChain struct {
+	header                *apiv1.BeaconBlockHeader
+	block                 *deneb.SignedBeaconBlock
+	genesisValidatorsRoot phase0.Root
+}
+
+func (c *fakeChain) Genesis(ctx context.Context, opts *api.GenesisOpts) (*api.Response[*apiv1.Genesis], error) {
+	return &api.Response[*apiv1.Genesis]{Data: &apiv1.Genesis{GenesisValidatorsRoot: c.genesisValidatorsRoot}}, nil
+}
+
+func (c *fakeChain) ForkSchedule(ctx context.Context, opts *api.ForkScheduleOpts) (*api.Response[[]*phase0.Fork], error) {
+	return &api.Response[[]*phase0.Fork]{Data: []*phase0.Fork{
+		{CurrentVersion: phase0.Version{0x00, 0x00, 0x00, 0x00}, Epoch: 0},
+		{PreviousVersion: phase0.Version{0x03, 0x00, 0x00, 0x00}, CurrentVersion: phase0.Version{0x04, 0x00, 0x00, 0x00}, Epoch: 269568},
+	}}, nil
+}
+
+func (c *fakeChain) Finality(ctx context.Context, opts *api.FinalityOpts) (*api.Response[*apiv1.Finality], error) {
+	return &api.Response[*apiv1.Finality]{Data: &apiv1.Finality{
+		Finalized:         &phase0.Checkpoint{Epoch: 269560, Root: phase0.Root{0x01}},
+		Justified:         &phase0.Checkpoint{Epoch: 269561, Root: phase0.Root{0x02}},
+		PreviousJustified: &phase0.Checkpoint{Epoch: 269560, Root: phase0.Root{0x01}},
+	}}, nil
+}
+
+func (c *fakeChain) BeaconBlockHeader(ctx context.Context, opts *api.BeaconBlockHeaderOpts) (*api.Response[*apiv1.BeaconBlockHeader], error) {
+	return &api.Response[*apiv1.BeaconBlockHeader]{Data: c.header}, nil
+}
+
+func (c *fakeChain) SignedBeaconBlock(ctx context.Context, opts *api.SignedBeaconBlockOpts) (*api.Response[*spec.VersionedSignedBeaconBlock], error) {
+	return (&fakeBeaconClient{header: c.header, block: c.block}).SignedBeaconBlock(ctx, opts)
+}
+
+func newTestP2PHost(t *testing.T) host.Host {
+	h, err := NewP2PHost("/ip4/127.0.0.1/tcp/0")
+	require.NoError(t, err)
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func addrInfo(h host.Host) peer.AddrInfo {
+	return peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}
+}
+
+// handleStream registers a handler on the peer which resets the stream and records the error it returns.
+func handleStream(h host.Host, errs handlerErrors, id protocol.ID, handler func(stream network.Stream) error) {
+	h.SetStreamHandler(id, func(stream network.Stream) {
+		if err := handler(stream); err != nil {
+			errs.record(err)
+			stream.Reset()
+			return
+		}
+		stream.Close()
+	})
+}
+
+func TestP2PSource(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	blobs := newTestBlobs(t, 2)
+	header, block := newTestBlock(t, 8626200, blobs)
+	client := &fakeBeaconClient{header: header, block: block}
+	sidecars, err := buildSidecars(ctx, client, header, func(ctx context.Context, commitments []deneb.KZGCommitment) ([]*deneb.Blob, []deneb.KZGProof, error) {
+		var res []*deneb.Blob
+		var proofs []deneb.KZGProof
+		for _, blob := range blobs {
+			res = append(res, &blob.blob)
+			proofs = append(proofs, blob.proof)
+		}
+		return res, proofs, nil
+	})
+	require.NoError(t, err)
+
+	chain := &fakeChain{header: header, block: block, genesisValidatorsRoot: phase0.Root{0xaa}}
+	forkData := &phase0.ForkData{CurrentVersion: phase0.Version{0x04, 0x00, 0x00, 0x00}, GenesisValidatorsRoot: chain.genesisValidatorsRoot}
+	root, err := forkData.HashTreeRoot()
+	require.NoError(t, err)
+	digest := root[:forkDigestLength]
+
+	// a peer answers the status handshake and serves the given sidecars of the block
+	errs := newHandlerErrors()
+	enc := encoder.SszNetworkEncoder{}
+	writeChunk := func(stream network.Stream, context []byte, msg ssz.Marshaler) error {
+		if _, err := stream.Write(append([]byte{responseCodeSuccess}, context...)); err != nil {
+			return err
+		}
+		_, err := enc.EncodeWithMaxLength(stream, msg)
+		return err
+	}
+	newServer := func(served []*deneb.BlobSidecar) host.Host {
+		server := newTestP2PHost(t)
+		handleStream(server, errs, ProtocolStatus, func(stream network.Stream) error {
+			status := &ethpb.Status{}
+			if err := enc.DecodeWithMaxLength(stream, status); err != nil {
+				return err
+			}
+			status.ForkDigest = digest
+			status.HeadSlot += 10
+			return writeChunk(stream, nil, status)
+		})
+		handleStream(server, errs, ProtocolBlobSidecarsByRange, func(stream network.Stream) error {
+			req := &ethpb.BlobSidecarsByRangeRequest{}
+			if err := enc.DecodeWithMaxLength(stream, req); err != nil {
+				return err
+			}
+			if uint64(req.StartSlot) > uint64(header.Header.Message.Slot) || uint64(header.Header.Message.Slot) >= uint64(req.StartSlot)+req.Count {
+				return nil
+			}
+			for _, sidecar := range served {
+				if err := writeChunk(stream, digest, storage.ConvSideCar(sidecar)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		handleStream(server, errs, ProtocolBlobSidecarsByRoot, func(stream network.Stream) error {
+			req := p2ptypes.BlobSidecarsByRootReq{}
+			if err := enc.DecodeWithMaxLength(stream, &req); err != nil {
+				return err
+			}
+			for _, id := range req {
+				if [32]byte(id.BlockRoot) == header.Root && id.Index < uint64(len(served)) {
+					if err := writeChunk(stream, digest, storage.ConvSideCar(served[id.Index])); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		return server
+	}
+	server := newServer(sidecars)
+
+	// a peer which is gone is skipped for the next one
+	gone := newTestP2PHost(t)
+	goneInfo := addrInfo(gone)
+	require.NoError(t, gone.Close())
+
+	source, err := NewP2PSource(newTestP2PHost(t), []peer.AddrInfo{goneInfo, addrInfo(server)}, chain, params.MainnetConfig())
+	require.NoError(t, err)
+
+	res, err := source.BlobSidecars(ctx, header)
+	require.NoError(t, err)
+	require.Equal(t, sidecars, res)
+
+	res, err = source.BlobSidecarsByRange(ctx, uint64(header.Header.Message.Slot)+1, 10)
+	require.NoError(t, err)
+	require.Empty(t, res)
+
+	res, err = source.BlobSidecarsByRoot(ctx, []*ethpb.BlobIdentifier{{BlockRoot: header.Root[:], Index: 1}})
+	require.NoError(t, err)
+	require.Equal(t, sidecars[1:], res)
+	errs.require(t)
+
+	// a peer missing sidecars of the block is skipped for the next one, and fails the block if it is the last
+	partial := newServer(sidecars[:1])
+	fallback, err := NewP2PSource(newTestP2PHost(t), []peer.AddrInfo{addrInfo(partial), addrInfo(server)}, chain, params.MainnetConfig())
+	require.NoError(t, err)
+	res, err = fallback.BlobSidecars(ctx, header)
+	require.NoError(t, err)
+	require.Equal(t, sidecars, res)
+	incomplete, err := NewP2PSource(newTestP2PHost(t), []peer.AddrInfo{addrInfo(partial)}, chain, params.MainnetConfig())
+	require.NoError(t, err)
+	res, err = incomplete.BlobSidecars(ctx, header)
+	require.ErrorContains(t, err, "peer sent 1 of 2 sidecars")
+	require.Nil(t, res)
+	errs.require(t)
+
+	// a peer on another chain fails the handshake
+	other, err := NewP2PSource(newTestP2PHost(t), []peer.AddrInfo{addrInfo(server)}, &fakeChain{header: header, block: block, genesisValidatorsRoot: phase0.Root{0xbb}}, params.MainnetConfig())
+	require.NoError(t, err)
+	_, err = other.BlobSidecars(ctx, header)
+	require.ErrorContains(t, err, "peer is on fork digest")
+
+	// error responses are surfaced with their message
+	handleStream(server, errs, ProtocolBlobSidecarsByRoot, func(stream network.Stream) error {
+		if err := enc.DecodeWithMaxLength(stream, &p2ptypes.BlobSidecarsByRootReq{}); err != nil {
+			return err
+		}
+		msg := p2ptypes.ErrorMessage("resource unavailable")
+		if _, err := stream.Write([]byte{0x03}); err != nil {
+			return err
+		}
+		_, err := enc.EncodeWithMaxLength(stream, &msg)
+		return err
+	})
+	_, err = source.BlobSidecars(ctx, header)
+	require.ErrorContains(t, err, "resource unavailable")
+	errs.require(t)
+}
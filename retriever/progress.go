@@ -0,0 +1,223 @@
+package retriever
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-isatty"
+)
+
+// progressBarWidth is the number of characters between the brackets of the progress bar.
+const progressBarWidth = 30
+
+// runProgress tracks the slots a run completed. Workers finish slots out of order, so the cursor is the lowest
+// slot not completed yet, the one a restarted run has to begin from.
+type runProgress struct {
+	mu        sync.Mutex
+	fromSlot  uint64
+	toSlot    uint64
+	startedAt time.Time
+	endedAt   time.Time
+	cursor    uint64
+	completed uint64
+	// done holds the completed slots above the cursor.
+	done map[uint64]struct{}
+}
+
+// progressSnapshot is the state of a run at a point in time.
+type progressSnapshot struct {
+	FromSlot  uint64
+	ToSlot    uint64
+	Cursor    uint64
+	Completed uint64
+	Elapsed   time.Duration
+}
+
+func (p *runProgress) start(fromSlot, toSlot uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fromSlot, p.toSlot = fromSlot, toSlot
+	p.startedAt, p.endedAt = time.Now(), time.Time{}
+	p.cursor = fromSlot
+	p.completed = 0
+	p.done = make(map[uint64]struct{})
+}
+
+// complete counts a slot which succeeded and advances the cursor over it.
+func (p *runProgress) complete(slot uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.completed++
+	if slot < p.cursor {
+		return
+	}
+	if slot != p.cursor {
+		p.done[slot] = struct{}{}
+		return
+	}
+	p.cursor++
+	for {
+		if _, ok := p.done[p.cursor]; !ok {
+			return
+		}
+		delete(p.done, p.cursor)
+		p.cursor++
+	}
+}
+
+// fail counts a slot which failed. The cursor stays below it, so a run resumed from the cursor runs it again.
+func (p *runProgress) fail() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.completed++
+}
+
+// finish stops the clock of the run.
+func (p *runProgress) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.endedAt = time.Now()
+}
+
+// retry uncounts the completion of slots which are run again.
+func (p *runProgress) retry(slots int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.completed -= min(uint64(slots), p.completed)
+}
+
+func (p *runProgress) snapshot() progressSnapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := progressSnapshot{FromSlot: p.fromSlot, ToSlot: p.toSlot, Cursor: p.cursor, Completed: p.completed}
+	switch {
+	case !p.endedAt.IsZero():
+		s.Elapsed = p.endedAt.Sub(p.startedAt)
+	case !p.startedAt.IsZero():
+		s.Elapsed = time.Since(p.startedAt)
+	}
+	return s
+}
+
+// Total returns the number of slots in the range of the run.
+func (s progressSnapshot) Total() uint64 {
+	return s.ToSlot - s.FromSlot + 1
+}
+
+// ETA projects the time left at the rate slots were completed so far, 0 before the first one.
+func (s progressSnapshot) ETA() time.Duration {
+	if s.Completed == 0 {
+		return 0
+	}
+	remaining := s.Total() - min(s.Completed, s.Total())
+	return time.Duration(float64(s.Elapsed) / float64(s.Completed) * float64(remaining))
+}
+
+// Rate returns the slots completed per second.
+func (s progressSnapshot) Rate() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Completed) / s.Elapsed.Seconds()
+}
+
+// Percent returns the share of the range completed, from 0 to 100.
+func (s progressSnapshot) Percent() float64 {
+	return float64(min(s.Completed, s.Total())) / float64(s.Total()) * 100
+}
+
+// progressLine renders the progress as a bar followed by the cursor, throughput, ETA and error rate.
+func progressLine(s progressSnapshot, failed uint64) string {
+	filled := int(s.Percent() / 100 * progressBarWidth)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	if filled < progressBarWidth {
+		bar = bar[:filled] + ">" + bar[filled+1:]
+	}
+	return fmt.Sprintf("[%s] %5.1f%% %d/%d slots, cursor %d, %.1f slots/s, ETA %s, errors %.2f%%",
+		bar, s.Percent(), s.Completed, s.Total(), s.Cursor, s.Rate(), s.ETA().Round(time.Second), errorRate(s, failed))
+}
+
+func errorRate(s progressSnapshot, failed uint64) float64 {
+	if s.Completed == 0 {
+		return 0
+	}
+	return float64(failed) / float64(s.Completed) * 100
+}
+
+// ProgressWriter writes log lines and draws the progress bar on a terminal. The bar is redrawn in place, so log lines
+// written while it is shown clear it first and draw it again after, instead of being overwritten by it.
+type ProgressWriter struct {
+	mu   sync.Mutex
+	log  io.Writer
+	bar  *os.File
+	line string
+}
+
+// NewProgressWriter returns a writer writing log lines to log and drawing the bar on bar.
+func NewProgressWriter(log io.Writer, bar *os.File) *ProgressWriter {
+	return &ProgressWriter{log: log, bar: bar}
+}
+
+// Terminal reports whether the bar is drawn on a terminal.
+func (w *ProgressWriter) Terminal() bool {
+	return isatty.IsTerminal(w.bar.Fd()) || isatty.IsCygwinTerminal(w.bar.Fd())
+}
+
+// Write writes a log line, clearing the bar around it.
+func (w *ProgressWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.line != "" {
+		fmt.Fprint(w.bar, "\r\033[K")
+	}
+	n, err := w.log.Write(p)
+	if w.line != "" {
+		fmt.Fprint(w.bar, w.line)
+	}
+	return n, err
+}
+
+// draw redraws the bar in place.
+func (w *ProgressWriter) draw(line string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.line = line
+	fmt.Fprintf(w.bar, "\r\033[K%s", line)
+}
+
+// finish draws the bar a last time and ends its line, so log lines are written below it.
+func (w *ProgressWriter) finish(line string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.line = ""
+	fmt.Fprintf(w.bar, "\r\033[K%s\n", line)
+}
+
+// reportProgress reports the progress of the run every interval until ctx is done, as a bar redrawn in place when
+// out draws on a terminal and as a log line otherwise.
+func (bs *BlobRetriever) reportProgress(ctx context.Context, interval time.Duration, out *ProgressWriter) {
+	tty := out.Terminal()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if tty {
+				out.finish(progressLine(bs.progress.snapshot(), bs.stats.failedCount()))
+			}
+			return
+		case <-ticker.C:
+		}
+		s, failed := bs.progress.snapshot(), bs.stats.failedCount()
+		if tty {
+			out.draw(progressLine(s, failed))
+			continue
+		}
+		bs.logger.Info().Float64("percent", s.Percent()).Uint64("completed", s.Completed).Uint64("total", s.Total()).Uint64("cursor", s.Cursor).Float64("slotsPerSecond", s.Rate()).Str("eta", s.ETA().Round(time.Second).String()).Uint64("failed", failed).Float64("errorRate", errorRate(s, failed)).Msg("Progress")
+	}
+}
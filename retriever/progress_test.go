@@ -0,0 +1,73 @@
+package retriever
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunProgressCursor(t *testing.T) {
+	var p runProgress
+	p.start(100, 109)
+
+	// workers finish out of order, the cursor waits for the lowest slot
+	for _, slot := range []uint64{101, 103, 102} {
+		p.complete(slot)
+	}
+	s := p.snapshot()
+	require.Equal(t, uint64(100), s.Cursor)
+	require.Equal(t, uint64(3), s.Completed)
+	require.Equal(t, uint64(10), s.Total())
+	require.Greater(t, s.ETA(), s.Elapsed)
+
+	p.complete(100)
+	require.Equal(t, uint64(104), p.snapshot().Cursor)
+	// a failed slot is counted but holds the cursor until it succeeds
+	p.fail()
+	for slot := uint64(104); slot <= 109; slot++ {
+		if slot != 105 {
+			p.complete(slot)
+		}
+	}
+	s = p.snapshot()
+	require.Equal(t, uint64(105), s.Cursor)
+	require.Equal(t, uint64(10), s.Completed)
+	p.retry(1)
+	p.complete(105)
+	s = p.snapshot()
+	require.Equal(t, uint64(110), s.Cursor)
+	require.Zero(t, s.ETA())
+}
+
+func TestProgressLine(t *testing.T) {
+	s := progressSnapshot{FromSlot: 100, ToSlot: 199, Cursor: 150, Completed: 50, Elapsed: 10 * time.Second}
+	require.Equal(t, "[===============>              ]  50.0% 50/100 slots, cursor 150, 5.0 slots/s, ETA 10s, errors 2.00%", progressLine(s, 1))
+
+	s.Completed, s.Cursor = 100, 200
+	require.Equal(t, "[==============================] 100.0% 100/100 slots, cursor 200, 10.0 slots/s, ETA 0s, errors 0.00%", progressLine(s, 0))
+}
+
+func TestProgressWriter(t *testing.T) {
+	bar, err := os.Create(filepath.Join(t.TempDir(), "bar"))
+	require.NoError(t, err)
+	defer bar.Close()
+	var log bytes.Buffer
+	w := NewProgressWriter(&log, bar)
+
+	// a log line clears the bar and draws it again after
+	w.draw("[=>] 1")
+	_, err = w.Write([]byte("line\n"))
+	require.NoError(t, err)
+	require.Equal(t, "line\n", log.String())
+	w.finish("[==] 2")
+	_, err = w.Write([]byte("after\n"))
+	require.NoError(t, err)
+	drawn, err := os.ReadFile(bar.Name())
+	require.NoError(t, err)
+	require.Equal(t, "\r\033[K[=>] 1\r\033[K[=>] 1\r\033[K[==] 2\n", string(drawn))
+	require.False(t, w.Terminal())
+}
@@ -0,0 +1,190 @@
+package retriever
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	apiv1 "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/attestantio/go-eth2-client/spec/deneb"
+	"github.com/rabbitprincess/blob-retriever/storage"
+)
+
+// Repair actions recorded in the repair log.
+const (
+	RepairFilled   = "filled"
+	RepairReplaced = "replaced"
+)
+
+// RepairEntry is a line of the repair log, one per sidecar written by repair mode.
+type RepairEntry struct {
+	Time   time.Time `json:"time"`
+	Slot   uint64    `json:"slot"`
+	Root   string    `json:"root"`
+	Kind   string    `json:"kind"`
+	Index  uint64    `json:"index"`
+	Action string    `json:"action"`
+	Reason string    `json:"reason"`
+}
+
+// RepairLog appends repair entries as JSON lines to a file.
+type RepairLog struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func OpenRepairLog(path string) (*RepairLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open repair log %s: %w", path, err)
+	}
+	return &RepairLog{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (l *RepairLog) Write(entry RepairEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(entry); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+func (l *RepairLog) Close() error {
+	return l.file.Close()
+}
+
+// RepairBlob verifies the remote sidecars of a block and compares them with the stored ones the way Valid does.
+// Missing sidecars are saved and mismatched or unreadable ones atomically replaced, each recorded in the repair log.
+func (bs *BlobRetriever) RepairBlob(ctx context.Context, slot uint64, header *apiv1.BeaconBlockHeader, sidecars []*deneb.BlobSidecar) error {
+	store, ok := bs.storage.(storage.RepairableBlobStore)
+	if !ok {
+		return fmt.Errorf("storage type %s does not support repair", bs.cfg.StorageType)
+	}
+	for _, sidecar := range sidecars {
+		if err := verifyRemoteSidecar(header, sidecar); err != nil {
+			return fmt.Errorf("remote sidecar %d failed verification: %w", sidecar.Index, err)
+		}
+	}
+	mask, err := store.Indices(header.Root)
+	if err != nil {
+		return err
+	}
+
+	for _, sidecar := range sidecars {
+		index := uint64(sidecar.Index)
+		entry := RepairEntry{Slot: slot, Root: header.Root.String(), Kind: "blob", Index: index}
+		var written uint64
+		if index >= uint64(len(mask)) || !mask[index] {
+			if written, err = store.Save(header.Root, sidecar); err != nil {
+				return err
+			}
+			entry.Action, entry.Reason = RepairFilled, "missing"
+		} else {
+			valid, err := store.Valid(header.Root, sidecar)
+			if err == nil && valid {
+				bs.stats.sidecarsPresent.Add(1)
+				continue
+			}
+			bs.stats.mismatches.Add(1)
+			entry.Reason = "mismatch"
+			if err != nil {
+				entry.Reason = err.Error()
+			}
+			if written, err = store.Replace(header.Root, sidecar); err != nil {
+				return err
+			}
+			entry.Action = RepairReplaced
+		}
+		bs.saved(1, written)
+		if err := bs.recordRepair(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RepairColumns fills missing and replaces mismatched data column sidecars of a block, as RepairBlob does for blobs.
+// The columns of a block share a file, so the missing ones are saved and the mismatched ones replaced together.
+func (bs *BlobRetriever) RepairColumns(ctx context.Context, slot uint64, header *apiv1.BeaconBlockHeader, sidecars []*storage.DataColumnSidecar) error {
+	for _, sidecar := range sidecars {
+		root, err := sidecar.BlockRoot()
+		if err != nil {
+			return err
+		}
+		if root != header.Root {
+			return fmt.Errorf("remote data column sidecar %d belongs to block %#x", sidecar.Index, root)
+		}
+		if err := storage.VerifyDataColumnSidecar(sidecar, bs.cfg.Network.NumberOfColumns); err != nil {
+			return fmt.Errorf("remote data column sidecar %d: %w", sidecar.Index, err)
+		}
+	}
+	mask, err := bs.columns.Indices(header.Root)
+	if err != nil {
+		return err
+	}
+
+	var missing, mismatched []*storage.DataColumnSidecar
+	var entries []RepairEntry
+	for _, sidecar := range sidecars {
+		entry := RepairEntry{Slot: slot, Root: header.Root.String(), Kind: "column", Index: sidecar.Index}
+		if sidecar.Index >= uint64(len(mask)) || !mask[sidecar.Index] {
+			missing = append(missing, sidecar)
+			entry.Action, entry.Reason = RepairFilled, "missing"
+		} else {
+			valid, err := bs.columns.Valid(header.Root, sidecar)
+			if err == nil && valid {
+				bs.stats.sidecarsPresent.Add(1)
+				continue
+			}
+			bs.stats.mismatches.Add(1)
+			mismatched = append(mismatched, sidecar)
+			entry.Action, entry.Reason = RepairReplaced, "mismatch"
+			if err != nil {
+				entry.Reason = err.Error()
+			}
+		}
+		entries = append(entries, entry)
+	}
+	saved, err := bs.columns.Save(header.Root, missing)
+	if err != nil {
+		return err
+	}
+	replaced, err := bs.columns.Replace(header.Root, mismatched)
+	if err != nil {
+		return err
+	}
+	bs.saved(uint64(len(missing)+len(mismatched)), saved+replaced)
+	for _, entry := range entries {
+		if err := bs.recordRepair(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bs *BlobRetriever) recordRepair(entry RepairEntry) error {
+	entry.Time = time.Now().UTC()
+	bs.logger.Info().Uint64("slot", entry.Slot).Str("root", entry.Root).Str("kind", entry.Kind).Uint64("index", entry.Index).Str("action", entry.Action).Str("reason", entry.Reason).Msg("Sidecar repaired")
+	if bs.repairLog == nil {
+		return nil
+	}
+	return bs.repairLog.Write(entry)
+}
+
+// verifyRemoteSidecar checks that a sidecar fetched for a block belongs to it and carries valid proofs.
+func verifyRemoteSidecar(header *apiv1.BeaconBlockHeader, denebSidecar *deneb.BlobSidecar) error {
+	sidecar := storage.ConvSideCar(denebSidecar)
+	root, err := sidecar.SignedBlockHeader.Header.HashTreeRoot()
+	if err != nil {
+		return err
+	}
+	if root != header.Root {
+		return fmt.Errorf("sidecar belongs to block %#x", root)
+	}
+	return storage.VerifySidecar(sidecar)
+}
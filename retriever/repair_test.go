@@ -0,0 +1,69 @@
+package retriever
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apiv1 "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/attestantio/go-eth2-client/spec/deneb"
+	"github.com/rabbitprincess/blob-retriever/internal/testutil"
+	"github.com/rabbitprincess/blob-retriever/storage"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepairBlob(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.NewArchiveBlobStorage(zerolog.Nop(), filepath.Join(dir, "blobs"), 6, storage.StoreOptions{Compression: storage.CompressionZstd, Dedup: true})
+	require.NoError(t, err)
+	root, sidecars := testutil.NewVerifiedSidecars(t, 9000100, 3)
+
+	// index 0 is intact, index 1 differs and index 2 is missing
+	_, err = store.Save(root, sidecars[0])
+	require.NoError(t, err)
+	corrupted := *sidecars[1]
+	corrupted.Blob[31] ^= 1
+	_, err = store.Save(root, &corrupted)
+	require.NoError(t, err)
+
+	logPath := filepath.Join(dir, "repair.log")
+	repairLog, err := OpenRepairLog(logPath)
+	require.NoError(t, err)
+	bs := &BlobRetriever{cfg: &Config{StorageType: "archive"}, logger: zerolog.Nop(), storage: store, repairLog: repairLog}
+	header := &apiv1.BeaconBlockHeader{Root: root}
+	require.NoError(t, bs.RepairBlob(context.Background(), 9000100, header, sidecars))
+	require.NoError(t, repairLog.Close())
+
+	for _, sidecar := range sidecars {
+		valid, err := store.Valid(root, sidecar)
+		require.NoError(t, err)
+		require.True(t, valid)
+	}
+	file, err := os.Open(logPath)
+	require.NoError(t, err)
+	defer file.Close()
+	var entries []RepairEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry RepairEntry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	require.Len(t, entries, 2)
+	require.Equal(t, uint64(1), entries[0].Index)
+	require.Equal(t, RepairReplaced, entries[0].Action)
+	require.Equal(t, uint64(2), entries[1].Index)
+	require.Equal(t, RepairFilled, entries[1].Action)
+	report := bs.stats.report("repair", 9000100, 9000100, time.Now())
+	require.Equal(t, uint64(2), report.SidecarsSaved)
+	require.Equal(t, uint64(1), report.SidecarsPresent)
+	require.Equal(t, uint64(1), report.Mismatches)
+
+	// a remote copy which fails verification is not written
+	require.Error(t, bs.RepairBlob(context.Background(), 9000100, header, []*deneb.BlobSidecar{&corrupted}))
+}
@@ -0,0 +1,214 @@
+package retriever
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Failure reasons counted in the run report.
+const (
+	FailureFetch        = "fetch"
+	FailureTooManyBlobs = "too_many_blobs"
+	FailureSave         = "save"
+	FailureCheck        = "check"
+	FailureRepair       = "repair"
+)
+
+// RunReport summarizes a run of the retriever. Bytes written counts the bytes the store wrote for the saved
+// sidecars, after compression and deduplication.
+type RunReport struct {
+	Mode               string            `json:"mode"`
+	FromSlot           uint64            `json:"from_slot"`
+	ToSlot             uint64            `json:"to_slot"`
+	StartedAt          time.Time         `json:"started_at"`
+	DurationSeconds    float64           `json:"duration_seconds"`
+	Interrupted        bool              `json:"interrupted"`
+	SlotsScanned       uint64            `json:"slots_scanned"`
+	EmptySlots         uint64            `json:"empty_slots"`
+	BlocksWithoutBlobs uint64            `json:"blocks_without_blobs"`
+	SidecarsSaved      uint64            `json:"sidecars_saved"`
+	SidecarsPresent    uint64            `json:"sidecars_present"`
+	Mismatches         uint64            `json:"mismatches"`
+	BytesWritten       uint64            `json:"bytes_written"`
+	Failures           map[string]uint64 `json:"failures"`
+}
+
+// FailureCount returns the number of failed slots over all reasons.
+func (r *RunReport) FailureCount() uint64 {
+	var count uint64
+	for _, n := range r.Failures {
+		count += n
+	}
+	return count
+}
+
+// WriteFile writes the report as CSV if path ends with .csv, and as JSON otherwise.
+// The CSV file has a metric and a value column, with failures as failures.<reason>.
+func (r *RunReport) WriteFile(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if filepath.Ext(path) != ".csv" {
+		enc := json.NewEncoder(file)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+
+	w := csv.NewWriter(file)
+	records := [][]string{
+		{"metric", "value"},
+		{"mode", r.Mode},
+		{"from_slot", strconv.FormatUint(r.FromSlot, 10)},
+		{"to_slot", strconv.FormatUint(r.ToSlot, 10)},
+		{"started_at", r.StartedAt.Format(time.RFC3339)},
+		{"duration_seconds", strconv.FormatFloat(r.DurationSeconds, 'f', 3, 64)},
+		{"interrupted", strconv.FormatBool(r.Interrupted)},
+		{"slots_scanned", strconv.FormatUint(r.SlotsScanned, 10)},
+		{"empty_slots", strconv.FormatUint(r.EmptySlots, 10)},
+		{"blocks_without_blobs", strconv.FormatUint(r.BlocksWithoutBlobs, 10)},
+		{"sidecars_saved", strconv.FormatUint(r.SidecarsSaved, 10)},
+		{"sidecars_present", strconv.FormatUint(r.SidecarsPresent, 10)},
+		{"mismatches", strconv.FormatUint(r.Mismatches, 10)},
+		{"bytes_written", strconv.FormatUint(r.BytesWritten, 10)},
+	}
+	reasons := make([]string, 0, len(r.Failures))
+	for reason := range r.Failures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		records = append(records, []string{"failures." + reason, strconv.FormatUint(r.Failures[reason], 10)})
+	}
+	if err := w.WriteAll(records); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// FailedSlot is a slot whose last attempt in a run failed.
+type FailedSlot struct {
+	Slot   uint64 `json:"slot"`
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+// runStats counts the outcomes of a run from its workers.
+type runStats struct {
+	slotsScanned       atomic.Uint64
+	emptySlots         atomic.Uint64
+	blocksWithoutBlobs atomic.Uint64
+	sidecarsSaved      atomic.Uint64
+	sidecarsPresent    atomic.Uint64
+	mismatches         atomic.Uint64
+	bytesWritten       atomic.Uint64
+
+	mu     sync.Mutex
+	failed map[uint64]FailedSlot
+}
+
+func (s *runStats) reset() {
+	s.slotsScanned.Store(0)
+	s.emptySlots.Store(0)
+	s.blocksWithoutBlobs.Store(0)
+	s.sidecarsSaved.Store(0)
+	s.sidecarsPresent.Store(0)
+	s.mismatches.Store(0)
+	s.bytesWritten.Store(0)
+	s.mu.Lock()
+	s.failed = nil
+	s.mu.Unlock()
+}
+
+func (s *runStats) saved(sidecars, bytes uint64) {
+	s.sidecarsSaved.Add(sidecars)
+	s.bytesWritten.Add(bytes)
+}
+
+func (s *runStats) fail(slot uint64, reason string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed == nil {
+		s.failed = make(map[uint64]FailedSlot)
+	}
+	failed := FailedSlot{Slot: slot, Reason: reason}
+	if err != nil {
+		failed.Error = err.Error()
+	}
+	s.failed[slot] = failed
+}
+
+// retry forgets the failures of the slots which are run again and returns the ones of the slots which had failed.
+func (s *runStats) retry(slots []uint64) []FailedSlot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var retried []FailedSlot
+	for _, slot := range slots {
+		if failed, ok := s.failed[slot]; ok {
+			delete(s.failed, slot)
+			retried = append(retried, failed)
+		}
+	}
+	return retried
+}
+
+// restore records failures again which were forgotten by retry.
+func (s *runStats) restore(failures []FailedSlot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, failed := range failures {
+		if _, ok := s.failed[failed.Slot]; !ok {
+			s.failed[failed.Slot] = failed
+		}
+	}
+}
+
+// failedSlots returns the failed slots in ascending order.
+func (s *runStats) failedSlots() []FailedSlot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failed := make([]FailedSlot, 0, len(s.failed))
+	for _, slot := range s.failed {
+		failed = append(failed, slot)
+	}
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Slot < failed[j].Slot })
+	return failed
+}
+
+func (s *runStats) failedCount() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return uint64(len(s.failed))
+}
+
+func (s *runStats) report(mode string, fromSlot, toSlot uint64, startedAt time.Time) *RunReport {
+	s.mu.Lock()
+	failures := make(map[string]uint64)
+	for _, failed := range s.failed {
+		failures[failed.Reason]++
+	}
+	s.mu.Unlock()
+	return &RunReport{
+		Mode:               mode,
+		FromSlot:           fromSlot,
+		ToSlot:             toSlot,
+		StartedAt:          startedAt.UTC(),
+		DurationSeconds:    time.Since(startedAt).Seconds(),
+		SlotsScanned:       s.slotsScanned.Load(),
+		EmptySlots:         s.emptySlots.Load(),
+		BlocksWithoutBlobs: s.blocksWithoutBlobs.Load(),
+		SidecarsSaved:      s.sidecarsSaved.Load(),
+		SidecarsPresent:    s.sidecarsPresent.Load(),
+		Mismatches:         s.mismatches.Load(),
+		BytesWritten:       s.bytesWritten.Load(),
+		Failures:           failures,
+	}
+}
@@ -0,0 +1,67 @@
+package retriever
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apiv1 "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/attestantio/go-eth2-client/spec/deneb"
+	"github.com/rabbitprincess/blob-retriever/internal/testutil"
+	"github.com/rabbitprincess/blob-retriever/storage"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunReport(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.NewArchiveBlobStorage(zerolog.Nop(), filepath.Join(dir, "blobs"), 6, storage.StoreOptions{Compression: storage.CompressionZstd})
+	require.NoError(t, err)
+	root, sidecars := testutil.NewVerifiedSidecars(t, 9000100, 2)
+	bs := &BlobRetriever{cfg: &Config{StorageType: "archive"}, logger: zerolog.Nop(), storage: store}
+	header := &apiv1.BeaconBlockHeader{Root: root}
+
+	require.NoError(t, bs.RestoreBlob(context.Background(), 9000100, header, sidecars))
+	require.NoError(t, bs.RestoreBlob(context.Background(), 9000100, header, sidecars))
+	corrupted := *sidecars[1]
+	corrupted.Blob[31] ^= 1
+	require.NoError(t, bs.CheckBlob(context.Background(), 9000100, header, sidecars[:1]))
+	require.NoError(t, bs.CheckBlob(context.Background(), 9000100, header, []*deneb.BlobSidecar{&corrupted}))
+	bs.stats.fail(9000101, FailureFetch, nil)
+	bs.stats.fail(9000102, FailureFetch, nil)
+	bs.stats.fail(9000103, FailureSave, nil)
+
+	report := bs.stats.report("retrieve", 9000100, 9000101, time.Now())
+	require.Equal(t, uint64(2), report.SidecarsSaved)
+	require.Equal(t, uint64(3), report.SidecarsPresent)
+	require.Equal(t, uint64(1), report.Mismatches)
+	// bytes written are the compressed size the store wrote
+	require.Equal(t, store.Stats().StoredBytes, report.BytesWritten)
+	require.Less(t, report.BytesWritten, 2*uint64(storage.SidecarSize))
+	require.Equal(t, uint64(3), report.FailureCount())
+
+	jsonPath := filepath.Join(dir, "run.json")
+	require.NoError(t, report.WriteFile(jsonPath))
+	data, err := os.ReadFile(jsonPath)
+	require.NoError(t, err)
+	var decoded RunReport
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	require.Equal(t, report.SidecarsSaved, decoded.SidecarsSaved)
+	require.Equal(t, report.Failures, decoded.Failures)
+
+	csvPath := filepath.Join(dir, "run.csv")
+	require.NoError(t, report.WriteFile(csvPath))
+	file, err := os.Open(csvPath)
+	require.NoError(t, err)
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, []string{"metric", "value"}, records[0])
+	require.Contains(t, records, []string{"sidecars_saved", "2"})
+	require.Equal(t, []string{"failures.fetch", "2"}, records[len(records)-2])
+	require.Equal(t, []string{"failures.save", "1"}, records[len(records)-1])
+}
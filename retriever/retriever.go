@@ -1,152 +1,701 @@
-package retriever
-
-import (
-	"context"
-	"fmt"
-	"strconv"
-	"time"
-
-	"github.com/attestantio/go-eth2-client/api"
-	apiv1 "github.com/attestantio/go-eth2-client/api/v1"
-	"github.com/attestantio/go-eth2-client/spec/deneb"
-	"github.com/avast/retry-go"
-	"github.com/gammazero/workerpool"
-	"github.com/rabbitprincess/blob-retriever/storage"
-	"github.com/rs/zerolog"
-)
-
-type BlobRetriever struct {
-	cfg     *Config
-	logger  zerolog.Logger
-	wp      *workerpool.WorkerPool
-	client  BeaconClient
-	storage storage.BlobStore
-}
-
-// NewBlobRetriever
-func NewBlobRetriever(ctx context.Context, log zerolog.Logger, cfg *Config) *BlobRetriever {
-	wp := workerpool.New(int(cfg.NumWorker))
-	client, err := NewBeaconClient(ctx, cfg.BeaconApiUrl, cfg.BeaconApiType, cfg.Timeout)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to create beacon client")
-		return nil
-	}
-	storage, err := storage.NewPrysmBlobStorage(log, cfg.StoragePath)
-	if err != nil {
-		log.Panic().Err(err).Msg("Failed to create blob storage")
-		return nil
-	}
-	return &BlobRetriever{
-		cfg:     cfg,
-		logger:  log,
-		wp:      wp,
-		client:  client,
-		storage: storage,
-	}
-}
-
-func (bs *BlobRetriever) Run(ctx context.Context, mode string, fromSlot, toSlot uint64) error {
-	if toSlot < fromSlot {
-		bs.logger.Warn().Uint64("toSlot", toSlot).Uint64("fromSlot", fromSlot).Msg("toSlot is less than fromSlot, set toSlot to fromSlot")
-		toSlot = fromSlot
-	}
-
-	for slot := fromSlot; slot <= toSlot; slot++ {
-		bs.wp.Submit(func() {
-			header, sidecars, err := bs.GetV1BlobFromApi(ctx, slot)
-			if err != nil {
-				bs.logger.Panic().Uint64("slot", slot).Err(err).Msg("Failed to get blob from block.")
-				return
-			}
-			// check empty block and sidecar
-			if header == nil {
-				bs.logger.Info().Uint64("slot", slot).Msg("block not exist in slot, continue...")
-				return
-			} else if len(sidecars) == 0 {
-				bs.logger.Info().Uint64("slot", slot).Str("root", header.Root.String()).Msg("blob sidecars not exist, continue...")
-				return
-			}
-
-			switch mode {
-			case "retrieve":
-				if err := bs.RestoreBlob(ctx, slot, header, sidecars); err != nil {
-					bs.logger.Panic().Uint64("slot", slot).Str("root", header.Root.String()).Err(err).Msg("Failed to restore blob")
-				}
-			case "check":
-				if err := bs.CheckBlob(ctx, slot, header, sidecars); err != nil {
-					bs.logger.Panic().Uint64("slot", slot).Str("root", header.Root.String()).Err(err).Msg("Failed to check blob sidecar")
-				}
-			default:
-				bs.logger.Panic().Str("mode", mode).Msg("Unknown mode. Only support 'retrieve' or 'check' mode")
-			}
-		})
-	}
-	bs.wp.StopWait()
-	bs.logger.Info().Uint64("fromSlot", fromSlot).Uint64("toSlot", toSlot).Msg("All tasks are done")
-	return nil
-}
-
-func (bs *BlobRetriever) RestoreBlob(ctx context.Context, slot uint64, header *apiv1.BeaconBlockHeader, sidecars []*deneb.BlobSidecar) error {
-	if bs.storage.Exist(header.Root) {
-		bs.logger.Info().Uint64("slot", slot).Str("root", header.Root.String()).Msg("Blob already exists in storage, continue...")
-		return nil
-	}
-
-	for _, sidecar := range sidecars {
-		if err := bs.storage.Save(header.Root, sidecar); err != nil {
-			bs.logger.Error().Uint64("slot", slot).Str("root", header.Root.String()).Err(err).Msg("Failed to save blob sidecar")
-			return err
-		}
-		bs.logger.Info().Uint64("slot", slot).Str("root", header.Root.String()).Uint64("index", uint64(sidecar.Index)).Msg("Blob sidecar saved")
-	}
-	return nil
-}
-
-func (bs *BlobRetriever) CheckBlob(ctx context.Context, slot uint64, header *apiv1.BeaconBlockHeader, sidecars []*deneb.BlobSidecar) error {
-	for _, sidecar := range sidecars {
-		valid, err := bs.storage.Valid(header.Root, sidecar)
-		if err != nil {
-			return err
-		}
-		if !valid {
-			err = fmt.Errorf("Blob sidecar is not valid")
-			bs.logger.Error().Err(err).Uint64("slot", slot).Str("root", header.Root.String()).Uint64("index", uint64(sidecar.Index)).Msg("Blob sidecar is not valid")
-			return err
-		}
-		bs.logger.Info().Uint64("slot", slot).Str("root", header.Root.String()).Uint64("index", uint64(sidecar.Index)).Msg("Blob sidecar is valid")
-	}
-	return nil
-}
-
-func (bs *BlobRetriever) GetV1BlobFromApi(ctx context.Context, slot uint64) (*apiv1.BeaconBlockHeader, []*deneb.BlobSidecar, error) {
-	var header *apiv1.BeaconBlockHeader
-	var sidecars []*deneb.BlobSidecar
-	err := retry.Do(func() error {
-		res, err := bs.client.BeaconBlockHeader(ctx, &api.BeaconBlockHeaderOpts{
-			Block: strconv.FormatUint(slot, 10),
-		})
-		if err != nil {
-			if apiErr, ok := err.(*api.Error); ok && apiErr.StatusCode == 404 {
-				return nil
-			}
-			return err
-		}
-		header = res.Data
-
-		if !res.Data.Root.IsZero() {
-			blobSideCars, err := bs.client.BlobSidecars(ctx, &api.BlobSidecarsOpts{
-				Block: header.Root.String(),
-			})
-			if err != nil {
-				return err
-			}
-			sidecars = blobSideCars.Data
-		}
-		return nil
-	}, retry.Attempts(5), retry.Delay(200*time.Millisecond))
-	if err != nil {
-		return nil, nil, err
-	}
-
-	return header, sidecars, nil
-}
+package retriever
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/attestantio/go-eth2-client/api"
+	apiv1 "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/attestantio/go-eth2-client/spec/deneb"
+	"github.com/avast/retry-go"
+	"github.com/gammazero/workerpool"
+	"github.com/rabbitprincess/blob-retriever/jobs"
+	"github.com/rabbitprincess/blob-retriever/storage"
+	"github.com/rs/zerolog"
+)
+
+type BlobRetriever struct {
+	cfg       *Config
+	logger    zerolog.Logger
+	wp        *workerpool.WorkerPool
+	control   *runControl
+	queue     *jobs.Queue
+	client    BeaconClient
+	source    BlobSource
+	storage   storage.BlobStore
+	guard     *storage.SpaceGuard
+	repairLog *RepairLog
+
+	// columns is the column store of the store at storagePath, opened by the first run reaching fulu.
+	columnSource *ColumnSource
+	columns      storage.ColumnStore
+	storagePath  string
+
+	// awaitingSpace is set while a run paused at a space limit waits for space to be freed.
+	awaitingSpace atomic.Bool
+
+	// stats counts the outcomes of the slots of a run, summarized in report once it finished.
+	stats  runStats
+	report *RunReport
+
+	progress runProgress
+	metrics  *Metrics
+
+	// slots, blobSlots and blobs count the slots processed by a run, the ones carrying blobs and their blobs,
+	// and savedBlobs and savedBytes the sidecars saved and the bytes they took, to project the space the rest
+	// of the range needs.
+	slots      atomic.Uint64
+	blobSlots  atomic.Uint64
+	blobs      atomic.Uint64
+	savedBlobs atomic.Uint64
+	savedBytes atomic.Uint64
+}
+
+const (
+	// projectionInterval is the number of processed slots between space projections.
+	projectionInterval = 1000
+
+	// spaceCheckInterval is the time between checks for freed space while a run is paused at a space limit.
+	spaceCheckInterval = 30 * time.Second
+
+	// fetchAttempts is the number of times the sidecars of a slot are requested before the slot fails.
+	fetchAttempts = 5
+)
+
+// NewBlobRetriever
+func NewBlobRetriever(ctx context.Context, log zerolog.Logger, cfg *Config) *BlobRetriever {
+	// workers are limited by the run control, which can resize a run up to maxWorkers
+	wp := workerpool.New(maxWorkers)
+	client, err := NewBeaconClientFromConfig(ctx, log, cfg)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create beacon client")
+		return nil
+	}
+	source, err := NewBlobSource(client, cfg)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create blob source")
+		return nil
+	}
+	blobStorage, err := storage.NewBlobStore(log, cfg.StorageType, cfg.StoragePath, cfg.Network.MaxBlobsPerBlockLimit(), cfg.StoreOptions())
+	if err != nil {
+		log.Panic().Err(err).Msg("Failed to create blob storage")
+		return nil
+	}
+	bs := &BlobRetriever{
+		cfg:     cfg,
+		logger:  log,
+		wp:      wp,
+		control: newRunControl(int(cfg.NumWorker)),
+		client:  client,
+		source:  source,
+		storage: blobStorage,
+	}
+	bs.storagePath = cfg.StoragePath
+	bs.metrics = newMetrics(bs)
+	bs.guard, err = newSpaceGuard(cfg, cfg.StoragePath)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create space guard")
+		return nil
+	}
+	if cfg.Network.FuluForkEpoch != math.MaxUint64 {
+		bs.columnSource = NewColumnSource(cfg.BeaconApiUrl, cfg.Network.NumberOfColumns, cfg.Timeout)
+	}
+	return bs
+}
+
+// openColumns opens the column store of the store at storagePath, unless it is open already.
+func (bs *BlobRetriever) openColumns() error {
+	if bs.columns != nil {
+		return nil
+	}
+	columns, err := storage.NewPrysmColumnStorage(bs.logger, storage.ColumnDir(bs.storagePath, bs.cfg.SharedNode), bs.cfg.ColumnLayout(), storage.WithSharedNode(bs.cfg.SharedNode))
+	if err != nil {
+		return fmt.Errorf("failed to create column storage: %w", err)
+	}
+	bs.columns = columns
+	return nil
+}
+
+// Close closes the blob store and the column store, so they record a clean shutdown and persist their indices.
+func (bs *BlobRetriever) Close() error {
+	var err error
+	for _, store := range []any{bs.storage, bs.columns} {
+		if closer, ok := store.(io.Closer); ok {
+			if closeErr := closer.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+// checkRetention refuses a range starting before the retention window of a shared beacon node, which ends at its
+// head: the node's pruner would remove the restored sidecars soon after they are written.
+func (bs *BlobRetriever) checkRetention(ctx context.Context, fromSlot uint64) error {
+	head, err := HeadSlot(ctx, bs.client)
+	if err != nil {
+		return fmt.Errorf("failed to get the head to check the retention window of the shared node: %w", err)
+	}
+	epochs := bs.cfg.NodeRetentionEpochs
+	if epochs == 0 {
+		epochs = bs.cfg.Network.MinEpochsForBlobSidecarsRequests
+	}
+	headEpoch := bs.cfg.Network.SlotToEpoch(head)
+	if headEpoch <= epochs {
+		return nil
+	}
+	firstSlot := (headEpoch - epochs) * bs.cfg.Network.SlotsPerEpoch
+	if fromSlot < firstSlot {
+		return fmt.Errorf("from slot %d is before slot %d, outside the %d epochs the shared node retains blobs for; raise its --blob-retention-epochs and set --node_retention_epochs to match", fromSlot, firstSlot, epochs)
+	}
+	return nil
+}
+
+// newSpaceGuard returns a guard of the store at path, or nil without space limits. The data columns directory is
+// inside the store, except for a shared node once fulu is scheduled, whose columns directory is guarded too.
+func newSpaceGuard(cfg *Config, path string) (*storage.SpaceGuard, error) {
+	if cfg.SpaceLimits == (storage.SpaceLimits{}) {
+		return nil, nil
+	}
+	var others []string
+	if cfg.SharedNode && cfg.Network.FuluForkEpoch != math.MaxUint64 {
+		others = append(others, storage.ColumnDir(path, true))
+	}
+	return storage.NewSpaceGuard(path, cfg.SpaceLimits, others...)
+}
+
+// Metrics returns the Prometheus metrics of the retriever.
+func (bs *BlobRetriever) Metrics() *Metrics {
+	return bs.metrics
+}
+
+// Storage returns the store sidecars are saved to.
+func (bs *BlobRetriever) Storage() storage.BlobStore {
+	return bs.storage
+}
+
+func (bs *BlobRetriever) Run(ctx context.Context, mode string, fromSlot, toSlot uint64) error {
+	if denebSlot := bs.cfg.Network.DenebForkSlot(); fromSlot < denebSlot {
+		return fmt.Errorf("from slot %d is before the %s deneb fork slot %d", fromSlot, bs.cfg.Network.ConfigName, denebSlot)
+	}
+	if toSlot < fromSlot {
+		bs.logger.Warn().Uint64("toSlot", toSlot).Uint64("fromSlot", fromSlot).Msg("toSlot is less than fromSlot, set toSlot to fromSlot")
+		toSlot = fromSlot
+	}
+
+	switch mode {
+	case "retrieve", "check", "repair":
+	default:
+		return fmt.Errorf("unknown mode %s. Only support 'retrieve', 'check' or 'repair' mode", mode)
+	}
+
+	if bs.cfg.SharedNode && mode != "check" {
+		if err := bs.checkRetention(ctx, fromSlot); err != nil {
+			return err
+		}
+	}
+
+	// the column store is only opened by a range reaching fulu
+	if toSlot >= bs.cfg.Network.FuluForkSlot() {
+		if err := bs.openColumns(); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if mode == "retrieve" {
+		bs.logSpace(fromSlot, toSlot)
+	}
+	if mode == "repair" && bs.cfg.RepairLogPath != "" {
+		repairLog, err := OpenRepairLog(bs.cfg.RepairLogPath)
+		if err != nil {
+			return err
+		}
+		bs.repairLog = repairLog
+		defer func() {
+			repairLog.Close()
+			bs.repairLog = nil
+		}()
+	}
+
+	bs.slots.Store(0)
+	bs.blobSlots.Store(0)
+	bs.blobs.Store(0)
+	bs.savedBlobs.Store(0)
+	bs.savedBytes.Store(0)
+	bs.stats.reset()
+	bs.progress.start(fromSlot, toSlot)
+	startedAt := time.Now()
+	progressCtx, stopProgress := context.WithCancel(ctx)
+	defer stopProgress()
+	progressDone := make(chan struct{})
+	go func() {
+		defer close(progressDone)
+		if bs.cfg.ProgressInterval > 0 {
+			out := bs.cfg.ProgressOutput
+			if out == nil {
+				out = NewProgressWriter(io.Discard, os.Stderr)
+			}
+			bs.reportProgress(progressCtx, bs.cfg.ProgressInterval, out)
+		}
+	}()
+	fuluSlot := bs.cfg.Network.FuluForkSlot()
+	bs.control.start(mode, fromSlot, toSlot)
+	stopWake := context.AfterFunc(ctx, bs.control.wake)
+	defer stopWake()
+	var wg sync.WaitGroup
+	for {
+		slot, ok := bs.control.take(ctx)
+		if !ok {
+			break
+		}
+		wg.Add(1)
+		bs.wp.Submit(func() {
+			defer wg.Done()
+			defer bs.control.done()
+			if ctx.Err() != nil {
+				return
+			}
+			bs.stats.slotsScanned.Add(1)
+			var outcome string
+			if slot >= fuluSlot {
+				outcome = bs.runColumns(ctx, mode, slot)
+			} else {
+				outcome = bs.runBlobs(ctx, mode, slot, fromSlot, toSlot)
+			}
+			bs.metrics.slot(outcome)
+			switch outcome {
+			case OutcomeRequeued, OutcomeCancelled:
+				// the slot runs again, later in this run or when the run is resumed from the cursor
+			case OutcomeFailed:
+				bs.progress.fail()
+			default:
+				bs.progress.complete(slot)
+			}
+		})
+	}
+	wg.Wait()
+	bs.progress.finish()
+	stopProgress()
+	<-progressDone
+	bs.report = bs.stats.report(mode, fromSlot, toSlot, startedAt)
+	bs.report.Interrupted = ctx.Err() != nil
+	bs.logger.Info().Uint64("slotsScanned", bs.report.SlotsScanned).Uint64("sidecarsSaved", bs.report.SidecarsSaved).Uint64("sidecarsPresent", bs.report.SidecarsPresent).Uint64("mismatches", bs.report.Mismatches).Uint64("failures", bs.report.FailureCount()).Float64("seconds", bs.report.DurationSeconds).Msg("Run report")
+	if bs.report.Interrupted {
+		return fmt.Errorf("run interrupted: %w", ctx.Err())
+	}
+	if failures := bs.report.FailureCount(); failures > 0 {
+		return fmt.Errorf("%d slots failed", failures)
+	}
+	if mode == "check" && bs.report.Mismatches > 0 {
+		return fmt.Errorf("%d sidecars are not valid", bs.report.Mismatches)
+	}
+	bs.logger.Info().Uint64("fromSlot", fromSlot).Uint64("toSlot", toSlot).Msg("All tasks are done")
+	if archive, ok := bs.storage.(*storage.ArchiveBlobStorage); ok {
+		stats := archive.Stats()
+		bs.logger.Info().Str("compression", stats.Compression).Uint64("rawBytes", stats.RawBytes).Uint64("storedBytes", stats.StoredBytes).Float64("ratio", stats.Ratio()).Uint64("dedupedBlobs", stats.DedupedBlobs).Msg("Archive stats")
+	}
+	return nil
+}
+
+// Report returns the report of the last run, or nil before a run finished.
+func (bs *BlobRetriever) Report() *RunReport {
+	return bs.report
+}
+
+// runBlobs retrieves, checks or repairs the blob sidecars of a slot before fulu.
+func (bs *BlobRetriever) runBlobs(ctx context.Context, mode string, slot, fromSlot, toSlot uint64) string {
+	header, sidecars, err := bs.GetV1BlobFromApi(ctx, slot)
+	if ctx.Err() != nil {
+		return OutcomeCancelled
+	} else if err != nil {
+		bs.logger.Error().Uint64("slot", slot).Err(err).Msg("Failed to get blob from block.")
+		bs.stats.fail(slot, FailureFetch, err)
+		return OutcomeFailed
+	}
+	if mode == "retrieve" {
+		bs.project(fromSlot, toSlot, len(sidecars))
+	}
+	// check empty block and sidecar
+	if header == nil {
+		bs.logger.Info().Uint64("slot", slot).Msg("block not exist in slot, continue...")
+		bs.stats.emptySlots.Add(1)
+		return OutcomeEmpty
+	} else if len(sidecars) == 0 {
+		bs.logger.Info().Uint64("slot", slot).Str("root", header.Root.String()).Msg("blob sidecars not exist, continue...")
+		bs.stats.blocksWithoutBlobs.Add(1)
+		return OutcomeNoBlobs
+	} else if uint64(len(sidecars)) > bs.cfg.Network.MaxBlobsPerBlockAtSlot(slot) {
+		bs.logger.Error().Uint64("slot", slot).Str("root", header.Root.String()).Int("count", len(sidecars)).Msg("Too many blob sidecars for the network")
+		bs.stats.fail(slot, FailureTooManyBlobs, nil)
+		return OutcomeFailed
+	}
+
+	switch mode {
+	case "retrieve":
+		if err := bs.RestoreBlob(ctx, slot, header, sidecars); errors.Is(err, storage.ErrSpaceLimit) {
+			bs.pauseForSpace(ctx, slot, err)
+			return OutcomeRequeued
+		} else if err != nil {
+			bs.logger.Error().Uint64("slot", slot).Str("root", header.Root.String()).Err(err).Msg("Failed to restore blob")
+			bs.stats.fail(slot, FailureSave, err)
+			return OutcomeFailed
+		}
+	case "check":
+		if err := bs.CheckBlob(ctx, slot, header, sidecars); err != nil {
+			bs.logger.Error().Uint64("slot", slot).Str("root", header.Root.String()).Err(err).Msg("Failed to check blob sidecar")
+			bs.stats.fail(slot, FailureCheck, err)
+			return OutcomeFailed
+		}
+	case "repair":
+		if err := bs.RepairBlob(ctx, slot, header, sidecars); err != nil {
+			bs.logger.Error().Uint64("slot", slot).Str("root", header.Root.String()).Err(err).Msg("Failed to repair blob sidecars")
+			bs.stats.fail(slot, FailureRepair, err)
+			return OutcomeFailed
+		}
+	}
+	return OutcomeDone
+}
+
+func (bs *BlobRetriever) RestoreBlob(ctx context.Context, slot uint64, header *apiv1.BeaconBlockHeader, sidecars []*deneb.BlobSidecar) error {
+	if bs.storage.Exist(header.Root) {
+		bs.logger.Info().Uint64("slot", slot).Str("root", header.Root.String()).Msg("Blob already exists in storage, continue...")
+		bs.stats.sidecarsPresent.Add(uint64(len(sidecars)))
+		return nil
+	}
+
+	// the SSZ size is reserved as the most the sidecars can take and settled to the bytes the store wrote
+	reserved := uint64(len(sidecars)) * storage.SidecarSize
+	if bs.guard != nil {
+		if err := bs.guard.Reserve(reserved); err != nil {
+			return err
+		}
+	}
+	var total uint64
+	defer func() {
+		if bs.guard != nil {
+			bs.guard.Settle(reserved, total)
+		}
+	}()
+	for _, sidecar := range sidecars {
+		written, err := bs.storage.Save(header.Root, sidecar)
+		if err != nil {
+			bs.logger.Error().Uint64("slot", slot).Str("root", header.Root.String()).Err(err).Msg("Failed to save blob sidecar")
+			return err
+		}
+		if written == 0 {
+			bs.stats.sidecarsPresent.Add(1)
+			continue
+		}
+		total += written
+		bs.savedBlobs.Add(1)
+		bs.savedBytes.Add(written)
+		bs.saved(1, written)
+		bs.logger.Info().Uint64("slot", slot).Str("root", header.Root.String()).Uint64("index", uint64(sidecar.Index)).Msg("Blob sidecar saved")
+	}
+	return nil
+}
+
+// CheckBlob compares the stored sidecars of a block with the remote ones. Sidecars which differ are logged and
+// counted as mismatches, an error is only returned when a stored sidecar can not be read.
+func (bs *BlobRetriever) CheckBlob(ctx context.Context, slot uint64, header *apiv1.BeaconBlockHeader, sidecars []*deneb.BlobSidecar) error {
+	for _, sidecar := range sidecars {
+		valid, err := bs.storage.Valid(header.Root, sidecar)
+		if err != nil {
+			return err
+		}
+		if !valid {
+			bs.logger.Error().Uint64("slot", slot).Str("root", header.Root.String()).Uint64("index", uint64(sidecar.Index)).Msg("Blob sidecar is not valid")
+			bs.stats.mismatches.Add(1)
+			continue
+		}
+		bs.stats.sidecarsPresent.Add(1)
+		bs.logger.Info().Uint64("slot", slot).Str("root", header.Root.String()).Uint64("index", uint64(sidecar.Index)).Msg("Blob sidecar is valid")
+	}
+	return nil
+}
+
+func (bs *BlobRetriever) GetV1BlobFromApi(ctx context.Context, slot uint64) (*apiv1.BeaconBlockHeader, []*deneb.BlobSidecar, error) {
+	var header *apiv1.BeaconBlockHeader
+	var sidecars []*deneb.BlobSidecar
+	// endpoint is the one the last attempt failed on, for counting retries
+	var endpoint string
+	err := retry.Do(func() error {
+		endpoint = endpointBlockHeader
+		start := time.Now()
+		res, err := bs.client.BeaconBlockHeader(ctx, &api.BeaconBlockHeaderOpts{
+			Block: strconv.FormatUint(slot, 10),
+		})
+		bs.metrics.observe(endpointBlockHeader, start)
+		if err != nil {
+			if apiErr, ok := err.(*api.Error); ok && apiErr.StatusCode == 404 {
+				return nil
+			}
+			return err
+		}
+		header = res.Data
+
+		if !res.Data.Root.IsZero() {
+			endpoint = endpointBlobSidecars
+			start = time.Now()
+			sidecars, err = bs.source.BlobSidecars(ctx, header)
+			bs.metrics.observe(endpointBlobSidecars, start)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}, retry.Context(ctx), retry.Attempts(fetchAttempts), retry.Delay(200*time.Millisecond), retry.OnRetry(func(n uint, err error) {
+		if n+1 < fetchAttempts {
+			bs.metrics.retry(endpoint)
+		}
+	}))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return header, sidecars, nil
+}
+
+// saved counts sidecars saved with the bytes the store wrote for them.
+func (bs *BlobRetriever) saved(sidecars, bytes uint64) {
+	bs.stats.saved(sidecars, bytes)
+	bs.metrics.saved(bytes)
+}
+
+// pauseForSpace requeues a slot which would cross a space limit and pauses the run. Running slots finish, and the
+// run resumes once enough space for a full block is freed, or when resumed through the admin API.
+func (bs *BlobRetriever) pauseForSpace(ctx context.Context, slot uint64, err error) {
+	if err := bs.control.requeue([]uint64{slot}); err != nil {
+		bs.logger.Error().Uint64("slot", slot).Err(err).Msg("Failed to requeue slot")
+	}
+	if err := bs.control.setPaused(true); err != nil {
+		return
+	}
+	if !bs.awaitingSpace.CompareAndSwap(false, true) {
+		return
+	}
+	bs.logger.Warn().Uint64("slot", slot).Err(err).Msg("Pausing blob retriever until space is freed")
+	go bs.awaitSpace(ctx, bs.guard)
+}
+
+// awaitSpace resumes a run paused at a space limit once a full block fits again. It returns without resuming if
+// the run ends or was resumed otherwise.
+func (bs *BlobRetriever) awaitSpace(ctx context.Context, guard *storage.SpaceGuard) {
+	defer bs.awaitingSpace.Store(false)
+	needed := bs.cfg.Network.MaxBlobsPerBlockLimit() * storage.SidecarSize
+	ticker := time.NewTicker(spaceCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if state := bs.control.state(); !state.Running || !state.Paused {
+			return
+		}
+		if err := guard.Refresh(); err != nil {
+			bs.logger.Warn().Err(err).Msg("Failed to measure store size")
+			continue
+		}
+		available, _, err := guard.Available()
+		if err != nil {
+			bs.logger.Warn().Err(err).Msg("Failed to read available space")
+			continue
+		}
+		if available >= needed {
+			bs.logger.Info().Uint64("availableBytes", available).Msg("Space freed, resuming blob retriever")
+			bs.control.setPaused(false)
+			return
+		}
+	}
+}
+
+// logSpace logs the space available under the limits and the most the range can take.
+func (bs *BlobRetriever) logSpace(fromSlot, toSlot uint64) {
+	if bs.guard == nil {
+		return
+	}
+	available, _, err := bs.guard.Available()
+	if err != nil {
+		bs.logger.Warn().Err(err).Msg("Failed to read available space")
+		return
+	}
+	worstCase := (toSlot - fromSlot + 1) * bs.cfg.Network.MaxBlobsPerBlockLimit() * storage.SidecarSize
+	bs.logger.Info().Uint64("availableBytes", available).Uint64("worstCaseBytes", worstCase).Msg("Space limits")
+}
+
+// project counts a processed slot and, every projectionInterval slots, logs the space the rest of the range
+// needs: the blob-bearing slots projected at the rate seen so far, times their average blob count, times the bytes
+// a saved blob took so far, or the SSZ size of a sidecar before one was saved.
+func (bs *BlobRetriever) project(fromSlot, toSlot uint64, blobs int) {
+	if blobs > 0 {
+		bs.blobSlots.Add(1)
+		bs.blobs.Add(uint64(blobs))
+	}
+	slots := bs.slots.Add(1)
+	if slots%projectionInterval != 0 {
+		return
+	}
+	total := toSlot - fromSlot + 1
+	remaining := total - min(slots, total)
+	blobSlots := bs.blobSlots.Load()
+	projectedSlots := blobSlots * remaining / slots
+	var projected uint64
+	if blobSlots > 0 {
+		blobSize := uint64(storage.SidecarSize)
+		if savedBlobs := bs.savedBlobs.Load(); savedBlobs > 0 {
+			blobSize = bs.savedBytes.Load() / savedBlobs
+		}
+		projected = projectedSlots * bs.blobs.Load() / blobSlots * blobSize
+	}
+	log := bs.logger.Info()
+	if bs.guard != nil {
+		if available, limited, err := bs.guard.Available(); err == nil && limited {
+			if projected > available {
+				log = bs.logger.Warn()
+			}
+			log = log.Uint64("availableBytes", available)
+		}
+	}
+	log.Uint64("slots", slots).Uint64("blobSlots", blobSlots).Uint64("projectedBlobSlots", projectedSlots).Uint64("projectedBytes", projected).Msg("Projected space for remaining slots")
+}
+
+// runColumns retrieves, checks or repairs the data column sidecars of a fulu slot.
+func (bs *BlobRetriever) runColumns(ctx context.Context, mode string, slot uint64) string {
+	header, sidecars, err := bs.GetColumnsFromApi(ctx, slot)
+	if ctx.Err() != nil {
+		return OutcomeCancelled
+	} else if err != nil {
+		bs.logger.Error().Uint64("slot", slot).Err(err).Msg("Failed to get data columns from block.")
+		bs.stats.fail(slot, FailureFetch, err)
+		return OutcomeFailed
+	}
+	if header == nil {
+		bs.logger.Info().Uint64("slot", slot).Msg("block not exist in slot, continue...")
+		bs.stats.emptySlots.Add(1)
+		return OutcomeEmpty
+	} else if len(sidecars) == 0 {
+		bs.logger.Info().Uint64("slot", slot).Str("root", header.Root.String()).Msg("data column sidecars not exist, continue...")
+		bs.stats.blocksWithoutBlobs.Add(1)
+		return OutcomeNoBlobs
+	}
+
+	switch mode {
+	case "retrieve":
+		if err := bs.RestoreColumns(ctx, slot, header, sidecars); errors.Is(err, storage.ErrSpaceLimit) {
+			bs.pauseForSpace(ctx, slot, err)
+			return OutcomeRequeued
+		} else if err != nil {
+			bs.logger.Error().Uint64("slot", slot).Str("root", header.Root.String()).Err(err).Msg("Failed to restore data columns")
+			bs.stats.fail(slot, FailureSave, err)
+			return OutcomeFailed
+		}
+	case "check":
+		if err := bs.CheckColumns(ctx, slot, header, sidecars); err != nil {
+			bs.logger.Error().Uint64("slot", slot).Str("root", header.Root.String()).Err(err).Msg("Failed to check data column sidecar")
+			bs.stats.fail(slot, FailureCheck, err)
+			return OutcomeFailed
+		}
+	case "repair":
+		if err := bs.RepairColumns(ctx, slot, header, sidecars); err != nil {
+			bs.logger.Error().Uint64("slot", slot).Str("root", header.Root.String()).Err(err).Msg("Failed to repair data column sidecars")
+			bs.stats.fail(slot, FailureRepair, err)
+			return OutcomeFailed
+		}
+	}
+	return OutcomeDone
+}
+
+func (bs *BlobRetriever) RestoreColumns(ctx context.Context, slot uint64, header *apiv1.BeaconBlockHeader, sidecars []*storage.DataColumnSidecar) error {
+	var size uint64
+	for _, sidecar := range sidecars {
+		size += uint64(len(sidecar.Raw))
+	}
+	if bs.guard != nil {
+		if err := bs.guard.Reserve(size); err != nil {
+			return err
+		}
+	}
+	written, err := bs.columns.Save(header.Root, sidecars)
+	if bs.guard != nil {
+		bs.guard.Settle(size, written)
+	}
+	if err != nil {
+		bs.logger.Error().Uint64("slot", slot).Str("root", header.Root.String()).Err(err).Msg("Failed to save data column sidecars")
+		return err
+	}
+	bs.saved(uint64(len(sidecars)), written)
+	bs.logger.Info().Uint64("slot", slot).Str("root", header.Root.String()).Int("count", len(sidecars)).Msg("Data column sidecars saved")
+	return nil
+}
+
+// CheckColumns compares the stored data column sidecars of a block with the remote ones, as CheckBlob does for blobs.
+func (bs *BlobRetriever) CheckColumns(ctx context.Context, slot uint64, header *apiv1.BeaconBlockHeader, sidecars []*storage.DataColumnSidecar) error {
+	for _, sidecar := range sidecars {
+		valid, err := bs.columns.Valid(header.Root, sidecar)
+		if err != nil {
+			return err
+		}
+		if !valid {
+			bs.logger.Error().Uint64("slot", slot).Str("root", header.Root.String()).Uint64("index", sidecar.Index).Msg("Data column sidecar is not valid")
+			bs.stats.mismatches.Add(1)
+			continue
+		}
+		bs.stats.sidecarsPresent.Add(1)
+	}
+	bs.logger.Info().Uint64("slot", slot).Str("root", header.Root.String()).Int("count", len(sidecars)).Msg("Data column sidecars checked")
+	return nil
+}
+
+func (bs *BlobRetriever) GetColumnsFromApi(ctx context.Context, slot uint64) (*apiv1.BeaconBlockHeader, []*storage.DataColumnSidecar, error) {
+	var header *apiv1.BeaconBlockHeader
+	var sidecars []*storage.DataColumnSidecar
+	// endpoint is the one the last attempt failed on, for counting retries
+	var endpoint string
+	err := retry.Do(func() error {
+		endpoint = endpointBlockHeader
+		start := time.Now()
+		res, err := bs.client.BeaconBlockHeader(ctx, &api.BeaconBlockHeaderOpts{
+			Block: strconv.FormatUint(slot, 10),
+		})
+		bs.metrics.observe(endpointBlockHeader, start)
+		if err != nil {
+			if apiErr, ok := err.(*api.Error); ok && apiErr.StatusCode == 404 {
+				return nil
+			}
+			return err
+		}
+		header = res.Data
+
+		if !res.Data.Root.IsZero() {
+			endpoint = endpointDataColumnSidecars
+			start = time.Now()
+			sidecars, err = bs.columnSource.DataColumnSidecars(ctx, header)
+			bs.metrics.observe(endpointDataColumnSidecars, start)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}, retry.Context(ctx), retry.Attempts(fetchAttempts), retry.Delay(200*time.Millisecond), retry.OnRetry(func(n uint, err error) {
+		if n+1 < fetchAttempts {
+			bs.metrics.retry(endpoint)
+		}
+	}))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return header, sidecars, nil
+}
@@ -0,0 +1,82 @@
+package retriever
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	apiv1 "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/gammazero/workerpool"
+	"github.com/rabbitprincess/blob-retriever/internal/testutil"
+	"github.com/rabbitprincess/blob-retriever/params"
+	"github.com/rabbitprincess/blob-retriever/storage"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreBlobSpace(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.NewArchiveBlobStorage(zerolog.Nop(), filepath.Join(dir, "blobs"), 6, storage.StoreOptions{Compression: storage.CompressionZstd})
+	require.NoError(t, err)
+	defer store.Close()
+	limit := uint64(4 * storage.SidecarSize)
+	guard, err := storage.NewSpaceGuard(filepath.Join(dir, "blobs"), storage.SpaceLimits{MaxStoreBytes: limit})
+	require.NoError(t, err)
+	bs := &BlobRetriever{
+		cfg:     &Config{Network: params.MainnetConfig()},
+		logger:  zerolog.Nop(),
+		control: newRunControl(1),
+		storage: store,
+		guard:   guard,
+	}
+
+	// the reservation is settled to the compressed size written
+	before, _, err := guard.Available()
+	require.NoError(t, err)
+	root, sidecars := testutil.NewVerifiedSidecars(t, 9000400, 3)
+	require.NoError(t, bs.RestoreBlob(context.Background(), 9000400, &apiv1.BeaconBlockHeader{Root: root}, sidecars))
+	available, limited, err := guard.Available()
+	require.NoError(t, err)
+	require.True(t, limited)
+	require.Greater(t, available, before-3*storage.SidecarSize)
+	require.Equal(t, before-bs.savedBytes.Load(), available)
+
+	// a block crossing the limit is requeued and pauses the run
+	bs.control.start("retrieve", 9000401, 9000410)
+	root, sidecars = testutil.NewVerifiedSidecars(t, 9000401, 4)
+	err = bs.RestoreBlob(context.Background(), 9000401, &apiv1.BeaconBlockHeader{Root: root}, sidecars)
+	require.ErrorIs(t, err, storage.ErrSpaceLimit)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	bs.pauseForSpace(ctx, 9000401, err)
+	state := bs.control.state()
+	require.True(t, state.Paused)
+	require.Equal(t, uint64(11), state.Queued)
+	require.False(t, store.Exist(root))
+}
+
+func TestRunOpensColumnsAtFulu(t *testing.T) {
+	dir := t.TempDir()
+	network := params.MainnetConfig()
+	bs := &BlobRetriever{
+		cfg:         &Config{Network: network, StorageType: "prysm", StoragePath: dir},
+		logger:      zerolog.Nop(),
+		wp:          workerpool.New(maxWorkers),
+		control:     newRunControl(2),
+		client:      &slotBeaconClient{},
+		source:      &gatedSource{},
+		storagePath: dir,
+	}
+
+	// a range before fulu leaves the column store closed
+	from := network.DenebForkSlot()
+	require.NoError(t, bs.Run(context.Background(), "check", from, from+4))
+	require.Nil(t, bs.columns)
+	require.NoDirExists(t, filepath.Join(dir, "data-columns"))
+
+	// the column store is kept inside the store
+	require.NoError(t, bs.openColumns())
+	require.NotNil(t, bs.columns)
+	require.DirExists(t, filepath.Join(dir, "data-columns"))
+	require.NoError(t, bs.Close())
+}
@@ -0,0 +1,208 @@
+package retriever
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rabbitprincess/blob-retriever/lease"
+)
+
+var (
+	// leasePollInterval is the interval at which an idle worker asks the coordinator for a lease again.
+	leasePollInterval = 5 * time.Second
+
+	// coordinatorTimeout is the time a worker keeps trying to reach an unreachable coordinator before it stops.
+	coordinatorTimeout = time.Minute
+
+	// errLeaseToken is returned by the lease client when the coordinator refuses its lease token.
+	errLeaseToken = errors.New("missing or invalid lease token")
+)
+
+// leaseClient calls the lease API of a coordinator on behalf of a worker.
+type leaseClient struct {
+	url    string
+	worker string
+	token  string
+	client *http.Client
+}
+
+func newLeaseClient(url, worker, token string) *leaseClient {
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	return &leaseClient{url: strings.TrimSuffix(url, "/"), worker: worker, token: token, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// claim claims a lease. It returns lease.ErrNoLease while every unfinished lease is held by another worker and
+// lease.ErrFinished once all of them are finished.
+func (c *leaseClient) claim(ctx context.Context) (lease.Lease, error) {
+	return c.post(ctx, "/leases/claim", leaseRequest{Worker: c.worker})
+}
+
+// renew extends a lease and reports its cursor. It returns lease.ErrLost if the lease was handed to another worker.
+func (c *leaseClient) renew(ctx context.Context, id, cursor uint64) (lease.Lease, error) {
+	return c.post(ctx, fmt.Sprintf("/leases/%d/renew", id), leaseRequest{Worker: c.worker, Cursor: cursor})
+}
+
+func (c *leaseClient) release(ctx context.Context, id uint64) (lease.Lease, error) {
+	return c.post(ctx, fmt.Sprintf("/leases/%d/release", id), leaseRequest{Worker: c.worker})
+}
+
+func (c *leaseClient) complete(ctx context.Context, id, cursor uint64, runErr error) (lease.Lease, error) {
+	req := leaseRequest{Worker: c.worker, Cursor: cursor}
+	if runErr != nil {
+		req.Error = runErr.Error()
+	}
+	return c.post(ctx, fmt.Sprintf("/leases/%d/complete", id), req)
+}
+
+func (c *leaseClient) post(ctx context.Context, path string, body leaseRequest) (lease.Lease, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return lease.Lease{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+path, bytes.NewReader(data))
+	if err != nil {
+		return lease.Lease{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return lease.Lease{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var l lease.Lease
+		if err := json.NewDecoder(resp.Body).Decode(&l); err != nil {
+			return lease.Lease{}, fmt.Errorf("failed to decode lease: %w", err)
+		}
+		return l, nil
+	case http.StatusNoContent:
+		return lease.Lease{}, lease.ErrNoLease
+	case http.StatusGone:
+		return lease.Lease{}, lease.ErrFinished
+	case http.StatusConflict:
+		return lease.Lease{}, lease.ErrLost
+	case http.StatusUnauthorized:
+		return lease.Lease{}, errLeaseToken
+	}
+	var apiErr struct {
+		Message string `json:"message"`
+	}
+	json.NewDecoder(resp.Body).Decode(&apiErr)
+	return lease.Lease{}, fmt.Errorf("coordinator answered %s with status %d: %s", path, resp.StatusCode, apiErr.Message)
+}
+
+// RunWorker claims leases from the coordinator at url and runs them against the store of the retriever, until every
+// lease is finished or ctx is done. A lease is renewed while it runs, and one interrupted by the end of ctx is
+// released, so the coordinator hands it to another worker. A run whose lease expired is stopped. Requests carry the
+// lease token of the config.
+func (bs *BlobRetriever) RunWorker(ctx context.Context, url, worker string) error {
+	client := newLeaseClient(url, worker, bs.cfg.LeaseToken)
+	log := bs.logger.With().Str("worker", worker).Logger()
+	var unreachableSince time.Time
+	for {
+		l, err := client.claim(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case errors.Is(err, lease.ErrFinished):
+			log.Info().Msg("All leases are finished")
+			return nil
+		case errors.Is(err, lease.ErrNoLease):
+			unreachableSince = time.Time{}
+		case errors.Is(err, errLeaseToken):
+			return fmt.Errorf("coordinator %s refused the worker: %w", url, err)
+		case err != nil:
+			if unreachableSince.IsZero() {
+				unreachableSince = time.Now()
+			} else if time.Since(unreachableSince) > coordinatorTimeout {
+				return fmt.Errorf("coordinator %s unreachable: %w", url, err)
+			}
+			log.Warn().Err(err).Str("coordinator", url).Msg("Failed to claim lease")
+		default:
+			unreachableSince = time.Time{}
+			bs.runLease(ctx, client, l)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(leasePollInterval):
+		}
+	}
+}
+
+// runLease runs the slots of a lease, renewing it at a third of its ttl, and reports the outcome to the coordinator.
+func (bs *BlobRetriever) runLease(ctx context.Context, client *leaseClient, l lease.Lease) {
+	log := bs.logger.With().Str("worker", client.worker).Uint64("lease", l.ID).Logger()
+	log.Info().Str("mode", l.Mode).Uint64("fromSlot", l.FromSlot).Uint64("toSlot", l.ToSlot).Uint64("cursor", l.Cursor).Msg("Running lease")
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the progress is started before the run, so the cursor renewed before the run started is the lease's. The
+	// cursor is past the first slot only for a lease handed out again on a shared store.
+	bs.progress.start(l.Cursor, l.ToSlot)
+	interval := max(time.Until(*l.ExpiresAt)/3, 10*time.Millisecond)
+	var lost atomic.Bool
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-runCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			_, err := client.renew(runCtx, l.ID, bs.progress.snapshot().Cursor)
+			if errors.Is(err, lease.ErrLost) {
+				log.Warn().Msg("Lease expired and was handed out again, stopping its run")
+				lost.Store(true)
+				cancel()
+				return
+			} else if err != nil && runCtx.Err() == nil {
+				log.Warn().Err(err).Msg("Failed to renew lease")
+			}
+		}
+	}()
+	runErr := bs.Run(runCtx, l.Mode, l.Cursor, l.ToSlot)
+	cancel()
+	<-renewed
+
+	if lost.Load() {
+		return
+	}
+	// the coordinator is told even when ctx is done, so the lease does not wait for its ttl to be handed out again
+	reportCtx, cancelReport := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelReport()
+	if ctx.Err() != nil {
+		if _, err := client.release(reportCtx, l.ID); err != nil {
+			log.Error().Err(err).Msg("Failed to release lease")
+		} else {
+			log.Info().Msg("Lease released")
+		}
+		return
+	}
+	cursor := bs.progress.snapshot().Cursor
+	if runErr != nil {
+		log.Error().Err(runErr).Msg("Lease failed")
+	} else {
+		log.Info().Msg("Lease done")
+	}
+	if _, err := client.complete(reportCtx, l.ID, cursor, runErr); err != nil {
+		log.Error().Err(err).Msg("Failed to complete lease")
+	}
+}
@@ -0,0 +1,77 @@
+package retriever
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gammazero/workerpool"
+	"github.com/rabbitprincess/blob-retriever/lease"
+	"github.com/rabbitprincess/blob-retriever/params"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunWorker(t *testing.T) {
+	leasePollInterval = 10 * time.Millisecond
+	network := params.MainnetConfig()
+	from := network.DenebForkSlot()
+	c, err := lease.Open(filepath.Join(t.TempDir(), "leases.json"), lease.Plan{Mode: "check", FromSlot: from, ToSlot: from + 39, Slots: 10}, 300*time.Millisecond)
+	require.NoError(t, err)
+	srv := httptest.NewServer(CoordinatorHandler(zerolog.Nop(), c, "secret"))
+	defer srv.Close()
+	post := func(path, body string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// workers without the token are refused
+	resp, err := http.Post(srv.URL+"/leases/claim", "application/json", strings.NewReader(`{"worker": "gone"}`))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// a worker which claims the first lease and never renews it
+	require.Equal(t, http.StatusOK, post("/leases/claim", `{"worker": "gone"}`).StatusCode)
+
+	done := make(chan error)
+	for _, worker := range []string{"a", "b"} {
+		bs := &BlobRetriever{
+			cfg:     &Config{Network: network, LeaseToken: "secret"},
+			logger:  zerolog.Nop(),
+			wp:      workerpool.New(maxWorkers),
+			control: newRunControl(2),
+			client:  &slotBeaconClient{},
+			source:  &gatedSource{},
+		}
+		go func() {
+			done <- bs.RunWorker(context.Background(), srv.URL, worker)
+		}()
+	}
+	for range 2 {
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("workers did not finish")
+		}
+	}
+
+	leases := c.List()
+	require.Len(t, leases, 4)
+	for _, l := range leases {
+		require.Equal(t, lease.StateDone, l.State)
+		require.Contains(t, []string{"a", "b"}, l.Worker)
+		require.Equal(t, l.ToSlot+1, l.Cursor)
+	}
+
+	require.Equal(t, http.StatusConflict, post("/leases/1/complete", `{"worker": "gone"}`).StatusCode)
+	require.Equal(t, http.StatusGone, post("/leases/claim", `{"worker": "a"}`).StatusCode)
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"fmt"
+
+	ethpb "github.com/prysmaticlabs/prysm/v5/proto/prysm/v1alpha1"
+	"github.com/rabbitprincess/blob-retriever/storage"
+)
+
+// Blob is a blob looked up by versioned hash. The fields of the Blobscan API are kept,
+// so the archive can be used as a blobscan source by other retrievers.
+type Blob struct {
+	VersionedHash string `json:"versionedHash"`
+	Commitment    string `json:"commitment"`
+	Proof         string `json:"proof"`
+	Data          string `json:"data"`
+	Slot          uint64 `json:"slot"`
+	BlockRoot     string `json:"blockRoot"`
+	Index         uint64 `json:"index"`
+}
+
+// NewBlob returns the lookup result for a stored sidecar.
+func NewBlob(sidecar *ethpb.BlobSidecar) (*Blob, error) {
+	root, err := sidecar.SignedBlockHeader.Header.HashTreeRoot()
+	if err != nil {
+		return nil, err
+	}
+	return &Blob{
+		VersionedHash: fmt.Sprintf("%#x", storage.KzgToVersionedHash(sidecar.KzgCommitment)),
+		Commitment:    fmt.Sprintf("%#x", sidecar.KzgCommitment),
+		Proof:         fmt.Sprintf("%#x", sidecar.KzgProof),
+		Data:          fmt.Sprintf("%#x", sidecar.Blob),
+		Slot:          uint64(sidecar.SignedBlockHeader.Header.Slot),
+		BlockRoot:     fmt.Sprintf("%#x", root),
+		Index:         sidecar.Index,
+	}, nil
+}
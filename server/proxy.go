@@ -0,0 +1,180 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	client "github.com/attestantio/go-eth2-client"
+	"github.com/attestantio/go-eth2-client/api"
+	"github.com/attestantio/go-eth2-client/spec/deneb"
+	"github.com/rabbitprincess/blob-retriever/params"
+	"github.com/rabbitprincess/blob-retriever/storage"
+	"github.com/rs/zerolog"
+)
+
+// Proxy serves blob sidecars from the local store and fetches missing ones from the upstream beacon node,
+// saving them after verification. Every other request is passed through to the upstream node.
+type Proxy struct {
+	*Server
+	store    storage.ReadableBlobStore
+	client   client.BlobSidecarsProvider
+	upstream *httputil.ReverseProxy
+}
+
+// NewProxy returns a proxy in front of the upstream beacon node at upstreamUrl, queried through client.
+func NewProxy(log zerolog.Logger, store storage.ReadableBlobStore, network *params.NetworkConfig, client client.BlobSidecarsProvider, upstreamUrl string) (*Proxy, error) {
+	target, err := url.Parse(upstreamUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream url %s: %w", upstreamUrl, err)
+	}
+	// the upstream node may be behind a virtual host, so requests are sent with its host
+	upstream := &httputil.ReverseProxy{Rewrite: func(r *httputil.ProxyRequest) {
+		r.SetURL(target)
+		r.SetXForwarded()
+	}}
+	p := &Proxy{
+		Server:   NewServer(log, store, network),
+		store:    store,
+		client:   client,
+		upstream: upstream,
+	}
+	p.mux = http.NewServeMux()
+	p.mux.HandleFunc("GET "+BlobSidecarsPath+"{block_id}", p.handleBlobSidecars)
+	p.mux.HandleFunc("GET "+BlobsPath+"{versioned_hash}", p.handleBlob)
+	p.mux.Handle("/", p.upstream)
+	return p, nil
+}
+
+func (p *Proxy) handleBlobSidecars(w http.ResponseWriter, r *http.Request) {
+	indices, err := parseIndices(r.URL.Query()["indices"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	blockId := r.PathValue("block_id")
+	// head moves with the chain, so it is always answered by the upstream node
+	if blockId != "head" {
+		if root, err := p.resolveBlockId(blockId); err == nil {
+			sidecars, err := p.BlobSidecars(root, indices)
+			if err == nil && complete(sidecars, indices) {
+				WriteBlobSidecars(w, r, p.network, sidecars)
+				return
+			}
+			if err == nil {
+				p.log.Debug().Str("root", fmt.Sprintf("%#x", root)).Int("stored", len(sidecars)).Msg("Blob sidecars stored partially, fetching from upstream")
+			} else if !errors.Is(err, errBlockNotFound) {
+				p.log.Error().Err(err).Str("root", fmt.Sprintf("%#x", root)).Msg("Failed to read blob sidecars")
+			}
+		}
+	}
+
+	sidecars, err := p.fetch(r, blockId)
+	if err != nil {
+		var apiErr *api.Error
+		if errors.As(err, &apiErr) && apiErr.StatusCode != 0 {
+			writeError(w, apiErr.StatusCode, apiErr.Error())
+			return
+		}
+		p.log.Error().Err(err).Str("block_id", blockId).Msg("Failed to fetch blob sidecars from upstream")
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	filtered := sidecars
+	if len(indices) > 0 {
+		filtered = make([]*deneb.BlobSidecar, 0, len(sidecars))
+		for _, sidecar := range sidecars {
+			if containsIndex(indices, uint64(sidecar.Index)) {
+				filtered = append(filtered, sidecar)
+			}
+		}
+	}
+	WriteBlobSidecars(w, r, p.network, filtered)
+}
+
+// fetch fetches all sidecars of the block from upstream, verifies them and saves them to the store.
+func (p *Proxy) fetch(r *http.Request, blockId string) ([]*deneb.BlobSidecar, error) {
+	res, err := p.client.BlobSidecars(r.Context(), &api.BlobSidecarsOpts{Block: blockId})
+	if err != nil {
+		return nil, err
+	}
+	sidecars := res.Data
+	if len(sidecars) == 0 {
+		return sidecars, nil
+	}
+
+	root, err := sidecars[0].SignedBlockHeader.Message.HashTreeRoot()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBlockId(blockId, root, uint64(sidecars[0].SignedBlockHeader.Message.Slot)); err != nil {
+		return nil, err
+	}
+	for _, sidecar := range sidecars {
+		sidecarRoot, err := sidecar.SignedBlockHeader.Message.HashTreeRoot()
+		if err != nil {
+			return nil, err
+		}
+		if sidecarRoot != root {
+			return nil, fmt.Errorf("blob sidecar %d belongs to block %#x, expected %#x", sidecar.Index, sidecarRoot, root)
+		}
+		if err := storage.VerifySidecar(storage.ConvSideCar(sidecar)); err != nil {
+			return nil, fmt.Errorf("invalid blob sidecar %d: %w", sidecar.Index, err)
+		}
+	}
+	for _, sidecar := range sidecars {
+		if _, err := p.store.Save(root, sidecar); err != nil {
+			return nil, fmt.Errorf("failed to save blob sidecar %d: %w", sidecar.Index, err)
+		}
+	}
+	p.log.Info().Str("block_id", blockId).Str("root", fmt.Sprintf("%#x", root)).Int("count", len(sidecars)).Msg("Blob sidecars fetched from upstream and saved")
+	return sidecars, nil
+}
+
+// complete reports whether the stored sidecars answer the request: every requested index is stored, or without
+// indices, the stored ones run from 0 without a gap. Missing sidecars at the end of a block can not be told from a
+// block with fewer blobs without fetching the block, so such a block is still served from the store.
+func complete(sidecars []*deneb.BlobSidecar, indices []uint64) bool {
+	if len(indices) == 0 {
+		for i, sidecar := range sidecars {
+			if uint64(sidecar.Index) != uint64(i) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, index := range indices {
+		found := false
+		for _, sidecar := range sidecars {
+			found = found || uint64(sidecar.Index) == index
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// checkBlockId checks that the upstream sidecars belong to the requested block, as far as the block id tells:
+// a root must match the block root, and a slot the block slot.
+func checkBlockId(blockId string, root [32]byte, slot uint64) error {
+	if strings.HasPrefix(blockId, "0x") {
+		var expected [32]byte
+		if err := storage.DecodeHex(blockId, expected[:]); err != nil {
+			return fmt.Errorf("invalid block id %s", blockId)
+		}
+		if root != expected {
+			return fmt.Errorf("upstream blob sidecars belong to block %#x, expected %#x", root, expected)
+		}
+		return nil
+	}
+	if expected, err := strconv.ParseUint(blockId, 10, 64); err == nil && slot != expected {
+		return fmt.Errorf("upstream blob sidecars belong to slot %d, expected %d", slot, expected)
+	}
+	return nil
+}
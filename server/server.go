@@ -0,0 +1,255 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/attestantio/go-eth2-client/spec/deneb"
+	"github.com/rabbitprincess/blob-retriever/params"
+	"github.com/rabbitprincess/blob-retriever/storage"
+	"github.com/rs/zerolog"
+)
+
+const (
+	BlobSidecarsPath = "/eth/v1/beacon/blob_sidecars/"
+	BlobsPath        = "/blobs/"
+
+	shutdownTimeout = 5 * time.Second
+)
+
+var errBlockNotFound = errors.New("block not found")
+
+// Server exposes the stored blob sidecars through the beacon API.
+type Server struct {
+	log     zerolog.Logger
+	store   storage.BlobReader
+	network *params.NetworkConfig
+	mux     *http.ServeMux
+}
+
+// NewServer returns a server reading sidecars from store.
+func NewServer(log zerolog.Logger, store storage.BlobReader, network *params.NetworkConfig) *Server {
+	s := &Server{
+		log:     log,
+		store:   store,
+		network: network,
+		mux:     http.NewServeMux(),
+	}
+	s.mux.HandleFunc("GET "+BlobSidecarsPath+"{block_id}", s.handleBlobSidecars)
+	s.mux.HandleFunc("GET "+BlobsPath+"{versioned_hash}", s.handleBlob)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves on addr until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	srv := &http.Server{Addr: addr, Handler: s}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			s.log.Error().Err(err).Msg("Failed to shut down server")
+		}
+	}()
+	s.log.Info().Str("addr", addr).Msg("Serving blob sidecars")
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) handleBlobSidecars(w http.ResponseWriter, r *http.Request) {
+	indices, err := parseIndices(r.URL.Query()["indices"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	root, err := s.resolveBlockId(r.PathValue("block_id"))
+	if err != nil {
+		if errors.Is(err, errBlockNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+		} else {
+			writeError(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+
+	sidecars, err := s.BlobSidecars(root, indices)
+	if err != nil {
+		if errors.Is(err, errBlockNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		s.log.Error().Err(err).Str("root", fmt.Sprintf("%#x", root)).Msg("Failed to read blob sidecars")
+		writeError(w, http.StatusInternalServerError, "failed to read blob sidecars")
+		return
+	}
+	WriteBlobSidecars(w, r, s.network, sidecars)
+}
+
+func (s *Server) handleBlob(w http.ResponseWriter, r *http.Request) {
+	var hash [32]byte
+	if err := storage.DecodeHex(r.PathValue("versioned_hash"), hash[:]); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid versioned hash: %s", err))
+		return
+	}
+	sidecar, err := s.store.GetByVersionedHash(hash)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			writeError(w, http.StatusNotFound, "blob not found")
+			return
+		}
+		s.log.Error().Err(err).Str("versioned_hash", fmt.Sprintf("%#x", hash)).Msg("Failed to read blob")
+		writeError(w, http.StatusInternalServerError, "failed to read blob")
+		return
+	}
+	blob, err := NewBlob(sidecar)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to encode blob")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blob)
+}
+
+// BlobSidecars returns the stored sidecars of the block, restricted to indices if given.
+func (s *Server) BlobSidecars(root [32]byte, indices []uint64) ([]*deneb.BlobSidecar, error) {
+	mask, err := s.store.Indices(root)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, ok := range mask {
+		found = found || ok
+	}
+	if !found {
+		return nil, errBlockNotFound
+	}
+
+	sidecars := make([]*deneb.BlobSidecar, 0, len(mask))
+	for i, ok := range mask {
+		if !ok || (len(indices) > 0 && !containsIndex(indices, uint64(i))) {
+			continue
+		}
+		sidecar, err := s.store.Get(root, uint64(i))
+		if err != nil {
+			return nil, err
+		}
+		sidecars = append(sidecars, storage.ConvDenebSideCar(sidecar))
+	}
+	return sidecars, nil
+}
+
+// resolveBlockId resolves a block id of the beacon API to a stored block root.
+// Only roots, slots and head can be resolved, as the store holds no chain state.
+func (s *Server) resolveBlockId(blockId string) ([32]byte, error) {
+	var root [32]byte
+	if strings.HasPrefix(blockId, "0x") {
+		if err := storage.DecodeHex(blockId, root[:]); err != nil {
+			return root, fmt.Errorf("invalid block id %s", blockId)
+		}
+		return root, nil
+	}
+
+	index, err := s.store.SlotIndex()
+	if err != nil {
+		return root, err
+	}
+	switch blockId {
+	case "head":
+		_, root, ok := index.Head()
+		if !ok {
+			return root, errBlockNotFound
+		}
+		return root, nil
+	case "genesis", "finalized", "justified":
+		return root, fmt.Errorf("block id %s is not supported by the archive", blockId)
+	}
+	slot, err := strconv.ParseUint(blockId, 10, 64)
+	if err != nil {
+		return root, fmt.Errorf("invalid block id %s", blockId)
+	}
+	root, ok := index.Root(slot)
+	if !ok {
+		return root, errBlockNotFound
+	}
+	return root, nil
+}
+
+// WriteBlobSidecars writes the sidecars as SSZ if the request accepts it, and as JSON otherwise.
+func WriteBlobSidecars(w http.ResponseWriter, r *http.Request, network *params.NetworkConfig, sidecars []*deneb.BlobSidecar) {
+	if len(sidecars) > 0 {
+		w.Header().Set("Eth-Consensus-Version", network.ForkAtSlot(uint64(sidecars[0].SignedBlockHeader.Message.Slot)))
+	}
+	if strings.Contains(r.Header.Get("Accept"), "application/octet-stream") {
+		var data []byte
+		for _, sidecar := range sidecars {
+			encoded, err := sidecar.MarshalSSZ()
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "failed to encode blob sidecars")
+				return
+			}
+			data = append(data, encoded...)
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Data                []*deneb.BlobSidecar `json:"data"`
+		ExecutionOptimistic bool                 `json:"execution_optimistic"`
+		Finalized           bool                 `json:"finalized"`
+	}{
+		Data:      sidecars,
+		Finalized: true,
+	})
+}
+
+// parseIndices parses the indices query parameter, given repeated or comma separated.
+func parseIndices(values []string) ([]uint64, error) {
+	var indices []uint64
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if part == "" {
+				continue
+			}
+			index, err := strconv.ParseUint(part, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid blob index %s", part)
+			}
+			indices = append(indices, index)
+		}
+	}
+	return indices, nil
+}
+
+func containsIndex(indices []uint64, index uint64) bool {
+	for _, i := range indices {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}{code, message})
+}
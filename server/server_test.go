@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/attestantio/go-eth2-client/api"
+	"github.com/attestantio/go-eth2-client/spec/deneb"
+	"github.com/prysmaticlabs/prysm/v5/consensus-types/primitives"
+	"github.com/rabbitprincess/blob-retriever/internal/testutil"
+	"github.com/rabbitprincess/blob-retriever/params"
+	"github.com/rabbitprincess/blob-retriever/storage"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStore(t *testing.T, slot uint64, root [32]byte, indices ...uint64) *storage.PrysmBlobStorage {
+	store, err := storage.NewPrysmBlobStorage(zerolog.Nop(), t.TempDir(), 6)
+	require.NoError(t, err)
+	for _, index := range indices {
+		sidecar := storage.HydrateBlobSidecar(nil)
+		sidecar.Index = index
+		sidecar.SignedBlockHeader.Header.Slot = primitives.Slot(slot)
+		_, err := store.Save(root, storage.ConvDenebSideCar(sidecar))
+		require.NoError(t, err)
+	}
+	return store
+}
+
+func get(t *testing.T, srv http.Handler, path string, accept string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestServeBlobSidecars(t *testing.T) {
+	root := [32]byte{0xaa}
+	srv := NewServer(zerolog.Nop(), newTestStore(t, 9000000, root, 0, 1, 3), params.MainnetConfig())
+
+	var res struct {
+		Data []*deneb.BlobSidecar `json:"data"`
+	}
+	rec := get(t, srv, BlobSidecarsPath+"9000000", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "deneb", rec.Header().Get("Eth-Consensus-Version"))
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+	require.Len(t, res.Data, 3)
+
+	rec = get(t, srv, fmt.Sprintf("%s%#x?indices=1,3&indices=5", BlobSidecarsPath, root), "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+	require.Len(t, res.Data, 2)
+	require.Equal(t, deneb.BlobIndex(1), res.Data[0].Index)
+	require.Equal(t, deneb.BlobIndex(3), res.Data[1].Index)
+
+	rec = get(t, srv, BlobSidecarsPath+"head?indices=0", "application/octet-stream")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "application/octet-stream", rec.Header().Get("Content-Type"))
+	sidecar := &deneb.BlobSidecar{}
+	require.NoError(t, sidecar.UnmarshalSSZ(rec.Body.Bytes()))
+	require.Equal(t, deneb.BlobIndex(0), sidecar.Index)
+
+	rec = get(t, srv, BlobSidecarsPath+"9000001", "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	rec = get(t, srv, BlobSidecarsPath+"9000000?indices=x", "")
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+type fakeBlobClient struct {
+	sidecars map[string][]*deneb.BlobSidecar
+	calls    int
+}
+
+func (c *fakeBlobClient) BlobSidecars(ctx context.Context, opts *api.BlobSidecarsOpts) (*api.Response[[]*deneb.BlobSidecar], error) {
+	c.calls++
+	sidecars, ok := c.sidecars[opts.Block]
+	if !ok {
+		return nil, &api.Error{StatusCode: http.StatusNotFound}
+	}
+	return &api.Response[[]*deneb.BlobSidecar]{Data: sidecars}, nil
+}
+
+func TestProxy(t *testing.T) {
+	root, sidecars := testutil.NewVerifiedSidecars(t, 9000000, 2)
+	tampered := *sidecars[1]
+	tampered.Blob[100] = 1
+	client := &fakeBlobClient{sidecars: map[string][]*deneb.BlobSidecar{
+		"9000000": sidecars,
+		"9000001": {sidecars[0], &tampered},
+		"9000003": sidecars,
+	}}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	store, err := storage.NewPrysmBlobStorage(zerolog.Nop(), t.TempDir(), 6)
+	require.NoError(t, err)
+	_, err = store.Save(root, sidecars[0])
+	require.NoError(t, err)
+	proxy, err := NewProxy(zerolog.Nop(), store, params.MainnetConfig(), client, upstream.URL)
+	require.NoError(t, err)
+
+	// a partial hit is fetched from upstream, saved and filtered
+	var res struct {
+		Data []*deneb.BlobSidecar `json:"data"`
+	}
+	rec := get(t, proxy, BlobSidecarsPath+"9000000?indices=1", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+	require.Len(t, res.Data, 1)
+	require.Equal(t, deneb.BlobIndex(1), res.Data[0].Index)
+	require.True(t, store.Exist(root))
+	require.Equal(t, 1, client.calls)
+
+	// the block is now served locally, by slot and by root
+	rec = get(t, proxy, BlobSidecarsPath+"9000000", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = get(t, proxy, fmt.Sprintf("%s%#x", BlobSidecarsPath, root), "application/octet-stream")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Len(t, rec.Body.Bytes(), 2*131928)
+	require.Equal(t, 1, client.calls)
+
+	rec = get(t, proxy, BlobSidecarsPath+"9000001", "")
+	require.Equal(t, http.StatusBadGateway, rec.Code)
+	rec = get(t, proxy, BlobSidecarsPath+"9000002", "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	// sidecars of another block than the requested one are rejected
+	rec = get(t, proxy, BlobSidecarsPath+"9000003", "")
+	require.Equal(t, http.StatusBadGateway, rec.Code)
+	require.Contains(t, rec.Body.String(), "expected 9000003")
+
+	// the saved blobs can be looked up by versioned hash
+	hash := storage.KzgToVersionedHash(sidecars[1].KZGCommitment[:])
+	rec = get(t, proxy, fmt.Sprintf("%s%#x", BlobsPath, hash), "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var blob Blob
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&blob))
+	require.Equal(t, fmt.Sprintf("%#x", root), blob.BlockRoot)
+	require.Equal(t, uint64(1), blob.Index)
+	require.Equal(t, fmt.Sprintf("%#x", sidecars[1].Blob), blob.Data)
+	rec = get(t, proxy, fmt.Sprintf("%s%#x", BlobsPath, [32]byte{1}), "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = get(t, proxy, "/eth/v1/node/version", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, strings.TrimPrefix(upstream.URL, "http://")+"/eth/v1/node/version", rec.Body.String())
+}
@@ -0,0 +1,575 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/attestantio/go-eth2-client/spec/deneb"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	fieldparams "github.com/prysmaticlabs/prysm/v5/config/fieldparams"
+	ethpb "github.com/prysmaticlabs/prysm/v5/proto/prysm/v1alpha1"
+	"github.com/rs/zerolog"
+	"github.com/spf13/afero"
+)
+
+const (
+	CompressionNone   = "none"
+	CompressionSnappy = "snappy"
+	CompressionZstd   = "zstd"
+)
+
+// compressionExts lists each codec with the suffix appended to the sidecar file name, in the order files are looked
+// up in. Reads pick the codec from the file name, so a store can hold files written with different settings.
+var compressionExts = []struct {
+	compression string
+	ext         string
+}{
+	{CompressionNone, ""},
+	{CompressionSnappy, ".snappy"},
+	{CompressionZstd, ".zst"},
+}
+
+// compressionExt returns the file name suffix of a codec.
+func compressionExt(compression string) (string, bool) {
+	for _, c := range compressionExts {
+		if c.compression == compression {
+			return c.ext, true
+		}
+	}
+	return "", false
+}
+
+var errUnknownCompression = errors.New("unknown compression")
+
+// NewArchiveBlobStorage returns an archival blob store. It keeps the directory structure of the prysm layout,
+// but sidecar files may be compressed or deduplicated, so the directory can not be used by a beacon node.
+func NewArchiveBlobStorage(log zerolog.Logger, path string, maxBlobsPerBlock uint64, opts StoreOptions) (*ArchiveBlobStorage, error) {
+	if opts.SharedNode {
+		return nil, errors.New("archive storage can not be shared with a beacon node")
+	}
+	compression := opts.Compression
+	if compression == "" {
+		compression = CompressionNone
+	}
+	if _, ok := compressionExt(compression); !ok {
+		return nil, errors.Wrap(errUnknownCompression, compression)
+	}
+	blobStorage, err := NewBlobStorage(append([]BlobStorageOption{
+		WithLogger(log),
+		WithBasePath(path),
+		WithMaxBlobsPerBlock(maxBlobsPerBlock),
+		WithSaveFsync(true),
+	}, opts.blobStorageOptions()...)...)
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+	if err != nil {
+		blobStorage.Close()
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		encoder.Close()
+		blobStorage.Close()
+		return nil, err
+	}
+	a := &ArchiveBlobStorage{
+		blobStorage: blobStorage,
+		compression: compression,
+		dedup:       opts.Dedup,
+		encoder:     encoder,
+		decoder:     decoder,
+	}
+	if err := a.indexes.init(log, a, blobStorage); err != nil {
+		a.closeCodecs()
+		blobStorage.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+var _ BlobStore = &ArchiveBlobStorage{}
+var _ BlobReader = &ArchiveBlobStorage{}
+
+type ArchiveBlobStorage struct {
+	blobStorage *BlobStorage
+	indexes     storeIndexes
+	compression string
+	dedup       bool
+	encoder     *zstd.Encoder
+	decoder     *zstd.Decoder
+	bodiesMu    sync.Mutex
+
+	rawBytes     atomic.Uint64
+	storedBytes  atomic.Uint64
+	dedupedBlobs atomic.Uint64
+}
+
+// ArchiveStats reports the SSZ size of the sidecars saved by this store, the bytes written for them and
+// the number of blob bodies which were already stored.
+type ArchiveStats struct {
+	Compression  string
+	RawBytes     uint64
+	StoredBytes  uint64
+	DedupedBlobs uint64
+}
+
+// Ratio returns the raw size divided by the stored size.
+func (s ArchiveStats) Ratio() float64 {
+	if s.StoredBytes == 0 {
+		return 0
+	}
+	return float64(s.RawBytes) / float64(s.StoredBytes)
+}
+
+func (a *ArchiveBlobStorage) Stats() ArchiveStats {
+	return ArchiveStats{
+		Compression:  a.compression,
+		RawBytes:     a.rawBytes.Load(),
+		StoredBytes:  a.storedBytes.Load(),
+		DedupedBlobs: a.dedupedBlobs.Load(),
+	}
+}
+
+func (a *ArchiveBlobStorage) Exist(root [32]byte) bool {
+	mask, err := a.Indices(root)
+	if err != nil {
+		return false
+	}
+	for _, ok := range mask {
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Save saves a sidecar unless one is stored for its index, and returns the number of bytes written, which are
+// fewer than its SSZ size when compressed or deduplicated.
+func (a *ArchiveBlobStorage) Save(root [32]byte, denebSidecar *deneb.BlobSidecar) (uint64, error) {
+	sidecar := ConvSideCar(denebSidecar)
+	if _, err := a.find(root, sidecar.Index); err == nil {
+		a.blobStorage.log.Debug().Msg("Ignoring a duplicate blob sidecar save attempt")
+		return 0, nil
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	data, err := sidecar.MarshalSSZ()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to serialize sidecar data")
+	} else if len(data) == 0 {
+		return 0, errSidecarEmptySSZData
+	}
+	var written uint64
+	if a.dedup {
+		if written, err = a.saveDeduped(root, sidecar.Index, data); err != nil {
+			return 0, err
+		}
+	} else {
+		encoded, err := a.compress(data)
+		if err != nil {
+			return 0, err
+		}
+		fname := archiveNamer{root: root, index: sidecar.Index, ext: "." + sszExt + a.compressionExt()}
+		if err := a.blobStorage.writeFile(fname.dir(), fname.partPath(fmt.Sprintf("%p", encoded)), fname.path(), encoded); err != nil {
+			return 0, err
+		}
+		written = uint64(len(encoded))
+	}
+	a.storedBytes.Add(written)
+	a.rawBytes.Add(uint64(len(data)))
+	return written, a.indexes.add(root, uint64(sidecar.SignedBlockHeader.Header.Slot), sidecar.Index, sidecar.KzgCommitment)
+}
+
+// Replace saves a sidecar, atomically replacing the file stored for its index. A file written with another
+// compression, or deduplicated differently, is removed after the new one is in place. With deduplication,
+// a stored body which does not match the sidecar is rewritten for every root referring to it. It returns the number
+// of bytes written, including a rewritten body.
+func (a *ArchiveBlobStorage) Replace(root [32]byte, denebSidecar *deneb.BlobSidecar) (uint64, error) {
+	sidecar := ConvSideCar(denebSidecar)
+	old, err := a.find(root, sidecar.Index)
+	if os.IsNotExist(err) {
+		return a.Save(root, denebSidecar)
+	} else if err != nil {
+		return 0, err
+	}
+	oldCommitment, _ := a.Commitment(root, sidecar.Index)
+	var oldMeta []byte
+	if old.meta {
+		if oldMeta, err = afero.ReadFile(a.blobStorage.fs, old.path); err != nil {
+			return 0, err
+		}
+	}
+
+	data, err := sidecar.MarshalSSZ()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to serialize sidecar data")
+	}
+	var fname archiveNamer
+	var written uint64
+	if a.dedup {
+		_, body := splitSidecar(data)
+		repaired, err := a.repairBody(sidecar.KzgCommitment, body)
+		if err != nil {
+			return 0, err
+		}
+		if written, err = a.saveDeduped(root, sidecar.Index, data); err != nil {
+			return 0, err
+		}
+		written += uint64(repaired)
+		fname = archiveNamer{root: root, index: sidecar.Index, ext: "." + metaExt}
+	} else {
+		encoded, err := a.compress(data)
+		if err != nil {
+			return 0, err
+		}
+		fname = archiveNamer{root: root, index: sidecar.Index, ext: "." + sszExt + a.compressionExt()}
+		if err := a.blobStorage.writeFile(fname.dir(), fname.partPath(fmt.Sprintf("%p", encoded)), fname.path(), encoded); err != nil {
+			return 0, err
+		}
+		written = uint64(len(encoded))
+	}
+
+	if old.path != fname.path() {
+		if err := a.blobStorage.fs.Remove(old.path); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	if len(oldMeta) >= metaCommitmentOffset+fieldparams.BLSPubkeyLength {
+		if err := a.releaseBody(oldMeta[metaCommitmentOffset : metaCommitmentOffset+fieldparams.BLSPubkeyLength]); err != nil {
+			return 0, err
+		}
+	}
+	return written, a.indexes.replace(root, uint64(sidecar.SignedBlockHeader.Header.Slot), sidecar.Index, oldCommitment, sidecar.KzgCommitment)
+}
+
+// saveDeduped writes the meta file of a sidecar and its body unless stored, and returns the number of bytes written.
+func (a *ArchiveBlobStorage) saveDeduped(root [32]byte, index uint64, data []byte) (uint64, error) {
+	meta, body := splitSidecar(data)
+	commitment := meta[metaCommitmentOffset : metaCommitmentOffset+fieldparams.BLSPubkeyLength]
+	written, err := a.acquireBody(commitment, body)
+	if err != nil {
+		return 0, err
+	}
+	fname := archiveNamer{root: root, index: index, ext: "." + metaExt}
+	if err := a.blobStorage.writeFile(fname.dir(), fname.partPath(fmt.Sprintf("%p", meta)), fname.path(), meta); err != nil {
+		if releaseErr := a.releaseBody(commitment); releaseErr != nil {
+			a.blobStorage.log.Error().Err(releaseErr).Msg("Failed to release blob body")
+		}
+		return 0, err
+	}
+	if written == 0 {
+		a.dedupedBlobs.Add(1)
+	}
+	return uint64(len(meta) + written), nil
+}
+
+// Remove removes all sidecars of a root, deleting the blob bodies they held the last reference to,
+// and drops them from the indices.
+func (a *ArchiveBlobStorage) Remove(root [32]byte) error {
+	slot, commitments, err := a.indexes.storedSidecars(root)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	mask, err := a.Indices(root)
+	if err != nil {
+		return err
+	}
+	for i, ok := range mask {
+		if !ok {
+			continue
+		}
+		file, err := a.find(root, uint64(i))
+		if err != nil {
+			return err
+		}
+		if !file.meta {
+			continue
+		}
+		meta, err := afero.ReadFile(a.blobStorage.fs, file.path)
+		if err != nil {
+			return err
+		}
+		if err := a.blobStorage.fs.Remove(file.path); err != nil {
+			return err
+		}
+		if err := a.releaseBody(meta[metaCommitmentOffset : metaCommitmentOffset+fieldparams.BLSPubkeyLength]); err != nil {
+			return err
+		}
+	}
+	if err := a.blobStorage.Remove(root); err != nil {
+		return err
+	}
+	return a.indexes.remove(root, slot, commitments)
+}
+
+// Close persists the versioned hash index, stops the zstd codecs and releases the lock on the storage directory.
+func (a *ArchiveBlobStorage) Close() error {
+	a.closeCodecs()
+	if err := a.indexes.close(); err != nil {
+		a.blobStorage.Close()
+		return err
+	}
+	return a.blobStorage.Close()
+}
+
+// closeCodecs stops the goroutines of the zstd encoder and decoder.
+func (a *ArchiveBlobStorage) closeCodecs() {
+	a.encoder.Close()
+	a.decoder.Close()
+}
+
+// Size returns the number of bytes stored for a root, including the blob bodies only it refers to.
+func (a *ArchiveBlobStorage) Size(root [32]byte) (uint64, error) {
+	size, err := dirSize(a.blobStorage.fs, archiveNamer{root: root}.dir())
+	if err != nil {
+		return 0, err
+	}
+	mask, err := a.Indices(root)
+	if err != nil {
+		return 0, err
+	}
+	for i, ok := range mask {
+		if !ok {
+			continue
+		}
+		file, err := a.find(root, uint64(i))
+		if err != nil {
+			return 0, err
+		}
+		if !file.meta {
+			continue
+		}
+		bodySize, err := a.bodySize(file.path)
+		if err != nil {
+			return 0, err
+		}
+		size += bodySize
+	}
+	return size, nil
+}
+
+func (a *ArchiveBlobStorage) RetentionSlots() uint64 {
+	return a.blobStorage.RetentionSlots()
+}
+
+func (a *ArchiveBlobStorage) Get(root [32]byte, index uint64) (*ethpb.BlobSidecar, error) {
+	data, err := a.read(root, index)
+	if err != nil {
+		return nil, err
+	}
+	sidecar := &ethpb.BlobSidecar{}
+	if err := sidecar.UnmarshalSSZ(data); err != nil {
+		return nil, err
+	}
+	return sidecar, nil
+}
+
+func (a *ArchiveBlobStorage) Valid(root [32]byte, denebSidecar *deneb.BlobSidecar) (bool, error) {
+	expected, err := ConvSideCar(denebSidecar).MarshalSSZ()
+	if err != nil {
+		return false, err
+	}
+	stored, err := a.read(root, uint64(denebSidecar.Index))
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(expected, stored), nil
+}
+
+// Indices returns a bitmap of the sidecar indices stored for a root, whatever their compression.
+func (a *ArchiveBlobStorage) Indices(root [32]byte) ([]bool, error) {
+	mask := make([]bool, a.blobStorage.maxBlobsPerBlock)
+	entries, err := afero.ReadDir(a.blobStorage.fs, rootString(root))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return mask, nil
+		}
+		return mask, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		index, ok := parseArchiveName(entry.Name())
+		if !ok {
+			continue
+		}
+		if index >= uint64(len(mask)) {
+			return mask, errIndexOutOfBounds
+		}
+		mask[index] = true
+	}
+	return mask, nil
+}
+
+func (a *ArchiveBlobStorage) Roots() ([][32]byte, error) {
+	return a.blobStorage.Roots()
+}
+
+func (a *ArchiveBlobStorage) Slot(root [32]byte) (uint64, error) {
+	mask, err := a.Indices(root)
+	if err != nil {
+		return 0, err
+	}
+	for i, ok := range mask {
+		if ok {
+			sidecar, err := a.Get(root, uint64(i))
+			if err != nil {
+				return 0, err
+			}
+			return uint64(sidecar.SignedBlockHeader.Header.Slot), nil
+		}
+	}
+	return 0, os.ErrNotExist
+}
+
+func (a *ArchiveBlobStorage) Commitment(root [32]byte, index uint64) ([]byte, error) {
+	sidecar, err := a.Get(root, index)
+	if err != nil {
+		return nil, err
+	}
+	return sidecar.KzgCommitment, nil
+}
+
+// SlotIndex returns the slot index of the store, built from disk on first use and kept up to date by Save.
+func (a *ArchiveBlobStorage) SlotIndex() (*SlotIndex, error) {
+	return a.indexes.slotIndex()
+}
+
+// GetByVersionedHash returns the stored sidecar carrying the blob with the EIP-4844 versioned hash.
+func (a *ArchiveBlobStorage) GetByVersionedHash(hash [32]byte) (*ethpb.BlobSidecar, error) {
+	location, err := a.indexes.locate(hash)
+	if err != nil {
+		return nil, err
+	}
+	return a.Get(location.Root, location.Index)
+}
+
+// read returns the SSZ encoding of a stored sidecar, decompressed and joined with its blob body if deduplicated.
+func (a *ArchiveBlobStorage) read(root [32]byte, index uint64) ([]byte, error) {
+	file, err := a.find(root, index)
+	if err != nil {
+		return nil, err
+	}
+	data, err := afero.ReadFile(a.blobStorage.fs, file.path)
+	if err != nil {
+		return nil, err
+	}
+	if file.meta {
+		if len(data) < metaCommitmentOffset+fieldparams.BLSPubkeyLength {
+			return nil, errors.Errorf("invalid metadata file %s", file.path)
+		}
+		body, err := a.readBody(data[metaCommitmentOffset : metaCommitmentOffset+fieldparams.BLSPubkeyLength])
+		if err != nil {
+			return nil, err
+		}
+		return joinSidecar(data, body), nil
+	}
+	return a.decompress(file.compression, data)
+}
+
+// archiveFile is the file stored for a sidecar, either a whole sidecar in some compression or the metadata
+// of a deduplicated sidecar.
+type archiveFile struct {
+	path        string
+	compression string
+	meta        bool
+}
+
+func (a *ArchiveBlobStorage) find(root [32]byte, index uint64) (archiveFile, error) {
+	metaPath := archiveNamer{root: root, index: index, ext: "." + metaExt}.path()
+	exists, err := afero.Exists(a.blobStorage.fs, metaPath)
+	if err != nil {
+		return archiveFile{}, err
+	}
+	if exists {
+		return archiveFile{path: metaPath, meta: true}, nil
+	}
+	for _, c := range compressionExts {
+		filePath := archiveNamer{root: root, index: index, ext: "." + sszExt + c.ext}.path()
+		exists, err := afero.Exists(a.blobStorage.fs, filePath)
+		if err != nil {
+			return archiveFile{}, err
+		}
+		if exists {
+			return archiveFile{path: filePath, compression: c.compression}, nil
+		}
+	}
+	return archiveFile{}, os.ErrNotExist
+}
+
+// compressionExt returns the file name suffix of the codec new sidecars are written with.
+func (a *ArchiveBlobStorage) compressionExt() string {
+	ext, _ := compressionExt(a.compression)
+	return ext
+}
+
+func (a *ArchiveBlobStorage) compress(data []byte) ([]byte, error) {
+	switch a.compression {
+	case CompressionSnappy:
+		return snappy.Encode(nil, data), nil
+	case CompressionZstd:
+		return a.encoder.EncodeAll(data, nil), nil
+	case CompressionNone:
+		return data, nil
+	}
+	return nil, errors.Wrap(errUnknownCompression, a.compression)
+}
+
+func (a *ArchiveBlobStorage) decompress(compression string, data []byte) ([]byte, error) {
+	switch compression {
+	case CompressionSnappy:
+		return snappy.Decode(nil, data)
+	case CompressionZstd:
+		return a.decoder.DecodeAll(data, nil)
+	case CompressionNone:
+		return data, nil
+	}
+	return nil, errors.Wrap(errUnknownCompression, compression)
+}
+
+type archiveNamer struct {
+	root  [32]byte
+	index uint64
+	ext   string
+}
+
+func (p archiveNamer) dir() string {
+	return rootString(p.root)
+}
+
+func (p archiveNamer) partPath(entropy string) string {
+	return path.Join(p.dir(), fmt.Sprintf("%s-%d.%s", entropy, p.index, partExt))
+}
+
+func (p archiveNamer) path() string {
+	return path.Join(p.dir(), fmt.Sprintf("%d%s", p.index, p.ext))
+}
+
+// parseArchiveName returns the sidecar index of an archive file name.
+func parseArchiveName(name string) (uint64, bool) {
+	prefix, suffix, ok := strings.Cut(name, ".")
+	if !ok {
+		return 0, false
+	}
+	known := suffix == metaExt
+	for _, c := range compressionExts {
+		known = known || suffix == sszExt+c.ext
+	}
+	if !known {
+		return 0, false
+	}
+	index, err := strconv.ParseUint(prefix, 10, 64)
+	return index, err == nil
+}
@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	fieldparams "github.com/prysmaticlabs/prysm/v5/config/fieldparams"
+	"github.com/spf13/afero"
+)
+
+// With deduplication, the archive store splits every sidecar in two: the blob body is stored once per KZG commitment
+// under bodyDir, and the rest of the sidecar is stored as a small metadata file in the root directory.
+// A refs file next to each body counts the metadata files pointing at it, so Remove deletes a body with its last
+// reference. References are added before and released after the metadata file is written or removed, so a crash can
+// leave a body with a count that is too high, but never delete a body still in use.
+const (
+	bodyDir = "blobs-by-commitment"
+	metaExt = "meta"
+	bodyExt = "blob"
+	refsExt = "refs"
+
+	// metaCommitmentOffset is the position of the KZG commitment in a metadata file,
+	// which is the SSZ encoded sidecar without its blob.
+	metaCommitmentOffset = 8
+)
+
+func splitSidecar(data []byte) (meta, body []byte) {
+	meta = make([]byte, 0, len(data)-fieldparams.BlobLength)
+	meta = append(meta, data[:8]...)
+	meta = append(meta, data[8+fieldparams.BlobLength:]...)
+	return meta, data[8 : 8+fieldparams.BlobLength]
+}
+
+func joinSidecar(meta, body []byte) []byte {
+	data := make([]byte, 0, len(meta)+len(body))
+	data = append(data, meta[:8]...)
+	data = append(data, body...)
+	return append(data, meta[8:]...)
+}
+
+type bodyNamer struct {
+	commitment []byte
+}
+
+func (p bodyNamer) path(ext string) string {
+	return path.Join(bodyDir, fmt.Sprintf("%#x.%s%s", p.commitment, bodyExt, ext))
+}
+
+func (p bodyNamer) partPath(entropy string) string {
+	return path.Join(bodyDir, fmt.Sprintf("%s-%x.%s", entropy, p.commitment[:8], partExt))
+}
+
+func (p bodyNamer) refsPath() string {
+	return path.Join(bodyDir, fmt.Sprintf("%#x.%s", p.commitment, refsExt))
+}
+
+// acquireBody adds a reference to the body of the commitment, writing the body if it is not stored yet.
+// It returns the number of bytes written for the body, which is 0 for a duplicate.
+func (a *ArchiveBlobStorage) acquireBody(commitment, body []byte) (int, error) {
+	a.bodiesMu.Lock()
+	defer a.bodiesMu.Unlock()
+
+	name := bodyNamer{commitment: commitment}
+	refs, err := a.refs(name)
+	if err != nil {
+		return 0, err
+	}
+	written := 0
+	if _, _, err := a.findBody(commitment); os.IsNotExist(err) {
+		encoded, err := a.compress(body)
+		if err != nil {
+			return 0, err
+		}
+		if err := a.blobStorage.writeFile(bodyDir, name.partPath(fmt.Sprintf("%p", encoded)), name.path(a.compressionExt()), encoded); err != nil {
+			return 0, err
+		}
+		written = len(encoded)
+	} else if err != nil {
+		return 0, err
+	}
+	return written, a.setRefs(name, refs+1)
+}
+
+// repairBody rewrites the stored body of the commitment if it can not be read or differs from body, and returns the
+// number of bytes written.
+func (a *ArchiveBlobStorage) repairBody(commitment, body []byte) (int, error) {
+	a.bodiesMu.Lock()
+	defer a.bodiesMu.Unlock()
+
+	stored, err := a.readBody(commitment)
+	if err == nil && bytes.Equal(stored, body) {
+		return 0, nil
+	}
+	oldPath, _, findErr := a.findBody(commitment)
+	if os.IsNotExist(findErr) {
+		return 0, nil
+	} else if findErr != nil {
+		return 0, findErr
+	}
+	name := bodyNamer{commitment: commitment}
+	encoded, err := a.compress(body)
+	if err != nil {
+		return 0, err
+	}
+	newPath := name.path(a.compressionExt())
+	if err := a.blobStorage.writeFile(bodyDir, name.partPath(fmt.Sprintf("%p", encoded)), newPath, encoded); err != nil {
+		return 0, err
+	}
+	if oldPath != newPath {
+		return len(encoded), a.blobStorage.fs.Remove(oldPath)
+	}
+	return len(encoded), nil
+}
+
+// releaseBody drops a reference to the body of the commitment and deletes it with its last reference.
+func (a *ArchiveBlobStorage) releaseBody(commitment []byte) error {
+	a.bodiesMu.Lock()
+	defer a.bodiesMu.Unlock()
+
+	name := bodyNamer{commitment: commitment}
+	refs, err := a.refs(name)
+	if err != nil {
+		return err
+	}
+	if refs > 1 {
+		return a.setRefs(name, refs-1)
+	}
+	bodyPath, _, err := a.findBody(commitment)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := a.blobStorage.fs.Remove(bodyPath); err != nil {
+			return err
+		}
+	}
+	if err := a.blobStorage.fs.Remove(name.refsPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (a *ArchiveBlobStorage) readBody(commitment []byte) ([]byte, error) {
+	bodyPath, compression, err := a.findBody(commitment)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := afero.ReadFile(a.blobStorage.fs, bodyPath)
+	if err != nil {
+		return nil, err
+	}
+	body, err := a.decompress(compression, encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) != fieldparams.BlobLength {
+		return nil, errors.Errorf("invalid blob body length %d for commitment %#x", len(body), commitment)
+	}
+	return body, nil
+}
+
+func (a *ArchiveBlobStorage) findBody(commitment []byte) (string, string, error) {
+	name := bodyNamer{commitment: commitment}
+	for _, c := range compressionExts {
+		exists, err := afero.Exists(a.blobStorage.fs, name.path(c.ext))
+		if err != nil {
+			return "", "", err
+		}
+		if exists {
+			return name.path(c.ext), c.compression, nil
+		}
+	}
+	return "", "", os.ErrNotExist
+}
+
+func (a *ArchiveBlobStorage) refs(name bodyNamer) (uint64, error) {
+	data, err := afero.ReadFile(a.blobStorage.fs, name.refsPath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	refs, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid refs file %s", name.refsPath())
+	}
+	return refs, nil
+}
+
+func (a *ArchiveBlobStorage) setRefs(name bodyNamer, refs uint64) error {
+	data := []byte(strconv.FormatUint(refs, 10))
+	return a.blobStorage.writeFile(bodyDir, name.refsPath()+"."+partExt, name.refsPath(), data)
+}
+
+// bodySize returns the size of the blob body of a metadata file if the file holds its last reference.
+func (a *ArchiveBlobStorage) bodySize(metaPath string) (uint64, error) {
+	meta, err := afero.ReadFile(a.blobStorage.fs, metaPath)
+	if err != nil {
+		return 0, err
+	}
+	if len(meta) < metaCommitmentOffset+fieldparams.BLSPubkeyLength {
+		return 0, errors.Errorf("invalid metadata file %s", metaPath)
+	}
+	commitment := meta[metaCommitmentOffset : metaCommitmentOffset+fieldparams.BLSPubkeyLength]
+
+	a.bodiesMu.Lock()
+	defer a.bodiesMu.Unlock()
+	refs, err := a.refs(bodyNamer{commitment: commitment})
+	if err != nil || refs > 1 {
+		return 0, err
+	}
+	bodyPath, _, err := a.findBody(commitment)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	info, err := a.blobStorage.fs.Stat(bodyPath)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(info.Size()), nil
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveBlobStorageCompression(t *testing.T) {
+	dir := t.TempDir()
+	root := [32]byte{1}
+	sidecars := []struct {
+		compression string
+		index       uint64
+	}{
+		{CompressionNone, 0},
+		{CompressionSnappy, 1},
+		{CompressionZstd, 2},
+	}
+
+	for _, s := range sidecars {
+		store, err := NewArchiveBlobStorage(zerolog.Nop(), dir, 6, StoreOptions{Compression: s.compression})
+		require.NoError(t, err)
+		sidecar := newTestSidecar(s.index, 100)
+		sidecar.KzgCommitment[0] = byte(s.index)
+		_, err = store.Save(root, ConvDenebSideCar(sidecar))
+		require.NoError(t, err)
+
+		stats := store.Stats()
+		require.Equal(t, s.compression, stats.Compression)
+		if s.compression == CompressionNone {
+			require.Equal(t, stats.RawBytes, stats.StoredBytes)
+		} else {
+			// the test blob is all zeros
+			require.Greater(t, stats.Ratio(), 10.0)
+		}
+	}
+
+	// files written with every compression are read back by any store
+	store, err := NewArchiveBlobStorage(zerolog.Nop(), dir, 6, StoreOptions{Compression: CompressionZstd})
+	require.NoError(t, err)
+	mask, err := store.Indices(root)
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, true, true, false, false, false}, mask)
+	for _, s := range sidecars {
+		sidecar := newTestSidecar(s.index, 100)
+		sidecar.KzgCommitment[0] = byte(s.index)
+		valid, err := store.Valid(root, ConvDenebSideCar(sidecar))
+		require.NoError(t, err)
+		require.True(t, valid, s.compression)
+
+		found, err := store.GetByVersionedHash(KzgToVersionedHash(sidecar.KzgCommitment))
+		require.NoError(t, err)
+		require.Equal(t, s.index, found.Index)
+	}
+	index, err := store.SlotIndex()
+	require.NoError(t, err)
+	indexed, ok := index.Root(100)
+	require.True(t, ok)
+	require.Equal(t, root, indexed)
+
+	_, err = NewArchiveBlobStorage(zerolog.Nop(), dir, 6, StoreOptions{Compression: "lz4"})
+	require.ErrorIs(t, err, errUnknownCompression)
+	_, err = NewBlobStore(zerolog.Nop(), "prysm", dir, 6, StoreOptions{Compression: CompressionZstd})
+	require.Error(t, err)
+}
+
+func TestArchiveBlobStorageDedup(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewArchiveBlobStorage(zerolog.Nop(), dir, 6, StoreOptions{Compression: CompressionZstd, Dedup: true})
+	require.NoError(t, err)
+
+	// the same blob is included by two blocks
+	roots := [][32]byte{{1}, {2}}
+	for i, root := range roots {
+		sidecar := newTestSidecar(0, uint64(100+i))
+		_, err := store.Save(root, ConvDenebSideCar(sidecar))
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint64(1), store.Stats().DedupedBlobs)
+
+	commitment := newTestSidecar(0, 100).KzgCommitment
+	bodies, err := afero.Glob(store.blobStorage.fs, filepath.Join(bodyDir, "*."+bodyExt+"*"))
+	require.NoError(t, err)
+	require.Len(t, bodies, 1)
+	refs, err := store.refs(bodyNamer{commitment: commitment})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), refs)
+
+	// removing one block keeps the body for the other
+	require.NoError(t, store.Remove(roots[0]))
+	require.False(t, store.Exist(roots[0]))
+	valid, err := store.Valid(roots[1], ConvDenebSideCar(newTestSidecar(0, 101)))
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// removing the last reference deletes the body
+	require.NoError(t, store.Remove(roots[1]))
+	bodies, err = afero.Glob(store.blobStorage.fs, filepath.Join(bodyDir, "*"))
+	require.NoError(t, err)
+	require.Empty(t, bodies)
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"encoding/binary"
+
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	"github.com/pkg/errors"
+	fieldparams "github.com/prysmaticlabs/prysm/v5/config/fieldparams"
+)
+
+const (
+	// dataColumnSidecarFixedSize is the size of the fixed part of a fulu DataColumnSidecar:
+	// index, three list offsets, the signed block header and the commitments inclusion proof.
+	dataColumnSidecarFixedSize = 8 + 4*3 + signedBlockHeaderSize + kzgCommitmentsInclusionProofDepth*32
+	signedBlockHeaderSize      = 112 + 96
+	dataColumnHeaderOffset     = 8 + 4*3
+	dataColumnProofOffset      = dataColumnHeaderOffset + signedBlockHeaderSize
+
+	// kzgCommitmentsInclusionProofDepth is the depth of the proof of the kzg_commitments list in the block body.
+	kzgCommitmentsInclusionProofDepth = 4
+	// bytesPerCell is the size of a cell, 64 field elements.
+	bytesPerCell = 64 * 32
+)
+
+var errInvalidColumnSidecar = errors.New("invalid data column sidecar")
+
+// DataColumnSidecar is an SSZ encoded fulu data column sidecar.
+// The consensus libraries used by this module predate fulu, so the sidecar is decoded here into views of its raw
+// bytes, which are stored unchanged.
+type DataColumnSidecar struct {
+	Index                        uint64
+	Column                       [][]byte
+	KZGCommitments               [][]byte
+	KZGProofs                    [][]byte
+	SignedBlockHeader            *phase0.SignedBeaconBlockHeader
+	KZGCommitmentsInclusionProof [][]byte
+	Raw                          []byte
+}
+
+// DecodeDataColumnSidecar decodes an SSZ encoded data column sidecar.
+func DecodeDataColumnSidecar(raw []byte) (*DataColumnSidecar, error) {
+	if len(raw) < dataColumnSidecarFixedSize {
+		return nil, errors.Wrapf(errInvalidColumnSidecar, "size %d is below the fixed size %d", len(raw), dataColumnSidecarFixedSize)
+	}
+	// the first variable field must start right after the fixed part, and every field after the previous one
+	offsets := [4]int{
+		int(binary.LittleEndian.Uint32(raw[8:12])),
+		int(binary.LittleEndian.Uint32(raw[12:16])),
+		int(binary.LittleEndian.Uint32(raw[16:20])),
+		len(raw),
+	}
+	if offsets[0] != dataColumnSidecarFixedSize {
+		return nil, errors.Wrapf(errInvalidColumnSidecar, "unexpected column offset %d", offsets[0])
+	}
+	for i := 0; i < 3; i++ {
+		if offsets[i] > offsets[i+1] {
+			return nil, errors.Wrapf(errInvalidColumnSidecar, "invalid list offset %d", offsets[i+1])
+		}
+	}
+	column, err := splitList(raw[offsets[0]:offsets[1]], bytesPerCell)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid column")
+	}
+	commitments, err := splitList(raw[offsets[1]:offsets[2]], fieldparams.BLSPubkeyLength)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid kzg commitments")
+	}
+	proofs, err := splitList(raw[offsets[2]:offsets[3]], fieldparams.BLSPubkeyLength)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid kzg proofs")
+	}
+
+	header := &phase0.SignedBeaconBlockHeader{}
+	if err := header.UnmarshalSSZ(raw[dataColumnHeaderOffset:dataColumnProofOffset]); err != nil {
+		return nil, errors.Wrap(err, "failed to decode signed block header")
+	}
+	inclusionProof, err := splitList(raw[dataColumnProofOffset:dataColumnSidecarFixedSize], 32)
+	if err != nil {
+		return nil, err
+	}
+	return &DataColumnSidecar{
+		Index:                        binary.LittleEndian.Uint64(raw[:8]),
+		Column:                       column,
+		KZGCommitments:               commitments,
+		KZGProofs:                    proofs,
+		SignedBlockHeader:            header,
+		KZGCommitmentsInclusionProof: inclusionProof,
+		Raw:                          raw,
+	}, nil
+}
+
+// splitList splits an SSZ list of fixed size items.
+func splitList(data []byte, size int) ([][]byte, error) {
+	if len(data)%size != 0 {
+		return nil, errors.Wrapf(errInvalidColumnSidecar, "list of %d bytes is not a multiple of %d", len(data), size)
+	}
+	if len(data)/size > fieldparams.MaxBlobCommitmentsPerBlock {
+		return nil, errors.Wrapf(errInvalidColumnSidecar, "list of %d items exceeds the limit %d", len(data)/size, fieldparams.MaxBlobCommitmentsPerBlock)
+	}
+	items := make([][]byte, len(data)/size)
+	for i := range items {
+		items[i] = data[i*size : (i+1)*size]
+	}
+	return items, nil
+}
+
+// BlockRoot returns the root of the block the column belongs to.
+func (s *DataColumnSidecar) BlockRoot() ([32]byte, error) {
+	return s.SignedBlockHeader.Message.HashTreeRoot()
+}
+
+// DecodeDataColumnSidecars decodes an SSZ list of data column sidecars, as served by the beacon API.
+func DecodeDataColumnSidecars(raw []byte) ([]*DataColumnSidecar, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	if len(raw) < 4 {
+		return nil, errors.Wrap(errInvalidColumnSidecar, "list too short")
+	}
+	first := binary.LittleEndian.Uint32(raw[:4])
+	if first%4 != 0 || first == 0 || int(first) > len(raw) {
+		return nil, errors.Wrapf(errInvalidColumnSidecar, "invalid list offset %d", first)
+	}
+	count := int(first / 4)
+	offsets := make([]int, count+1)
+	for i := 0; i < count; i++ {
+		offsets[i] = int(binary.LittleEndian.Uint32(raw[i*4:]))
+	}
+	offsets[count] = len(raw)
+
+	sidecars := make([]*DataColumnSidecar, 0, count)
+	for i := 0; i < count; i++ {
+		if offsets[i] > offsets[i+1] || offsets[i+1] > len(raw) {
+			return nil, errors.Wrapf(errInvalidColumnSidecar, "invalid list offset %d", offsets[i])
+		}
+		sidecar, err := DecodeDataColumnSidecar(raw[offsets[i]:offsets[i+1]])
+		if err != nil {
+			return nil, err
+		}
+		sidecars = append(sidecars, sidecar)
+	}
+	return sidecars, nil
+}
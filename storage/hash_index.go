@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// hashIndexFileName is the file the versioned hash index of a store is persisted to, in its base path.
+	hashIndexFileName = "versioned-hashes.idx"
+
+	// hashRecordSize is the size of a record of the index file: its kind, the versioned hash, the root and the index.
+	hashRecordSize = 1 + 32 + 32 + 8
+
+	hashRecordAdd    = 1
+	hashRecordRemove = 2
+	// hashRecordClean is appended when the store is closed. A file not ending with it may lack the last changes
+	// of a process which did not exit cleanly, and is rebuilt from the sidecars.
+	hashRecordClean = 3
+)
+
+// BlobLocation identifies a stored blob sidecar.
+type BlobLocation struct {
+	Root  [32]byte
+	Index uint64
+}
+
+// VersionedHashIndex maps EIP-4844 versioned hashes to the stored sidecars carrying the blob.
+type VersionedHashIndex struct {
+	mu        sync.RWMutex
+	locations map[[32]byte]BlobLocation
+}
+
+func NewVersionedHashIndex() *VersionedHashIndex {
+	return &VersionedHashIndex{locations: make(map[[32]byte]BlobLocation)}
+}
+
+// BuildVersionedHashIndex indexes every sidecar of a store by the versioned hash of its commitment.
+func BuildVersionedHashIndex(log zerolog.Logger, bs sidecarLister) (*VersionedHashIndex, error) {
+	roots, err := bs.Roots()
+	if err != nil {
+		return nil, err
+	}
+	index := NewVersionedHashIndex()
+	for _, root := range roots {
+		mask, err := bs.Indices(root)
+		if err != nil {
+			log.Warn().Err(err).Str("root", rootString(root)).Msg("Skipping root with unreadable indices in versioned hash index")
+			continue
+		}
+		for i, ok := range mask {
+			if !ok {
+				continue
+			}
+			commitment, err := bs.Commitment(root, uint64(i))
+			if err != nil {
+				log.Warn().Err(err).Str("root", rootString(root)).Int("index", i).Msg("Skipping unreadable sidecar in versioned hash index")
+				continue
+			}
+			index.Add(KzgToVersionedHash(commitment), BlobLocation{Root: root, Index: uint64(i)})
+		}
+	}
+	return index, nil
+}
+
+func (h *VersionedHashIndex) Add(hash [32]byte, location BlobLocation) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.locations[hash] = location
+}
+
+// Remove drops the versioned hash if it is indexed to the location.
+func (h *VersionedHashIndex) Remove(hash [32]byte, location BlobLocation) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.locations[hash] == location {
+		delete(h.locations, hash)
+	}
+}
+
+// Location returns where the blob with the versioned hash is stored.
+// A blob included in several blocks resolves to the last one indexed.
+func (h *VersionedHashIndex) Location(hash [32]byte) (BlobLocation, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	location, ok := h.locations[hash]
+	return location, ok
+}
+
+func (h *VersionedHashIndex) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.locations)
+}
+
+// hashIndexLog persists a versioned hash index as a file of the records added to and removed from it.
+// The file is rewritten when the index is built, and appended to afterwards.
+type hashIndexLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// openHashIndexLog opens the index file at path for appending if it was closed cleanly, and removes it otherwise.
+func openHashIndexLog(path string) (*hashIndexLog, error) {
+	l := &hashIndexLog{path: path}
+	clean, err := hashIndexClean(path)
+	if err != nil {
+		return nil, err
+	}
+	if !clean {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return l, nil
+	}
+	l.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// hashIndexClean reports whether the index file at path exists and ends with a clean record.
+func hashIndexClean(path string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() == 0 || info.Size()%hashRecordSize != 0 {
+		return false, nil
+	}
+	kind := make([]byte, 1)
+	if _, err := f.ReadAt(kind, info.Size()-hashRecordSize); err != nil {
+		return false, err
+	}
+	return kind[0] == hashRecordClean, nil
+}
+
+// loadVersionedHashIndex replays the index file at path, returning nil if there is none.
+// A partial record at the end, of a write in progress, is ignored.
+func loadVersionedHashIndex(path string) (*VersionedHashIndex, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	index := NewVersionedHashIndex()
+	for offset := 0; offset+hashRecordSize <= len(data); offset += hashRecordSize {
+		kind, hash, location := decodeHashRecord(data[offset : offset+hashRecordSize])
+		switch kind {
+		case hashRecordAdd:
+			index.Add(hash, location)
+		case hashRecordRemove:
+			index.Remove(hash, location)
+		case hashRecordClean:
+		default:
+			return nil, errors.Errorf("unknown record kind %d in %s", kind, path)
+		}
+	}
+	return index, nil
+}
+
+// create writes the index to a new file, replacing the one at the log's path, and opens it for appending.
+func (l *hashIndexLog) create(index *VersionedHashIndex) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	index.mu.RLock()
+	data := make([]byte, 0, len(index.locations)*hashRecordSize)
+	for hash, location := range index.locations {
+		data = appendHashRecord(data, hashRecordAdd, hash, location)
+	}
+	index.mu.RUnlock()
+
+	partPath := l.path + "." + partExt
+	f, err := os.Create(partPath)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(partPath, l.path); err != nil {
+		return err
+	}
+	l.file, err = os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+// append records a change of the index, once the file exists.
+func (l *hashIndexLog) append(kind byte, hash [32]byte, location BlobLocation) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	_, err := l.file.Write(appendHashRecord(nil, kind, hash, location))
+	return err
+}
+
+// close marks the file clean and closes it.
+func (l *hashIndexLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	f := l.file
+	l.file = nil
+	if _, err := f.Write(appendHashRecord(nil, hashRecordClean, [32]byte{}, BlobLocation{})); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func appendHashRecord(data []byte, kind byte, hash [32]byte, location BlobLocation) []byte {
+	data = append(data, kind)
+	data = append(data, hash[:]...)
+	data = append(data, location.Root[:]...)
+	return binary.LittleEndian.AppendUint64(data, location.Index)
+}
+
+func decodeHashRecord(record []byte) (byte, [32]byte, BlobLocation) {
+	var hash [32]byte
+	var location BlobLocation
+	copy(hash[:], record[1:33])
+	copy(location.Root[:], record[33:65])
+	location.Index = binary.LittleEndian.Uint64(record[65:])
+	return record[0], hash, location
+}
@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// sidecarLister is the read access to a store needed to build its slot and versioned hash indices.
+type sidecarLister interface {
+	Roots() ([][32]byte, error)
+	Indices(root [32]byte) ([]bool, error)
+	Slot(root [32]byte) (uint64, error)
+	Commitment(root [32]byte, idx uint64) ([]byte, error)
+}
+
+// storeIndexes holds the slot and versioned hash indices of a store. They are built from disk on first use
+// and kept up to date by the store's Save afterwards. The versioned hash index is persisted to the base path of
+// stores holding their lock, and loaded from it by the ones opened read-only.
+type storeIndexes struct {
+	log zerolog.Logger
+	src sidecarLister
+
+	// mu is held to build an index, and read held to update the built ones, so a sidecar saved or removed while
+	// an index is built is not missed.
+	mu       sync.RWMutex
+	hashPath string
+	hashLog  *hashIndexLog
+
+	slotsOnce sync.Once
+	slots     atomic.Pointer[SlotIndex]
+	slotsErr  error
+
+	hashesOnce sync.Once
+	hashes     atomic.Pointer[VersionedHashIndex]
+	hashesErr  error
+}
+
+// init sets up the indices of a store over bs. The versioned hash index of a store shared with a beacon node is not
+// persisted, since the node prunes its sidecars without updating it.
+func (x *storeIndexes) init(log zerolog.Logger, src sidecarLister, bs *BlobStorage) error {
+	x.log, x.src = log, src
+	if bs.shared {
+		return nil
+	}
+	x.hashPath = filepath.Join(bs.base, hashIndexFileName)
+	if bs.dirLock == nil {
+		return nil
+	}
+	hashLog, err := openHashIndexLog(x.hashPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to open versioned hash index")
+	}
+	x.hashLog = hashLog
+	return nil
+}
+
+// close marks the persisted versioned hash index clean.
+func (x *storeIndexes) close() error {
+	if x.hashLog == nil {
+		return nil
+	}
+	return x.hashLog.close()
+}
+
+func (x *storeIndexes) slotIndex() (*SlotIndex, error) {
+	x.slotsOnce.Do(func() {
+		x.mu.Lock()
+		defer x.mu.Unlock()
+		var slots *SlotIndex
+		slots, x.slotsErr = BuildSlotIndex(x.log, x.src)
+		x.slots.Store(slots)
+	})
+	return x.slots.Load(), x.slotsErr
+}
+
+func (x *storeIndexes) versionedHashIndex() (*VersionedHashIndex, error) {
+	x.hashesOnce.Do(func() {
+		x.mu.Lock()
+		defer x.mu.Unlock()
+		hashes, err := x.loadVersionedHashIndex()
+		if err != nil {
+			x.hashesErr = err
+			return
+		}
+		x.hashes.Store(hashes)
+	})
+	return x.hashes.Load(), x.hashesErr
+}
+
+// loadVersionedHashIndex reads the persisted versioned hash index, or builds it from disk and persists it.
+func (x *storeIndexes) loadVersionedHashIndex() (*VersionedHashIndex, error) {
+	if x.hashPath != "" && (x.hashLog == nil || x.hashLog.file != nil) {
+		hashes, err := loadVersionedHashIndex(x.hashPath)
+		if err != nil || hashes != nil {
+			return hashes, err
+		}
+	}
+	hashes, err := BuildVersionedHashIndex(x.log, x.src)
+	if err != nil {
+		return nil, err
+	}
+	if x.hashLog != nil {
+		if err := x.hashLog.create(hashes); err != nil {
+			return nil, errors.Wrap(err, "failed to persist versioned hash index")
+		}
+	}
+	return hashes, nil
+}
+
+// locate returns where the blob with the versioned hash is stored.
+func (x *storeIndexes) locate(hash [32]byte) (BlobLocation, error) {
+	hashes, err := x.versionedHashIndex()
+	if err != nil {
+		return BlobLocation{}, err
+	}
+	location, ok := hashes.Location(hash)
+	if !ok {
+		return BlobLocation{}, errors.Wrapf(os.ErrNotExist, "blob %#x", hash)
+	}
+	return location, nil
+}
+
+// add records a saved sidecar in the indices which are already built, and in the persisted versioned hash index.
+func (x *storeIndexes) add(root [32]byte, slot, index uint64, commitment []byte) error {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.addLocked(root, slot, index, commitment)
+}
+
+func (x *storeIndexes) addLocked(root [32]byte, slot, index uint64, commitment []byte) error {
+	if slots := x.slots.Load(); slots != nil {
+		slots.Add(slot, root)
+	}
+	hash, location := KzgToVersionedHash(commitment), BlobLocation{Root: root, Index: index}
+	if hashes := x.hashes.Load(); hashes != nil {
+		hashes.Add(hash, location)
+	}
+	return x.appendHashRecord(hashRecordAdd, hash, location)
+}
+
+// replace records a sidecar which replaced a stored one with another commitment, or nil if unknown.
+func (x *storeIndexes) replace(root [32]byte, slot, index uint64, old, commitment []byte) error {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if old != nil {
+		hash, location := KzgToVersionedHash(old), BlobLocation{Root: root, Index: index}
+		if hashes := x.hashes.Load(); hashes != nil {
+			hashes.Remove(hash, location)
+		}
+		if err := x.appendHashRecord(hashRecordRemove, hash, location); err != nil {
+			return err
+		}
+	}
+	return x.addLocked(root, slot, index, commitment)
+}
+
+func (x *storeIndexes) appendHashRecord(kind byte, hash [32]byte, location BlobLocation) error {
+	if x.hashLog == nil {
+		return nil
+	}
+	if err := x.hashLog.append(kind, hash, location); err != nil {
+		return errors.Wrap(err, "failed to update versioned hash index")
+	}
+	return nil
+}
+
+// storedSidecars reads the slot and commitments of a root, so it can be dropped from the indices after removal.
+func (x *storeIndexes) storedSidecars(root [32]byte) (uint64, map[uint64][]byte, error) {
+	slot, err := x.src.Slot(root)
+	if err != nil {
+		return 0, nil, err
+	}
+	mask, err := x.src.Indices(root)
+	if err != nil {
+		return 0, nil, err
+	}
+	commitments := make(map[uint64][]byte)
+	for i, ok := range mask {
+		if !ok {
+			continue
+		}
+		commitment, err := x.src.Commitment(root, uint64(i))
+		if err != nil {
+			return 0, nil, err
+		}
+		commitments[uint64(i)] = commitment
+	}
+	return slot, commitments, nil
+}
+
+// remove drops the sidecars of a removed root from the indices which are already built, and from the persisted
+// versioned hash index.
+func (x *storeIndexes) remove(root [32]byte, slot uint64, commitments map[uint64][]byte) error {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if slots := x.slots.Load(); slots != nil {
+		slots.Remove(slot, root)
+	}
+	for index, commitment := range commitments {
+		hash, location := KzgToVersionedHash(commitment), BlobLocation{Root: root, Index: index}
+		if hashes := x.hashes.Load(); hashes != nil {
+			hashes.Remove(hash, location)
+		}
+		if err := x.appendHashRecord(hashRecordRemove, hash, location); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+
+	goethkzg "github.com/crate-crypto/go-eth-kzg"
+	gokzg4844 "github.com/crate-crypto/go-kzg-4844"
+	"github.com/pkg/errors"
+	fieldparams "github.com/prysmaticlabs/prysm/v5/config/fieldparams"
+	"github.com/prysmaticlabs/prysm/v5/consensus-types/blocks"
+	ethpb "github.com/prysmaticlabs/prysm/v5/proto/prysm/v1alpha1"
+)
+
+const blobCommitmentVersionKZG = 0x01
+
+var (
+	kzgContext     *gokzg4844.Context
+	kzgContextErr  error
+	kzgContextOnce sync.Once
+)
+
+func getKzgContext() (*gokzg4844.Context, error) {
+	kzgContextOnce.Do(func() {
+		kzgContext, kzgContextErr = gokzg4844.NewContext4096Secure()
+	})
+	return kzgContext, kzgContextErr
+}
+
+var (
+	cellKzgContext     *goethkzg.Context
+	cellKzgContextErr  error
+	cellKzgContextOnce sync.Once
+)
+
+// getCellKzgContext returns the context of the PeerDAS cell proofs, which go-kzg-4844 predates.
+func getCellKzgContext() (*goethkzg.Context, error) {
+	cellKzgContextOnce.Do(func() {
+		cellKzgContext, cellKzgContextErr = goethkzg.NewContext4096Secure()
+	})
+	return cellKzgContext, cellKzgContextErr
+}
+
+// VerifySidecar checks that the sidecar's KZG commitment is included in the block body committed to by its header,
+// and that the blob matches its KZG commitment and proof.
+func VerifySidecar(sidecar *ethpb.BlobSidecar) error {
+	if err := VerifyInclusionProof(sidecar); err != nil {
+		return err
+	}
+	return VerifyKZGProof(sidecar)
+}
+
+// VerifyInclusionProof checks that the sidecar's KZG commitment is included in the block body committed to by its header.
+func VerifyInclusionProof(sidecar *ethpb.BlobSidecar) error {
+	roBlob, err := blocks.NewROBlob(sidecar)
+	if err != nil {
+		return err
+	}
+	return blocks.VerifyKZGInclusionProof(roBlob)
+}
+
+// VerifyKZGProof checks that the blob matches its KZG commitment and proof.
+func VerifyKZGProof(sidecar *ethpb.BlobSidecar) error {
+	ctx, err := getKzgContext()
+	if err != nil {
+		return errors.Wrap(err, "failed to load kzg trusted setup")
+	}
+	if len(sidecar.Blob) != fieldparams.BlobLength {
+		return errors.Errorf("invalid blob length %d", len(sidecar.Blob))
+	}
+	var (
+		blob       gokzg4844.Blob
+		commitment gokzg4844.KZGCommitment
+		proof      gokzg4844.KZGProof
+	)
+	copy(blob[:], sidecar.Blob)
+	copy(commitment[:], sidecar.KzgCommitment)
+	copy(proof[:], sidecar.KzgProof)
+	if err := ctx.VerifyBlobKZGProof(&blob, commitment, proof); err != nil {
+		return errors.Wrap(err, "invalid kzg proof")
+	}
+	return nil
+}
+
+// VerifyDataColumnSidecar checks that the column's KZG commitments are included in the block body committed to by
+// its header, and that its cells match the commitments and cell proofs.
+func VerifyDataColumnSidecar(sidecar *DataColumnSidecar, numberOfColumns uint64) error {
+	if sidecar.Index >= numberOfColumns {
+		return errors.Wrapf(errInvalidColumnSidecar, "column index %d out of range", sidecar.Index)
+	}
+	if len(sidecar.KZGCommitments) == 0 {
+		return errors.Wrap(errInvalidColumnSidecar, "column has no kzg commitments")
+	}
+	if len(sidecar.Column) != len(sidecar.KZGCommitments) || len(sidecar.KZGProofs) != len(sidecar.KZGCommitments) {
+		return errors.Wrapf(errInvalidColumnSidecar, "column has %d cells and %d proofs for %d commitments", len(sidecar.Column), len(sidecar.KZGProofs), len(sidecar.KZGCommitments))
+	}
+	if err := VerifyColumnInclusionProof(sidecar); err != nil {
+		return err
+	}
+	return VerifyCellKZGProofs(sidecar)
+}
+
+// VerifyColumnInclusionProof checks that the column's KZG commitments list is the one of the block body committed to
+// by its header.
+func VerifyColumnInclusionProof(sidecar *DataColumnSidecar) error {
+	if len(sidecar.KZGCommitmentsInclusionProof) != kzgCommitmentsInclusionProofDepth {
+		return errors.Wrapf(errInvalidColumnSidecar, "inclusion proof has %d hashes", len(sidecar.KZGCommitmentsInclusionProof))
+	}
+	// blob_kzg_commitments is the 12th of the 16 field leaves of the block body
+	root := commitmentsRoot(sidecar.KZGCommitments)
+	index := 11
+	for _, sibling := range sidecar.KZGCommitmentsInclusionProof {
+		if index&1 == 1 {
+			root = sha256.Sum256(append(append([]byte{}, sibling...), root[:]...))
+		} else {
+			root = sha256.Sum256(append(root[:], sibling...))
+		}
+		index >>= 1
+	}
+	if !bytes.Equal(root[:], sidecar.SignedBlockHeader.Message.BodyRoot[:]) {
+		return errors.Wrap(errInvalidColumnSidecar, "invalid kzg commitments inclusion proof")
+	}
+	return nil
+}
+
+// commitmentsRoot returns the hash tree root of a list of KZG commitments, limited to MaxBlobCommitmentsPerBlock.
+func commitmentsRoot(commitments [][]byte) [32]byte {
+	layer := make([][32]byte, len(commitments))
+	for i, commitment := range commitments {
+		var chunks [64]byte
+		copy(chunks[:], commitment)
+		layer[i] = sha256.Sum256(chunks[:])
+	}
+	var zero [32]byte
+	for depth := 0; depth < fieldparams.LogMaxBlobCommitments; depth++ {
+		next := make([][32]byte, (len(layer)+1)/2)
+		for i := range next {
+			right := zero
+			if 2*i+1 < len(layer) {
+				right = layer[2*i+1]
+			}
+			next[i] = sha256.Sum256(append(layer[2*i][:], right[:]...))
+		}
+		if len(layer) == 0 {
+			next = nil
+		}
+		layer = next
+		zero = sha256.Sum256(append(zero[:], zero[:]...))
+	}
+	root := zero
+	if len(layer) > 0 {
+		root = layer[0]
+	}
+	var length [32]byte
+	binary.LittleEndian.PutUint64(length[:], uint64(len(commitments)))
+	return sha256.Sum256(append(root[:], length[:]...))
+}
+
+// VerifyCellKZGProofs checks that the cells of the column match their KZG commitments and cell proofs.
+func VerifyCellKZGProofs(sidecar *DataColumnSidecar) error {
+	ctx, err := getCellKzgContext()
+	if err != nil {
+		return errors.Wrap(err, "failed to load kzg trusted setup")
+	}
+	commitments := make([]goethkzg.KZGCommitment, len(sidecar.KZGCommitments))
+	indices := make([]uint64, len(sidecar.KZGCommitments))
+	cells := make([]*goethkzg.Cell, len(sidecar.KZGCommitments))
+	proofs := make([]goethkzg.KZGProof, len(sidecar.KZGCommitments))
+	for i := range sidecar.KZGCommitments {
+		copy(commitments[i][:], sidecar.KZGCommitments[i])
+		indices[i] = sidecar.Index
+		cells[i] = &goethkzg.Cell{}
+		copy(cells[i][:], sidecar.Column[i])
+		copy(proofs[i][:], sidecar.KZGProofs[i])
+	}
+	if err := ctx.VerifyCellKZGProofBatch(commitments, indices, cells, proofs); err != nil {
+		return errors.Wrap(err, "invalid cell kzg proofs")
+	}
+	return nil
+}
+
+// KzgToVersionedHash computes the EIP-4844 versioned hash of a KZG commitment.
+func KzgToVersionedHash(commitment []byte) [32]byte {
+	hash := sha256.Sum256(commitment)
+	hash[0] = blobCommitmentVersionKZG
+	return hash
+}
@@ -1 +1 @@
-package storage
+package storage
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// lockFileName is the advisory lock file taken in the base directory of a blob storage.
+const lockFileName = "blob-retriever.lock"
+
+// ErrStorageLocked is returned by NewBlobStorage when another process holds the lock of the directory.
+var ErrStorageLocked = errors.New("blob storage is locked by another process")
+
+// dirLocks holds the locks taken by this process, so stores opened more than once on a directory, such as the
+// blob and column stores of a retriever, share one lock.
+var dirLocks = struct {
+	sync.Mutex
+	locks map[string]*dirLock
+}{locks: make(map[string]*dirLock)}
+
+type dirLock struct {
+	path string
+	file *os.File
+	refs int
+}
+
+// lockDir takes the lock of a directory for this process.
+func lockDir(dir string) (*dirLock, error) {
+	dirLocks.Lock()
+	defer dirLocks.Unlock()
+	path := filepath.Join(dir, lockFileName)
+	if l, ok := dirLocks.locks[path]; ok {
+		l.refs++
+		return l, nil
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open lock file %s", path)
+	}
+	if err := flock(file); err != nil {
+		owner, _ := os.ReadFile(path)
+		file.Close()
+		if errors.Is(err, ErrStorageLocked) {
+			return nil, errors.Wrapf(ErrStorageLocked, "%s is held by pid %s; stop the other retriever or use another data path",
+				path, strings.TrimSpace(string(owner)))
+		}
+		return nil, errors.Wrapf(err, "failed to lock %s", path)
+	}
+	// the pid names the holder in the error of a second retriever
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "failed to truncate lock file %s", path)
+	}
+	if _, err := file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "failed to write lock file %s", path)
+	}
+	l := &dirLock{path: path, file: file, refs: 1}
+	dirLocks.locks[path] = l
+	return l, nil
+}
+
+// release drops the lock once every store of this process sharing it released it, calling last before if not nil.
+func (l *dirLock) release(last func()) error {
+	dirLocks.Lock()
+	defer dirLocks.Unlock()
+	l.refs--
+	if l.refs > 0 {
+		return nil
+	}
+	if last != nil {
+		last()
+	}
+	delete(dirLocks.locks, l.path)
+	// closing the file releases the flock
+	return l.file.Close()
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package storage
+
+import "os"
+
+// flock is a no-op on this platform, so the lock file does not keep other processes out.
+func flock(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlobStorageLock(t *testing.T) {
+	dir := t.TempDir()
+	bs, err := NewBlobStorage(WithLogger(zerolog.Nop()), WithBasePath(dir))
+	require.NoError(t, err)
+	// stores of one process share the lock
+	other, err := NewBlobStorage(WithLogger(zerolog.Nop()), WithBasePath(dir))
+	require.NoError(t, err)
+	require.NoError(t, other.Close())
+	require.NoError(t, bs.Close())
+
+	// a lock held through another file description, as by another process
+	file, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	require.NoError(t, flock(file))
+	_, err = NewBlobStorage(WithLogger(zerolog.Nop()), WithBasePath(dir))
+	require.ErrorIs(t, err, ErrStorageLocked)
+	_, err = NewBlobStorage(WithLogger(zerolog.Nop()), WithBasePath(dir), WithLock(false))
+	require.NoError(t, err)
+
+	require.NoError(t, file.Close())
+	bs, err = NewBlobStorage(WithLogger(zerolog.Nop()), WithBasePath(dir))
+	require.NoError(t, err)
+	require.NoError(t, bs.Close())
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// PrunableStore is a store whose roots can be listed, measured and removed. RetentionSlots is the retention window
+// of the store set with WithBlobRetentionEpochs, 0 keeps every slot.
+type PrunableStore interface {
+	Roots() ([][32]byte, error)
+	Slot(root [32]byte) (uint64, error)
+	Size(root [32]byte) (uint64, error)
+	Remove(root [32]byte) error
+	RetentionSlots() uint64
+}
+
+// PrunePolicy selects the roots kept by Prune. Roots outside the retention window of the store or the slot range
+// are removed.
+type PrunePolicy struct {
+	// HeadSlot is the slot of the chain head the retention window ends at. It is required if the store has a window.
+	HeadSlot uint64
+	// FromSlot and ToSlot keep roots in the slot range. A ToSlot of 0 leaves the range open-ended.
+	FromSlot uint64
+	ToSlot   uint64
+}
+
+func (p PrunePolicy) keep(slot, retention uint64) bool {
+	if retention > 0 && p.HeadSlot > retention && slot < p.HeadSlot-retention {
+		return false
+	}
+	if slot < p.FromSlot {
+		return false
+	}
+	return p.ToSlot == 0 || slot <= p.ToSlot
+}
+
+// PruneReport counts the roots removed by Prune, or the ones it would remove in a dry run.
+type PruneReport struct {
+	DryRun bool
+	Pruned int
+	Kept   int
+	Bytes  uint64
+}
+
+// Prune removes the roots of the store the policy does not keep and reports the bytes reclaimed.
+// In a dry run the roots are only logged. Roots whose slot can not be read are kept.
+func Prune(log zerolog.Logger, store PrunableStore, policy PrunePolicy, dryRun bool) (PruneReport, error) {
+	report := PruneReport{DryRun: dryRun}
+	retention := store.RetentionSlots()
+	if retention > 0 && policy.HeadSlot == 0 {
+		return report, errors.New("the retention window needs the head slot of the chain")
+	}
+	roots, err := store.Roots()
+	if err != nil {
+		return report, err
+	}
+	slots := make(map[[32]byte]uint64, len(roots))
+	for _, root := range roots {
+		slot, err := store.Slot(root)
+		if err != nil {
+			log.Warn().Err(err).Str("root", rootString(root)).Msg("Keeping root without readable sidecars")
+			report.Kept++
+			continue
+		}
+		slots[root] = slot
+	}
+
+	for _, root := range roots {
+		slot, ok := slots[root]
+		if !ok {
+			continue
+		}
+		if policy.keep(slot, retention) {
+			report.Kept++
+			continue
+		}
+		size, err := store.Size(root)
+		if err != nil {
+			return report, err
+		}
+		if dryRun {
+			log.Info().Uint64("slot", slot).Str("root", rootString(root)).Uint64("bytes", size).Msg("Would prune root")
+		} else {
+			if err := store.Remove(root); err != nil {
+				return report, err
+			}
+			log.Debug().Uint64("slot", slot).Str("root", rootString(root)).Uint64("bytes", size).Msg("Pruned root")
+		}
+		report.Pruned++
+		report.Bytes += size
+	}
+	return report, nil
+}
+
+// RunPruner prunes the store every interval until the context is done, with the retention window ending at the
+// slot head returns.
+func RunPruner(ctx context.Context, log zerolog.Logger, store PrunableStore, head func(context.Context) (uint64, error), interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		headSlot, err := head(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to get the head slot to prune blob storage")
+			continue
+		}
+		report, err := Prune(log, store, PrunePolicy{HeadSlot: headSlot}, false)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to prune blob storage")
+			continue
+		}
+		if report.Pruned > 0 {
+			log.Info().Int("pruned", report.Pruned).Int("kept", report.Kept).Uint64("bytes", report.Bytes).Msg("Pruned blob storage")
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"testing"
+
+	fieldparams "github.com/prysmaticlabs/prysm/v5/config/fieldparams"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrune(t *testing.T) {
+	store, err := NewPrysmBlobStorage(zerolog.Nop(), t.TempDir(), 6, WithBlobRetentionEpochs(8))
+	require.NoError(t, err)
+	slots := map[[32]byte]uint64{{1}: 100, {2}: 200, {3}: 300, {4}: 400}
+	for root, slot := range slots {
+		sidecar := newTestSidecar(0, slot)
+		sidecar.KzgCommitment[0] = root[0]
+		_, err := store.Save(root, ConvDenebSideCar(sidecar))
+		require.NoError(t, err)
+	}
+	index, err := store.SlotIndex()
+	require.NoError(t, err)
+
+	// the retention window needs the head, which may be past the newest stored slot
+	_, err = Prune(zerolog.Nop(), store, PrunePolicy{ToSlot: 350}, true)
+	require.Error(t, err)
+
+	// slot 100 is outside the 256 slot retention window behind the head, slot 400 outside the range
+	policy := PrunePolicy{HeadSlot: 450, ToSlot: 350}
+	report, err := Prune(zerolog.Nop(), store, policy, true)
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Pruned)
+	require.Equal(t, 2, report.Kept)
+	require.Greater(t, report.Bytes, uint64(2*fieldparams.BlobLength))
+	require.Len(t, mustRoots(t, store), 4)
+
+	report, err = Prune(zerolog.Nop(), store, policy, false)
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Pruned)
+	require.Len(t, mustRoots(t, store), 2)
+	_, ok := index.Root(100)
+	require.False(t, ok)
+	head, _, _ := index.Head()
+	require.Equal(t, uint64(300), head)
+	_, err = store.GetByVersionedHash(KzgToVersionedHash(append([]byte{4}, make([]byte, 47)...)))
+	require.Error(t, err)
+	_, err = store.GetByVersionedHash(KzgToVersionedHash(append([]byte{2}, make([]byte, 47)...)))
+	require.NoError(t, err)
+}
+
+func mustRoots(t *testing.T, store PrunableStore) [][32]byte {
+	roots, err := store.Roots()
+	require.NoError(t, err)
+	return roots
+}
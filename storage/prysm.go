@@ -1,157 +1,265 @@
-package storage
-
-import (
-	"bytes"
-	"math"
-
-	"github.com/attestantio/go-eth2-client/spec/deneb"
-	fieldparams "github.com/prysmaticlabs/prysm/v5/config/fieldparams"
-	"github.com/prysmaticlabs/prysm/v5/consensus-types/primitives"
-	ethpb "github.com/prysmaticlabs/prysm/v5/proto/prysm/v1alpha1"
-	"github.com/rs/zerolog"
-)
-
-func NewPrysmBlobStorage(log zerolog.Logger, path string) (*PrysmBlobStorage, error) {
-	blobStorage, err := NewBlobStorage(
-		WithLogger(log),
-		WithBasePath(path),
-		WithBlobRetentionEpochs(math.MaxUint64),
-		WithSaveFsync(true),
-	)
-	if err != nil {
-		return nil, err
-	}
-	return &PrysmBlobStorage{blobStorage: blobStorage}, nil
-}
-
-var _ BlobStore = &PrysmBlobStorage{}
-
-type PrysmBlobStorage struct {
-	blobStorage *BlobStorage
-}
-
-func (p *PrysmBlobStorage) Exist(root [32]byte) bool {
-	data, err := p.blobStorage.Indices(root)
-	if err != nil {
-		return false
-	}
-	for _, d := range data {
-		if d == true {
-			return true
-		}
-	}
-	return false
-}
-
-func (p *PrysmBlobStorage) Save(root [32]byte, denebSidecar *deneb.BlobSidecar) error {
-	sidecar := ConvSideCar(denebSidecar)
-	return p.blobStorage.Save(root, sidecar)
-}
-
-func (p *PrysmBlobStorage) Get(root [32]byte, index uint64) (*ethpb.BlobSidecar, error) {
-	blob, err := p.blobStorage.Get(root, index)
-	if err != nil {
-		return nil, err
-	}
-
-	return blob, nil
-}
-
-func (p *PrysmBlobStorage) Valid(root [32]byte, denebSidecar *deneb.BlobSidecar) (bool, error) {
-	sidecar1 := ConvSideCar(denebSidecar)
-	marshal1, err := sidecar1.MarshalSSZ()
-	if err != nil {
-		return false, err
-	}
-	sidecar2, err := p.Get(root, sidecar1.Index)
-	if err != nil {
-		return false, err
-	}
-	marshal2, err := sidecar2.MarshalSSZ()
-	if err != nil {
-		return false, err
-	}
-	return bytes.Equal(marshal1, marshal2), nil
-}
-
-func ConvSideCar(denebSidecar *deneb.BlobSidecar) *ethpb.BlobSidecar {
-	var sidecar *ethpb.BlobSidecar = HydrateBlobSidecar(nil)
-	sidecar.Index = uint64(denebSidecar.Index)
-	sidecar.Blob = denebSidecar.Blob[:]
-	sidecar.KzgCommitment = denebSidecar.KZGCommitment[:]
-	sidecar.KzgProof = denebSidecar.KZGProof[:]
-	for i, proof := range denebSidecar.KZGCommitmentInclusionProof {
-		sidecar.CommitmentInclusionProof[i] = proof[:]
-	}
-	sidecar.SignedBlockHeader.Signature = denebSidecar.SignedBlockHeader.Signature[:]
-	sidecar.SignedBlockHeader.Header.Slot = primitives.Slot(denebSidecar.SignedBlockHeader.Message.Slot)
-	sidecar.SignedBlockHeader.Header.ProposerIndex = primitives.ValidatorIndex(denebSidecar.SignedBlockHeader.Message.ProposerIndex)
-	sidecar.SignedBlockHeader.Header.ParentRoot = denebSidecar.SignedBlockHeader.Message.ParentRoot[:]
-	sidecar.SignedBlockHeader.Header.BodyRoot = denebSidecar.SignedBlockHeader.Message.BodyRoot[:]
-	sidecar.SignedBlockHeader.Header.StateRoot = denebSidecar.SignedBlockHeader.Message.StateRoot[:]
-	return sidecar
-}
-
-// HydrateBlobSidecar hydrates a blob sidecar with correct field length sizes
-// to comply with SSZ marshalling and unmarshalling rules.
-func HydrateBlobSidecar(b *ethpb.BlobSidecar) *ethpb.BlobSidecar {
-	if b == nil {
-		b = &ethpb.BlobSidecar{}
-	}
-	if b.SignedBlockHeader == nil {
-		b.SignedBlockHeader = HydrateSignedBeaconHeader(&ethpb.SignedBeaconBlockHeader{
-			Header: &ethpb.BeaconBlockHeader{},
-		})
-	}
-	if b.Blob == nil {
-		b.Blob = make([]byte, fieldparams.BlobLength)
-	}
-	if b.KzgCommitment == nil {
-		b.KzgCommitment = make([]byte, fieldparams.BLSPubkeyLength)
-	}
-	if b.KzgProof == nil {
-		b.KzgProof = make([]byte, fieldparams.BLSPubkeyLength)
-	}
-
-	if b.CommitmentInclusionProof == nil {
-		b.CommitmentInclusionProof = HydrateCommitmentInclusionProofs()
-	}
-	return b
-}
-
-// HydrateCommitmentInclusionProofs returns 2d byte slice of Commitment Inclusion Proofs
-func HydrateCommitmentInclusionProofs() [][]byte {
-	r := make([][]byte, fieldparams.KzgCommitmentInclusionProofDepth)
-	for i := range r {
-		r[i] = make([]byte, fieldparams.RootLength)
-	}
-	return r
-}
-
-// HydrateSignedBeaconHeader hydrates a signed beacon block header with correct field length sizes
-// to comply with fssz marshalling and unmarshalling rules.
-func HydrateSignedBeaconHeader(h *ethpb.SignedBeaconBlockHeader) *ethpb.SignedBeaconBlockHeader {
-	if h.Signature == nil {
-		h.Signature = make([]byte, fieldparams.BLSSignatureLength)
-	}
-	h.Header = HydrateBeaconHeader(h.Header)
-	return h
-}
-
-// HydrateBeaconHeader hydrates a beacon block header with correct field length sizes
-// to comply with fssz marshalling and unmarshalling rules.
-func HydrateBeaconHeader(h *ethpb.BeaconBlockHeader) *ethpb.BeaconBlockHeader {
-	if h == nil {
-		h = &ethpb.BeaconBlockHeader{}
-	}
-	if h.BodyRoot == nil {
-		h.BodyRoot = make([]byte, fieldparams.RootLength)
-	}
-	if h.StateRoot == nil {
-		h.StateRoot = make([]byte, fieldparams.RootLength)
-	}
-	if h.ParentRoot == nil {
-		h.ParentRoot = make([]byte, fieldparams.RootLength)
-	}
-	return h
-}
+package storage
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/attestantio/go-eth2-client/spec/deneb"
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	fieldparams "github.com/prysmaticlabs/prysm/v5/config/fieldparams"
+	"github.com/prysmaticlabs/prysm/v5/consensus-types/primitives"
+	ethpb "github.com/prysmaticlabs/prysm/v5/proto/prysm/v1alpha1"
+	"github.com/rs/zerolog"
+)
+
+func NewPrysmBlobStorage(log zerolog.Logger, path string, maxBlobsPerBlock uint64, opts ...BlobStorageOption) (*PrysmBlobStorage, error) {
+	blobStorage, err := NewBlobStorage(append([]BlobStorageOption{
+		WithLogger(log),
+		WithBasePath(path),
+		WithMaxBlobsPerBlock(maxBlobsPerBlock),
+		WithSaveFsync(true),
+	}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	p := &PrysmBlobStorage{blobStorage: blobStorage}
+	if err := p.indexes.init(log, blobStorage, blobStorage); err != nil {
+		blobStorage.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+var _ BlobStore = &PrysmBlobStorage{}
+var _ BlobReader = &PrysmBlobStorage{}
+
+type PrysmBlobStorage struct {
+	blobStorage *BlobStorage
+	indexes     storeIndexes
+}
+
+func (p *PrysmBlobStorage) Exist(root [32]byte) bool {
+	data, err := p.blobStorage.Indices(root)
+	if err != nil {
+		return false
+	}
+	for _, d := range data {
+		if d == true {
+			return true
+		}
+	}
+	return false
+}
+
+// Save saves a sidecar unless one is stored for its index, and returns the number of bytes written.
+func (p *PrysmBlobStorage) Save(root [32]byte, denebSidecar *deneb.BlobSidecar) (uint64, error) {
+	sidecar := ConvSideCar(denebSidecar)
+	written, err := p.blobStorage.Save(root, sidecar)
+	if err != nil {
+		return 0, err
+	}
+	return written, p.indexes.add(root, uint64(sidecar.SignedBlockHeader.Header.Slot), sidecar.Index, sidecar.KzgCommitment)
+}
+
+func (p *PrysmBlobStorage) Get(root [32]byte, index uint64) (*ethpb.BlobSidecar, error) {
+	blob, err := p.blobStorage.Get(root, index)
+	if err != nil {
+		return nil, err
+	}
+
+	return blob, nil
+}
+
+func (p *PrysmBlobStorage) Indices(root [32]byte) ([]bool, error) {
+	return p.blobStorage.Indices(root)
+}
+
+// Replace saves a sidecar, atomically replacing the one stored for its index, and returns the number of bytes written.
+func (p *PrysmBlobStorage) Replace(root [32]byte, denebSidecar *deneb.BlobSidecar) (uint64, error) {
+	sidecar := ConvSideCar(denebSidecar)
+	old, _ := p.blobStorage.Commitment(root, sidecar.Index)
+	written, err := p.blobStorage.Replace(root, sidecar)
+	if err != nil {
+		return 0, err
+	}
+	return written, p.indexes.replace(root, uint64(sidecar.SignedBlockHeader.Header.Slot), sidecar.Index, old, sidecar.KzgCommitment)
+}
+
+// Roots returns the block roots which have sidecars in the store.
+func (p *PrysmBlobStorage) Roots() ([][32]byte, error) {
+	return p.blobStorage.Roots()
+}
+
+func (p *PrysmBlobStorage) Slot(root [32]byte) (uint64, error) {
+	return p.blobStorage.Slot(root)
+}
+
+func (p *PrysmBlobStorage) Size(root [32]byte) (uint64, error) {
+	return p.blobStorage.Size(root)
+}
+
+func (p *PrysmBlobStorage) RetentionSlots() uint64 {
+	return p.blobStorage.RetentionSlots()
+}
+
+// Close persists the versioned hash index and releases the lock on the storage directory.
+func (p *PrysmBlobStorage) Close() error {
+	if err := p.indexes.close(); err != nil {
+		p.blobStorage.Close()
+		return err
+	}
+	return p.blobStorage.Close()
+}
+
+// Remove removes all sidecars of a root and drops them from the indices.
+func (p *PrysmBlobStorage) Remove(root [32]byte) error {
+	slot, commitments, err := p.indexes.storedSidecars(root)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := p.blobStorage.Remove(root); err != nil {
+		return err
+	}
+	return p.indexes.remove(root, slot, commitments)
+}
+
+// SlotIndex returns the slot index of the store, built from disk on first use and kept up to date by Save.
+func (p *PrysmBlobStorage) SlotIndex() (*SlotIndex, error) {
+	return p.indexes.slotIndex()
+}
+
+// GetByVersionedHash returns the stored sidecar carrying the blob with the EIP-4844 versioned hash.
+// The versioned hash index is built from disk on first use.
+func (p *PrysmBlobStorage) GetByVersionedHash(hash [32]byte) (*ethpb.BlobSidecar, error) {
+	location, err := p.indexes.locate(hash)
+	if err != nil {
+		return nil, err
+	}
+	return p.Get(location.Root, location.Index)
+}
+
+func (p *PrysmBlobStorage) Valid(root [32]byte, denebSidecar *deneb.BlobSidecar) (bool, error) {
+	sidecar1 := ConvSideCar(denebSidecar)
+	marshal1, err := sidecar1.MarshalSSZ()
+	if err != nil {
+		return false, err
+	}
+	sidecar2, err := p.Get(root, sidecar1.Index)
+	if err != nil {
+		return false, err
+	}
+	marshal2, err := sidecar2.MarshalSSZ()
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(marshal1, marshal2), nil
+}
+
+func ConvSideCar(denebSidecar *deneb.BlobSidecar) *ethpb.BlobSidecar {
+	var sidecar *ethpb.BlobSidecar = HydrateBlobSidecar(nil)
+	sidecar.Index = uint64(denebSidecar.Index)
+	sidecar.Blob = denebSidecar.Blob[:]
+	sidecar.KzgCommitment = denebSidecar.KZGCommitment[:]
+	sidecar.KzgProof = denebSidecar.KZGProof[:]
+	for i, proof := range denebSidecar.KZGCommitmentInclusionProof {
+		sidecar.CommitmentInclusionProof[i] = proof[:]
+	}
+	sidecar.SignedBlockHeader.Signature = denebSidecar.SignedBlockHeader.Signature[:]
+	sidecar.SignedBlockHeader.Header.Slot = primitives.Slot(denebSidecar.SignedBlockHeader.Message.Slot)
+	sidecar.SignedBlockHeader.Header.ProposerIndex = primitives.ValidatorIndex(denebSidecar.SignedBlockHeader.Message.ProposerIndex)
+	sidecar.SignedBlockHeader.Header.ParentRoot = denebSidecar.SignedBlockHeader.Message.ParentRoot[:]
+	sidecar.SignedBlockHeader.Header.BodyRoot = denebSidecar.SignedBlockHeader.Message.BodyRoot[:]
+	sidecar.SignedBlockHeader.Header.StateRoot = denebSidecar.SignedBlockHeader.Message.StateRoot[:]
+	return sidecar
+}
+
+// ConvDenebSideCar converts a prysm blob sidecar back to the go-eth2-client representation.
+func ConvDenebSideCar(sidecar *ethpb.BlobSidecar) *deneb.BlobSidecar {
+	sidecar = HydrateBlobSidecar(sidecar)
+	denebSidecar := &deneb.BlobSidecar{
+		Index: deneb.BlobIndex(sidecar.Index),
+		SignedBlockHeader: &phase0.SignedBeaconBlockHeader{
+			Message: &phase0.BeaconBlockHeader{
+				Slot:          phase0.Slot(sidecar.SignedBlockHeader.Header.Slot),
+				ProposerIndex: phase0.ValidatorIndex(sidecar.SignedBlockHeader.Header.ProposerIndex),
+			},
+		},
+	}
+	copy(denebSidecar.Blob[:], sidecar.Blob)
+	copy(denebSidecar.KZGCommitment[:], sidecar.KzgCommitment)
+	copy(denebSidecar.KZGProof[:], sidecar.KzgProof)
+	for i, proof := range sidecar.CommitmentInclusionProof {
+		if i < len(denebSidecar.KZGCommitmentInclusionProof) {
+			copy(denebSidecar.KZGCommitmentInclusionProof[i][:], proof)
+		}
+	}
+	copy(denebSidecar.SignedBlockHeader.Signature[:], sidecar.SignedBlockHeader.Signature)
+	copy(denebSidecar.SignedBlockHeader.Message.ParentRoot[:], sidecar.SignedBlockHeader.Header.ParentRoot)
+	copy(denebSidecar.SignedBlockHeader.Message.StateRoot[:], sidecar.SignedBlockHeader.Header.StateRoot)
+	copy(denebSidecar.SignedBlockHeader.Message.BodyRoot[:], sidecar.SignedBlockHeader.Header.BodyRoot)
+	return denebSidecar
+}
+
+// HydrateBlobSidecar hydrates a blob sidecar with correct field length sizes
+// to comply with SSZ marshalling and unmarshalling rules.
+func HydrateBlobSidecar(b *ethpb.BlobSidecar) *ethpb.BlobSidecar {
+	if b == nil {
+		b = &ethpb.BlobSidecar{}
+	}
+	if b.SignedBlockHeader == nil {
+		b.SignedBlockHeader = HydrateSignedBeaconHeader(&ethpb.SignedBeaconBlockHeader{
+			Header: &ethpb.BeaconBlockHeader{},
+		})
+	}
+	if b.Blob == nil {
+		b.Blob = make([]byte, fieldparams.BlobLength)
+	}
+	if b.KzgCommitment == nil {
+		b.KzgCommitment = make([]byte, fieldparams.BLSPubkeyLength)
+	}
+	if b.KzgProof == nil {
+		b.KzgProof = make([]byte, fieldparams.BLSPubkeyLength)
+	}
+
+	if b.CommitmentInclusionProof == nil {
+		b.CommitmentInclusionProof = HydrateCommitmentInclusionProofs()
+	}
+	return b
+}
+
+// HydrateCommitmentInclusionProofs returns 2d byte slice of Commitment Inclusion Proofs
+func HydrateCommitmentInclusionProofs() [][]byte {
+	r := make([][]byte, fieldparams.KzgCommitmentInclusionProofDepth)
+	for i := range r {
+		r[i] = make([]byte, fieldparams.RootLength)
+	}
+	return r
+}
+
+// HydrateSignedBeaconHeader hydrates a signed beacon block header with correct field length sizes
+// to comply with fssz marshalling and unmarshalling rules.
+func HydrateSignedBeaconHeader(h *ethpb.SignedBeaconBlockHeader) *ethpb.SignedBeaconBlockHeader {
+	if h.Signature == nil {
+		h.Signature = make([]byte, fieldparams.BLSSignatureLength)
+	}
+	h.Header = HydrateBeaconHeader(h.Header)
+	return h
+}
+
+// HydrateBeaconHeader hydrates a beacon block header with correct field length sizes
+// to comply with fssz marshalling and unmarshalling rules.
+func HydrateBeaconHeader(h *ethpb.BeaconBlockHeader) *ethpb.BeaconBlockHeader {
+	if h == nil {
+		h = &ethpb.BeaconBlockHeader{}
+	}
+	if h.BodyRoot == nil {
+		h.BodyRoot = make([]byte, fieldparams.RootLength)
+	}
+	if h.StateRoot == nil {
+		h.StateRoot = make([]byte, fieldparams.RootLength)
+	}
+	if h.ParentRoot == nil {
+		h.ParentRoot = make([]byte, fieldparams.RootLength)
+	}
+	return h
+}
@@ -0,0 +1,382 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/spf13/afero"
+)
+
+const (
+	columnExt = "sszs"
+
+	// columnFileVersion, maxColumnsPerFile and columnHeaderSize describe the header of prysm's data column files:
+	// a version byte, the big endian uint32 size of one sidecar, and one byte per column holding 128 plus the
+	// position of the column's sidecar in the file, or a value below 128 for a missing column.
+	columnFileVersion = 0x01
+	maxColumnsPerFile = 128
+	columnHeaderSize  = 1 + 4 + maxColumnsPerFile
+
+	// columnDirName is the directory data columns are kept in, named like the one prysm keeps next to its blobs
+	// directory.
+	columnDirName = "data-columns"
+)
+
+var (
+	errColumnIndexOutOfBounds = errors.New("column index >= NumberOfColumns")
+	errColumnFile             = errors.New("invalid data column file")
+)
+
+// ColumnDir returns the data column directory of the store at path. It is inside the store, so stores at different
+// paths never share one, except for the blob directory of a shared node, whose columns prysm keeps next to it.
+func ColumnDir(path string, sharedNode bool) string {
+	if sharedNode {
+		return filepath.Join(filepath.Dir(filepath.Clean(path)), columnDirName)
+	}
+	return filepath.Join(path, columnDirName)
+}
+
+// ColumnLayout is the network configuration data column files are laid out by.
+type ColumnLayout struct {
+	NumberOfColumns uint64
+	SlotsPerEpoch   uint64
+	// EpochsPerPeriod is the number of epoch directories grouped in a period directory,
+	// MIN_EPOCHS_FOR_DATA_COLUMN_SIDECARS_REQUESTS in prysm.
+	EpochsPerPeriod uint64
+}
+
+// NewPrysmColumnStorage returns a store for fulu data column sidecars in prysm's format. The sidecars of a block
+// share one `<period>/<epoch>/<block root>.sszs` file, which starts with an index of the columns it holds.
+func NewPrysmColumnStorage(log zerolog.Logger, path string, layout ColumnLayout, opts ...BlobStorageOption) (*PrysmColumnStorage, error) {
+	if layout.NumberOfColumns == 0 || layout.NumberOfColumns > maxColumnsPerFile {
+		return nil, fmt.Errorf("number of columns %d is not within 1 and %d", layout.NumberOfColumns, maxColumnsPerFile)
+	}
+	if layout.SlotsPerEpoch == 0 || layout.EpochsPerPeriod == 0 {
+		return nil, errors.New("slots per epoch and epochs per period must be greater than 0")
+	}
+	// the recovery of blob storage knows the blob layout only, stale part files are cleaned up by the index walk
+	blobStorage, err := NewBlobStorage(append([]BlobStorageOption{
+		WithLogger(log),
+		WithBasePath(path),
+		WithSaveFsync(true),
+	}, append(opts, WithRecovery(false))...)...)
+	if err != nil {
+		return nil, err
+	}
+	p := &PrysmColumnStorage{blobStorage: blobStorage, layout: layout, paths: make(map[[32]byte]string)}
+	if err := p.index(); err != nil {
+		blobStorage.Close()
+		return nil, errors.Wrapf(err, "failed to index column storage at %s", path)
+	}
+	return p, nil
+}
+
+var _ ColumnStore = &PrysmColumnStorage{}
+
+type PrysmColumnStorage struct {
+	blobStorage *BlobStorage
+	layout      ColumnLayout
+
+	// paths maps the block roots to their files, the root alone does not tell the epoch directory.
+	mu    sync.RWMutex
+	paths map[[32]byte]string
+}
+
+// index walks the period and epoch directories for the column files, removing stale part files.
+func (p *PrysmColumnStorage) index() error {
+	periods, err := afero.ReadDir(p.blobStorage.fs, ".")
+	if err != nil {
+		return err
+	}
+	for _, period := range periods {
+		if !period.IsDir() {
+			continue
+		}
+		epochs, err := afero.ReadDir(p.blobStorage.fs, period.Name())
+		if err != nil {
+			return err
+		}
+		for _, epoch := range epochs {
+			if !epoch.IsDir() {
+				continue
+			}
+			dir := path.Join(period.Name(), epoch.Name())
+			entries, err := afero.ReadDir(p.blobStorage.fs, dir)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				name := path.Join(dir, entry.Name())
+				switch {
+				case strings.HasSuffix(entry.Name(), "."+partExt):
+					if p.blobStorage.shared || time.Since(entry.ModTime()) < partFileMaxAge {
+						continue
+					}
+					if err := p.blobStorage.fs.Remove(name); err != nil {
+						return err
+					}
+					p.blobStorage.log.Debug().Str("path", name).Msg("Removed stale part file")
+				case strings.HasSuffix(entry.Name(), "."+columnExt):
+					root, err := stringToRoot(strings.TrimSuffix(entry.Name(), "."+columnExt))
+					if err != nil {
+						continue
+					}
+					p.paths[root] = name
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (p *PrysmColumnStorage) Exist(root [32]byte) bool {
+	data, err := p.Indices(root)
+	if err != nil {
+		return false
+	}
+	for _, d := range data {
+		if d {
+			return true
+		}
+	}
+	return false
+}
+
+// Close releases the lock on the storage directory.
+func (p *PrysmColumnStorage) Close() error {
+	return p.blobStorage.Close()
+}
+
+// Save adds the columns missing from the block's file. Columns already stored are left as they are.
+func (p *PrysmColumnStorage) Save(root [32]byte, sidecars []*DataColumnSidecar) (uint64, error) {
+	return p.write(root, sidecars, false)
+}
+
+// Replace saves columns, replacing the ones stored for their indices. The block's file is rewritten atomically.
+func (p *PrysmColumnStorage) Replace(root [32]byte, sidecars []*DataColumnSidecar) (uint64, error) {
+	return p.write(root, sidecars, true)
+}
+
+// write puts columns into the file of their block and returns the size of the rewritten file, 0 if none changed.
+func (p *PrysmColumnStorage) write(root [32]byte, sidecars []*DataColumnSidecar, replace bool) (uint64, error) {
+	if len(sidecars) == 0 {
+		return 0, nil
+	}
+	for _, sidecar := range sidecars {
+		if sidecar.Index >= p.layout.NumberOfColumns {
+			return 0, errColumnIndexOutOfBounds
+		}
+		if len(sidecar.Raw) == 0 {
+			return 0, errSidecarEmptySSZData
+		}
+	}
+	fname := p.namer(root, uint64(sidecars[0].SignedBlockHeader.Message.Slot))
+	file, err := p.readFile(fname.path())
+	if errors.Is(err, os.ErrNotExist) {
+		file = &columnFile{size: len(sidecars[0].Raw)}
+	} else if err != nil {
+		return 0, err
+	}
+
+	changed := false
+	for _, sidecar := range sidecars {
+		ok, err := file.put(sidecar, replace)
+		if err != nil {
+			return 0, err
+		}
+		changed = changed || ok
+	}
+	if !changed {
+		p.blobStorage.log.Debug().Msg("Ignoring a duplicate data column sidecar save attempt")
+		return 0, nil
+	}
+	data := file.encode()
+	if err := p.blobStorage.writeFile(fname.dir(), fname.partPath(fmt.Sprintf("%p", data)), fname.path(), data); err != nil {
+		return 0, err
+	}
+	p.mu.Lock()
+	p.paths[root] = fname.path()
+	p.mu.Unlock()
+	return uint64(len(data)), nil
+}
+
+func (p *PrysmColumnStorage) Get(root [32]byte, index uint64) (*DataColumnSidecar, error) {
+	file, err := p.fileOf(root)
+	if err != nil {
+		return nil, err
+	}
+	raw, ok := file.get(index)
+	if !ok {
+		return nil, errors.Wrapf(os.ErrNotExist, "column %d of %#x", index, root)
+	}
+	return DecodeDataColumnSidecar(raw)
+}
+
+func (p *PrysmColumnStorage) Valid(root [32]byte, sidecar *DataColumnSidecar) (bool, error) {
+	stored, err := p.Get(root, sidecar.Index)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(stored.Raw, sidecar.Raw), nil
+}
+
+// Indices returns a bitmap of the column indices present on disk for a given root.
+func (p *PrysmColumnStorage) Indices(root [32]byte) ([]bool, error) {
+	mask := make([]bool, p.layout.NumberOfColumns)
+	p.mu.RLock()
+	name, ok := p.paths[root]
+	p.mu.RUnlock()
+	if !ok {
+		return mask, nil
+	}
+	f, err := p.blobStorage.fs.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return mask, nil
+		}
+		return mask, err
+	}
+	defer f.Close()
+	header := make([]byte, columnHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return mask, errors.Wrapf(errColumnFile, "%s: short header", name)
+	}
+	for index, position := range header[5:] {
+		if position < maxColumnsPerFile {
+			continue
+		}
+		if uint64(index) >= p.layout.NumberOfColumns {
+			return mask, errColumnIndexOutOfBounds
+		}
+		mask[index] = true
+	}
+	return mask, nil
+}
+
+func (p *PrysmColumnStorage) fileOf(root [32]byte) (*columnFile, error) {
+	p.mu.RLock()
+	name, ok := p.paths[root]
+	p.mu.RUnlock()
+	if !ok {
+		return nil, errors.Wrapf(os.ErrNotExist, "columns of %#x", root)
+	}
+	return p.readFile(name)
+}
+
+func (p *PrysmColumnStorage) readFile(name string) (*columnFile, error) {
+	data, err := afero.ReadFile(p.blobStorage.fs, name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := decodeColumnFile(data)
+	return file, errors.Wrap(err, name)
+}
+
+func (p *PrysmColumnStorage) namer(root [32]byte, slot uint64) columnNamer {
+	epoch := slot / p.layout.SlotsPerEpoch
+	return columnNamer{root: root, epoch: epoch, period: epoch / p.layout.EpochsPerPeriod}
+}
+
+// columnFile is a decoded data column file. positions holds the position of each column's sidecar plus one,
+// zero for a missing column.
+type columnFile struct {
+	size      int
+	positions [maxColumnsPerFile]int
+	sidecars  [][]byte
+}
+
+func decodeColumnFile(data []byte) (*columnFile, error) {
+	if len(data) < columnHeaderSize {
+		return nil, errors.Wrap(errColumnFile, "short header")
+	}
+	if data[0] != columnFileVersion {
+		return nil, errors.Wrapf(errColumnFile, "unsupported version %d", data[0])
+	}
+	file := &columnFile{size: int(binary.BigEndian.Uint32(data[1:5]))}
+	if file.size == 0 {
+		return nil, errors.Wrap(errColumnFile, "zero sidecar size")
+	}
+	body := data[columnHeaderSize:]
+	for index, position := range data[5:columnHeaderSize] {
+		if position < maxColumnsPerFile {
+			continue
+		}
+		offset := int(position-maxColumnsPerFile) * file.size
+		if offset+file.size > len(body) {
+			return nil, errors.Wrapf(errColumnFile, "column %d is beyond the end of the file", index)
+		}
+		file.positions[index] = int(position-maxColumnsPerFile) + 1
+	}
+	for offset := 0; offset+file.size <= len(body); offset += file.size {
+		file.sidecars = append(file.sidecars, body[offset:offset+file.size])
+	}
+	return file, nil
+}
+
+func (f *columnFile) get(index uint64) ([]byte, bool) {
+	if index >= maxColumnsPerFile || f.positions[index] == 0 {
+		return nil, false
+	}
+	return f.sidecars[f.positions[index]-1], true
+}
+
+// put adds a sidecar, or overwrites the stored one with replace, and reports whether the file changed.
+func (f *columnFile) put(sidecar *DataColumnSidecar, replace bool) (bool, error) {
+	// prysm reads the sidecars of a file by position, so they must all have the same size
+	if len(sidecar.Raw) != f.size {
+		return false, errors.Wrapf(errColumnFile, "column %d has size %d, the stored columns %d", sidecar.Index, len(sidecar.Raw), f.size)
+	}
+	if stored, ok := f.get(sidecar.Index); ok {
+		if !replace || bytes.Equal(stored, sidecar.Raw) {
+			return false, nil
+		}
+		f.sidecars[f.positions[sidecar.Index]-1] = sidecar.Raw
+		return true, nil
+	}
+	f.sidecars = append(f.sidecars, sidecar.Raw)
+	f.positions[sidecar.Index] = len(f.sidecars)
+	return true, nil
+}
+
+func (f *columnFile) encode() []byte {
+	data := make([]byte, columnHeaderSize, columnHeaderSize+len(f.sidecars)*f.size)
+	data[0] = columnFileVersion
+	binary.BigEndian.PutUint32(data[1:5], uint32(f.size))
+	for index, position := range f.positions {
+		if position > 0 {
+			data[5+index] = byte(maxColumnsPerFile + position - 1)
+		}
+	}
+	for _, sidecar := range f.sidecars {
+		data = append(data, sidecar...)
+	}
+	return data
+}
+
+type columnNamer struct {
+	root   [32]byte
+	epoch  uint64
+	period uint64
+}
+
+func (p columnNamer) dir() string {
+	return path.Join(fmt.Sprintf("%d", p.period), fmt.Sprintf("%d", p.epoch))
+}
+
+func (p columnNamer) partPath(entropy string) string {
+	return path.Join(p.dir(), fmt.Sprintf("%s-%s.%s", rootString(p.root), entropy, partExt))
+}
+
+func (p columnNamer) path() string {
+	return path.Join(p.dir(), fmt.Sprintf("%s.%s", rootString(p.root), columnExt))
+}
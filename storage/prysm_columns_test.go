@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/attestantio/go-eth2-client/spec/altair"
+	"github.com/attestantio/go-eth2-client/spec/deneb"
+	"github.com/attestantio/go-eth2-client/spec/electra"
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	goethkzg "github.com/crate-crypto/go-eth-kzg"
+	"github.com/holiman/uint256"
+	"github.com/prysmaticlabs/go-bitfield"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestColumn(t *testing.T, index uint64, slot uint64) []byte {
+	header := &phase0.SignedBeaconBlockHeader{Message: &phase0.BeaconBlockHeader{Slot: phase0.Slot(slot)}}
+	encoded, err := header.MarshalSSZ()
+	require.NoError(t, err)
+
+	raw := binary.LittleEndian.AppendUint64(nil, index)
+	for i := 0; i < 3; i++ {
+		raw = binary.LittleEndian.AppendUint32(raw, dataColumnSidecarFixedSize)
+	}
+	raw = append(raw, encoded...)
+	return append(raw, make([]byte, 4*32)...)
+}
+
+func TestDecodeDataColumnSidecars(t *testing.T) {
+	columns := [][]byte{newTestColumn(t, 3, 100), newTestColumn(t, 7, 100)}
+	list := binary.LittleEndian.AppendUint32(nil, 8)
+	list = binary.LittleEndian.AppendUint32(list, uint32(8+len(columns[0])))
+	list = append(append(list, columns[0]...), columns[1]...)
+
+	sidecars, err := DecodeDataColumnSidecars(list)
+	require.NoError(t, err)
+	require.Len(t, sidecars, 2)
+	require.Equal(t, uint64(3), sidecars[0].Index)
+	require.Equal(t, uint64(7), sidecars[1].Index)
+	require.Equal(t, phase0.Slot(100), sidecars[1].SignedBlockHeader.Message.Slot)
+
+	_, err = DecodeDataColumnSidecars(list[:len(list)-1])
+	require.ErrorIs(t, err, errInvalidColumnSidecar)
+}
+
+// newTestColumns returns columns of a block with one blob, which verify against their block root.
+func newTestColumns(t *testing.T, slot uint64, indices ...uint64) []*DataColumnSidecar {
+	ctx, err := getCellKzgContext()
+	require.NoError(t, err)
+	blob := &goethkzg.Blob{}
+	blob[31], blob[63] = 1, 2
+	commitment, err := ctx.BlobToKZGCommitment(blob, 0)
+	require.NoError(t, err)
+	cells, proofs, err := ctx.ComputeCellsAndKZGProofs(blob, 0)
+	require.NoError(t, err)
+
+	body := &electra.BeaconBlockBody{
+		ETH1Data:           &phase0.ETH1Data{BlockHash: make([]byte, 32)},
+		SyncAggregate:      &altair.SyncAggregate{SyncCommitteeBits: bitfield.NewBitvector512()},
+		ExecutionPayload:   &deneb.ExecutionPayload{BaseFeePerGas: uint256.NewInt(7)},
+		ExecutionRequests:  &electra.ExecutionRequests{},
+		BlobKZGCommitments: []deneb.KZGCommitment{deneb.KZGCommitment(commitment)},
+	}
+	bodyRoot, err := body.HashTreeRoot()
+	require.NoError(t, err)
+	tree, err := body.GetTree()
+	require.NoError(t, err)
+	// blob_kzg_commitments is field 11 of the 16 leaves of the body
+	proof, err := tree.Prove(16 + 11)
+	require.NoError(t, err)
+	header := &phase0.SignedBeaconBlockHeader{Message: &phase0.BeaconBlockHeader{Slot: phase0.Slot(slot), BodyRoot: bodyRoot}}
+	encoded, err := header.MarshalSSZ()
+	require.NoError(t, err)
+
+	var sidecars []*DataColumnSidecar
+	for _, index := range indices {
+		raw := binary.LittleEndian.AppendUint64(nil, index)
+		raw = binary.LittleEndian.AppendUint32(raw, dataColumnSidecarFixedSize)
+		raw = binary.LittleEndian.AppendUint32(raw, dataColumnSidecarFixedSize+bytesPerCell)
+		raw = binary.LittleEndian.AppendUint32(raw, dataColumnSidecarFixedSize+bytesPerCell+48)
+		raw = append(raw, encoded...)
+		for _, hash := range proof.Hashes {
+			raw = append(raw, hash...)
+		}
+		raw = append(raw, cells[index][:]...)
+		raw = append(raw, commitment[:]...)
+		raw = append(raw, proofs[index][:]...)
+		sidecar, err := DecodeDataColumnSidecar(raw)
+		require.NoError(t, err)
+		sidecars = append(sidecars, sidecar)
+	}
+	return sidecars
+}
+
+func TestVerifyDataColumnSidecar(t *testing.T) {
+	sidecars := newTestColumns(t, 100, 3, 64)
+	for _, sidecar := range sidecars {
+		require.NoError(t, VerifyDataColumnSidecar(sidecar, 128))
+	}
+	require.ErrorIs(t, VerifyDataColumnSidecar(sidecars[1], 64), errInvalidColumnSidecar)
+
+	// a cell of another column does not match the proof
+	sidecars[0].Column[0] = sidecars[1].Column[0]
+	require.Error(t, VerifyDataColumnSidecar(sidecars[0], 128))
+
+	// nor does a tampered inclusion proof
+	sidecars[1].KZGCommitmentsInclusionProof[2][0] ^= 0xff
+	require.ErrorContains(t, VerifyDataColumnSidecar(sidecars[1], 128), "inclusion proof")
+}
+
+func TestColumnStorage(t *testing.T) {
+	dir := t.TempDir()
+	layout := ColumnLayout{NumberOfColumns: 8, SlotsPerEpoch: 32, EpochsPerPeriod: 4}
+	cs, err := NewPrysmColumnStorage(zerolog.Nop(), dir, layout)
+	require.NoError(t, err)
+
+	sidecars := newTestColumns(t, 1000, 5, 2, 7)
+	root, err := sidecars[0].BlockRoot()
+	require.NoError(t, err)
+	require.False(t, cs.Exist(root))
+
+	_, err = cs.Save(root, sidecars[:1])
+	require.NoError(t, err)
+	require.True(t, cs.Exist(root))
+	written, err := cs.Save(root, sidecars[:2])
+	require.NoError(t, err)
+
+	// slot 1000 is in epoch 31 of period 7, and the file indexes the columns in the order they were saved
+	data, err := os.ReadFile(filepath.Join(dir, "7", "31", fmt.Sprintf("%#x.sszs", root)))
+	require.NoError(t, err)
+	size := len(sidecars[0].Raw)
+	require.Len(t, data, columnHeaderSize+2*size)
+	require.Equal(t, uint64(len(data)), written)
+	require.Equal(t, byte(0x01), data[0])
+	require.Equal(t, uint32(size), binary.BigEndian.Uint32(data[1:5]))
+	require.Equal(t, []byte{0, 0, 129, 0, 0, 128, 0, 0}, data[5:13])
+	require.Equal(t, sidecars[0].Raw, data[columnHeaderSize:columnHeaderSize+size])
+	require.Equal(t, sidecars[1].Raw, data[columnHeaderSize+size:])
+
+	mask, err := cs.Indices(root)
+	require.NoError(t, err)
+	require.Equal(t, []bool{false, false, true, false, false, true, false, false}, mask)
+	valid, err := cs.Valid(root, sidecars[1])
+	require.NoError(t, err)
+	require.True(t, valid)
+	_, err = cs.Valid(root, sidecars[2])
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// a replaced column keeps its position
+	replaced, err := DecodeDataColumnSidecar(append([]byte{}, sidecars[0].Raw...))
+	require.NoError(t, err)
+	replaced.Column[0][0] ^= 0xff
+	_, err = cs.Replace(root, []*DataColumnSidecar{replaced})
+	require.NoError(t, err)
+	valid, err = cs.Valid(root, replaced)
+	require.NoError(t, err)
+	require.True(t, valid)
+	require.NoError(t, cs.Close())
+
+	// the files are found again on open
+	cs, err = NewPrysmColumnStorage(zerolog.Nop(), dir, layout)
+	require.NoError(t, err)
+	defer cs.Close()
+	stored, err := cs.Get(root, 2)
+	require.NoError(t, err)
+	require.Equal(t, sidecars[1].Raw, stored.Raw)
+	mask, err = cs.Indices(root)
+	require.NoError(t, err)
+	require.Equal(t, []bool{false, false, true, false, false, true, false, false}, mask)
+
+	outOfRange := newTestColumns(t, 1000, 8)
+	_, err = cs.Save(root, outOfRange)
+	require.ErrorIs(t, err, errColumnIndexOutOfBounds)
+	short, err := DecodeDataColumnSidecar(newTestColumn(t, 7, 1000))
+	require.NoError(t, err)
+	_, err = cs.Save(root, []*DataColumnSidecar{short})
+	require.ErrorIs(t, err, errColumnFile)
+}
+
+func TestColumnDir(t *testing.T) {
+	require.Equal(t, filepath.Join("data", "blobs", "data-columns"), ColumnDir(filepath.Join("data", "blobs"), false))
+	require.Equal(t, filepath.Join("data", "data-columns"), ColumnDir(filepath.Join("data", "blobs"), true))
+}
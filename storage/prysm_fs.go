@@ -1,288 +1,628 @@
-package storage
-
-import (
-	"fmt"
-	"os"
-	"path"
-	"strconv"
-	"strings"
-
-	"github.com/pkg/errors"
-	fieldparams "github.com/prysmaticlabs/prysm/v5/config/fieldparams"
-	"github.com/prysmaticlabs/prysm/v5/consensus-types/primitives"
-	ethpb "github.com/prysmaticlabs/prysm/v5/proto/prysm/v1alpha1"
-	"github.com/rs/zerolog"
-	"github.com/spf13/afero"
-)
-
-var (
-	errIndexOutOfBounds    = errors.New("blob index in file name >= MaxBlobsPerBlock")
-	errEmptyBlobWritten    = errors.New("zero bytes written to disk when saving blob sidecar")
-	errSidecarEmptySSZData = errors.New("sidecar marshalled to an empty ssz byte slice")
-	errNoBasePath          = errors.New("BlobStorage base path not specified in init")
-)
-
-const (
-	sszExt  = "ssz"
-	partExt = "part"
-
-	directoryPermissions = 0700
-)
-
-// BlobStorageOption is a functional option for configuring a BlobStorage.
-type BlobStorageOption func(*BlobStorage) error
-
-// WithBlobRetentionEpochs is an option that changes the number of epochs blobs will be persisted.
-func WithLogger(log zerolog.Logger) BlobStorageOption {
-	return func(b *BlobStorage) error {
-		b.log = log
-		return nil
-	}
-}
-
-// WithBasePath is a required option that sets the base path of blob storage.
-func WithBasePath(base string) BlobStorageOption {
-	return func(b *BlobStorage) error {
-		b.base = base
-		return nil
-	}
-}
-
-// WithBlobRetentionEpochs is an option that changes the number of epochs blobs will be persisted.
-func WithBlobRetentionEpochs(e primitives.Epoch) BlobStorageOption {
-	return func(b *BlobStorage) error {
-		b.retentionEpochs = e
-		return nil
-	}
-}
-
-// WithSaveFsync is an option that causes Save to call fsync before renaming part files for improved durability.
-func WithSaveFsync(fsync bool) BlobStorageOption {
-	return func(b *BlobStorage) error {
-		b.fsync = fsync
-		return nil
-	}
-}
-
-// NewBlobStorage creates a new instance of the BlobStorage object. Note that the implementation of BlobStorage may
-// attempt to hold a file lock to guarantee exclusive control of the blob storage directory, so this should only be
-// initialized once per beacon node.
-func NewBlobStorage(opts ...BlobStorageOption) (*BlobStorage, error) {
-	b := &BlobStorage{}
-	for _, o := range opts {
-		if err := o(b); err != nil {
-			return nil, errors.Wrap(err, "failed to create blob storage")
-		}
-	}
-
-	if b.base == "" {
-		return nil, errNoBasePath
-	}
-	b.base = path.Clean(b.base)
-	if err := os.MkdirAll(b.base, 0755); err != nil {
-		return nil, errors.Wrapf(err, "failed to create blob storage at %s", b.base)
-	}
-	b.fs = afero.NewBasePathFs(afero.NewOsFs(), b.base)
-	return b, nil
-}
-
-// BlobStorage is the concrete implementation of the filesystem backend for saving and retrieving BlobSidecars.
-type BlobStorage struct {
-	log             zerolog.Logger
-	base            string
-	retentionEpochs primitives.Epoch
-	fsync           bool
-	fs              afero.Fs
-}
-
-// Save saves blobs given a list of sidecars.
-func (bs *BlobStorage) Save(root [32]byte, sidecar *ethpb.BlobSidecar) error {
-	fname := namerForSidecar(root, sidecar.Index)
-	sszPath := fname.path()
-	exists, err := afero.Exists(bs.fs, sszPath)
-	if err != nil {
-		return err
-	}
-	if exists {
-		bs.log.Debug().Msg("Ignoring a duplicate blob sidecar save attempt")
-		return nil
-	}
-
-	// Serialize the ethpb.BlobSidecar to binary data using SSZ.
-	sidecarData, err := sidecar.MarshalSSZ()
-	if err != nil {
-		return errors.Wrap(err, "failed to serialize sidecar data")
-	} else if len(sidecarData) == 0 {
-		return errSidecarEmptySSZData
-	}
-
-	if err := bs.fs.MkdirAll(fname.dir(), directoryPermissions); err != nil {
-		return err
-	}
-	partPath := fname.partPath(fmt.Sprintf("%p", sidecarData))
-
-	partialMoved := false
-	// Ensure the partial file is deleted.
-	defer func() {
-		if partialMoved {
-			return
-		}
-		// It's expected to error if the save is successful.
-		err = bs.fs.Remove(partPath)
-		if err == nil {
-			bs.log.Debug().Str("partPath", partPath).Msg("Removed partial file")
-		}
-	}()
-
-	// Create a partial file and write the serialized data to it.
-	partialFile, err := bs.fs.Create(partPath)
-	if err != nil {
-		return errors.Wrap(err, "failed to create partial file")
-	}
-
-	n, err := partialFile.Write(sidecarData)
-	if err != nil {
-		closeErr := partialFile.Close()
-		if closeErr != nil {
-			return closeErr
-		}
-		return errors.Wrap(err, "failed to write to partial file")
-	}
-	if bs.fsync {
-		if err := partialFile.Sync(); err != nil {
-			return err
-		}
-	}
-
-	if err := partialFile.Close(); err != nil {
-		return err
-	}
-
-	if n != len(sidecarData) {
-		return fmt.Errorf("failed to write the full bytes of sidecarData, wrote only %d of %d bytes", n, len(sidecarData))
-	}
-
-	if n == 0 {
-		return errEmptyBlobWritten
-	}
-
-	// Atomically rename the partial file to its final name.
-	err = bs.fs.Rename(partPath, sszPath)
-	if err != nil {
-		return errors.Wrap(err, "failed to rename partial file to final name")
-	}
-	partialMoved = true
-	return nil
-}
-
-// Get retrieves a single BlobSidecar by its root and index.
-// Since BlobStorage only writes blobs that have undergone full verification, the return
-// value is always a VerifiedROBlob.
-func (bs *BlobStorage) Get(root [32]byte, idx uint64) (*ethpb.BlobSidecar, error) {
-	expected := blobNamer{root: root, index: idx}
-	encoded, err := afero.ReadFile(bs.fs, expected.path())
-	if err != nil {
-		return nil, err
-	}
-	s := &ethpb.BlobSidecar{}
-	if err := s.UnmarshalSSZ(encoded); err != nil {
-		return s, err
-	}
-	return s, nil
-}
-
-// Remove removes all blobs for a given root.
-func (bs *BlobStorage) Remove(root [32]byte) error {
-	rootDir := blobNamer{root: root}.dir()
-	return bs.fs.RemoveAll(rootDir)
-}
-
-// Indices generates a bitmap representing which BlobSidecar.Index values are present on disk for a given root.
-// This value can be compared to the commitments observed in a block to determine which indices need to be found
-// on the network to confirm data availability.
-func (bs *BlobStorage) Indices(root [32]byte) ([fieldparams.MaxBlobsPerBlock]bool, error) {
-	var mask [fieldparams.MaxBlobsPerBlock]bool
-	rootDir := blobNamer{root: root}.dir()
-	entries, err := afero.ReadDir(bs.fs, rootDir)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return mask, nil
-		}
-		return mask, err
-	}
-	for i := range entries {
-		if entries[i].IsDir() {
-			continue
-		}
-		name := entries[i].Name()
-		if !strings.HasSuffix(name, sszExt) {
-			continue
-		}
-		parts := strings.Split(name, ".")
-		if len(parts) != 2 {
-			continue
-		}
-		u, err := strconv.ParseUint(parts[0], 10, 64)
-		if err != nil {
-			return mask, errors.Wrapf(err, "unexpected directory entry breaks listing, %s", parts[0])
-		}
-		if u >= fieldparams.MaxBlobsPerBlock {
-			return mask, errIndexOutOfBounds
-		}
-		mask[u] = true
-	}
-	return mask, nil
-}
-
-// Clear deletes all files on the filesystem.
-func (bs *BlobStorage) Clear() error {
-	dirs, err := listDir(bs.fs, ".")
-	if err != nil {
-		return err
-	}
-	for _, dir := range dirs {
-		if err := bs.fs.RemoveAll(dir); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-type blobNamer struct {
-	root  [32]byte
-	index uint64
-}
-
-func namerForSidecar(root [32]byte, index uint64) blobNamer {
-	return blobNamer{root: root, index: index}
-}
-
-func (p blobNamer) dir() string {
-	return rootString(p.root)
-}
-
-func (p blobNamer) partPath(entropy string) string {
-	return path.Join(p.dir(), fmt.Sprintf("%s-%d.%s", entropy, p.index, partExt))
-}
-
-func (p blobNamer) path() string {
-	return path.Join(p.dir(), fmt.Sprintf("%d.%s", p.index, sszExt))
-}
-
-func rootString(root [32]byte) string {
-	return fmt.Sprintf("%#x", root)
-}
-
-func listDir(fs afero.Fs, dir string) ([]string, error) {
-	top, err := fs.Open(dir)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to open directory descriptor")
-	}
-	defer top.Close()
-	// re the -1 param: "If n <= 0, Readdirnames returns all the names from the directory in a single slice"
-	dirs, err := top.Readdirnames(-1)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to read directory listing")
-	}
-	return dirs, nil
-}
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	fieldparams "github.com/prysmaticlabs/prysm/v5/config/fieldparams"
+	"github.com/prysmaticlabs/prysm/v5/consensus-types/primitives"
+	ethpb "github.com/prysmaticlabs/prysm/v5/proto/prysm/v1alpha1"
+	"github.com/rs/zerolog"
+	"github.com/spf13/afero"
+)
+
+var (
+	errIndexOutOfBounds    = errors.New("blob index in file name >= MaxBlobsPerBlock")
+	errEmptyBlobWritten    = errors.New("zero bytes written to disk when saving blob sidecar")
+	errSidecarEmptySSZData = errors.New("sidecar marshalled to an empty ssz byte slice")
+	errNoBasePath          = errors.New("BlobStorage base path not specified in init")
+)
+
+const (
+	sszExt  = "ssz"
+	partExt = "part"
+
+	directoryPermissions = 0700
+
+	// defaultSlotsPerEpoch is the mainnet slots per epoch, and epochsPerPeriod the epochs of a period directory of
+	// prysm's by-epoch layout.
+	defaultSlotsPerEpoch = 32
+	epochsPerPeriod      = 4096
+
+	// sidecarCommitmentOffset and sidecarSlotOffset are the positions of the KZG commitment and the header slot
+	// in an SSZ encoded blob sidecar, which starts with the index, blob, commitment and proof.
+	sidecarCommitmentOffset = 8 + fieldparams.BlobLength
+	sidecarSlotOffset       = sidecarCommitmentOffset + 2*fieldparams.BLSPubkeyLength
+)
+
+// BlobStorageOption is a functional option for configuring a BlobStorage.
+type BlobStorageOption func(*BlobStorage) error
+
+// WithLogger is an option that sets the logger of blob storage.
+func WithLogger(log zerolog.Logger) BlobStorageOption {
+	return func(b *BlobStorage) error {
+		b.log = log
+		return nil
+	}
+}
+
+// WithBasePath is a required option that sets the base path of blob storage.
+func WithBasePath(base string) BlobStorageOption {
+	return func(b *BlobStorage) error {
+		b.base = base
+		return nil
+	}
+}
+
+// WithBlobRetentionEpochs is an option that changes the number of epochs blobs will be persisted.
+func WithBlobRetentionEpochs(e primitives.Epoch) BlobStorageOption {
+	return func(b *BlobStorage) error {
+		b.retentionEpochs = e
+		return nil
+	}
+}
+
+// WithMaxBlobsPerBlock is an option that sets the largest number of blobs a block may carry across all forks.
+// Blob indices on disk at or beyond this limit are rejected by Indices.
+func WithMaxBlobsPerBlock(max uint64) BlobStorageOption {
+	return func(b *BlobStorage) error {
+		if max == 0 {
+			return errors.New("max blobs per block must be greater than 0")
+		}
+		b.maxBlobsPerBlock = max
+		return nil
+	}
+}
+
+// WithSaveFsync is an option that causes Save to call fsync before renaming part files for improved durability.
+func WithSaveFsync(fsync bool) BlobStorageOption {
+	return func(b *BlobStorage) error {
+		b.fsync = fsync
+		return nil
+	}
+}
+
+// WithRecovery is an option that enables or disables the startup recovery pass, which is enabled by default.
+// It should be disabled for directories only read from, such as the blob directory of another node.
+func WithRecovery(enabled bool) BlobStorageOption {
+	return func(b *BlobStorage) error {
+		b.recovery = enabled
+		return nil
+	}
+}
+
+// WithLock is an option that enables or disables the advisory lock on the base path, which is enabled by default.
+// It should be disabled for directories only read from.
+func WithLock(enabled bool) BlobStorageOption {
+	return func(b *BlobStorage) error {
+		b.lock = enabled
+		return nil
+	}
+}
+
+// WithSharedNode is an option for a base path which is also the blob directory of a running beacon node. The node
+// does not take the lock of the base path, so writes are not coordinated with it: they only tolerate its pruning.
+// The node's files are left alone at startup, sidecars are written in the layout the node uses, flat or by-epoch,
+// and a save whose directory is removed by the node's pruner while it is written is retried once.
+func WithSharedNode(shared bool) BlobStorageOption {
+	return func(b *BlobStorage) error {
+		b.shared = shared
+		return nil
+	}
+}
+
+// WithSlotsPerEpoch is an option that sets the slots per epoch of the network, which places the root directories of
+// the by-epoch layout. It defaults to the mainnet value.
+func WithSlotsPerEpoch(slotsPerEpoch uint64) BlobStorageOption {
+	return func(b *BlobStorage) error {
+		if slotsPerEpoch == 0 {
+			return errors.New("slots per epoch must be greater than 0")
+		}
+		b.slotsPerEpoch = slotsPerEpoch
+		return nil
+	}
+}
+
+// NewBlobStorage creates a new instance of the BlobStorage object. Unless disabled with WithLock, it holds an
+// advisory file lock on the base path to keep other retrievers out, and returns ErrStorageLocked if one is running.
+// Unless disabled with WithRecovery or WithSharedNode, stale part files and corrupt sidecar files left by a process
+// which did not shut down cleanly are cleaned up first.
+func NewBlobStorage(opts ...BlobStorageOption) (*BlobStorage, error) {
+	b := &BlobStorage{maxBlobsPerBlock: fieldparams.MaxBlobsPerBlock, retentionEpochs: math.MaxUint64, slotsPerEpoch: defaultSlotsPerEpoch, recovery: true, lock: true}
+	for _, o := range opts {
+		if err := o(b); err != nil {
+			return nil, errors.Wrap(err, "failed to create blob storage")
+		}
+	}
+
+	if b.base == "" {
+		return nil, errNoBasePath
+	}
+	b.base = path.Clean(b.base)
+	if err := os.MkdirAll(b.base, 0755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create blob storage at %s", b.base)
+	}
+	b.fs = afero.NewBasePathFs(afero.NewOsFs(), b.base)
+	if b.lock {
+		l, err := lockDir(b.base)
+		if err != nil {
+			return nil, err
+		}
+		b.dirLock = l
+	}
+	if b.shared {
+		if err := b.detectLayout(); err != nil {
+			b.Close()
+			return nil, errors.Wrapf(err, "failed to read the layout of blob storage at %s", b.base)
+		}
+	}
+	if b.recovery && !b.shared {
+		report, err := b.recoverFiles()
+		if err != nil {
+			b.Close()
+			return nil, errors.Wrapf(err, "failed to recover blob storage at %s", b.base)
+		}
+		if report.PartFiles > 0 || report.Quarantined > 0 {
+			b.log.Info().Str("path", b.base).Int("partFiles", report.PartFiles).Int("quarantined", report.Quarantined).Msg("Recovered blob storage")
+		}
+	}
+	return b, nil
+}
+
+// BlobStorage is the concrete implementation of the filesystem backend for saving and retrieving BlobSidecars.
+type BlobStorage struct {
+	log              zerolog.Logger
+	base             string
+	retentionEpochs  primitives.Epoch
+	maxBlobsPerBlock uint64
+	slotsPerEpoch    uint64
+	fsync            bool
+	recovery         bool
+	lock             bool
+	shared           bool
+	dirLock          *dirLock
+	fs               afero.Fs
+
+	// byEpoch is set for a shared node using the by-epoch layout, whose root directories are found in rootDirs.
+	byEpoch  bool
+	dirsMu   sync.RWMutex
+	rootDirs map[[32]byte]string
+}
+
+// Save saves a sidecar unless one is stored for its index, and returns the number of bytes written.
+func (bs *BlobStorage) Save(root [32]byte, sidecar *ethpb.BlobSidecar) (uint64, error) {
+	fname := bs.namerForSidecar(root, sidecar)
+	sszPath := fname.path()
+	exists, err := afero.Exists(bs.fs, sszPath)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		bs.log.Debug().Msg("Ignoring a duplicate blob sidecar save attempt")
+		return 0, nil
+	}
+	return bs.write(root, sidecar)
+}
+
+// Replace saves a sidecar, atomically replacing the file stored for its index if there is one, and returns the
+// number of bytes written.
+func (bs *BlobStorage) Replace(root [32]byte, sidecar *ethpb.BlobSidecar) (uint64, error) {
+	return bs.write(root, sidecar)
+}
+
+func (bs *BlobStorage) write(root [32]byte, sidecar *ethpb.BlobSidecar) (uint64, error) {
+	fname := bs.namerForSidecar(root, sidecar)
+	// Serialize the ethpb.BlobSidecar to binary data using SSZ.
+	sidecarData, err := sidecar.MarshalSSZ()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to serialize sidecar data")
+	} else if len(sidecarData) == 0 {
+		return 0, errSidecarEmptySSZData
+	}
+
+	if err := bs.writeFile(fname.dir, fname.partPath(fmt.Sprintf("%p", sidecarData)), fname.path(), sidecarData); err != nil {
+		return 0, err
+	}
+	if bs.byEpoch {
+		bs.dirsMu.Lock()
+		bs.rootDirs[root] = fname.dir
+		bs.dirsMu.Unlock()
+	}
+	return uint64(len(sidecarData)), nil
+}
+
+// Close releases the lock on the base path. The last store of this process holding the lock marks the shutdown
+// clean, so the next startup recovery has nothing to check.
+func (bs *BlobStorage) Close() error {
+	if bs.dirLock == nil {
+		return nil
+	}
+	l := bs.dirLock
+	bs.dirLock = nil
+	return l.release(func() {
+		if !bs.recovery || bs.shared {
+			return
+		}
+		if err := bs.writeShutdownMarker(shutdownMarker{clean: true, at: time.Now()}); err != nil {
+			bs.log.Warn().Err(err).Msg("Failed to mark clean shutdown")
+		}
+	})
+}
+
+// writeFile writes data to a partial file in dir and atomically renames it to finalPath.
+// With a shared node, a write whose directory was removed meanwhile is retried once.
+func (bs *BlobStorage) writeFile(dir, partPath, finalPath string, data []byte) error {
+	err := bs.writePartFile(dir, partPath, finalPath, data)
+	if bs.shared && bs.removedDuringWrite(dir, finalPath, err) {
+		bs.log.Warn().Err(err).Str("dir", dir).Msg("Directory removed during save, likely by the beacon node's pruner, retrying")
+		err = bs.writePartFile(dir, partPath, finalPath, data)
+	}
+	return err
+}
+
+// removedDuringWrite reports whether a failed write lost its directory, or a successful one its file.
+func (bs *BlobStorage) removedDuringWrite(dir, finalPath string, err error) bool {
+	if err != nil {
+		exists, existsErr := afero.DirExists(bs.fs, dir)
+		return existsErr == nil && !exists
+	}
+	exists, existsErr := afero.Exists(bs.fs, finalPath)
+	return existsErr == nil && !exists
+}
+
+func (bs *BlobStorage) writePartFile(dir, partPath, finalPath string, data []byte) error {
+	if err := bs.fs.MkdirAll(dir, directoryPermissions); err != nil {
+		return err
+	}
+
+	partialMoved := false
+	// Ensure the partial file is deleted.
+	defer func() {
+		if partialMoved {
+			return
+		}
+		// It's expected to error if the save is successful.
+		if err := bs.fs.Remove(partPath); err == nil {
+			bs.log.Debug().Str("partPath", partPath).Msg("Removed partial file")
+		}
+	}()
+
+	// Create a partial file and write the serialized data to it.
+	partialFile, err := bs.fs.Create(partPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to create partial file")
+	}
+
+	n, err := partialFile.Write(data)
+	if err != nil {
+		closeErr := partialFile.Close()
+		if closeErr != nil {
+			return closeErr
+		}
+		return errors.Wrap(err, "failed to write to partial file")
+	}
+	if bs.fsync {
+		if err := partialFile.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if err := partialFile.Close(); err != nil {
+		return err
+	}
+
+	if n != len(data) {
+		return fmt.Errorf("failed to write the full bytes of data, wrote only %d of %d bytes", n, len(data))
+	}
+
+	if n == 0 {
+		return errEmptyBlobWritten
+	}
+
+	// Atomically rename the partial file to its final name.
+	err = bs.fs.Rename(partPath, finalPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to rename partial file to final name")
+	}
+	partialMoved = true
+	return nil
+}
+
+// Get retrieves a single BlobSidecar by its root and index.
+// Since BlobStorage only writes blobs that have undergone full verification, the return
+// value is always a VerifiedROBlob.
+func (bs *BlobStorage) Get(root [32]byte, idx uint64) (*ethpb.BlobSidecar, error) {
+	expected := bs.namer(root, idx)
+	encoded, err := afero.ReadFile(bs.fs, expected.path())
+	if err != nil {
+		return nil, err
+	}
+	s := &ethpb.BlobSidecar{}
+	if err := s.UnmarshalSSZ(encoded); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// Remove removes all blobs for a given root.
+func (bs *BlobStorage) Remove(root [32]byte) error {
+	if err := bs.fs.RemoveAll(bs.rootDir(root)); err != nil {
+		return err
+	}
+	if bs.byEpoch {
+		bs.dirsMu.Lock()
+		delete(bs.rootDirs, root)
+		bs.dirsMu.Unlock()
+	}
+	return nil
+}
+
+// Size returns the number of bytes stored for a root.
+func (bs *BlobStorage) Size(root [32]byte) (uint64, error) {
+	return dirSize(bs.fs, bs.rootDir(root))
+}
+
+// RetentionSlots returns the number of slots behind the chain head the store keeps blobs for, 0 keeps every slot.
+func (bs *BlobStorage) RetentionSlots() uint64 {
+	if bs.retentionEpochs == math.MaxUint64 {
+		return 0
+	}
+	return uint64(bs.retentionEpochs) * bs.slotsPerEpoch
+}
+
+// Indices generates a bitmap representing which BlobSidecar.Index values are present on disk for a given root.
+// This value can be compared to the commitments observed in a block to determine which indices need to be found
+// on the network to confirm data availability. The bitmap is sized to the configured max blobs per block.
+func (bs *BlobStorage) Indices(root [32]byte) ([]bool, error) {
+	mask := make([]bool, bs.maxBlobsPerBlock)
+	entries, err := afero.ReadDir(bs.fs, bs.rootDir(root))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return mask, nil
+		}
+		return mask, err
+	}
+	for i := range entries {
+		if entries[i].IsDir() {
+			continue
+		}
+		name := entries[i].Name()
+		if !strings.HasSuffix(name, sszExt) {
+			continue
+		}
+		parts := strings.Split(name, ".")
+		if len(parts) != 2 {
+			continue
+		}
+		u, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			return mask, errors.Wrapf(err, "unexpected directory entry breaks listing, %s", parts[0])
+		}
+		if u >= bs.maxBlobsPerBlock {
+			return mask, errIndexOutOfBounds
+		}
+		mask[u] = true
+	}
+	return mask, nil
+}
+
+// Roots returns the block roots which have a directory in the blob storage.
+func (bs *BlobStorage) Roots() ([][32]byte, error) {
+	if bs.byEpoch {
+		bs.dirsMu.RLock()
+		defer bs.dirsMu.RUnlock()
+		roots := make([][32]byte, 0, len(bs.rootDirs))
+		for root := range bs.rootDirs {
+			roots = append(roots, root)
+		}
+		return roots, nil
+	}
+	dirs, err := listDir(bs.fs, ".")
+	if err != nil {
+		return nil, err
+	}
+	roots := make([][32]byte, 0, len(dirs))
+	for _, dir := range dirs {
+		root, err := stringToRoot(dir)
+		if err != nil {
+			continue
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// Slot returns the slot of the block a root directory belongs to, read from the header of its first stored sidecar
+// without decoding the blob.
+func (bs *BlobStorage) Slot(root [32]byte) (uint64, error) {
+	mask, err := bs.Indices(root)
+	if err != nil {
+		return 0, err
+	}
+	for i, ok := range mask {
+		if !ok {
+			continue
+		}
+		var buf [8]byte
+		if err := bs.readAt(root, uint64(i), buf[:], sidecarSlotOffset); err != nil {
+			return 0, errors.Wrap(err, "failed to read sidecar slot")
+		}
+		return binary.LittleEndian.Uint64(buf[:]), nil
+	}
+	return 0, os.ErrNotExist
+}
+
+// Commitment returns the KZG commitment of a stored sidecar without decoding the blob.
+func (bs *BlobStorage) Commitment(root [32]byte, idx uint64) ([]byte, error) {
+	commitment := make([]byte, fieldparams.BLSPubkeyLength)
+	if err := bs.readAt(root, idx, commitment, sidecarCommitmentOffset); err != nil {
+		return nil, errors.Wrap(err, "failed to read sidecar commitment")
+	}
+	return commitment, nil
+}
+
+func (bs *BlobStorage) readAt(root [32]byte, idx uint64, buf []byte, offset int64) error {
+	f, err := bs.fs.Open(bs.namer(root, idx).path())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.ReadAt(buf, offset)
+	return err
+}
+
+// Clear deletes all files on the filesystem.
+func (bs *BlobStorage) Clear() error {
+	dirs, err := listDir(bs.fs, ".")
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := bs.fs.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// detectLayout finds the layout of a shared node's blob directory. With a by-epoch directory, prysm keeps root
+// directories under by-epoch/<epoch / 4096>/<epoch>, which are indexed by root since reads only know the root.
+func (bs *BlobStorage) detectLayout() error {
+	exists, err := afero.DirExists(bs.fs, byEpochDir)
+	if err != nil || !exists {
+		return err
+	}
+	epochs, err := epochDirs(path.Join(bs.base, byEpochDir))
+	if err != nil {
+		return err
+	}
+	bs.byEpoch = true
+	bs.rootDirs = make(map[[32]byte]string)
+	for _, epoch := range epochs {
+		rel, err := filepath.Rel(bs.base, epoch)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		names, err := listDir(bs.fs, rel)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if root, err := stringToRoot(name); err == nil {
+				bs.rootDirs[root] = path.Join(rel, name)
+			}
+		}
+	}
+	bs.log.Info().Str("path", bs.base).Int("roots", len(bs.rootDirs)).Msg("Shared node uses the by-epoch blob layout")
+	return nil
+}
+
+// rootDir returns the directory of a root relative to the base path. A root the by-epoch layout has no directory
+// for, such as one saved by the node since the storage was opened, is looked up at the top level, where it is not
+// found.
+func (bs *BlobStorage) rootDir(root [32]byte) string {
+	if bs.byEpoch {
+		bs.dirsMu.RLock()
+		defer bs.dirsMu.RUnlock()
+		if dir, ok := bs.rootDirs[root]; ok {
+			return dir
+		}
+	}
+	return rootString(root)
+}
+
+func (bs *BlobStorage) namer(root [32]byte, index uint64) blobNamer {
+	return blobNamer{dir: bs.rootDir(root), index: index}
+}
+
+// namerForSidecar names the file of a sidecar, placing a new root of the by-epoch layout by the slot of its block.
+func (bs *BlobStorage) namerForSidecar(root [32]byte, sidecar *ethpb.BlobSidecar) blobNamer {
+	if !bs.byEpoch {
+		return blobNamer{dir: rootString(root), index: sidecar.Index}
+	}
+	bs.dirsMu.RLock()
+	dir, ok := bs.rootDirs[root]
+	bs.dirsMu.RUnlock()
+	if !ok {
+		epoch := uint64(sidecar.SignedBlockHeader.Header.Slot) / bs.slotsPerEpoch
+		dir = path.Join(byEpochDir, strconv.FormatUint(epoch/epochsPerPeriod, 10), strconv.FormatUint(epoch, 10), rootString(root))
+	}
+	return blobNamer{dir: dir, index: sidecar.Index}
+}
+
+type blobNamer struct {
+	dir   string
+	index uint64
+}
+
+func (p blobNamer) partPath(entropy string) string {
+	return path.Join(p.dir, fmt.Sprintf("%s-%d.%s", entropy, p.index, partExt))
+}
+
+func (p blobNamer) path() string {
+	return path.Join(p.dir, fmt.Sprintf("%d.%s", p.index, sszExt))
+}
+
+func rootString(root [32]byte) string {
+	return fmt.Sprintf("%#x", root)
+}
+
+func stringToRoot(str string) ([32]byte, error) {
+	var root [32]byte
+	if !strings.HasPrefix(str, "0x") || len(str) != 2+2*len(root) {
+		return root, errors.Errorf("invalid root directory name %s", str)
+	}
+	if _, err := hex.Decode(root[:], []byte(str[2:])); err != nil {
+		return root, errors.Wrapf(err, "invalid root directory name %s", str)
+	}
+	return root, nil
+}
+
+// DecodeHex decodes a hex string, with or without a 0x prefix, into dst, which must match the decoded length.
+func DecodeHex(s string, dst []byte) error {
+	s = strings.TrimPrefix(s, "0x")
+	if hex.DecodedLen(len(s)) != len(dst) {
+		return errors.Errorf("expected hex of %d bytes, got %d", len(dst), hex.DecodedLen(len(s)))
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
+
+func listDir(fs afero.Fs, dir string) ([]string, error) {
+	top, err := fs.Open(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open directory descriptor")
+	}
+	defer top.Close()
+	// re the -1 param: "If n <= 0, Readdirnames returns all the names from the directory in a single slice"
+	dirs, err := top.Readdirnames(-1)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read directory listing")
+	}
+	return dirs, nil
+}
+
+func dirSize(fs afero.Fs, dir string) (uint64, error) {
+	entries, err := afero.ReadDir(fs, dir)
+	if err != nil {
+		return 0, err
+	}
+	var size uint64
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			size += uint64(entry.Size())
+		}
+	}
+	return size, nil
+}
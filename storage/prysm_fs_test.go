@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prysmaticlabs/prysm/v5/consensus-types/primitives"
+	ethpb "github.com/prysmaticlabs/prysm/v5/proto/prysm/v1alpha1"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSidecar(index uint64, slot uint64) *ethpb.BlobSidecar {
+	sidecar := HydrateBlobSidecar(nil)
+	sidecar.Index = index
+	sidecar.SignedBlockHeader.Header.Slot = primitives.Slot(slot)
+	return sidecar
+}
+
+func TestBlobStorageIndices(t *testing.T) {
+	bs, err := NewBlobStorage(WithLogger(zerolog.Nop()), WithBasePath(t.TempDir()), WithMaxBlobsPerBlock(9))
+	require.NoError(t, err)
+
+	root := [32]byte{1}
+	for _, index := range []uint64{0, 6, 8} {
+		_, err := bs.Save(root, newTestSidecar(index, 100))
+		require.NoError(t, err)
+	}
+	mask, err := bs.Indices(root)
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, false, false, false, false, false, true, false, true}, mask)
+
+	sidecar, err := bs.Get(root, 8)
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), sidecar.Index)
+
+	_, err = bs.Save(root, newTestSidecar(9, 100))
+
+	require.NoError(t, err)
+	_, err = bs.Indices(root)
+	require.ErrorIs(t, err, errIndexOutOfBounds)
+
+	mask, err = bs.Indices([32]byte{2})
+	require.NoError(t, err)
+	require.Len(t, mask, 9)
+}
+
+func TestGetByVersionedHash(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewPrysmBlobStorage(zerolog.Nop(), dir, 6)
+	require.NoError(t, err)
+
+	root := [32]byte{1}
+	sidecar := newTestSidecar(2, 100)
+	sidecar.KzgCommitment[0] = 0xc0
+	_, err = store.Save(root, ConvDenebSideCar(sidecar))
+	require.NoError(t, err)
+
+	// the index is built from disk when first used by a new store
+	store, err = NewPrysmBlobStorage(zerolog.Nop(), dir, 6)
+	require.NoError(t, err)
+	found, err := store.GetByVersionedHash(KzgToVersionedHash(sidecar.KzgCommitment))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), found.Index)
+
+	// and kept up to date by Save afterwards
+	other := newTestSidecar(0, 101)
+	other.KzgCommitment[0] = 0xc1
+	_, err = store.Save([32]byte{2}, ConvDenebSideCar(other))
+	require.NoError(t, err)
+	found, err = store.GetByVersionedHash(KzgToVersionedHash(other.KzgCommitment))
+	require.NoError(t, err)
+	require.Equal(t, uint64(101), uint64(found.SignedBlockHeader.Header.Slot))
+
+	_, err = store.GetByVersionedHash([32]byte{3})
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// the index is persisted with the changes made to it, and marked clean on close
+	require.NoError(t, store.Remove(root))
+	require.NoError(t, store.Close())
+	path := filepath.Join(dir, hashIndexFileName)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, byte(hashRecordClean), data[len(data)-hashRecordSize])
+	hashes, err := loadVersionedHashIndex(path)
+	require.NoError(t, err)
+	require.Equal(t, 1, hashes.Len())
+	_, ok := hashes.Location(KzgToVersionedHash(sidecar.KzgCommitment))
+	require.False(t, ok)
+
+	// an index which was not closed cleanly is rebuilt
+	require.NoError(t, os.WriteFile(path, data[:len(data)-hashRecordSize], 0600))
+	store, err = NewPrysmBlobStorage(zerolog.Nop(), dir, 6)
+	require.NoError(t, err)
+	require.NoFileExists(t, path)
+	found, err = store.GetByVersionedHash(KzgToVersionedHash(other.KzgCommitment))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), found.Index)
+	require.FileExists(t, path)
+	require.NoError(t, store.Close())
+}
+
+func TestVersionedHashIndexReload(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewPrysmBlobStorage(zerolog.Nop(), dir, 6)
+	require.NoError(t, err)
+	root := [32]byte{1}
+	sidecar := newTestSidecar(1, 100)
+	sidecar.KzgCommitment[0] = 0xc0
+	_, err = store.Save(root, ConvDenebSideCar(sidecar))
+	require.NoError(t, err)
+	hash := KzgToVersionedHash(sidecar.KzgCommitment)
+	_, err = store.GetByVersionedHash(hash)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	// the sidecar is removed behind the store's back, so only an index loaded from its file still locates it
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, rootString(root))))
+	store, err = NewPrysmBlobStorage(zerolog.Nop(), dir, 6)
+	require.NoError(t, err)
+	defer store.Close()
+	require.FileExists(t, filepath.Join(dir, hashIndexFileName))
+	location, err := store.indexes.locate(hash)
+	require.NoError(t, err)
+	require.Equal(t, BlobLocation{Root: root, Index: 1}, location)
+}
+
+func TestSharedNodeByEpochLayout(t *testing.T) {
+	dir := t.TempDir()
+	nodeRoot, root := [32]byte{1}, [32]byte{2}
+	data, err := newTestSidecar(0, 100).MarshalSSZ()
+	require.NoError(t, err)
+	nodeDir := filepath.Join(dir, byEpochDir, "0", "3", rootString(nodeRoot))
+	require.NoError(t, os.MkdirAll(nodeDir, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(nodeDir, "0.ssz"), data, 0600))
+
+	bs, err := NewBlobStorage(WithLogger(zerolog.Nop()), WithBasePath(dir), WithMaxBlobsPerBlock(6), WithSharedNode(true), WithSlotsPerEpoch(32))
+	require.NoError(t, err)
+	defer bs.Close()
+	mask, err := bs.Indices(nodeRoot)
+	require.NoError(t, err)
+	require.True(t, mask[0])
+
+	// a new root is placed by the epoch of its slot, next to the node's
+	_, err = bs.Save(root, newTestSidecar(1, 200))
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(dir, byEpochDir, "0", "6", rootString(root), "1.ssz"))
+	sidecar, err := bs.Get(root, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), sidecar.Index)
+	roots, err := bs.Roots()
+	require.NoError(t, err)
+	require.ElementsMatch(t, [][32]byte{nodeRoot, root}, roots)
+
+	require.NoError(t, bs.Remove(root))
+	require.NoDirExists(t, filepath.Join(dir, byEpochDir, "0", "6", rootString(root)))
+	roots, err = bs.Roots()
+	require.NoError(t, err)
+	require.Equal(t, [][32]byte{nodeRoot}, roots)
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// byEpochDir is the directory of prysm's by-epoch blob layout, which nests root directories as
+// by-epoch/<epoch / 4096>/<epoch>/<root>. The flat layout keeps root directories at the top level.
+const byEpochDir = "by-epoch"
+
+// OpenBlobDirs opens the blob directory of a prysm node, in the flat or the by-epoch layout.
+// The by-epoch layout is opened as one BlobStorage per epoch directory, so every returned storage holds
+// root directories at its top level and can be read with Roots, Indices and Get. The directories are only read,
+// so the startup recovery pass and the lock are disabled.
+func OpenBlobDirs(log zerolog.Logger, dir string, maxBlobsPerBlock uint64) ([]*BlobStorage, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.Errorf("%s is not a directory", dir)
+	}
+
+	bases := []string{dir}
+	if _, err := os.Stat(filepath.Join(dir, byEpochDir)); err == nil {
+		if bases, err = epochDirs(filepath.Join(dir, byEpochDir)); err != nil {
+			return nil, err
+		}
+	}
+
+	stores := make([]*BlobStorage, 0, len(bases))
+	for _, base := range bases {
+		bs, err := NewBlobStorage(WithLogger(log), WithBasePath(base), WithMaxBlobsPerBlock(maxBlobsPerBlock), WithRecovery(false), WithLock(false))
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, bs)
+	}
+	return stores, nil
+}
+
+// epochDirs lists the epoch directories of a by-epoch layout in epoch order.
+func epochDirs(dir string) ([]string, error) {
+	periods, err := numericDirs(dir)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, period := range periods {
+		epochs, err := numericDirs(period)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, epochs...)
+	}
+	return dirs, nil
+}
+
+func numericDirs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read directory %s", dir)
+	}
+	type numbered struct {
+		n    uint64
+		path string
+	}
+	var dirs []numbered
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		n, err := strconv.ParseUint(entry.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		dirs = append(dirs, numbered{n, filepath.Join(dir, entry.Name())})
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].n < dirs[j].n })
+	paths := make([]string, len(dirs))
+	for i := range dirs {
+		paths[i] = dirs[i].path
+	}
+	return paths, nil
+}
@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	fieldparams "github.com/prysmaticlabs/prysm/v5/config/fieldparams"
+	ethpb "github.com/prysmaticlabs/prysm/v5/proto/prysm/v1alpha1"
+	"github.com/spf13/afero"
+)
+
+const (
+	// quarantineDir holds the sidecar files recovery found corrupt, named <root>-<file>, for inspection.
+	quarantineDir = "quarantine"
+
+	// partFileMaxAge is the age from which a part file is left over from an interrupted save rather than
+	// being written by a save in progress, e.g. of a beacon node sharing the directory.
+	partFileMaxAge = time.Minute
+
+	// shutdownMarkerName is the file in the base path recording the last clean shutdown of a store.
+	shutdownMarkerName = "blob-retriever.shutdown"
+)
+
+// RecoveryReport counts the files cleaned up by the startup recovery of a blob storage.
+type RecoveryReport struct {
+	PartFiles   int
+	Quarantined int
+}
+
+// shutdownMarker is the content of the shutdown marker: the time of the last clean shutdown, zero if there was none,
+// and whether the store was closed since. It is set to open by the recovery pass and to clean by Close, so a store
+// which was not closed cleanly still knows the time from which files may be corrupt.
+type shutdownMarker struct {
+	clean bool
+	at    time.Time
+}
+
+// recoverFiles deletes stale part files and moves corrupt sidecar files to the quarantine directory, walking the root
+// directories of the flat and the by-epoch layout. After a clean shutdown there is nothing to recover, otherwise only
+// the directories and files changed since the last clean shutdown are checked, or all of them without a marker.
+// Every checked sidecar file is decoded: .ssz files, compressed or not, must decode to a sidecar of the index in their
+// name, and .meta files of a deduplicating archive store must decode as well and point at a stored blob body.
+func (bs *BlobStorage) recoverFiles() (RecoveryReport, error) {
+	var report RecoveryReport
+	marker, err := bs.readShutdownMarker()
+	if err != nil {
+		return report, err
+	}
+	if !marker.clean {
+		r := &recovery{bs: bs, since: marker.at}
+		defer r.close()
+		dirs := []string{"."}
+		if exists, err := afero.DirExists(bs.fs, byEpochDir); err != nil {
+			return report, err
+		} else if exists {
+			epochs, err := epochDirs(filepath.Join(bs.base, byEpochDir))
+			if err != nil {
+				return report, err
+			}
+			for _, epoch := range epochs {
+				rel, err := filepath.Rel(bs.base, epoch)
+				if err != nil {
+					return report, err
+				}
+				dirs = append(dirs, filepath.ToSlash(rel))
+			}
+		}
+		for _, dir := range dirs {
+			if err := r.walk(dir, &report); err != nil {
+				return report, err
+			}
+		}
+	}
+	// the marker stays open until Close, so a crash leaves the time of the last clean shutdown to check from
+	return report, bs.writeShutdownMarker(shutdownMarker{at: marker.at})
+}
+
+// recovery holds the state of a recovery pass.
+type recovery struct {
+	bs      *BlobStorage
+	since   time.Time
+	decoder *zstd.Decoder
+}
+
+// walk checks the directories in parent, which holds root directories and, at the top level, the other directories
+// of a store. Directories unchanged since the last clean shutdown are skipped.
+func (r *recovery) walk(parent string, report *RecoveryReport) error {
+	dirs, err := afero.ReadDir(r.bs.fs, parent)
+	if err != nil {
+		return err
+	}
+	for _, info := range dirs {
+		if !info.IsDir() || info.Name() == quarantineDir || info.Name() == byEpochDir || info.ModTime().Before(r.since) {
+			continue
+		}
+		dir := path.Join(parent, info.Name())
+		entries, err := afero.ReadDir(r.bs.fs, dir)
+		if err != nil {
+			return err
+		}
+		root, rootErr := stringToRoot(info.Name())
+		for _, entry := range entries {
+			if entry.IsDir() || entry.ModTime().Before(r.since) {
+				continue
+			}
+			name := path.Join(dir, entry.Name())
+			if strings.HasSuffix(entry.Name(), "."+partExt) {
+				if time.Since(entry.ModTime()) < partFileMaxAge {
+					continue
+				}
+				if err := r.bs.fs.Remove(name); err != nil {
+					return err
+				}
+				r.bs.log.Debug().Str("path", name).Msg("Removed stale part file")
+				report.PartFiles++
+				continue
+			}
+			if rootErr != nil {
+				continue
+			}
+			reason, err := r.check(root, name, entry)
+			if err != nil {
+				return err
+			}
+			if reason == "" {
+				continue
+			}
+			if err := r.bs.quarantine(dir, entry.Name()); err != nil {
+				return err
+			}
+			r.bs.log.Warn().Str("path", name).Int64("size", entry.Size()).Str("reason", reason).Msg("Quarantined corrupt sidecar file")
+			report.Quarantined++
+		}
+		if rootErr == nil {
+			r.bs.removeIfEmpty(dir)
+		}
+	}
+	return nil
+}
+
+// check returns why a file in a root directory is corrupt, or an empty string if it is not. Files of unknown names
+// are left alone.
+func (r *recovery) check(root [32]byte, name string, info os.FileInfo) (string, error) {
+	if info.Size() == 0 {
+		return "empty", nil
+	}
+	index, ok := parseArchiveName(info.Name())
+	if !ok {
+		return "", nil
+	}
+	if index >= r.bs.maxBlobsPerBlock {
+		return "index out of bounds", nil
+	}
+	data, err := afero.ReadFile(r.bs.fs, name)
+	if err != nil {
+		return "", err
+	}
+	_, suffix, _ := strings.Cut(info.Name(), ".")
+	switch suffix {
+	case sszExt + ".snappy":
+		if data, err = snappy.Decode(nil, data); err != nil {
+			return "decompress: " + err.Error(), nil
+		}
+	case sszExt + ".zst":
+		if r.decoder == nil {
+			if r.decoder, err = zstd.NewReader(nil); err != nil {
+				return "", err
+			}
+		}
+		if data, err = r.decoder.DecodeAll(data, nil); err != nil {
+			return "decompress: " + err.Error(), nil
+		}
+	case metaExt:
+		if len(data) != SidecarSize-fieldparams.BlobLength {
+			return fmt.Sprintf("size %d", len(data)), nil
+		}
+		commitment := data[metaCommitmentOffset : metaCommitmentOffset+fieldparams.BLSPubkeyLength]
+		if found, err := r.bodyExists(commitment); err != nil {
+			return "", err
+		} else if !found {
+			return "missing blob body", nil
+		}
+		data = joinSidecar(data, make([]byte, fieldparams.BlobLength))
+	}
+	if len(data) != SidecarSize {
+		return fmt.Sprintf("size %d", len(data)), nil
+	}
+	sidecar := &ethpb.BlobSidecar{}
+	if err := sidecar.UnmarshalSSZ(data); err != nil {
+		return "decode: " + err.Error(), nil
+	}
+	if sidecar.Index != index {
+		return fmt.Sprintf("index %d", sidecar.Index), nil
+	}
+	return "", nil
+}
+
+func (r *recovery) bodyExists(commitment []byte) (bool, error) {
+	name := bodyNamer{commitment: commitment}
+	for _, c := range compressionExts {
+		if exists, err := afero.Exists(r.bs.fs, name.path(c.ext)); err != nil || exists {
+			return exists, err
+		}
+	}
+	return false, nil
+}
+
+func (r *recovery) close() {
+	if r.decoder != nil {
+		r.decoder.Close()
+	}
+}
+
+// readShutdownMarker reads the shutdown marker, returning an open marker without a clean shutdown if there is none.
+func (bs *BlobStorage) readShutdownMarker() (shutdownMarker, error) {
+	data, err := afero.ReadFile(bs.fs, shutdownMarkerName)
+	if os.IsNotExist(err) {
+		return shutdownMarker{}, nil
+	} else if err != nil {
+		return shutdownMarker{}, err
+	}
+	state, at, ok := strings.Cut(strings.TrimSpace(string(data)), " ")
+	nanos, err := strconv.ParseInt(at, 10, 64)
+	if !ok || err != nil || (state != "clean" && state != "open") {
+		bs.log.Warn().Str("content", string(data)).Msg("Ignoring invalid shutdown marker")
+		return shutdownMarker{}, nil
+	}
+	marker := shutdownMarker{clean: state == "clean"}
+	if nanos > 0 {
+		marker.at = time.Unix(0, nanos)
+	}
+	return marker, nil
+}
+
+// writeShutdownMarker atomically replaces the shutdown marker, syncing it so it is not lost with the files it covers.
+func (bs *BlobStorage) writeShutdownMarker(marker shutdownMarker) error {
+	state, nanos := "open", int64(0)
+	if marker.clean {
+		state = "clean"
+	}
+	if !marker.at.IsZero() {
+		nanos = marker.at.UnixNano()
+	}
+	partPath := shutdownMarkerName + "." + partExt
+	file, err := bs.fs.Create(partPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to write shutdown marker")
+	}
+	if _, err := fmt.Fprintf(file, "%s %d\n", state, nanos); err != nil {
+		file.Close()
+		return errors.Wrap(err, "failed to write shutdown marker")
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return errors.Wrap(err, "failed to sync shutdown marker")
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return bs.fs.Rename(partPath, shutdownMarkerName)
+}
+
+func (bs *BlobStorage) quarantine(dir, name string) error {
+	if err := bs.fs.MkdirAll(quarantineDir, directoryPermissions); err != nil {
+		return err
+	}
+	return bs.fs.Rename(path.Join(dir, name), path.Join(quarantineDir, path.Base(dir)+"-"+name))
+}
+
+func (bs *BlobStorage) removeIfEmpty(dir string) {
+	if empty, err := afero.IsEmpty(bs.fs, dir); err == nil && empty {
+		if err := bs.fs.Remove(dir); err != nil {
+			bs.log.Debug().Err(err).Str("dir", dir).Msg("Failed to remove empty root directory")
+		}
+	}
+}
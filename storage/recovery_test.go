@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlobStorageRecovery(t *testing.T) {
+	dir := t.TempDir()
+	bs, err := NewBlobStorage(WithLogger(zerolog.Nop()), WithBasePath(dir), WithMaxBlobsPerBlock(6))
+	require.NoError(t, err)
+	root, corrupt := [32]byte{1}, [32]byte{2}
+	_, err = bs.Save(root, newTestSidecar(0, 100))
+	require.NoError(t, err)
+	// the store crashes, leaving its shutdown marker open
+	require.NoError(t, bs.dirLock.release(nil))
+	bs.dirLock = nil
+
+	rootDir := filepath.Join(dir, rootString(root))
+	stale := filepath.Join(rootDir, "0xc000-1.part")
+	fresh := filepath.Join(rootDir, "0xc001-2.part")
+	require.NoError(t, os.WriteFile(stale, []byte{1}, 0600))
+	require.NoError(t, os.Chtimes(stale, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)))
+	require.NoError(t, os.WriteFile(fresh, []byte{1}, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "1.ssz"), nil, 0600))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, rootString(corrupt)), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, rootString(corrupt), "0.ssz"), []byte{1, 2, 3}, 0600))
+	// a sidecar of the right size stored under another index, and a metadata file without its blob body
+	data, err := newTestSidecar(3, 100).MarshalSSZ()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "2.ssz"), data, 0600))
+	meta, _ := splitSidecar(data)
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "3.meta"), meta, 0600))
+	// the by-epoch layout is walked as well
+	epochRoot := filepath.Join(dir, byEpochDir, "0", "3", rootString([32]byte{3}))
+	require.NoError(t, os.MkdirAll(epochRoot, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(epochRoot, "0.ssz"), []byte{1}, 0600))
+
+	// a read-only storage leaves the files alone
+	readOnly, err := NewBlobStorage(WithLogger(zerolog.Nop()), WithBasePath(dir), WithMaxBlobsPerBlock(6), WithRecovery(false))
+	require.NoError(t, err)
+	require.FileExists(t, stale)
+	require.NoError(t, readOnly.Close())
+
+	bs, err = NewBlobStorage(WithLogger(zerolog.Nop()), WithBasePath(dir), WithMaxBlobsPerBlock(6))
+	require.NoError(t, err)
+	require.NoFileExists(t, stale)
+	require.FileExists(t, fresh)
+	mask, err := bs.Indices(root)
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, false, false, false, false, false}, mask)
+	require.NoDirExists(t, filepath.Join(dir, rootString(corrupt)))
+	require.FileExists(t, filepath.Join(dir, quarantineDir, rootString(root)+"-1.ssz"))
+	require.FileExists(t, filepath.Join(dir, quarantineDir, rootString(corrupt)+"-0.ssz"))
+	require.FileExists(t, filepath.Join(dir, quarantineDir, rootString(root)+"-2.ssz"))
+	require.FileExists(t, filepath.Join(dir, quarantineDir, rootString(root)+"-3.meta"))
+	require.NoDirExists(t, epochRoot)
+
+	roots, err := bs.Roots()
+	require.NoError(t, err)
+	require.Equal(t, [][32]byte{root}, roots)
+
+	// after a clean shutdown nothing is checked, after a crash only what changed since the last clean shutdown
+	require.NoError(t, bs.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "4.ssz"), nil, 0600))
+	bs, err = NewBlobStorage(WithLogger(zerolog.Nop()), WithBasePath(dir), WithMaxBlobsPerBlock(6))
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(rootDir, "4.ssz"))
+	require.NoError(t, os.Remove(filepath.Join(rootDir, "4.ssz")))
+	old := filepath.Join(dir, rootString(corrupt))
+	require.NoError(t, os.Mkdir(old, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(old, "0.ssz"), nil, 0600))
+	require.NoError(t, os.Chtimes(filepath.Join(old, "0.ssz"), time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)))
+	require.NoError(t, os.Chtimes(old, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "5.ssz"), nil, 0600))
+	require.NoError(t, bs.dirLock.release(nil))
+	bs.dirLock = nil
+	_, err = NewBlobStorage(WithLogger(zerolog.Nop()), WithBasePath(dir), WithMaxBlobsPerBlock(6))
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(old, "0.ssz"))
+	require.NoFileExists(t, filepath.Join(rootDir, "5.ssz"))
+}
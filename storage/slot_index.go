@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// SlotIndex maps slots to the block roots stored for them, since blob directories are keyed by root only.
+type SlotIndex struct {
+	mu    sync.RWMutex
+	roots map[uint64][32]byte
+	head  uint64
+}
+
+func NewSlotIndex() *SlotIndex {
+	return &SlotIndex{roots: make(map[uint64][32]byte)}
+}
+
+// BuildSlotIndex indexes every root directory of a store by the slot of its sidecars.
+func BuildSlotIndex(log zerolog.Logger, bs sidecarLister) (*SlotIndex, error) {
+	roots, err := bs.Roots()
+	if err != nil {
+		return nil, err
+	}
+	index := NewSlotIndex()
+	for _, root := range roots {
+		slot, err := bs.Slot(root)
+		if err != nil {
+			log.Warn().Err(err).Str("root", rootString(root)).Msg("Skipping root without readable sidecars in slot index")
+			continue
+		}
+		index.Add(slot, root)
+	}
+	return index, nil
+}
+
+func (s *SlotIndex) Add(slot uint64, root [32]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roots[slot] = root
+	if slot > s.head {
+		s.head = slot
+	}
+}
+
+// Remove drops the slot if it is indexed to the root.
+func (s *SlotIndex) Remove(slot uint64, root [32]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if indexed, ok := s.roots[slot]; !ok || indexed != root {
+		return
+	}
+	delete(s.roots, slot)
+	if slot == s.head {
+		s.head = 0
+		for indexed := range s.roots {
+			if indexed > s.head {
+				s.head = indexed
+			}
+		}
+	}
+}
+
+// Root returns the block root stored for the slot.
+func (s *SlotIndex) Root(slot uint64) ([32]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	root, ok := s.roots[slot]
+	return root, ok
+}
+
+// Head returns the highest indexed slot and its root.
+func (s *SlotIndex) Head() (uint64, [32]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	root, ok := s.roots[s.head]
+	return s.head, root, ok
+}
+
+func (s *SlotIndex) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.roots)
+}
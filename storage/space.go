@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	fieldparams "github.com/prysmaticlabs/prysm/v5/config/fieldparams"
+)
+
+// SidecarSize is the SSZ size of a blob sidecar: its index, blob, commitment, proof, signed block header and
+// inclusion proof. It is the most a saved sidecar takes on disk.
+const SidecarSize = 8 + fieldparams.BlobLength + 2*fieldparams.BLSPubkeyLength + signedHeaderSize + fieldparams.KzgCommitmentInclusionProofDepth*32
+
+// signedHeaderSize is the SSZ size of a signed beacon block header.
+const signedHeaderSize = 112 + fieldparams.BLSSignatureLength
+
+// ErrSpaceLimit is returned by a space guard once saving would cross its free space threshold or size limit.
+var ErrSpaceLimit = errors.New("disk space limit reached")
+
+// SpaceLimits bounds the disk space used by a store. Zero values disable a limit.
+type SpaceLimits struct {
+	// MinFreeBytes is the free space to leave on the file system of the store.
+	MinFreeBytes uint64
+	// MaxStoreBytes is the largest size the store may grow to.
+	MaxStoreBytes uint64
+}
+
+// SpaceGuard checks saves against the space limits of a store directory. The store size is measured once and then
+// grown by every reservation. Callers reserve the SSZ size of what they save, since compression and deduplication
+// are not known upfront, and settle the reservation to the bytes actually written once saved.
+type SpaceGuard struct {
+	paths  []string
+	limits SpaceLimits
+	used   atomic.Uint64
+}
+
+// NewSpaceGuard returns a guard of the store at path. The size of the store includes the other directories it
+// writes to, such as the data columns directory.
+func NewSpaceGuard(path string, limits SpaceLimits, others ...string) (*SpaceGuard, error) {
+	g := &SpaceGuard{paths: append([]string{path}, others...), limits: limits}
+	if err := g.Refresh(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Refresh measures the store size again, e.g. after sidecars were pruned.
+func (g *SpaceGuard) Refresh() error {
+	if g.limits.MaxStoreBytes == 0 {
+		return nil
+	}
+	var used uint64
+	for _, path := range g.paths {
+		size, err := treeSize(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return errors.Wrapf(err, "failed to measure store size at %s", path)
+		}
+		used += size
+	}
+	g.used.Store(used)
+	return nil
+}
+
+// Available returns the number of bytes which can still be saved, or false if no limit is set.
+func (g *SpaceGuard) Available() (uint64, bool, error) {
+	available, limited := uint64(0), false
+	if g.limits.MaxStoreBytes > 0 {
+		used := g.used.Load()
+		available, limited = 0, true
+		if used < g.limits.MaxStoreBytes {
+			available = g.limits.MaxStoreBytes - used
+		}
+	}
+	if g.limits.MinFreeBytes > 0 {
+		free, err := FreeSpace(g.paths[0])
+		if err != nil {
+			return 0, false, err
+		}
+		allowed := uint64(0)
+		if free > g.limits.MinFreeBytes {
+			allowed = free - g.limits.MinFreeBytes
+		}
+		if !limited || allowed < available {
+			available = allowed
+		}
+		limited = true
+	}
+	return available, limited, nil
+}
+
+// Reserve checks that size bytes can be saved and counts them in the store size.
+func (g *SpaceGuard) Reserve(size uint64) error {
+	available, limited, err := g.Available()
+	if err != nil {
+		return err
+	}
+	if limited && size > available {
+		return errors.Wrapf(ErrSpaceLimit, "%d bytes left under the limits of %s (min free %d bytes, max store %d bytes)",
+			available, g.paths[0], g.limits.MinFreeBytes, g.limits.MaxStoreBytes)
+	}
+	g.used.Add(size)
+	return nil
+}
+
+// Settle replaces a reservation of reserved bytes with the written bytes of what was saved. A failed save settles
+// its reservation with the bytes it wrote, usually none.
+func (g *SpaceGuard) Settle(reserved, written uint64) {
+	if written >= reserved {
+		g.used.Add(written - reserved)
+		return
+	}
+	for {
+		used := g.used.Load()
+		if g.used.CompareAndSwap(used, used-min(used, reserved-written)) {
+			return
+		}
+	}
+}
+
+func treeSize(root string) (uint64, error) {
+	var size uint64
+	err := filepath.WalkDir(root, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += uint64(info.Size())
+		return nil
+	})
+	return size, err
+}
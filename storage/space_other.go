@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package storage
+
+import "github.com/pkg/errors"
+
+// FreeSpace is not supported on this platform, so a free space threshold can not be enforced.
+func FreeSpace(path string) (uint64, error) {
+	return 0, errors.Errorf("free space of %s can not be read on this platform", path)
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin
+
+package storage
+
+import "syscall"
+
+// FreeSpace returns the bytes available to unprivileged users on the file system holding path.
+func FreeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpaceGuard(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "existing"), make([]byte, 1000), 0600))
+
+	guard, err := NewSpaceGuard(dir, SpaceLimits{MaxStoreBytes: 3000})
+	require.NoError(t, err)
+	available, limited, err := guard.Available()
+	require.NoError(t, err)
+	require.True(t, limited)
+	require.Equal(t, uint64(2000), available)
+
+	require.NoError(t, guard.Reserve(1500))
+	require.ErrorIs(t, guard.Reserve(1000), ErrSpaceLimit)
+	// a save which wrote less than it reserved, such as a compressed one, leaves room for more
+	guard.Settle(1500, 600)
+	require.NoError(t, guard.Reserve(1000))
+	require.NoError(t, guard.Reserve(400))
+	require.ErrorIs(t, guard.Reserve(1), ErrSpaceLimit)
+
+	// the size is measured again over every directory of the store
+	columns := filepath.Join(t.TempDir(), "data-columns")
+	guard, err = NewSpaceGuard(dir, SpaceLimits{MaxStoreBytes: 3000}, columns)
+	require.NoError(t, err)
+	require.NoError(t, os.Mkdir(columns, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(columns, "column"), make([]byte, 500), 0600))
+	require.NoError(t, guard.Refresh())
+	available, _, err = guard.Available()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1500), available)
+
+	unlimited, err := NewSpaceGuard(dir, SpaceLimits{})
+	require.NoError(t, err)
+	_, limited, err = unlimited.Available()
+	require.NoError(t, err)
+	require.False(t, limited)
+}
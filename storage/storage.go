@@ -1,9 +1,103 @@
-package storage
-
-import "github.com/attestantio/go-eth2-client/spec/deneb"
-
-type BlobStore interface {
-	Exist(root [32]byte) bool
-	Save(root [32]byte, denebSidecar *deneb.BlobSidecar) error
-	Valid(root [32]byte, denebSidecar *deneb.BlobSidecar) (bool, error)
-}
+package storage
+
+import (
+	"github.com/attestantio/go-eth2-client/spec/deneb"
+	"github.com/pkg/errors"
+	"github.com/prysmaticlabs/prysm/v5/consensus-types/primitives"
+	ethpb "github.com/prysmaticlabs/prysm/v5/proto/prysm/v1alpha1"
+	"github.com/rs/zerolog"
+)
+
+type BlobStore interface {
+	Exist(root [32]byte) bool
+	// Save saves a sidecar unless one is stored for its index, and returns the number of bytes written.
+	Save(root [32]byte, denebSidecar *deneb.BlobSidecar) (uint64, error)
+	Valid(root [32]byte, denebSidecar *deneb.BlobSidecar) (bool, error)
+}
+
+// BlobReader reads stored sidecars back by block root, by slot through the slot index,
+// or by EIP-4844 versioned hash.
+type BlobReader interface {
+	Indices(root [32]byte) ([]bool, error)
+	Get(root [32]byte, index uint64) (*ethpb.BlobSidecar, error)
+	GetByVersionedHash(hash [32]byte) (*ethpb.BlobSidecar, error)
+	SlotIndex() (*SlotIndex, error)
+}
+
+// RepairableBlobStore is a blob store whose stored sidecars can be replaced.
+type RepairableBlobStore interface {
+	BlobStore
+	Indices(root [32]byte) ([]bool, error)
+	// Replace saves a sidecar, replacing the one stored for its index, and returns the number of bytes written.
+	Replace(root [32]byte, denebSidecar *deneb.BlobSidecar) (uint64, error)
+}
+
+// ReadableBlobStore is a blob store whose sidecars can be read back and pruned.
+type ReadableBlobStore interface {
+	BlobStore
+	BlobReader
+	PrunableStore
+}
+
+// StoreOptions configures a store. Compression and deduplication are supported by archive stores,
+// sharing the directory with a beacon node by prysm stores.
+type StoreOptions struct {
+	// Compression is the codec new sidecars are written with.
+	Compression string
+	// Dedup stores each distinct blob body once, keyed by its KZG commitment.
+	Dedup bool
+	// SharedNode marks the directory as the blob directory of a running beacon node.
+	SharedNode bool
+	// SlotsPerEpoch places the root directories of a shared node using the by-epoch layout, 0 is the mainnet value.
+	SlotsPerEpoch uint64
+	// RetentionEpochs is the number of epochs behind the chain head pruning keeps, 0 keeps every epoch.
+	RetentionEpochs uint64
+	// ReadOnly opens the store without its lock and startup recovery, for modes which do not write,
+	// so they can run next to a retriever writing the store.
+	ReadOnly bool
+}
+
+func (o StoreOptions) blobStorageOptions() []BlobStorageOption {
+	opts := []BlobStorageOption{WithSharedNode(o.SharedNode), WithLock(!o.ReadOnly), WithRecovery(!o.ReadOnly)}
+	if o.SlotsPerEpoch > 0 {
+		opts = append(opts, WithSlotsPerEpoch(o.SlotsPerEpoch))
+	}
+	if o.RetentionEpochs > 0 {
+		opts = append(opts, WithBlobRetentionEpochs(primitives.Epoch(o.RetentionEpochs)))
+	}
+	return opts
+}
+
+// NewBlobStore opens the store of the storage type at path. The prysm type keeps the beacon node's layout
+// and can not be compressed or deduplicated; the archive type supports compression and deduplication.
+func NewBlobStore(log zerolog.Logger, storageType, path string, maxBlobsPerBlock uint64, opts StoreOptions) (ReadableBlobStore, error) {
+	switch storageType {
+	case "", "prysm":
+		if (opts.Compression != "" && opts.Compression != CompressionNone) || opts.Dedup {
+			return nil, errors.Errorf("compression and deduplication are not supported by the prysm storage, use the archive storage")
+		}
+		store, err := NewPrysmBlobStorage(log, path, maxBlobsPerBlock, opts.blobStorageOptions()...)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "archive":
+		store, err := NewArchiveBlobStorage(log, path, maxBlobsPerBlock, opts)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+	return nil, errors.Errorf("unknown storage type %s", storageType)
+}
+
+// ColumnStore stores the data column sidecars of blocks. The columns of a block are saved together, since they
+// share a file.
+type ColumnStore interface {
+	Exist(root [32]byte) bool
+	// Save and Replace return the number of bytes written, the size of the rewritten file of the block.
+	Save(root [32]byte, sidecars []*DataColumnSidecar) (uint64, error)
+	Valid(root [32]byte, sidecar *DataColumnSidecar) (bool, error)
+	Indices(root [32]byte) ([]bool, error)
+	Replace(root [32]byte, sidecars []*DataColumnSidecar) (uint64, error)
+}